@@ -0,0 +1,66 @@
+package function
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultSignatureMaxAge is used when AUTH_MAX_AGE is unset or invalid
+const defaultSignatureMaxAge = 5 * time.Minute
+
+// authEnabled reports whether AUTH_SECRET is set and requests must be signed
+func authEnabled() bool {
+	return os.Getenv("AUTH_SECRET") != ""
+}
+
+// signaturePayload returns the bytes covered by a request signature. The session key
+// and timestamp are included so a captured request can't be replayed for another
+// user or session, or after the signature window. The key of a request without a
+// session_id is its uid alone, so such requests are signed as they always were.
+func signaturePayload(key, timestamp string, body []byte) []byte {
+	payload := make([]byte, 0, len(key)+len(timestamp)+2+len(body))
+	payload = append(payload, key...)
+	payload = append(payload, '\n')
+	payload = append(payload, timestamp...)
+	payload = append(payload, '\n')
+	return append(payload, body...)
+}
+
+// verifySignature checks that X-Signature holds the hex HMAC-SHA256, keyed by
+// AUTH_SECRET, of the session key (the uid, or uid/session_id for a named session),
+// the X-Timestamp header (Unix seconds) and the raw body, and that the timestamp is
+// within AUTH_MAX_AGE of now
+func verifySignature(r *http.Request, key string, body []byte) error {
+	signature := r.Header.Get("X-Signature")
+	timestamp := r.Header.Get("X-Timestamp")
+	if signature == "" || timestamp == "" {
+		return fmt.Errorf("X-Signature and X-Timestamp headers are required")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid X-Timestamp %q", timestamp)
+	}
+	maxAge := envDuration("AUTH_MAX_AGE", defaultSignatureMaxAge)
+	if age := nowFunc().Sub(time.Unix(seconds, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("X-Timestamp is outside the %s signature window", maxAge)
+	}
+
+	provided, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("X-Signature is not valid hex")
+	}
+
+	mac := hmac.New(sha256.New, []byte(os.Getenv("AUTH_SECRET")))
+	mac.Write(signaturePayload(key, timestamp, body))
+	if !hmac.Equal(provided, mac.Sum(nil)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
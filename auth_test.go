@@ -0,0 +1,92 @@
+package function
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testSecret is the AUTH_SECRET of tests that enable signing
+const testSecret = "test-secret"
+
+// signRequest sets the X-Timestamp and X-Signature headers of r as a client holding
+// testSecret would for session key and body
+func signRequest(r *http.Request, key string, body []byte) {
+	timestamp := strconv.FormatInt(nowFunc().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write(signaturePayload(key, timestamp, body))
+	r.Header.Set("X-Timestamp", timestamp)
+	r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// serveSigned is serve for a request signed by signRequest
+func serveSigned(t *testing.T, handler http.HandlerFunc, method, target, key string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	signRequest(req, key, body)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestVerifySignature(t *testing.T) {
+	t.Setenv("AUTH_SECRET", testSecret)
+	useFakeClock(t, testStart)
+	body := []byte("audio")
+
+	tests := []struct {
+		name    string
+		modify  func(r *http.Request)
+		wantErr bool
+	}{
+		{"valid", func(r *http.Request) {}, false},
+		{"missing headers", func(r *http.Request) { r.Header.Del("X-Signature") }, true},
+		{"other uid", func(r *http.Request) { signRequest(r, "bob", body) }, true},
+		{"other body", func(r *http.Request) { signRequest(r, "alice", []byte("other")) }, true},
+		{"not hex", func(r *http.Request) { r.Header.Set("X-Signature", "zz") }, true},
+		{"expired", func(r *http.Request) {
+			r.Header.Set("X-Timestamp", strconv.FormatInt(testStart.Add(-time.Hour).Unix(), 10))
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/?uid=alice", bytes.NewReader(body))
+			signRequest(req, "alice", body)
+			tt.modify(req)
+			if err := verifySignature(req, "alice", body); (err != nil) != tt.wantErr {
+				t.Fatalf("verifySignature error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignatureCoversSessionID(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	t.Setenv("AUTH_SECRET", testSecret)
+	body := tone(100*time.Millisecond, 16000)
+
+	if w := serveSigned(t, HandlePostAudio, http.MethodPost, "/?uid=alice&session_id=s1", "alice", body); w.Code != http.StatusUnauthorized {
+		t.Fatalf("upload signed without its session answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serveSigned(t, HandlePostAudio, http.MethodPost, "/?uid=alice&session_id=s1", "alice/s1", body); w.Code != http.StatusCreated {
+		t.Fatalf("upload signed for its session answered %d: %s", w.Code, w.Body)
+	}
+
+	// A finalize signed for one session can't close another
+	if w := serveSigned(t, HandleFinalize, http.MethodPost, "/?uid=alice&session_id=s1", "alice/s2", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("finalize signed for another session answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if _, ok := f.get(metadataPath("alice/s1")); !ok {
+		t.Fatal("session was finalized by a request signed for another")
+	}
+	if w := serveSigned(t, HandleFinalize, http.MethodPost, "/?uid=alice&session_id=s1", "alice/s1", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize signed for its session answered %d: %s", w.Code, w.Body)
+	}
+}
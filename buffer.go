@@ -0,0 +1,193 @@
+package function
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// defaultMaxOpenBuffers is used when MAX_OPEN_BUFFERS is unset or invalid
+const defaultMaxOpenBuffers = 64
+
+// Every chunk normally costs a part upload and a compose. With WRITE_BUFFER_BYTES
+// set, an instance instead holds each session's chunks in memory and appends them
+// together once they add up to that many bytes. At most MAX_OPEN_BUFFERS sessions
+// are buffered at once: buffering another first flushes the least recently used
+// buffer to storage and evicts it, so a burst of uids can't exhaust the instance's
+// memory. Finalizing a session on the instance holding its buffer flushes it too.
+//
+// Buffered audio is acknowledged before it is stored, so it is lost if the instance
+// shuts down first, and only the instance holding it can flush it. Chunks carrying
+// seq or force_new are written directly, after flushing what is buffered before them.
+
+// sessionBuffer is the audio an instance holds for one session
+type sessionBuffer struct {
+	// mu is held while audio is added to the buffer or flushed, keeping the session's
+	// chunks in order
+	mu       sync.Mutex
+	key      string
+	bucket   *storage.BucketHandle
+	params   audioParams
+	deviceID string
+	audio    []byte
+	// used orders the buffers by when they were last taken; openBuffers guards it
+	used uint64
+	// evicted is set once the buffer has left openBuffers; writers must take a new one
+	evicted bool
+}
+
+// openBuffers holds the session buffers of this instance. There are at most
+// MAX_OPEN_BUFFERS, so finding the least recently used one is a scan.
+var openBuffers = struct {
+	sync.Mutex
+	byKey map[string]*sessionBuffer
+	// uses counts the times a buffer was taken, stamping each buffer's used
+	uses uint64
+	// draining holds the keys of evicted buffers still being flushed, closed once
+	// they are stored, so a new buffer for the session can't overtake the old one
+	draining map[string]chan struct{}
+}{byKey: make(map[string]*sessionBuffer), draining: make(map[string]chan struct{})}
+
+// bufferingEnabled reports whether a chunk with params may wait in a buffer
+func bufferingEnabled(params audioParams) bool {
+	return writeBufferBytes > 0 && params.clientSeq == nil && !params.forceNew
+}
+
+// bufferChunk adds body to the buffer of session key, flushing the buffer once it
+// reaches WRITE_BUFFER_BYTES or when body is in another format than the audio
+// buffered before it. It reports whether body was only buffered; otherwise result
+// describes the flush that stored it. When the flush fails, the audio buffered
+// before body stays buffered and body is not, so the client can resend it.
+func bufferChunk(ctx context.Context, bucket *storage.BucketHandle, key string, params audioParams, deviceID string, body []byte) (result chunkResult, buffered bool, err error) {
+	buf := lockBuffer(ctx, key, true)
+	defer buf.mu.Unlock()
+
+	if len(buf.audio) > 0 && !buf.holds(params, deviceID) {
+		if _, err := buf.flush(ctx); err != nil {
+			return chunkResult{}, false, err
+		}
+	}
+	if len(buf.audio)+len(body) < int(writeBufferBytes) {
+		buf.bucket, buf.params, buf.deviceID = bucket, params, deviceID
+		buf.audio = append(buf.audio, body...)
+		return chunkResult{}, true, nil
+	}
+
+	result, err = writeChunk(ctx, bucket, key, params, deviceID, append(buf.audio[:len(buf.audio):len(buf.audio)], body...))
+	if err != nil {
+		return chunkResult{}, false, err
+	}
+	buf.audio = nil
+	return result, false, nil
+}
+
+// flushBuffer stores the audio buffered for session key, if any, and drops the
+// buffer, so the session can be read or closed without it
+func flushBuffer(ctx context.Context, key string) error {
+	buf := lockBuffer(ctx, key, false)
+	if buf == nil {
+		return nil
+	}
+	defer buf.mu.Unlock()
+	if _, err := buf.flush(ctx); err != nil {
+		return err
+	}
+	openBuffers.Lock()
+	delete(openBuffers.byKey, key)
+	buf.evicted = true
+	openBuffers.Unlock()
+	return nil
+}
+
+// lockBuffer returns the buffer of session key, locked and marked most recently
+// used. When the session has none, it returns nil unless create is set, in which
+// case it starts one, first flushing and evicting the least recently used buffer
+// when MAX_OPEN_BUFFERS are open.
+func lockBuffer(ctx context.Context, key string, create bool) *sessionBuffer {
+	for {
+		openBuffers.Lock()
+		openBuffers.uses++
+		if buf, ok := openBuffers.byKey[key]; ok {
+			buf.used = openBuffers.uses
+			openBuffers.Unlock()
+			buf.mu.Lock()
+			if !buf.evicted {
+				return buf
+			}
+			buf.mu.Unlock()
+			continue
+		}
+		if drained, ok := openBuffers.draining[key]; ok {
+			openBuffers.Unlock()
+			<-drained
+			continue
+		}
+		if !create {
+			openBuffers.Unlock()
+			return nil
+		}
+
+		var victim *sessionBuffer
+		var drained chan struct{}
+		if len(openBuffers.byKey) >= maxOpenBuffers {
+			for _, open := range openBuffers.byKey {
+				if victim == nil || open.used < victim.used {
+					victim = open
+				}
+			}
+			delete(openBuffers.byKey, victim.key)
+			drained = make(chan struct{})
+			openBuffers.draining[victim.key] = drained
+		}
+		buf := &sessionBuffer{key: key, used: openBuffers.uses}
+		buf.mu.Lock()
+		openBuffers.byKey[key] = buf
+		openBuffers.Unlock()
+
+		if victim != nil {
+			evictBuffer(ctx, victim, drained)
+		}
+		return buf
+	}
+}
+
+// evictBuffer flushes victim, which has left openBuffers, then closes drained.
+// Eviction can't be refused, so audio that fails to flush is lost, and logged.
+func evictBuffer(ctx context.Context, victim *sessionBuffer, drained chan struct{}) {
+	victim.mu.Lock()
+	victim.evicted = true
+	if len(victim.audio) > 0 {
+		loggerFrom(ctx).Info("Flushing least recently used buffer", "session", victim.key, "bytes", len(victim.audio))
+	}
+	if lost, err := victim.flush(ctx); err != nil {
+		loggerFrom(ctx).Error("Failed to flush evicted buffer, its audio is lost", "session", victim.key, "bytes", lost, "error", err)
+	}
+	victim.mu.Unlock()
+
+	openBuffers.Lock()
+	delete(openBuffers.draining, victim.key)
+	openBuffers.Unlock()
+	close(drained)
+}
+
+// holds reports whether the buffered audio is in the format params describes and
+// from deviceID, so a chunk with those can join it
+func (buf *sessionBuffer) holds(params audioParams, deviceID string) bool {
+	p := buf.params
+	return p.sampleRate == params.sampleRate && p.channels == params.channels && p.bits == params.bits &&
+		p.float == params.float && buf.deviceID == deviceID
+}
+
+// flush writes the buffered audio to storage, emptying the buffer on success. On
+// failure it returns the number of bytes that remain buffered. buf.mu must be held.
+func (buf *sessionBuffer) flush(ctx context.Context) (int, error) {
+	if len(buf.audio) == 0 {
+		return 0, nil
+	}
+	if _, err := writeChunk(ctx, buf.bucket, buf.key, buf.params, buf.deviceID, buf.audio); err != nil {
+		return len(buf.audio), err
+	}
+	buf.audio = nil
+	return 0, nil
+}
@@ -0,0 +1,129 @@
+package function
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useBuffers enables WRITE_BUFFER_BYTES for the test, dropping whatever the
+// instance buffered once it ends
+func useBuffers(t *testing.T, bufferBytes int64, maxOpen int) {
+	t.Helper()
+	setVar(t, &writeBufferBytes, bufferBytes)
+	setVar(t, &maxOpenBuffers, maxOpen)
+	t.Cleanup(func() {
+		openBuffers.Lock()
+		defer openBuffers.Unlock()
+		openBuffers.byKey = make(map[string]*sessionBuffer)
+	})
+}
+
+func TestBufferCoalescesChunks(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	chunk := tone(100*time.Millisecond, 16000)
+	useBuffers(t, int64(3*len(chunk)), 8)
+
+	for i := 0; i < 2; i++ {
+		if w := mustPost(t, "uid=alice", chunk); w.Code != http.StatusOK || currentMetadata(t, f, "alice") != nil {
+			t.Fatalf("chunk %d answered %d and reached storage: %s", i, w.Code, w.Body)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	if w := mustPost(t, "uid=alice", chunk); w.Code != http.StatusCreated {
+		t.Fatalf("chunk filling the buffer answered %d, want %d", w.Code, http.StatusCreated)
+	}
+	metadata := currentMetadata(t, f, "alice")
+	if pcm, _ := f.get(pcmPath(metadata.Filename)); !bytes.Equal(pcm, bytes.Repeat(chunk, 3)) {
+		t.Fatalf("flush stored %d bytes, want the three chunks", len(pcm))
+	}
+}
+
+func TestBufferEvictsLeastRecentlyUsed(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	useBuffers(t, 1<<20, 2)
+	audio := map[string][]byte{
+		"alice": sine(440, 16000, 1600, 8000),
+		"bob":   sine(550, 16000, 1600, 8000),
+		"carol": sine(660, 16000, 1600, 8000),
+	}
+
+	mustPost(t, "uid=alice", audio["alice"])
+	mustPost(t, "uid=bob", audio["bob"])
+	mustPost(t, "uid=alice", audio["alice"])
+	// A third uid flushes bob, used less recently than alice, to make room
+	mustPost(t, "uid=carol", audio["carol"])
+	for uid, stored := range map[string]bool{"alice": false, "bob": true, "carol": false} {
+		if got := currentMetadata(t, f, uid) != nil; got != stored {
+			t.Errorf("%s stored = %v, want %v", uid, got, stored)
+		}
+	}
+
+	// Finalizing flushes what is still buffered, so no audio is lost
+	want := map[string][]byte{"alice": bytes.Repeat(audio["alice"], 2), "bob": audio["bob"], "carol": audio["carol"]}
+	for uid, pcm := range want {
+		if w := serve(t, HandleFinalize, http.MethodPost, "/?uid="+uid, nil); w.Code != http.StatusOK {
+			t.Fatalf("finalize %s answered %d: %s", uid, w.Code, w.Body)
+		}
+		if data, _ := f.get(uid + "/2024-05-01T12-00-00Z.wav"); len(data) < wavHeaderSize || !bytes.Equal(data[wavHeaderSize:], pcm) {
+			t.Errorf("%s's recording holds %d bytes, want its %d bytes of audio", uid, len(data)-wavHeaderSize, len(pcm))
+		}
+	}
+	if open := len(openBuffers.byKey); open != 0 {
+		t.Errorf("%d buffers remain open after finalizing every session", open)
+	}
+}
+
+func TestBufferConcurrentSessions(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	useBuffers(t, 3200, 3)
+	uids := []string{"u0", "u1", "u2", "u3", "u4", "u5"}
+
+	// Each uid sends its chunks in order while the others evict its buffer
+	var wg sync.WaitGroup
+	for i, uid := range uids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if w := postAudio(t, "uid="+uid, sine(float64(200+100*i+10*j), 16000, 400, 8000)); w.Code >= 300 {
+					t.Errorf("%s chunk %d answered %d: %s", uid, j, w.Code, w.Body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, uid := range uids {
+		if w := serve(t, HandleFinalize, http.MethodPost, "/?uid="+uid, nil); w.Code != http.StatusOK {
+			t.Fatalf("finalize %s answered %d: %s", uid, w.Code, w.Body)
+		}
+		var want []byte
+		for j := 0; j < 5; j++ {
+			want = append(want, sine(float64(200+100*i+10*j), 16000, 400, 8000)...)
+		}
+		if data, _ := f.get(uid + "/2024-05-01T12-00-00Z.wav"); len(data) < wavHeaderSize || !bytes.Equal(data[wavHeaderSize:], want) {
+			t.Errorf("%s's recording does not hold its five chunks in order", uid)
+		}
+	}
+}
+
+func TestBufferFlushesBeforeDirectWrite(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	useBuffers(t, 1<<20, 8)
+	first, second := sine(440, 16000, 1600, 8000), sine(660, 16000, 1600, 8000)
+
+	mustPost(t, "uid=alice", first)
+	// A chunk carrying seq is never buffered
+	mustPost(t, "uid=alice&seq=1", second)
+	metadata := currentMetadata(t, f, "alice")
+	if pcm, _ := f.get(pcmPath(metadata.Filename)); !bytes.Equal(pcm, concat(first, second)) {
+		t.Fatal("buffered audio was not stored ahead of the direct write")
+	}
+}
@@ -0,0 +1,38 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+
+	"cloud.google.com/go/storage"
+)
+
+// Each session keeps a running CRC32C of the PCM it has stored, the same checksum GCS
+// computes for every object, so the accumulator can be checked against it without
+// downloading it.
+
+// crc32cTable is the Castagnoli table GCS checksums objects with
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// formatChecksum renders a CRC32C the way it is reported to clients
+func formatChecksum(checksum uint32) string {
+	return fmt.Sprintf("%08x", checksum)
+}
+
+// extendChecksum returns the running checksum of metadata's file once audio has been
+// composed onto it, producing the accumulator described by attrs. When audio landed
+// right after the bytes metadata accounts for, the checksum is extended with it and
+// checked against the one GCS computed. When other audio was composed in between, or
+// metadata predates checksums, the stored object's checksum is adopted instead.
+func extendChecksum(ctx context.Context, metadata *WAVMetadata, audio []byte, attrs *storage.ObjectAttrs) uint32 {
+	if int(attrs.Size) != metadata.CurrentSize+len(audio) || (metadata.Checksum == 0 && metadata.CurrentSize > 0) {
+		return attrs.CRC32C
+	}
+	checksum := crc32.Update(metadata.Checksum, crc32cTable, audio)
+	if checksum != attrs.CRC32C {
+		loggerFrom(ctx).Warn("Accumulator checksum does not match the audio appended to it",
+			"expected", formatChecksum(checksum), "stored", formatChecksum(attrs.CRC32C))
+	}
+	return checksum
+}
@@ -0,0 +1,71 @@
+package function
+
+import (
+	"context"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestCRC32CTable(t *testing.T) {
+	// The check value of CRC-32C, from RFC 3720
+	if got := crc32.Checksum([]byte("123456789"), crc32cTable); got != 0xe3069283 {
+		t.Fatalf("CRC32C of the check string = %08x, want e3069283", got)
+	}
+}
+
+func TestVerifyCRC32C(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("alice/file.pcm", []byte("header and audio"))
+	obj := f.bucket().Object("alice/file.pcm")
+
+	if err := verifyCRC32C(context.Background(), obj, []byte("header "), []byte("and audio")); err != nil {
+		t.Fatalf("verifying the written bytes in pieces: %v", err)
+	}
+	if err := verifyCRC32C(context.Background(), obj, []byte("header and audiO")); err == nil {
+		t.Fatal("verifying other bytes succeeded")
+	}
+}
+
+func TestExtendChecksum(t *testing.T) {
+	stored := []byte("first chunksecond chunk")
+	metadata := &WAVMetadata{CurrentSize: len("first chunk"), Checksum: crc32.Checksum([]byte("first chunk"), crc32cTable)}
+	attrs := &storage.ObjectAttrs{Size: int64(len(stored)), CRC32C: crc32.Checksum(stored, crc32cTable)}
+
+	if got := extendChecksum(context.Background(), metadata, []byte("second chunk"), attrs); got != attrs.CRC32C {
+		t.Fatalf("extended checksum = %08x, want %08x", got, attrs.CRC32C)
+	}
+
+	// Audio composed in between by another request is adopted from the object
+	attrs = &storage.ObjectAttrs{Size: int64(len(stored)) + 5, CRC32C: 0x1234}
+	if got := extendChecksum(context.Background(), metadata, []byte("second chunk"), attrs); got != 0x1234 {
+		t.Fatalf("checksum after a gap = %08x, want the stored 00001234", got)
+	}
+}
+
+func TestUploadFailsOnCRC32CMismatch(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	t.Setenv("VERIFY_CRC32C", "true")
+	body := tone(100*time.Millisecond, 16000)
+
+	mustPost(t, "uid=alice", body)
+	f.corrupt = func(name string, data []byte) []byte {
+		if strings.Contains(name, "/parts/") {
+			data = append([]byte(nil), data...)
+			data[0] ^= 0xff
+		}
+		return data
+	}
+	w := postAudio(t, "uid=alice", body)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("append with a corrupted part answered %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != len(body) {
+		t.Fatalf("session holds %d bytes, want the corrupted chunk left out", size)
+	}
+}
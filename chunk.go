@@ -0,0 +1,555 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// chunkResult describes what writeChunk did with a chunk
+type chunkResult struct {
+	// metadata describes the session after the chunk was written
+	metadata *WAVMetadata
+	// created is set when the chunk started a new file
+	created bool
+	// stale is set when the chunk's seq was already applied, so nothing was written
+	stale bool
+	// unrecorded is set when the chunk's audio was stored but the session metadata
+	// could not be updated to account for it
+	unrecorded bool
+	// dropped is set when the chunk arrived after its session was finalized and
+	// LATE_CHUNK_POLICY dropped it, so nothing was written
+	dropped bool
+}
+
+// chunkError is a chunk that could not be written, along with the HTTP status the
+// failure maps to
+type chunkError struct {
+	status  int
+	message string
+}
+
+func (e *chunkError) Error() string {
+	return e.message
+}
+
+// writeChunkError answers a failed writeChunk with the status it maps to
+func writeChunkError(ctx context.Context, w http.ResponseWriter, err error) {
+	var chunkErr *chunkError
+	if errors.As(err, &chunkErr) && chunkErr.status != http.StatusInternalServerError {
+		writeError(w, chunkErr.status, chunkErr.message)
+		return
+	}
+	writeServerError(ctx, w, err.Error())
+}
+
+// writeChunk stores body, little-endian PCM in the format described by params, in
+// the session keyed by uid, as returned by sessionKey. A named session that was
+// finalized refuses the chunk with a 409, and a chunk arriving shortly after a
+// finalize is handled by lateChunk. The chunk starts a new file when
+// shouldCreateNewFile says so, finalizing the previous one, and is otherwise
+// composed onto the current file, which it must match in format. Failures are
+// returned as a *chunkError.
+//
+// Audio is written before the metadata that accounts for it, and the accumulator,
+// not the metadata, is the record of what was stored: reconcileMetadata repairs the
+// size and generation from it on the next chunk. A failure before the audio is
+// stored is an error the client can safely retry. A failure to update the metadata
+// after the audio is stored is not, since a resent chunk would be appended twice, so
+// it is reported as success with unrecorded set, and the chunk's held-back partial
+// frame and seq are lost rather than its audio duplicated.
+func writeChunk(ctx context.Context, bucket *storage.BucketHandle, uid string, params audioParams, deviceID string, body []byte) (chunkResult, error) {
+	logger := loggerFrom(ctx)
+	store := openStore(bucket)
+	clientSeq := params.clientSeq
+
+	release, err := acquireLock(ctx, store, uid)
+	if errors.Is(err, errLockBusy) {
+		return chunkResult{}, &chunkError{status: http.StatusServiceUnavailable, message: "Session is busy with another write, please resend"}
+	}
+	if err != nil {
+		countGCSError("lock")
+		logger.Error("Failed to lock session", "error", err)
+		return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: err.Error()}
+	}
+	defer release()
+
+	metadata, metadataGeneration, err := getCurrentMetadata(ctx, store, uid)
+	if err != nil {
+		countGCSError("read_metadata")
+		logger.Error("Failed to get metadata", "error", err)
+		return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to get metadata: %v", err)}
+	}
+
+	metadata, metadataGeneration, err = recoverParts(ctx, bucket, store, uid, metadata, metadataGeneration)
+	if err != nil {
+		countGCSError("read_metadata")
+		logger.Error("Failed to recover interrupted appends", "error", err)
+		return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to recover interrupted appends: %v", err)}
+	}
+	metadata, err = reconcileMetadata(ctx, bucket, metadata)
+	if err != nil {
+		countGCSError("read_metadata")
+		logger.Error("Failed to reconcile metadata", "error", err)
+		return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to reconcile metadata: %v", err)}
+	}
+
+	if metadata == nil {
+		var dropped bool
+		metadata, dropped, err = lateChunk(ctx, bucket, store, uid)
+		if err != nil {
+			return chunkResult{}, err
+		}
+		if dropped {
+			return chunkResult{dropped: true}, nil
+		}
+	}
+	if metadata == nil {
+		finalized, err := sessionFinalized(ctx, store, uid)
+		if err != nil {
+			countGCSError("read_metadata")
+			logger.Error("Failed to check whether the session was finalized", "error", err)
+			return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to get metadata: %v", err)}
+		}
+		if finalized {
+			_, sessionID := splitSessionKey(uid)
+			logger.Warn("Rejecting chunk for a finalized session")
+			return chunkResult{}, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("Session %s was already finalized", sessionID)}
+		}
+	}
+
+	// Drop retried chunks and refuse chunks that skip ahead of the stream
+	var lastClientSeq *int64
+	if metadata != nil {
+		lastClientSeq = metadata.LastClientSeq
+	}
+	if clientSeq != nil && lastClientSeq != nil {
+		if *clientSeq <= *lastClientSeq {
+			logger.Info("Skipping stale chunk", "seq", *clientSeq, "last_seq", *lastClientSeq)
+			return chunkResult{metadata: metadata, stale: true}, nil
+		}
+		if *clientSeq > *lastClientSeq+1 {
+			logger.Warn("Rejecting out-of-order chunk", "seq", *clientSeq, "expected_seq", *lastClientSeq+1)
+			return chunkResult{}, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("seq %d is out of order, expected %d", *clientSeq, *lastClientSeq+1)}
+		}
+	}
+	if clientSeq != nil {
+		lastClientSeq = clientSeq
+	}
+
+	prepared, err := prepareChunk(ctx, metadata, params, body)
+	if err != nil {
+		return chunkResult{}, err
+	}
+	createNew, audio, pending := prepared.createNew, prepared.audio, prepared.pending
+	fileSampleRate, channels, bits, float := prepared.sampleRate, prepared.channels, prepared.bits, prepared.float
+
+	// A file started by rolling over keeps the session's language hint
+	language := params.lang
+	if language == "" && metadata != nil {
+		language = metadata.Language
+	}
+
+	if createNew {
+		// Create new WAV file
+		currentTime := nowFunc()
+
+		// The previous file is closed by rolling over, so write its header now, after
+		// filling it with the part of the chunk that still fits
+		if metadata != nil {
+			if len(prepared.rollover) > 0 {
+				// The rest of the chunk goes to the new file, so the rollover is not all of it
+				if err := appendAudio(ctx, bucket, store, uid, metadata, prepared.rollover, nil); err != nil {
+					return chunkResult{}, err
+				}
+			}
+			if _, err := closeRecording(ctx, bucket, uid, metadata); err != nil {
+				countGCSError("finalize")
+				logger.Error("Failed to finalize previous WAV file", "file", metadata.Filename, "error", err)
+				return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: "Failed to finalize previous WAV file"}
+			}
+		}
+
+		// Start the PCM accumulator with this chunk under a name no other file holds
+		filename, attrs, err := createAccumulator(ctx, bucket, uid, metadata, currentTime, audio)
+		if err != nil {
+			return chunkResult{}, err
+		}
+		ctx, logger = logWith(ctx, "object", filename)
+		logger.Info("Created new WAV file")
+		if metadata == nil {
+			if err := startPlaylist(ctx, store, uid, currentTime); err != nil {
+				logger.Warn("Failed to start the session's playlist", "error", err)
+			}
+		}
+
+		seq, err := assignSequence(ctx, store, uid, filename)
+		if err != nil {
+			countGCSError("assign_sequence")
+			logger.Error("Failed to assign sequence", "error", err)
+			return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to assign sequence: %v", err)}
+		}
+
+		// Update metadata
+		metadata = &WAVMetadata{
+			Filename:      filename,
+			StartTime:     currentTime,
+			LastWriteTime: currentTime,
+			CurrentSize:   int(attrs.Size),
+			SampleRate:    fileSampleRate,
+			Channels:      channels,
+			BitsPerSample: bits,
+			Float:         float,
+			Sequence:      seq,
+			DeviceID:      deviceID,
+			Checksum:      attrs.CRC32C,
+			Language:      language,
+
+			ObjectGeneration: attrs.Generation,
+			TrailingSilence:  prepared.trailingSilence,
+		}
+		wavFilesCreated.Inc()
+
+		// The sidecar is auxiliary, so failing to write it doesn't fail the upload
+		if err := writeSidecar(ctx, bucket, uid, metadata, 0); err != nil {
+			countGCSError("sidecar")
+			logger.Error("Failed to write sidecar", "error", err)
+		}
+	} else {
+		ctx, logger = logWith(ctx, "object", metadata.Filename)
+		if err := appendAudio(ctx, bucket, store, uid, metadata, audio, clientSeq); err != nil {
+			return chunkResult{}, err
+		}
+		metadata.TrailingSilence = prepared.trailingSilence
+		metadata.Language = language
+	}
+	metadata.PendingBytes = pending
+	metadata.LastClientSeq = lastClientSeq
+
+	if err := commitMetadata(ctx, store, uid, metadata, metadataGeneration); err != nil {
+		countGCSError("write_metadata")
+		if createNew || len(audio) > 0 {
+			logger.Error("Stored audio but failed to update metadata, leaving it for the next chunk to reconcile", "error", err)
+			return chunkResult{metadata: metadata, created: createNew, unrecorded: true}, nil
+		}
+		logger.Error("Failed to update metadata", "error", err)
+		return chunkResult{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to update metadata: %v", err)}
+	}
+
+	return chunkResult{metadata: metadata, created: createNew}, nil
+}
+
+// maxNameAttempts is how many numbered names a new file tries before giving up
+const maxNameAttempts = 10
+
+// numberedFilename returns filename with n appended to its base name, the name a new
+// file takes when an earlier file of the same creation window holds filename. The
+// first name, n = 0, is filename itself.
+func numberedFilename(filename string, n int) string {
+	if n == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s_%d.wav", strings.TrimSuffix(filename, ".wav"), n)
+}
+
+// filenameTaken reports whether filename belongs to a file other than a new one: the
+// current file described by metadata, or a recording finalized under that name,
+// whose accumulator is gone so it would not otherwise be noticed. An accumulator
+// still open under filename is left to the caller.
+func filenameTaken(ctx context.Context, bucket *storage.BucketHandle, metadata *WAVMetadata, filename string) (bool, error) {
+	if metadata != nil && filename == metadata.Filename {
+		return true, nil
+	}
+	for _, name := range []string{filename, flacPath(filename), rawPath(filename)} {
+		_, err := bucket.Object(name).Attrs(ctx)
+		if err == nil {
+			return true, nil
+		}
+		if err != storage.ErrObjectNotExist {
+			return false, fmt.Errorf("failed to read attributes of %s: %v", name, err)
+		}
+	}
+	return false, nil
+}
+
+// createAccumulator starts the PCM accumulator of a new file of session uid with
+// audio, returning the file's name and the accumulator's attributes. The name is
+// rendered from the start of the creation window holding now, so a retried first
+// chunk resolves to the same object, and numbered when that name is taken, so a file
+// started in the window of one already closed never composes over it. An existing
+// accumulator is only adopted when it holds exactly audio, the work of an earlier
+// attempt at this chunk; any other is a different file, and the next name is tried.
+// Failures are returned as a *chunkError.
+func createAccumulator(ctx context.Context, bucket *storage.BucketHandle, uid string, metadata *WAVMetadata, now time.Time, audio []byte) (string, *storage.ObjectAttrs, error) {
+	logger := loggerFrom(ctx)
+	base := filePathTemplate.render(uid, now.Truncate(newFileWindow()))
+	checksum := crc32.Checksum(audio, crc32cTable)
+	for n := 0; n < maxNameAttempts; n++ {
+		filename := numberedFilename(base, n)
+		taken, err := filenameTaken(ctx, bucket, metadata, filename)
+		if err != nil {
+			countGCSError("create")
+			logger.Error("Failed to check the new file name", "file", filename, "error", err)
+			return "", nil, &chunkError{status: http.StatusInternalServerError, message: "Failed to check the new file name"}
+		}
+		if taken {
+			continue
+		}
+
+		obj := bucket.Object(pcmPath(filename))
+		attrs, err := writeObject(ctx, obj.If(storage.Conditions{DoesNotExist: true}), "application/octet-stream", audio)
+		if isPreconditionFailed(err) {
+			attrs, err = obj.Attrs(ctx)
+			if err != nil && err != storage.ErrObjectNotExist {
+				countGCSError("create")
+				logger.Error("Failed to read existing file attributes", "file", filename, "error", err)
+				return "", nil, &chunkError{status: http.StatusInternalServerError, message: "Failed to read existing file attributes"}
+			}
+			if err == nil && attrs.Size == int64(len(audio)) && attrs.CRC32C == checksum {
+				logger.Info("WAV file was already created by an earlier attempt, not writing it again", "file", filename)
+				return filename, attrs, nil
+			}
+			logger.Info("Another file holds the new file's name, trying the next", "file", filename)
+			continue
+		}
+		if err != nil {
+			countGCSError("create")
+			logger.Error("Failed to write audio data", "file", filename, "error", err)
+			return "", nil, &chunkError{status: http.StatusInternalServerError, message: "Failed to write audio data"}
+		}
+		if crc32cVerificationEnabled() {
+			if err := verifyCRC32C(ctx, obj, audio); err != nil {
+				logger.Error("Failed to verify written file", "file", filename, "error", err)
+				return "", nil, &chunkError{status: http.StatusInternalServerError, message: "Failed to verify written file, please resend"}
+			}
+		}
+		return filename, attrs, nil
+	}
+	logger.Warn("Every name for the new file is taken", "file", base, "attempts", maxNameAttempts)
+	return "", nil, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("Too many files were started at %s, please resend", base)}
+}
+
+// appendAudio composes audio onto the file described by metadata, or stores it as a
+// segment of the file with STREAMING_MODE=lazy, and updates metadata to match.
+// clientSeq is the seq param of the chunk audio is all of, or nil. Failures are
+// returned as a *chunkError.
+func appendAudio(ctx context.Context, bucket *storage.BucketHandle, store objectStore, uid string, metadata *WAVMetadata, audio []byte, clientSeq *int64) error {
+	logger := loggerFrom(ctx)
+	logger.Info("Appending to existing WAV file", "file", metadata.Filename)
+
+	seq, err := assignSequence(ctx, store, uid, metadata.Filename)
+	if err != nil {
+		countGCSError("assign_sequence")
+		logger.Error("Failed to assign sequence", "error", err)
+		return &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to assign sequence: %v", err)}
+	}
+
+	// With STREAMING_MODE=lazy the chunk is stored as a segment, left for finalizing
+	// to fold into the accumulated PCM
+	if len(audio) > 0 && streamingMode == "lazy" {
+		appendStart := time.Now()
+		_, err := appendSegment(ctx, bucket, metadata.Filename, int64(metadata.CurrentSize), audio)
+		appendDuration.Observe(time.Since(appendStart).Seconds())
+		if err != nil {
+			countGCSError("append")
+		}
+		if isPreconditionFailed(err) {
+			logger.Warn("WAV file changed concurrently", "error", err)
+			return &chunkError{status: http.StatusConflict, message: "WAV file changed concurrently, please resend"}
+		}
+		if err != nil {
+			logger.Error("Failed to append audio data", "error", err)
+			return &chunkError{status: http.StatusInternalServerError, message: "Failed to append audio data, please resend"}
+		}
+
+		recordAppend(ctx, 0, len(audio))
+
+		// A checksum lost to a repair stays unknown until the file is finalized
+		if metadata.Checksum != 0 || metadata.CurrentSize == 0 {
+			metadata.Checksum = crc32.Update(metadata.Checksum, crc32cTable, audio)
+		}
+		metadata.CurrentSize += len(audio)
+		audio = nil
+	}
+
+	// Compose the chunk onto the accumulated PCM. The new size is taken from the
+	// composed object rather than from metadata, which may lag behind it. A chunk
+	// too short to complete a sample only updates the pending bytes.
+	if len(audio) > 0 {
+		appendStart := time.Now()
+		attrs, err := appendPart(ctx, bucket, metadata.Filename, seq, metadata.ObjectGeneration, audio, clientSeq)
+		appendDuration.Observe(time.Since(appendStart).Seconds())
+		if err != nil {
+			countGCSError("append")
+		}
+		if isPreconditionFailed(err) {
+			logger.Warn("WAV file changed concurrently", "error", err)
+			return &chunkError{status: http.StatusConflict, message: "WAV file changed concurrently, please resend"}
+		}
+		if err != nil {
+			logger.Error("Failed to append audio data", "error", err)
+			return &chunkError{status: http.StatusInternalServerError, message: "Failed to append audio data, please resend"}
+		}
+
+		recordAppend(ctx, 0, len(audio))
+
+		metadata.Checksum = extendChecksum(ctx, metadata, audio, attrs)
+		metadata.CurrentSize = int(attrs.Size)
+		metadata.ObjectGeneration = attrs.Generation
+	}
+
+	// Update metadata
+	metadata.LastWriteTime = nowFunc()
+	metadata.Sequence = seq
+	return nil
+}
+
+// preparedChunk is a chunk ready to be written to a session
+type preparedChunk struct {
+	// createNew is set when the chunk starts a new file
+	createNew bool
+	// sampleRate, channels, bits and float describe the format of the file the chunk
+	// is written to
+	sampleRate int
+	channels   int
+	bits       int
+	float      bool
+	// audio is the whole frames to write, converted to the file's sample rate
+	audio []byte
+	// rollover is the leading part of the chunk that fills the current file up to its
+	// limit before audio starts the next one; it is only set along with createNew
+	rollover []byte
+	// pending is the partial frame held back until the next chunk
+	pending []byte
+	// trailingSilence is the quiet audio ending the file once audio is written to
+	// it, tracked while SEGMENT_ON_SILENCE is on
+	trailingSilence int
+}
+
+// prepareChunk decides whether body, described by params, starts a new file or is
+// appended to the one described by metadata, checks that an append matches that
+// file's format, and converts body to whole frames at the file's sample rate. It
+// writes nothing, so it also serves to plan a chunk without storing it.
+func prepareChunk(ctx context.Context, metadata *WAVMetadata, params audioParams, body []byte) (preparedChunk, error) {
+	logger := loggerFrom(ctx)
+	requestSampleRate := params.sampleRate
+	requestChannels, channelsDeclared := params.channels, params.channelsDeclared
+	requestBits, requestFloat, formatDeclared := params.bits, params.float, params.formatDeclared
+
+	// Audio is stored at TARGET_SAMPLE_RATE when set so every file in the bucket
+	// has a uniform rate
+	fileSampleRate := requestSampleRate
+	if targetSampleRate != 0 {
+		fileSampleRate = targetSampleRate
+	}
+
+	// New files take the requested sample rate, channel count and sample format;
+	// appends must match the file's. A client marking a logical boundary with
+	// force_new starts a new file even when the current one is within its limits.
+	createNew := params.forceNew || shouldCreateNewFile(metadata)
+	if params.forceNew && metadata != nil {
+		logger.Info("Starting a new file on client request", "file", metadata.Filename)
+	}
+	channels := requestChannels
+	bits, float := requestBits, requestFloat
+	if !createNew {
+		if fileSampleRate != metadata.fileSampleRate() {
+			logger.Warn("Rejecting append with a mismatched sample rate", "file", metadata.Filename, "sample_rate", fileSampleRate, "file_sample_rate", metadata.fileSampleRate())
+			return preparedChunk{}, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("sample_rate=%d does not match the %d Hz rate of the current file %s", requestSampleRate, metadata.fileSampleRate(), metadata.Filename)}
+		}
+		channels = metadata.fileChannels()
+		if channelsDeclared && requestChannels != channels {
+			logger.Warn("Rejecting append with mismatched channels", "file", metadata.Filename, "channels", requestChannels, "file_channels", channels)
+			return preparedChunk{}, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("channels=%d does not match the %d channels of the current file %s", requestChannels, channels, metadata.Filename)}
+		}
+		bits, float = metadata.fileBits(), metadata.Float
+		if formatDeclared && (requestBits != bits || requestFloat != float) {
+			logger.Warn("Rejecting append with a mismatched sample format", "file", metadata.Filename, "bits", requestBits, "file_bits", bits)
+			return preparedChunk{}, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("bits=%d does not match the %d-bit samples of the current file %s", requestBits, bits, metadata.Filename)}
+		}
+	}
+
+	// Complete any sample torn across the previous chunk boundary, and hold back a
+	// trailing partial sample until the next chunk arrives
+	var pending []byte
+	if metadata != nil {
+		pending = metadata.PendingBytes
+	}
+	audio, pending := alignFrames(pending, body, bits/8*channels)
+	if len(pending) > 0 {
+		logger.Info("Holding back a partial frame until the next chunk", "bytes", len(pending))
+	}
+
+	if fileSampleRate != requestSampleRate {
+		audio = resample(audio, requestSampleRate, fileSampleRate, channels)
+	}
+
+	// Segmenting measures 16-bit integer samples only, like trimming
+	segmenting := segmentOnSilence && bits == 16 && !float
+	quiet := 0
+	if segmenting && !createNew {
+		quiet = metadata.TrailingSilence
+	}
+
+	// A chunk that would carry the file past its limit fills it exactly and starts
+	// the next file with the rest, so files roll over on the limit rather than on
+	// the first chunk boundary after it. When segmenting, speech resuming after a
+	// silent gap also starts the next file, unless the file holds nothing but that
+	// gap. A chunk is split at most once, at the earlier of the two.
+	var rollover []byte
+	if !createNew {
+		split := len(audio)
+		if segmenting && quiet < metadata.CurrentSize {
+			if gap, _ := silenceGap(audio, fileSampleRate, channels, quiet); gap >= 0 {
+				logger.Info("Speech resumed after a silent gap, starting a new segment", "file", metadata.Filename, "offset", gap)
+				split = gap
+			}
+		}
+		if room := roomLeft(metadata); room < split {
+			logger.Info("Chunk crosses the file limit, splitting it across a rollover", "file", metadata.Filename, "bytes", len(audio), "room", room)
+			split = room
+		}
+		if split < len(audio) {
+			rollover, audio = audio[:split], audio[split:]
+			createNew = true
+			quiet = 0
+		}
+	}
+	trailingSilence := 0
+	if segmenting {
+		_, trailingSilence = silenceGap(audio, fileSampleRate, channels, quiet)
+	}
+
+	return preparedChunk{
+		createNew:  createNew,
+		sampleRate: fileSampleRate,
+		channels:   channels,
+		bits:       bits,
+		float:      float,
+		audio:      audio,
+		rollover:   rollover,
+		pending:    pending,
+
+		trailingSilence: trailingSilence,
+	}, nil
+}
+
+// roomLeft returns how many bytes of audio, in whole frames, the file described by
+// metadata can take before it reaches MAX_DURATION or MAX_FILE_BYTES
+func roomLeft(metadata *WAVMetadata) int {
+	frameSize := int64(metadata.fileChannels() * metadata.fileBits() / 8)
+	limit := int64(maxDuration.Seconds()*float64(metadata.fileSampleRate())) * frameSize
+	if byteLimit := maxFileBytes - maxFileBytes%frameSize; byteLimit < limit {
+		limit = byteLimit
+	}
+	if room := limit - int64(metadata.CurrentSize); room > 0 {
+		return int(room)
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNumberedFilename(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "alice/2024-05-01T12-00-00Z.wav"},
+		{1, "alice/2024-05-01T12-00-00Z_1.wav"},
+		{12, "alice/2024-05-01T12-00-00Z_12.wav"},
+	}
+	for _, tt := range tests {
+		if got := numberedFilename("alice/2024-05-01T12-00-00Z.wav", tt.n); got != tt.want {
+			t.Errorf("numberedFilename(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNewFileAfterFinalizeKeepsFinalizedRecording(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	first := tone(500*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", first)
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	// The next chunk lands in the same creation window as the finalized recording
+	clock.Advance(2 * time.Second)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.Filename != "alice/2024-05-01T12-00-00Z_1.wav" {
+		t.Fatalf("new file is %s, want a numbered name", metadata.Filename)
+	}
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("second finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	if _, dataLen := storedWAV(t, f, "alice/2024-05-01T12-00-00Z.wav"); dataLen != len(first) {
+		t.Fatalf("first recording holds %d bytes, want %d", dataLen, len(first))
+	}
+	if _, dataLen := storedWAV(t, f, "alice/2024-05-01T12-00-00Z_1.wav"); dataLen != 8000 {
+		t.Fatalf("second recording holds %d bytes, want 8000", dataLen)
+	}
+}
+
+func TestRetriedFirstChunkIsAdopted(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	chunk := tone(500*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", chunk)
+	// The first attempt stored its audio but not the metadata accounting for it
+	f.mu.Lock()
+	delete(f.objects, metadataPath("alice"))
+	f.mu.Unlock()
+
+	mustPost(t, "uid=alice", chunk)
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.Filename != "alice/2024-05-01T12-00-00Z.wav" || metadata.CurrentSize != len(chunk) {
+		t.Fatalf("retry produced %s of %d bytes, want the original file of %d", metadata.Filename, metadata.CurrentSize, len(chunk))
+	}
+}
+
+func TestDifferentFirstChunkIsNotAdopted(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	other := tone(100*time.Millisecond, 16000)
+	f.put("alice/2024-05-01T12-00-00Z.pcm", other)
+
+	chunk := tone(500*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", chunk)
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.Filename != "alice/2024-05-01T12-00-00Z_1.wav" || metadata.CurrentSize != len(chunk) {
+		t.Fatalf("chunk landed in %s of %d bytes, want a numbered file of %d", metadata.Filename, metadata.CurrentSize, len(chunk))
+	}
+	if data, _ := f.get("alice/2024-05-01T12-00-00Z.pcm"); len(data) != len(other) {
+		t.Fatalf("other file's accumulator was changed to %d bytes", len(data))
+	}
+}
+
+func TestDryRunSkipsFinalizedName(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	f.put("alice/2024-05-01T12-00-00Z.wav", []byte("finalized"))
+
+	w := mustPost(t, "uid=alice&dry_run=true", tone(250*time.Millisecond, 16000))
+	var plan dryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &plan); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Action != "create" || plan.Filename != "alice/2024-05-01T12-00-00Z_1.wav" {
+		t.Fatalf("dry run planned to %s %s", plan.Action, plan.Filename)
+	}
+	if names := f.names("alice/"); len(names) != 1 {
+		t.Fatalf("dry run wrote objects: %v", names)
+	}
+}
+
+func TestClientSeq(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(100*time.Millisecond, 16000)
+
+	tests := []struct {
+		name     string
+		seq      string
+		wantCode int
+		wantSize int
+	}{
+		{"first", "0", http.StatusCreated, len(body)},
+		{"next", "1", http.StatusOK, 2 * len(body)},
+		{"duplicate", "1", http.StatusOK, 2 * len(body)},
+		{"stale", "0", http.StatusOK, 2 * len(body)},
+		{"gapped", "3", http.StatusConflict, 2 * len(body)},
+		{"in order again", "2", http.StatusOK, 3 * len(body)},
+	}
+	for _, tt := range tests {
+		w := postAudio(t, "uid=alice&seq="+tt.seq, body)
+		if w.Code != tt.wantCode {
+			t.Fatalf("%s seq %s answered %d, want %d: %s", tt.name, tt.seq, w.Code, tt.wantCode, w.Body)
+		}
+		if size := currentMetadata(t, f, "alice").CurrentSize; size != tt.wantSize {
+			t.Fatalf("after %s seq %s the session holds %d bytes, want %d", tt.name, tt.seq, size, tt.wantSize)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package function
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKMSKey = "projects/p/locations/global/keyRings/audio/cryptoKeys/recordings"
+
+// objectKeys returns the KMS key each stored object is encrypted with
+func objectKeys(f *fakeGCS) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make(map[string]string, len(f.objects))
+	for name, obj := range f.objects {
+		keys[name] = obj.kmsKeyName
+	}
+	return keys
+}
+
+func TestCMEKEncryptsEveryObject(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &cmekKey, testKMSKey)
+	first, second := tone(250*time.Millisecond, 16000), sine(440, 16000, 4000, 8000)
+
+	rewrites := 0
+	f.fail = func(r *http.Request) int {
+		if strings.Contains(r.URL.Path, "/rewriteTo/") {
+			rewrites++
+		}
+		return 0
+	}
+	mustPost(t, "uid=alice", first)
+	clock.Advance(time.Second)
+	mustPost(t, "uid=alice", second)
+
+	// GCS decrypts for the reader, so the in-progress recording reads back as WAV
+	w := getCurrent(t, "uid=alice", "")
+	header, _ := createWAVHeader(len(first)+len(second), 16000, 1, 16, false)
+	if want := concat(header, first, second); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want) {
+		t.Fatalf("GET answered %d with %d bytes, want the %d byte WAV", w.Code, w.Body.Len(), len(want))
+	}
+
+	// Appending costs no rewrite of the file so far
+	if rewrites != 0 {
+		t.Fatalf("appends rewrote %d objects", rewrites)
+	}
+
+	filename := currentMetadata(t, f, "alice").Filename
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	if data, _ := f.get(filename); !bytes.Equal(data[wavHeaderSize:], concat(first, second)) {
+		t.Fatal("finalized recording does not hold both chunks")
+	}
+	if rewrites != 1 {
+		t.Fatalf("finalizing rewrote %d objects, want only the recording", rewrites)
+	}
+	if obj, _ := f.object(filename); obj.contentType != "audio/wav" || obj.metadata["uid"] != "alice" {
+		t.Fatalf("re-encrypting lost the attributes of the recording: %q, %v", obj.contentType, obj.metadata)
+	}
+
+	// Written, composed and copied objects alike are encrypted with the key
+	for name, key := range objectKeys(f) {
+		if key != testKMSKey {
+			t.Errorf("%s is encrypted with %q, want %q", name, key, testKMSKey)
+		}
+	}
+}
+
+func TestNoCMEKByDefault(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &cmekKey, "")
+
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	for name, key := range objectKeys(f) {
+		if key != "" {
+			t.Errorf("%s is encrypted with %q without CMEK_KEY", name, key)
+		}
+	}
+}
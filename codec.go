@@ -0,0 +1,209 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pion/opus"
+)
+
+// maxOpusPacketDuration is the longest audio a single Opus packet can carry, in ms
+const maxOpusPacketDuration = 120
+
+// supportedCodecs lists the values accepted in the codec param
+var supportedCodecs = map[string]bool{
+	"pcm":   true,
+	"opus":  true,
+	"mulaw": true,
+	"alaw":  true,
+}
+
+// opusDecoder decodes the Opus packets of one upload to 16-bit little-endian PCM, so
+// they can go through the regular PCM path. Each packet is decoded against the state
+// the ones before it left, so every packet of an upload goes through one decoder.
+type opusDecoder struct {
+	decoder  opus.Decoder
+	channels int
+	samples  []int16
+}
+
+// newOpusDecoder returns an opusDecoder producing PCM at the given sample rate and
+// channel count
+func newOpusDecoder(sampleRate, channels int) (*opusDecoder, error) {
+	decoder, err := opus.NewDecoderWithOutput(sampleRate, channels)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Opus at %d Hz with %d channels: %v", sampleRate, channels, err)
+	}
+	return &opusDecoder{
+		decoder:  decoder,
+		channels: channels,
+		samples:  make([]int16, sampleRate*maxOpusPacketDuration/1000*channels),
+	}, nil
+}
+
+// decode decodes the next packet of the upload
+func (d *opusDecoder) decode(packet []byte) ([]byte, error) {
+	n, err := d.decoder.DecodeToInt16(packet, d.samples)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Opus packet: %v", err)
+	}
+
+	pcm := make([]byte, n*d.channels*2)
+	for i, sample := range d.samples[:n*d.channels] {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	return pcm, nil
+}
+
+// decodeMulaw expands G.711 mu-law, one byte per sample, to 16-bit little-endian PCM
+func decodeMulaw(data []byte) []byte {
+	pcm := make([]byte, len(data)*2)
+	for i, b := range data {
+		b = ^b
+		exponent := (b >> 4) & 0x07
+		mantissa := int16(b & 0x0f)
+		sample := ((mantissa<<3)+0x84)<<exponent - 0x84
+		if b&0x80 != 0 {
+			sample = -sample
+		}
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	return pcm
+}
+
+// decodeALaw expands G.711 A-law, one byte per sample, to 16-bit little-endian PCM
+func decodeALaw(data []byte) []byte {
+	pcm := make([]byte, len(data)*2)
+	for i, b := range data {
+		b ^= 0x55
+		exponent := (b >> 4) & 0x07
+		mantissa := int16(b & 0x0f)
+		sample := mantissa<<4 + 8
+		if exponent > 0 {
+			sample = (mantissa<<4 + 0x108) << (exponent - 1)
+		}
+		// A-law sets the sign bit for positive samples
+		if b&0x80 == 0 {
+			sample = -sample
+		}
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	return pcm
+}
+
+// sniffLength is how much of a body textSignature inspects
+const sniffLength = 512
+
+// textSignatures maps the opening of common text payloads to what they are
+var textSignatures = []struct {
+	prefix string
+	kind   string
+}{
+	{"{", "JSON"},
+	{"[", "JSON"},
+	{"<!doctype html", "HTML"},
+	{"<html", "HTML"},
+	{"<?xml", "XML"},
+}
+
+// textSignature returns the kind of text payload body holds, such as "JSON" or
+// "HTML", or "" when it may be audio. A body only counts as text when its first
+// sniffLength bytes are all printable ASCII and it opens with a known signature,
+// so silence and quiet audio, which are full of 0x00 and 0xff bytes, always pass.
+func textSignature(body []byte) string {
+	head := body[:min(len(body), sniffLength)]
+	for _, b := range head {
+		if (b < 0x20 || b > 0x7e) && b != '\t' && b != '\n' && b != '\r' {
+			return ""
+		}
+	}
+
+	text := strings.ToLower(strings.TrimLeft(string(head), " \t\r\n"))
+	for _, signature := range textSignatures {
+		if strings.HasPrefix(text, signature.prefix) {
+			return signature.kind
+		}
+	}
+	return ""
+}
+
+// looksLikeWAV reports whether body opens with the RIFF/WAVE signature of a complete
+// WAV file rather than raw PCM
+func looksLikeWAV(body []byte) bool {
+	return len(body) >= 12 && bytes.Equal(body[0:4], []byte("RIFF")) && bytes.Equal(body[8:12], []byte("WAVE"))
+}
+
+// stripWAVHeader walks the chunks of the WAV file body and returns the format of its
+// fmt chunk and the payload of its data chunk. Unlike parseWAVHeader it accepts the
+// files other tools write: longer fmt chunks, WAVE_FORMAT_EXTENSIBLE and extra chunks
+// such as LIST before the data. A data length of 0 or 0xffffffff, written by encoders
+// that stream before they know the length, takes the rest of body, as does a data
+// chunk cut short.
+func stripWAVHeader(body []byte) (format wavFormat, data []byte, err error) {
+	if !looksLikeWAV(body) {
+		return wavFormat{}, nil, errors.New("missing RIFF/WAVE magic")
+	}
+	haveFormat := false
+	for offset := 12; offset+8 <= len(body); {
+		id, declared := string(body[offset:offset+4]), binary.LittleEndian.Uint32(body[offset+4:offset+8])
+		payload := body[offset+8:]
+		size := len(payload)
+		if uint64(declared) < uint64(size) {
+			size = int(declared)
+		}
+		switch id {
+		case "fmt ":
+			if declared < 16 || size < int(declared) {
+				return wavFormat{}, nil, fmt.Errorf("fmt chunk of %d bytes is invalid", declared)
+			}
+			if format, err = parseWAVFormat(payload[:size]); err != nil {
+				return wavFormat{}, nil, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return wavFormat{}, nil, errors.New("data chunk comes before the fmt chunk")
+			}
+			if declared == 0 || declared == math.MaxUint32 {
+				size = len(payload)
+			}
+			return format, payload[:size], nil
+		}
+		// Chunks are padded to an even length
+		offset += 8 + size + size%2
+	}
+	if !haveFormat {
+		return wavFormat{}, nil, errors.New("missing fmt chunk")
+	}
+	return wavFormat{}, nil, errors.New("missing data chunk")
+}
+
+// parseWAVFormat parses the payload of a fmt chunk, accepting integer PCM and IEEE
+// float either directly or as the subformat of WAVE_FORMAT_EXTENSIBLE
+func parseWAVFormat(chunk []byte) (format wavFormat, err error) {
+	tag := binary.LittleEndian.Uint16(chunk[0:2])
+	if tag == 0xfffe && len(chunk) >= 26 {
+		tag = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+	switch tag {
+	case 1:
+	case 3:
+		format.float = true
+	default:
+		return wavFormat{}, fmt.Errorf("unsupported format tag %d", tag)
+	}
+	format.channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+	format.sampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+	format.bits = int(binary.LittleEndian.Uint16(chunk[14:16]))
+	if format.channels == 0 || format.sampleRate == 0 || format.bits == 0 || format.bits%8 != 0 {
+		return wavFormat{}, fmt.Errorf("invalid format: %d channels, %d Hz, %d bits", format.channels, format.sampleRate, format.bits)
+	}
+	if blockAlign := int(binary.LittleEndian.Uint16(chunk[12:14])); blockAlign != format.channels*format.bits/8 {
+		return wavFormat{}, fmt.Errorf("block align %d does not match %d channels of %d bits", blockAlign, format.channels, format.bits)
+	}
+	return format, nil
+}
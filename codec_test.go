@@ -0,0 +1,241 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// opusPacket is a 20 ms SILK packet taken from the tiny.ogg test file of
+// github.com/pion/opus (MIT)
+var opusPacket, _ = hex.DecodeString("4883cade8ae567d51caca254faffbf")
+
+// lengthPrefixed frames packets as a framing=lp body
+func lengthPrefixed(packets ...[]byte) []byte {
+	var body []byte
+	for _, packet := range packets {
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+		body = append(body, packet...)
+	}
+	return body
+}
+
+func TestOpusDecoderKeepsStateAcrossPackets(t *testing.T) {
+	decoder, err := newOpusDecoder(16000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream, isolated []byte
+	for i := 0; i < 3; i++ {
+		pcm, err := decoder.decode(opusPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, pcm...)
+
+		fresh, _ := newOpusDecoder(16000, 1)
+		pcm, err = fresh.decode(opusPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isolated = append(isolated, pcm...)
+	}
+	if len(stream) != 3*320*2 {
+		t.Fatalf("decoded %d bytes, want %d", len(stream), 3*320*2)
+	}
+	// Decoding each packet from a fresh state loses the SILK history
+	if bytes.Equal(stream, isolated) {
+		t.Fatal("decoding with fresh decoders matched the continuous decode, the test packet carries no state")
+	}
+}
+
+func TestPostOpusFramesShareDecoder(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice&codec=opus&framing=lp&sample_rate=16000", lengthPrefixed(opusPacket, opusPacket, opusPacket))
+
+	decoder, _ := newOpusDecoder(16000, 1)
+	var want []byte
+	for i := 0; i < 3; i++ {
+		pcm, _ := decoder.decode(opusPacket)
+		want = append(want, pcm...)
+	}
+	got, _ := f.get(pcmPath(currentMetadata(t, f, "alice").Filename))
+	if !bytes.Equal(got, want) {
+		t.Fatalf("stored %d bytes that differ from decoding the frames as one stream", len(got))
+	}
+}
+
+func TestTextSignature(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"json object", []byte(`{"error": "unauthorized"}`), "JSON"},
+		{"json array", []byte("\n  [1, 2, 3]"), "JSON"},
+		{"html", []byte("<!DOCTYPE html><html><body>502 Bad Gateway</body></html>"), "HTML"},
+		{"xml", []byte(`<?xml version="1.0"?><Error/>`), "XML"},
+		{"silence", make([]byte, 3200), ""},
+		{"tone", tone(100*time.Millisecond, 16000), ""},
+		// Quiet audio can open with text-like bytes, but not 512 of them
+		{"quiet audio", bytes.Repeat([]byte{'{', 0x00, 0x85, 0xff}, 800), ""},
+	}
+	for _, tt := range tests {
+		if got := textSignature(tt.body); got != tt.want {
+			t.Errorf("%s: textSignature = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPostRejectsJSONBody(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	w := postAudio(t, "uid=alice", []byte(`{"audio": "AAAA", "sample_rate": 16000}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "JSON") {
+		t.Fatalf("JSON body answered %d: %s, want 400 naming JSON", w.Code, w.Body)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("rejected upload wrote %v", names)
+	}
+
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+}
+
+// g711Samples decodes the 16-bit samples produced by a G.711 decoder
+func g711Samples(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return samples
+}
+
+func TestDecodeMulaw(t *testing.T) {
+	// Values from the ITU-T G.711 reference decoder
+	input := []byte{0xff, 0x7f, 0xfe, 0x7e, 0x80, 0x00, 0xe7, 0x9c}
+	want := []int16{0, 0, 8, -8, 32124, -32124, 260, 9852}
+	if got := g711Samples(decodeMulaw(input)); !slices.Equal(got, want) {
+		t.Fatalf("decodeMulaw(% x) = %v, want %v", input, got, want)
+	}
+}
+
+func TestDecodeALaw(t *testing.T) {
+	// Values from the ITU-T G.711 reference decoder
+	input := []byte{0xd5, 0x55, 0xaa, 0x2a, 0xc5, 0xe5}
+	want := []int16{8, -8, 32256, -32256, 264, 1056}
+	if got := g711Samples(decodeALaw(input)); !slices.Equal(got, want) {
+		t.Fatalf("decodeALaw(% x) = %v, want %v", input, got, want)
+	}
+}
+
+func TestPostMulawAudio(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice&codec=mulaw&sample_rate=8000", bytes.Repeat([]byte{0x80, 0x00}, 4000))
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.SampleRate != 8000 || metadata.CurrentSize != 16000 {
+		t.Fatalf("mu-law upload stored %d bytes at %d Hz, want 16000 at 8000 Hz", metadata.CurrentSize, metadata.SampleRate)
+	}
+	pcm, _ := f.get(pcmPath(metadata.Filename))
+	if got := g711Samples(pcm[:4]); !slices.Equal(got, []int16{32124, -32124}) {
+		t.Fatalf("stored samples %v, want the decoded mu-law", got)
+	}
+}
+
+// wavFile assembles a WAV file from its chunks, each given as an id and payload
+func wavFile(chunks ...any) []byte {
+	body := []byte("RIFF\x00\x00\x00\x00WAVE")
+	for i := 0; i < len(chunks); i += 2 {
+		payload := chunks[i+1].([]byte)
+		body = append(body, chunks[i].(string)...)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(payload)))
+		body = append(body, payload...)
+		if len(payload)%2 != 0 {
+			body = append(body, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(body)-8))
+	return body
+}
+
+func TestStripWAVHeader(t *testing.T) {
+	pcm := tone(10*time.Millisecond, 8000)
+	streamed := wavFile("fmt ", fmtChunk(1, 1, 8000, 16), "data", []byte{})
+	streamed = append(streamed, pcm...)
+	extensible := append(fmtChunk(0xfffe, 2, 48000, 32), make([]byte, 24)...)
+	binary.LittleEndian.PutUint16(extensible[24:], 3)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		want    wavFormat
+		wantErr bool
+	}{
+		{"plain", wavFile("fmt ", fmtChunk(1, 1, 16000, 16), "data", pcm), wavFormat{sampleRate: 16000, channels: 1, bits: 16}, false},
+		{"LIST before data", wavFile("fmt ", fmtChunk(1, 2, 44100, 24), "LIST", []byte("INFOx"), "data", pcm), wavFormat{sampleRate: 44100, channels: 2, bits: 24}, false},
+		{"extensible float", wavFile("fmt ", extensible, "data", pcm), wavFormat{sampleRate: 48000, channels: 2, bits: 32, float: true}, false},
+		{"streamed length", streamed, wavFormat{sampleRate: 8000, channels: 1, bits: 16}, false},
+		{"data before fmt", wavFile("data", pcm, "fmt ", fmtChunk(1, 1, 16000, 16)), wavFormat{}, true},
+		{"no data", wavFile("fmt ", fmtChunk(1, 1, 16000, 16)), wavFormat{}, true},
+		{"mp3", wavFile("fmt ", fmtChunk(0x55, 1, 16000, 16), "data", pcm), wavFormat{}, true},
+	}
+	for _, tt := range tests {
+		if !looksLikeWAV(tt.body) {
+			t.Errorf("%s: looksLikeWAV = false", tt.name)
+			continue
+		}
+		format, data, err := stripWAVHeader(tt.body)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: stripWAVHeader error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (format != tt.want || !bytes.Equal(data, pcm)) {
+			t.Errorf("%s: stripWAVHeader = %+v with %d bytes, want %+v with %d", tt.name, format, len(data), tt.want, len(pcm))
+		}
+	}
+	if looksLikeWAV(pcm) {
+		t.Error("looksLikeWAV is true for raw PCM")
+	}
+}
+
+func TestPostWAVBody(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	pcm := tone(250*time.Millisecond, 8000)
+	stereo := concat(pcm, pcm)
+
+	// The header stands in for the format params and only the data chunk is stored
+	mustPost(t, "uid=alice", wavFile("fmt ", fmtChunk(1, 2, 8000, 16), "LIST", []byte("INFO"), "data", stereo))
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.fileSampleRate() != 8000 || metadata.fileChannels() != 2 || metadata.fileBits() != 16 {
+		t.Fatalf("WAV body stored as %d Hz, %d channels, %d bits", metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits())
+	}
+
+	// Raw PCM in the file's format appends after it
+	clock.Advance(time.Second)
+	mustPost(t, "uid=alice&sample_rate=8000&channels=2", stereo)
+	if stored, _ := f.get(pcmPath(metadata.Filename)); !bytes.Equal(stored, concat(stereo, stereo)) {
+		t.Fatalf("file holds %d bytes, want the data of the WAV body and the raw chunk", len(stored))
+	}
+
+	// A header that disagrees with the file or with the params is rejected
+	clock.Advance(time.Second)
+	if w := postAudio(t, "uid=alice", wavFile("fmt ", fmtChunk(1, 2, 16000, 16), "data", stereo)); w.Code != http.StatusConflict {
+		t.Errorf("16 kHz WAV appended to an 8 kHz file answered %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := postAudio(t, "uid=alice&sample_rate=16000", wavFile("fmt ", fmtChunk(1, 2, 8000, 16), "data", stereo)); w.Code != http.StatusBadRequest {
+		t.Errorf("WAV body contradicting sample_rate answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != 2*len(stereo) {
+		t.Errorf("rejected WAV bodies changed the file to %d bytes", size)
+	}
+}
@@ -0,0 +1,221 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// compactResponse is the JSON body returned by HandleCompact
+type compactResponse struct {
+	Status       string   `json:"status"`
+	Finalized    []string `json:"finalized"`
+	PartsRemoved int      `json:"parts_removed"`
+}
+
+// HandleCompact consolidates the intermediate objects left behind for uid by
+// sessions that ended without being finalized, e.g. after their metadata was reset.
+// Every orphaned PCM accumulator is finalized into a WAV with a correct header and
+// added to the recordings index, along with any segments STREAMING_MODE=lazy stored
+// for it, and stray chunk parts and segments are deleted. The files open in uid's
+// sessions, and any written to within GCS_TIMEOUT, are never touched, so compaction
+// is safe to run while uid is still streaming.
+func HandleCompact(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	uid := r.URL.Query().Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received compact request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting compact with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+
+	// Compact requests carry no body, so the signature covers only uid and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, uid, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated compact", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	dir, scoped := filePathTemplate.userDir(uid)
+	if !scoped {
+		writeError(w, http.StatusNotImplemented, "Compaction requires PATH_TEMPLATE to give {uid} a folder of its own")
+		return
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	var accumulators, parts, segments []*storage.ObjectAttrs
+	it := bucket.Objects(ctx, &storage.Query{Prefix: dir})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logger.Error("Failed to list objects", "prefix", dir, "error", err)
+			writeServerError(ctx, w, "Failed to list objects")
+			return
+		}
+		_, part := partBase(attrs.Name)
+		_, segment := segmentBase(attrs.Name)
+		switch {
+		case !strings.HasSuffix(attrs.Name, ".pcm"):
+		case part:
+			parts = append(parts, attrs)
+		case segment:
+			segments = append(segments, attrs)
+		default:
+			accumulators = append(accumulators, attrs)
+		}
+	}
+
+	// The open files are read under the lock of every session of uid, after the
+	// listing, so a file a session rolled over to while the listing ran is seen as
+	// open. A file younger than GCS_TIMEOUT may still be in the middle of being
+	// created by a session whose metadata doesn't name it yet, or by one that
+	// started after its lock was taken, so it is left for a later compaction.
+	store := openStore(bucket)
+	keys, err := sessionKeys(ctx, store, uid)
+	if err != nil {
+		logger.Error("Failed to list sessions", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to list sessions: %v", err))
+		return
+	}
+	release, err := acquireLocks(ctx, store, keys)
+	if errors.Is(err, errLockBusy) {
+		writeError(w, http.StatusServiceUnavailable, "A session is busy with another write, please retry")
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to lock sessions", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to lock sessions: %v", err))
+		return
+	}
+	defer release()
+	active, err := activeFiles(ctx, store, keys)
+	if err != nil {
+		logger.Error("Failed to get metadata", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to get metadata: %v", err))
+		return
+	}
+	settled := nowFunc().Add(-gcsTimeout)
+
+	response := compactResponse{Status: "ok", Finalized: []string{}}
+	for _, attrs := range parts {
+		// Parts are composed as soon as they are uploaded, so only those of an
+		// open file can still be waiting on a compose
+		base, _ := partBase(attrs.Name)
+		if !active[base] && attrs.Updated.Before(settled) {
+			deleteObject(ctx, bucket.Object(attrs.Name))
+			response.PartsRemoved++
+		}
+	}
+	for _, attrs := range accumulators {
+		base := strings.TrimSuffix(attrs.Name, ".pcm")
+		if active[base] || !attrs.Updated.Before(settled) {
+			continue
+		}
+		orphan, key := orphanMetadata(ctx, bucket, uid, base+".wav", attrs)
+		if _, err := closeRecording(ctx, bucket, key, orphan); err != nil {
+			logger.Error("Failed to finalize orphaned recording", "file", orphan.Filename, "error", err)
+			writeServerError(ctx, w, fmt.Sprintf("Failed to finalize %s", orphan.Filename))
+			return
+		}
+		response.Finalized = append(response.Finalized, orphan.Filename)
+	}
+	// Segments are folded into their accumulator, finalizing an orphan included, so
+	// only those of a file without one are stray
+	accumulated := map[string]bool{}
+	for _, attrs := range accumulators {
+		accumulated[strings.TrimSuffix(attrs.Name, ".pcm")] = true
+	}
+	for _, attrs := range segments {
+		base, _ := segmentBase(attrs.Name)
+		if !active[base] && !accumulated[base] && attrs.Updated.Before(settled) {
+			deleteObject(ctx, bucket.Object(attrs.Name))
+			response.PartsRemoved++
+		}
+	}
+
+	logger.Info("Compacted uid", "finalized", len(response.Finalized), "parts_removed", response.PartsRemoved)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sessionKeys returns the keys of uid's sessions: the unnamed one and every one
+// named by a session_id that has metadata
+func sessionKeys(ctx context.Context, store objectStore, uid string) ([]string, error) {
+	names, err := store.List(ctx, metadataPrefix+uid+"/")
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{uid}
+	for _, name := range names {
+		keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(name, metadataPrefix), ".json"))
+	}
+	return keys, nil
+}
+
+// activeFiles returns the base names, without extension, of the files open in the
+// sessions keys
+func activeFiles(ctx context.Context, store objectStore, keys []string) (map[string]bool, error) {
+	active := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		metadata, _, err := getCurrentMetadata(ctx, store, key)
+		if err != nil {
+			return nil, err
+		}
+		if metadata != nil {
+			active[strings.TrimSuffix(metadata.Filename, ".wav")] = true
+		}
+	}
+	return active, nil
+}
+
+// orphanMetadata rebuilds the metadata of a file of uid whose session metadata is
+// gone from its sidecar, and returns it with the key of the session the sidecar
+// names. Without a sidecar it falls back to the defaults, the accumulator's creation
+// time and the unnamed session.
+func orphanMetadata(ctx context.Context, bucket *storage.BucketHandle, uid, filename string, accumulator *storage.ObjectAttrs) (*WAVMetadata, string) {
+	metadata := &WAVMetadata{
+		Filename:    filename,
+		StartTime:   accumulator.Created,
+		CurrentSize: int(accumulator.Size),
+	}
+
+	r, err := bucket.Object(sidecarPath(filename)).NewReader(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warn("No sidecar, finalizing with the default format", "file", filename, "error", err)
+		return metadata, uid
+	}
+	defer r.Close()
+
+	var info sidecar
+	if err := json.NewDecoder(r).Decode(&info); err != nil {
+		loggerFrom(ctx).Warn("Unreadable sidecar, finalizing with the default format", "file", filename, "error", err)
+		return metadata, uid
+	}
+	metadata.StartTime = info.CreatedAt
+	metadata.SampleRate = info.SampleRate
+	metadata.Channels = info.Channels
+	metadata.BitsPerSample = info.Bits
+	metadata.Float = info.Float
+	metadata.DeviceID = info.DeviceID
+	return metadata, sessionKey(uid, info.SessionID)
+}
@@ -0,0 +1,191 @@
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// orphanRecording leaves an accumulator of d of audio for key whose session metadata
+// is gone, as a session reset leaves it, and returns the file's name
+func orphanRecording(t *testing.T, f *fakeGCS, key string, d time.Duration) string {
+	t.Helper()
+	mustPost(t, "uid="+key, tone(d, 16000))
+	filename := currentMetadata(t, f, key).Filename
+	f.mu.Lock()
+	delete(f.objects, metadataPath(key))
+	f.mu.Unlock()
+	return filename
+}
+
+func compact(t *testing.T, uid string) (int, compactResponse) {
+	t.Helper()
+	w := serve(t, HandleCompact, http.MethodPost, "/?uid="+uid, nil)
+	var response compactResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, response
+}
+
+func TestCompactFinalizesOrphans(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	orphan := orphanRecording(t, f, "alice", 500*time.Millisecond)
+	f.put(partPath(orphan, 7), []byte("stray"))
+	clock.Advance(time.Minute)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	open := currentMetadata(t, f, "alice").Filename
+
+	code, response := compact(t, "alice")
+	if code != http.StatusOK {
+		t.Fatalf("compact answered %d", code)
+	}
+	if len(response.Finalized) != 1 || response.Finalized[0] != orphan || response.PartsRemoved != 1 {
+		t.Fatalf("compact = %+v, want %s finalized and 1 part removed", response, orphan)
+	}
+	if _, dataLen := storedWAV(t, f, orphan); dataLen != 16000 {
+		t.Fatalf("orphan finalized with %d bytes, want 16000", dataLen)
+	}
+	if _, ok := f.get(pcmPath(open)); !ok {
+		t.Fatalf("open file %s was compacted", open)
+	}
+}
+
+func TestCompactLeavesRecentAndOtherUIDs(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	older := orphanRecording(t, f, "alice_bob", 500*time.Millisecond)
+	clock.Advance(time.Minute)
+	recent := orphanRecording(t, f, "alice", 500*time.Millisecond)
+	clock.Advance(gcsTimeout / 2)
+
+	code, response := compact(t, "alice")
+	if code != http.StatusOK {
+		t.Fatalf("compact answered %d", code)
+	}
+	if len(response.Finalized) != 0 {
+		t.Fatalf("compact finalized %v, want nothing", response.Finalized)
+	}
+	for _, name := range []string{pcmPath(older), pcmPath(recent)} {
+		if _, ok := f.get(name); !ok {
+			t.Fatalf("%s was compacted", name)
+		}
+	}
+}
+
+func TestCompactRequiresUserFolder(t *testing.T) {
+	newFakeGCS(t)
+	template, err := parsePathTemplate("{uid}_{iso}.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &filePathTemplate, template)
+
+	if code, _ := compact(t, "alice"); code != http.StatusNotImplemented {
+		t.Fatalf("compact with a shared prefix answered %d, want %d", code, http.StatusNotImplemented)
+	}
+}
+
+func TestCompactWaitsForSessionLock(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &writeLockTimeout, 100*time.Millisecond)
+	f.put(lockPath("alice"), []byte("held"))
+
+	if code, _ := compact(t, "alice"); code != http.StatusServiceUnavailable {
+		t.Fatalf("compact of a locked session answered %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestCompactThreeChunks(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	var want []byte
+	for _, d := range []time.Duration{250 * time.Millisecond, 500 * time.Millisecond} {
+		chunk := tone(d, 16000)
+		mustPost(t, "uid=alice", chunk)
+		want = append(want, chunk...)
+	}
+	// The third chunk is the last before the session's metadata is lost
+	orphan := orphanRecording(t, f, "alice", 250*time.Millisecond)
+	want = append(want, tone(250*time.Millisecond, 16000)...)
+	clock.Advance(time.Minute)
+
+	code, response := compact(t, "alice")
+	if code != http.StatusOK || len(response.Finalized) != 1 || response.Finalized[0] != orphan {
+		t.Fatalf("compact = %d %+v, want %s finalized", code, response, orphan)
+	}
+	if _, dataLen := storedWAV(t, f, orphan); dataLen != len(want) {
+		t.Fatalf("compacted file holds %d bytes of audio, want %d", dataLen, len(want))
+	}
+	data, _ := f.get(orphan)
+	if !bytes.Equal(data[wavHeaderSize:], want) {
+		t.Fatal("compacted audio differs from the chunks in order")
+	}
+	if names := f.names(strings.TrimSuffix(orphan, ".wav") + "/parts/"); len(names) != 0 {
+		t.Fatalf("compaction left parts %v", names)
+	}
+
+	var index recordingIndex
+	indexData, _ := f.get(indexPath("alice"))
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Recordings) != 1 || index.Recordings[0].Filename != orphan || index.Recordings[0].DurationSeconds != 1 {
+		t.Fatalf("index after compaction = %+v", index.Recordings)
+	}
+}
+
+func TestCompactFinalizesNamedSessionOrphan(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice&session_id=s1", tone(500*time.Millisecond, 16000))
+	orphan := currentMetadata(t, f, "alice/s1").Filename
+	f.mu.Lock()
+	delete(f.objects, metadataPath("alice/s1"))
+	f.mu.Unlock()
+	clock.Advance(time.Minute)
+
+	if code, response := compact(t, "alice"); code != http.StatusOK || len(response.Finalized) != 1 {
+		t.Fatalf("compact = %d %+v, want %s finalized", code, response, orphan)
+	}
+	var info sidecar
+	data, _ := f.get(sidecarPath(orphan))
+	if err := json.Unmarshal(data, &info); err != nil || info.SessionID != "s1" {
+		t.Fatalf("sidecar = %+v, %v, want the recording kept in session s1", info, err)
+	}
+}
+
+func TestCompactKeepsAccumulatorInFolderNamedParts(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	// A session named parts, from before the name was reserved, holds its files in a
+	// folder of that name
+	accumulator := pcmPath(filePathTemplate.render("alice/parts", testStart))
+	f.put(accumulator, tone(500*time.Millisecond, 16000))
+	part := partPath(filePathTemplate.render("alice", testStart), 3)
+	f.put(part, []byte("stray"))
+	clock.Advance(time.Minute)
+
+	code, response := compact(t, "alice")
+	if code != http.StatusOK || len(response.Finalized) != 1 || response.PartsRemoved != 1 {
+		t.Fatalf("compact = %d %+v, want the accumulator finalized and the part removed", code, response)
+	}
+	if _, dataLen := storedWAV(t, f, strings.TrimSuffix(accumulator, ".pcm")+".wav"); dataLen != 16000 {
+		t.Fatalf("accumulator finalized with %d bytes, want 16000", dataLen)
+	}
+	if _, ok := f.get(part); ok {
+		t.Fatal("stray part was kept")
+	}
+}
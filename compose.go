@@ -0,0 +1,483 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// An open WAV file is stored as headerless PCM in an accumulator object next to
+// where the WAV will live. Each incoming chunk is uploaded as its own part object
+// and composed onto the end of the accumulator, so appending costs one upload of the
+// chunk regardless of how much audio has already been captured. The WAV header is
+// only written once, when the file is finalized.
+
+// pcmPath returns the name of the object accumulating the PCM data of filename
+func pcmPath(filename string) string {
+	return strings.TrimSuffix(filename, ".wav") + ".pcm"
+}
+
+// rawPath returns the name of the headerless PCM rendition of filename. Unlike the
+// accumulator at pcmPath, which only exists while the file is open, it is written
+// when the file is finalized.
+func rawPath(filename string) string {
+	return strings.TrimSuffix(filename, ".wav") + ".raw"
+}
+
+// partPath returns the name of the temporary object holding chunk seq of filename
+func partPath(filename string, seq int64) string {
+	return fmt.Sprintf("%s/parts/%d.pcm", strings.TrimSuffix(filename, ".wav"), seq)
+}
+
+// partBase returns the base name, without extension, of the file whose part is
+// name, and whether name is a part as partPath names them
+func partBase(name string) (string, bool) {
+	return pieceBase(name, "/parts/")
+}
+
+// pieceBase returns what precedes the last dir in name when a number and ".pcm"
+// follow it, as partPath and segmentPath name a file's pieces. Only the last dir is
+// matched, so the accumulator of a session named like dir isn't taken for a piece.
+func pieceBase(name, dir string) (string, bool) {
+	i := strings.LastIndex(name, dir)
+	if i < 0 {
+		return "", false
+	}
+	n, ok := strings.CutSuffix(name[i+len(dir):], ".pcm")
+	if _, err := strconv.ParseInt(n, 10, 64); !ok || err != nil {
+		return "", false
+	}
+	return name[:i], true
+}
+
+// headerPath returns the name of the temporary object holding the header of filename
+func headerPath(filename string) string {
+	return strings.TrimSuffix(filename, ".wav") + ".header"
+}
+
+// padPath returns the name of the temporary object holding the pad byte of filename
+func padPath(filename string) string {
+	return strings.TrimSuffix(filename, ".wav") + ".pad"
+}
+
+// writeObject writes data to obj and returns the attributes of the stored object.
+// Transient failures are retried, since rewriting the same bytes is harmless. Like
+// every object the function stores, it is encrypted with CMEK_KEY when that is set.
+func writeObject(ctx context.Context, obj *storage.ObjectHandle, contentType string, data ...[]byte) (*storage.ObjectAttrs, error) {
+	return writeTaggedObject(ctx, obj, contentType, nil, data...)
+}
+
+// writeTaggedObject is writeObject for an object that also carries custom metadata
+func writeTaggedObject(ctx context.Context, obj *storage.ObjectHandle, contentType string, metadata map[string]string, data ...[]byte) (attrs *storage.ObjectAttrs, err error) {
+	err = withGCSRetry(ctx, "write "+obj.ObjectName(), func() error {
+		writer := obj.NewWriter(ctx)
+		writer.ContentType = contentType
+		writer.KMSKeyName = cmekKey
+		writer.Metadata = metadata
+		for _, d := range data {
+			if _, err := writer.Write(d); err != nil {
+				writer.Close()
+				return err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		attrs = writer.Attrs()
+		return nil
+	})
+	return attrs, err
+}
+
+// streamObject writes the bytes read from the reader open returns to obj, copying
+// them through rather than holding them in memory, so an object can be rewritten
+// from another however large it is. A header can be prepended with io.MultiReader.
+// Transient failures are retried with a fresh reader from open, and a failed read
+// abandons the upload rather than storing what was read before it.
+func streamObject(ctx context.Context, obj *storage.ObjectHandle, contentType string, open func() (io.ReadCloser, error)) (*storage.ObjectAttrs, error) {
+	return streamTaggedObject(ctx, obj, contentType, nil, open)
+}
+
+// streamTaggedObject is streamObject for an object that also carries custom metadata
+func streamTaggedObject(ctx context.Context, obj *storage.ObjectHandle, contentType string, metadata map[string]string, open func() (io.ReadCloser, error)) (attrs *storage.ObjectAttrs, err error) {
+	err = withGCSRetry(ctx, "write "+obj.ObjectName(), func() error {
+		src, err := open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		// Closing a writer commits the upload unless its context is cancelled first
+		uploadCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		writer := obj.NewWriter(uploadCtx)
+		writer.ContentType = contentType
+		writer.KMSKeyName = cmekKey
+		writer.Metadata = metadata
+		if _, err := io.Copy(writer, src); err != nil {
+			cancel()
+			writer.Close()
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		attrs = writer.Attrs()
+		return nil
+	})
+	return attrs, err
+}
+
+// pipe returns a reader of what produce writes, producing it as the reader is read
+// so output can be streamed to an object without being held whole. Closing the
+// reader early stops produce, whose writes then fail.
+func pipe(produce func(w io.Writer) error) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(produce(writer))
+	}()
+	return reader
+}
+
+// deleteObject removes obj, logging rather than failing since leftovers are harmless
+func deleteObject(ctx context.Context, obj *storage.ObjectHandle) {
+	if err := obj.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		loggerFrom(ctx).Warn("Failed to delete object", "name", obj.ObjectName(), "error", err)
+	}
+}
+
+// appendPart uploads body as chunk seq of filename and composes it onto the end of
+// the accumulated PCM, provided the accumulator is still at generation. When another
+// request appends first the compose fails; it is then retried with backoff against
+// the new generation, up to maxCASAttempts times. The part is tagged with clientSeq,
+// the seq param of the chunk it holds all of, if any, for recoverParts.
+func appendPart(ctx context.Context, bucket *storage.BucketHandle, filename string, seq, generation int64, body []byte, clientSeq *int64) (*storage.ObjectAttrs, error) {
+	var tags map[string]string
+	if clientSeq != nil {
+		tags = map[string]string{"client_seq": strconv.FormatInt(*clientSeq, 10)}
+	}
+	part := bucket.Object(partPath(filename, seq))
+	if _, err := writeTaggedObject(ctx, part, "application/octet-stream", tags, body); err != nil {
+		return nil, fmt.Errorf("failed to write chunk part: %w", err)
+	}
+	defer deleteObject(ctx, part)
+
+	if crc32cVerificationEnabled() {
+		if err := verifyCRC32C(ctx, part, body); err != nil {
+			return nil, err
+		}
+	}
+
+	accumulator := bucket.Object(pcmPath(filename))
+	for attempt := 1; ; attempt++ {
+		composer := accumulator.If(storage.Conditions{GenerationMatch: generation}).
+			ComposerFrom(accumulator.Generation(generation), part)
+		composer.ContentType = "application/octet-stream"
+		attrs, err := composer.Run(ctx)
+		if err == nil {
+			return attrs, nil
+		}
+		// Composing replaces the generation it read, so once another request has
+		// appended, that generation is gone and the compose fails with 404 rather
+		// than 412
+		var gErr *googleapi.Error
+		stale := isPreconditionFailed(err) || (errors.As(err, &gErr) && gErr.Code == http.StatusNotFound)
+		if !stale || attempt >= maxCASAttempts {
+			return nil, fmt.Errorf("failed to compose chunk onto %s: %w", accumulator.ObjectName(), err)
+		}
+
+		loggerFrom(ctx).Info("Accumulator changed concurrently, retrying compose", "accumulator", accumulator.ObjectName(), "attempt", attempt, "max_attempts", maxCASAttempts)
+		time.Sleep(casBackoff(attempt))
+		current, err := accumulator.Attrs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attributes of %s: %w", accumulator.ObjectName(), err)
+		}
+		generation = current.Generation
+	}
+}
+
+// encryptComposed rewrites the object obj was composed into, described by attrs, so
+// it is encrypted with CMEK_KEY, returning the attributes of the rewritten object.
+// The storage client does not pass a compose destination's KMS key on to GCS, which
+// therefore encrypts composed objects with the bucket's default key. Rewriting copies
+// the whole object, so only finished recordings are rewritten: the accumulator of a
+// file being recorded keeps the bucket's default key rather than costing every append
+// a copy of the file. Without CMEK_KEY, attrs is returned as is.
+func encryptComposed(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs) (*storage.ObjectAttrs, error) {
+	if cmekKey == "" {
+		return attrs, nil
+	}
+	copier := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).CopierFrom(obj.Generation(attrs.Generation))
+	copier.DestinationKMSKeyName = cmekKey
+	encrypted, err := copier.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s with CMEK_KEY: %w", obj.ObjectName(), err)
+	}
+	return encrypted, nil
+}
+
+// finalizeWAV materializes the WAV described by metadata by folding any segments
+// into the accumulated PCM and composing a header in front of it, then removes the
+// intermediate objects, returning the size of the audio data. The WAV carries the
+// custom metadata of recordingTags. A file whose PCM accumulator is already gone has
+// been finalized, so retrying is a no-op.
+func finalizeWAV(ctx context.Context, bucket *storage.BucketHandle, uid string, metadata *WAVMetadata) (int, error) {
+	logger := loggerFrom(ctx)
+	accumulator := bucket.Object(pcmPath(metadata.Filename))
+	attrs, err := accumulator.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		logger.Info("WAV file is already finalized", "file", metadata.Filename)
+		// The stored WAV reflects any trimming, which the session's size does not
+		format, dataLen, err := readWAVHeader(ctx, bucket.Object(metadata.Filename))
+		if err != nil {
+			return metadata.CurrentSize, nil
+		}
+		if format != metadata.format() {
+			logger.Warn("Finalized WAV does not have the session's format", "file", metadata.Filename,
+				"sample_rate", format.sampleRate, "channels", format.channels, "bits", format.bits,
+				"session_sample_rate", metadata.fileSampleRate(), "session_channels", metadata.fileChannels(), "session_bits", metadata.fileBits())
+		}
+		return dataLen, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read attributes of %s: %v", accumulator.ObjectName(), err)
+	}
+	if attrs, err = foldSegments(ctx, bucket, metadata.Filename, attrs); err != nil {
+		return 0, err
+	}
+
+	// GCS checksums the stored bytes itself, so a mismatch means the accumulator no
+	// longer holds the audio that was appended to it
+	if metadata.Checksum != 0 && int(attrs.Size) == metadata.CurrentSize && attrs.CRC32C != metadata.Checksum {
+		logger.Warn("Accumulated audio does not match its running checksum", "file", metadata.Filename,
+			"expected", formatChecksum(metadata.Checksum), "stored", formatChecksum(attrs.CRC32C))
+	}
+
+	// Silence detection and normalizing work on 16-bit integer samples only
+	if (trimSilenceOnFinalize || normalizeOnFinalize) && metadata.fileBits() == 16 {
+		if attrs, err = processAccumulator(ctx, accumulator, attrs, metadata); err != nil {
+			return 0, err
+		}
+	}
+
+	if outputFormat != "wav" {
+		if err := writeRaw(ctx, bucket, accumulator.Generation(attrs.Generation), uid, metadata); err != nil {
+			return 0, err
+		}
+	}
+
+	if finalizeFormat != "wav" {
+		if !flacSupported(metadata) {
+			logger.Warn("FLAC cannot store the file's samples, keeping it as WAV only", "file", metadata.Filename, "bits", metadata.fileBits(), "float", metadata.Float)
+		} else if err := writeFLAC(ctx, bucket, accumulator.Generation(attrs.Generation), uid, metadata); err != nil {
+			return 0, err
+		}
+	}
+
+	if wavSkipped(metadata) {
+		deleteObject(ctx, accumulator.If(storage.Conditions{GenerationMatch: attrs.Generation}))
+		logger.Info("Finalized without a WAV file", "file", recordingPath(metadata), "bytes", attrs.Size)
+		return int(attrs.Size), nil
+	}
+
+	headerBytes, pad := createWAVHeader(int(attrs.Size), metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits(), metadata.Float)
+	header := bucket.Object(headerPath(metadata.Filename))
+	if _, err := writeObject(ctx, header, "application/octet-stream", headerBytes); err != nil {
+		return 0, fmt.Errorf("failed to write header: %v", err)
+	}
+	defer deleteObject(ctx, header)
+
+	sources := []*storage.ObjectHandle{header, accumulator.Generation(attrs.Generation)}
+	if len(pad) > 0 {
+		padding := bucket.Object(padPath(metadata.Filename))
+		if _, err := writeObject(ctx, padding, "application/octet-stream", pad); err != nil {
+			return 0, fmt.Errorf("failed to write pad byte: %v", err)
+		}
+		defer deleteObject(ctx, padding)
+		sources = append(sources, padding)
+	}
+
+	composer := bucket.Object(metadata.Filename).ComposerFrom(sources...)
+	composer.ContentType = "audio/wav"
+	composer.Metadata = recordingTags(uid, metadata)
+	composed, err := composer.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compose %s: %v", metadata.Filename, err)
+	}
+	if _, err := encryptComposed(ctx, bucket.Object(metadata.Filename), composed); err != nil {
+		return 0, err
+	}
+
+	deleteObject(ctx, accumulator.If(storage.Conditions{GenerationMatch: attrs.Generation}))
+	logger.Info("Finalized WAV file", "file", metadata.Filename, "bytes", attrs.Size)
+	return int(attrs.Size), nil
+}
+
+// closeRecording finalizes the WAV described by metadata, records its final size in
+// its sidecar, records it in the recordings index of the uid owning session key and
+// in the session's playlist, announces it on Pub/Sub and hands it to the STT
+// backend. It returns the size of the finalized audio data, which is smaller than the
+// session's CurrentSize when silence was trimmed.
+func closeRecording(ctx context.Context, bucket *storage.BucketHandle, key string, metadata *WAVMetadata) (int, error) {
+	uid, _ := splitSessionKey(key)
+	size, err := finalizeWAV(ctx, bucket, key, metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writeSidecar(ctx, bucket, key, metadata, size); err != nil {
+		loggerFrom(ctx).Error("Failed to write sidecar", "error", err)
+	}
+
+	entry := recordingEntry{
+		Filename:        metadata.Filename,
+		StartTime:       metadata.StartTime,
+		DurationSeconds: calculateDuration(size, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()).Seconds(),
+		Size:            wavObjectSize(size),
+	}
+	if entry.Fingerprint, err = fingerprintRecording(ctx, bucket, metadata); err != nil {
+		loggerFrom(ctx).Warn("Failed to fingerprint recording", "error", err)
+	}
+	if path := recordingPath(metadata); path != metadata.Filename {
+		attrs, err := bucket.Object(path).Attrs(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read attributes of %s: %v", path, err)
+		}
+		entry.Filename = attrs.Name
+		entry.Size = int(attrs.Size)
+	}
+	if err := appendIndexEntry(ctx, bucket, uid, entry); err != nil {
+		return 0, fmt.Errorf("failed to update recordings index: %v", err)
+	}
+	if err := addToPlaylist(ctx, openStore(bucket), key, entry); err != nil {
+		loggerFrom(ctx).Warn("Failed to add recording to the session's playlist", "error", err)
+	}
+	notifyFinalized(ctx, uid, entry)
+	requestTranscript(ctx, bucket.BucketName(), uid, metadata, entry)
+	return size, nil
+}
+
+// processAccumulator replaces the accumulated PCM of metadata's file with a copy that
+// has long silent runs removed when TRIM_SILENCE is on, then is leveled to
+// NORMALIZE_TARGET_DBFS when NORMALIZE is on, returning the attributes of the object
+// to finalize. The audio is streamed through twice, pcmBlockSize bytes at a time,
+// rather than read whole: once to measure what trimming keeps and its peak, then to
+// write the processed copy. The rewrite is conditional on the generation that was
+// read, so audio appended meanwhile fails the write rather than being lost.
+func processAccumulator(ctx context.Context, accumulator *storage.ObjectHandle, attrs *storage.ObjectAttrs, metadata *WAVMetadata) (*storage.ObjectAttrs, error) {
+	source := accumulator.Generation(attrs.Generation)
+	process := func(dst io.Writer) error {
+		reader, err := source.NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		if !trimSilenceOnFinalize {
+			return copyPCM(dst, reader)
+		}
+		trimmer := newSilenceTrimmer(dst, metadata.fileSampleRate(), metadata.fileChannels())
+		if err := copyPCM(trimmer, reader); err != nil {
+			return err
+		}
+		return trimmer.Close()
+	}
+
+	var measured peakMeter
+	if err := process(&measured); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", accumulator.ObjectName(), err)
+	}
+	changed := false
+	if trimSilenceOnFinalize && measured.size != attrs.Size {
+		loggerFrom(ctx).Info("Trimmed silence", "file", metadata.Filename, "bytes", attrs.Size-measured.size)
+		changed = true
+	}
+	gain := 1.0
+	if normalizeOnFinalize {
+		if gain = normalizeGain(measured.peak, normalizeTarget); gain != 1 {
+			loggerFrom(ctx).Info("Normalized audio", "file", metadata.Filename, "gain", gain, "target_dbfs", normalizeTarget)
+			changed = true
+		}
+	}
+	if !changed {
+		return attrs, nil
+	}
+
+	processed, err := streamObject(ctx, accumulator.If(storage.Conditions{GenerationMatch: attrs.Generation}), "application/octet-stream", func() (io.ReadCloser, error) {
+		return pipe(func(w io.Writer) error {
+			return process(&gainWriter{out: w, gain: gain})
+		}), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write processed %s: %w", accumulator.ObjectName(), err)
+	}
+	return processed, nil
+}
+
+// flacOnly reports whether metadata's file is kept as FLAC alone once finalized
+func flacOnly(metadata *WAVMetadata) bool {
+	return finalizeFormat == "flac" && flacSupported(metadata)
+}
+
+// wavSkipped reports whether finalizing metadata's file produces no WAV, keeping
+// its audio only as FLAC or headerless PCM
+func wavSkipped(metadata *WAVMetadata) bool {
+	return flacOnly(metadata) || outputFormat == "pcm"
+}
+
+// recordingPath returns the name of the object that holds metadata's file once
+// finalized: the WAV, or the rendition kept instead of it, preferring FLAC
+func recordingPath(metadata *WAVMetadata) string {
+	switch {
+	case flacOnly(metadata):
+		return flacPath(metadata.Filename)
+	case outputFormat == "pcm":
+		return rawPath(metadata.Filename)
+	}
+	return metadata.Filename
+}
+
+// writeRaw copies the accumulated PCM in accumulator to the headerless PCM rendition
+// of metadata's file, carrying the custom metadata of recordingTags
+func writeRaw(ctx context.Context, bucket *storage.BucketHandle, accumulator *storage.ObjectHandle, uid string, metadata *WAVMetadata) error {
+	copier := bucket.Object(rawPath(metadata.Filename)).CopierFrom(accumulator)
+	copier.ContentType = "application/octet-stream"
+	copier.Metadata = recordingTags(uid, metadata)
+	copier.DestinationKMSKeyName = cmekKey
+	attrs, err := copier.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", rawPath(metadata.Filename), err)
+	}
+	loggerFrom(ctx).Info("Wrote raw PCM file", "file", attrs.Name, "bytes", attrs.Size)
+	return nil
+}
+
+// writeFLAC encodes the accumulated PCM in accumulator and stores it next to the
+// WAV of metadata's file, carrying the same custom metadata. The audio is encoded as
+// it is read and uploaded as it is encoded, so it is never held whole.
+func writeFLAC(ctx context.Context, bucket *storage.BucketHandle, accumulator *storage.ObjectHandle, uid string, metadata *WAVMetadata) error {
+	name := flacPath(metadata.Filename)
+	var audioBytes int64
+	attrs, err := streamTaggedObject(ctx, bucket.Object(name), "audio/flac", recordingTags(uid, metadata), func() (io.ReadCloser, error) {
+		reader, err := accumulator.NewReader(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", accumulator.ObjectName(), err)
+		}
+		audioBytes = reader.Attrs.Size
+		return pipe(func(w io.Writer) error {
+			defer reader.Close()
+			return streamFLAC(w, reader, audioBytes, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits())
+		}), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	loggerFrom(ctx).Info("Wrote FLAC file", "file", name, "audio_bytes", audioBytes, "encoded_bytes", attrs.Size)
+	return nil
+}
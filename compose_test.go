@@ -0,0 +1,35 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestAppendPartRetriesStaleGeneration(t *testing.T) {
+	f := newFakeGCS(t)
+	const filename = "alice/2024-05-01T12-00-00Z.wav"
+	stale := f.put(pcmPath(filename), []byte("ab"))
+	// Another request appended after this one read the accumulator's generation
+	f.put(pcmPath(filename), []byte("abcd"))
+
+	attrs, err := appendPart(context.Background(), f.bucket(), filename, 2, stale, []byte("ef"), nil)
+	if err != nil {
+		t.Fatalf("appendPart with a stale generation: %v", err)
+	}
+	stored, _ := f.get(pcmPath(filename))
+	if !bytes.Equal(stored, []byte("abcdef")) || attrs.Size != 6 {
+		t.Fatalf("accumulator = %q (%d bytes reported), want the chunk composed onto the current generation", stored, attrs.Size)
+	}
+	if _, ok := f.get(partPath(filename, 2)); ok {
+		t.Fatal("part left behind after the append")
+	}
+}
+
+func TestAppendPartFailsWithoutAccumulator(t *testing.T) {
+	f := newFakeGCS(t)
+	const filename = "alice/2024-05-01T12-00-00Z.wav"
+	if _, err := appendPart(context.Background(), f.bucket(), filename, 1, 1, []byte("ef"), nil); err == nil {
+		t.Fatal("appendPart onto a missing accumulator succeeded")
+	}
+}
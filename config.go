@@ -0,0 +1,397 @@
+package function
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deployment-tunable settings, read from the environment once per instance.
+// Unset or malformed values fall back to the built-in defaults.
+var (
+	maxDuration       time.Duration
+	inactivityLimit   time.Duration
+	defaultSampleRate int
+	// targetSampleRate, when non-zero, is the rate all incoming audio is resampled to
+	targetSampleRate int
+	// filePathTemplate builds the object path of each new WAV file
+	filePathTemplate pathTemplate
+	// maxBodyBytes caps the size of a request body as sent
+	maxBodyBytes int64
+	// maxDecompressedBytes caps the decoded size of a compressed request body
+	maxDecompressedBytes int64
+	// rateLimitPerMin, when positive, is how many requests each uid may make per minute
+	rateLimitPerMin int
+	// allowedOrigins lists the origins browser clients may call from, "*" for any
+	allowedOrigins []string
+	// trimSilenceOnFinalize enables dropping long quiet runs when a file is finalized
+	trimSilenceOnFinalize bool
+	// silenceThreshold is the RMS amplitude below which audio counts as silent
+	silenceThreshold int
+	// minSilence is how long audio must stay silent before it is trimmed
+	minSilence time.Duration
+	// gcsTimeout bounds the GCS work done for a single request
+	gcsTimeout time.Duration
+	// deleteTimeout bounds the work of erasing a user, which for a uid with many
+	// recordings far outlasts GCS_TIMEOUT
+	deleteTimeout time.Duration
+	// maxFileBytes is the audio size at which a file rolls over whatever its duration
+	maxFileBytes int64
+	// gcsMaxRetries is how many times a transient GCS failure is retried
+	gcsMaxRetries int
+	// allowedBuckets lists the buckets a request may select instead of GCS_BUCKET_NAME
+	allowedBuckets []string
+	// finalizeFormat selects what finalizing produces: "wav", "flac", or "both"
+	finalizeFormat string
+	// retentionClass is recorded on finalized recordings for lifecycle rules
+	retentionClass string
+	// cmekKey is the Cloud KMS key every object is encrypted with, or "" for the
+	// bucket's default encryption. Accumulators are composed, so they carry the
+	// bucket's default key until finalized.
+	cmekKey string
+	// outputFormat selects whether finalizing keeps the audio as a WAV, as headerless
+	// PCM, or both: "wav", "pcm", or "both"
+	outputFormat string
+	// allowEmptyBody lets uploads without audio reach storage instead of answering 204
+	allowEmptyBody bool
+	// segmentOnSilence starts a new file wherever speech resumes after a silent gap
+	segmentOnSilence bool
+	// writeLockTimeout is how long a write waits for another to release its session's
+	// lock; 0 disables locking
+	writeLockTimeout time.Duration
+	// normalizeOnFinalize enables scaling each file so its peak reaches normalizeTarget
+	normalizeOnFinalize bool
+	// normalizeTarget is the peak level normalizing aims for, in dBFS
+	normalizeTarget float64
+	// pairMaxSkew is how far one ear of a stereo pair may get ahead of the other
+	// before the other is padded with silence
+	pairMaxSkew time.Duration
+	// writeBufferBytes, when positive, is how much of a session's audio an instance
+	// holds before appending it to storage
+	writeBufferBytes int64
+	// maxOpenBuffers caps how many sessions an instance holds buffered audio for
+	maxOpenBuffers int
+	// lateChunkPolicy selects what becomes of a chunk arriving shortly after its
+	// session was finalized: "new", "drop", or "reopen"
+	lateChunkPolicy string
+	// lateChunkGrace is how long after a finalize a chunk counts as late
+	lateChunkGrace time.Duration
+	// sttURL is the speech-to-text backend finalized recordings are posted to, or ""
+	// to transcribe nothing
+	sttURL string
+	// sttDefaultLanguage is the language passed to the STT backend for sessions that
+	// gave no lang hint
+	sttDefaultLanguage string
+	// fingerprintOnFinalize enables recording an acoustic fingerprint of each file
+	// in its index entry
+	fingerprintOnFinalize bool
+	// fingerprintMaxDuration bounds how much of each file is fingerprinted
+	fingerprintMaxDuration time.Duration
+	// playlistsEnabled keeps a playlist of the files of each session
+	playlistsEnabled bool
+	// streamingMode selects how chunks are stored: "eager" composes each onto the
+	// file's accumulator, "lazy" keeps each as a segment until the file is finalized
+	streamingMode string
+	// storageBackend selects where session bookkeeping is kept: "gcs" or "s3"
+	storageBackend string
+	// s3Endpoint is the base URL of the S3-compatible service used with
+	// STORAGE_BACKEND=s3, and s3Region the region requests to it are signed for
+	s3Endpoint string
+	s3Region   string
+	// s3BucketName is the S3 bucket bookkeeping is kept in, or "" for the bucket
+	// named like the GCS one
+	s3BucketName string
+)
+
+func init() {
+	initLogging()
+	loadConfig()
+	checkStorageConfig()
+}
+
+// loadConfig reads MAX_DURATION, INACTIVITY_LIMIT, DEFAULT_SAMPLE_RATE,
+// TARGET_SAMPLE_RATE, PATH_TEMPLATE, MAX_BODY_BYTES, MAX_DECOMPRESSED_BYTES,
+// RATE_LIMIT_PER_MIN, ALLOWED_ORIGINS, TRIM_SILENCE, SILENCE_THRESHOLD,
+// MIN_SILENCE_MS, GCS_TIMEOUT, DELETE_TIMEOUT, MAX_FILE_BYTES, GCS_MAX_RETRIES,
+// ALLOWED_BUCKETS, FINALIZE_FORMAT, RETENTION_CLASS, OUTPUT_FORMAT, ALLOW_EMPTY_BODY,
+// SEGMENT_ON_SILENCE, WRITE_LOCK_TIMEOUT, NORMALIZE, NORMALIZE_TARGET_DBFS, CMEK_KEY,
+// PAIR_MAX_SKEW, WRITE_BUFFER_BYTES, MAX_OPEN_BUFFERS, LATE_CHUNK_POLICY,
+// LATE_CHUNK_GRACE, STT_URL, STT_DEFAULT_LANGUAGE, FINGERPRINT,
+// FINGERPRINT_MAX_DURATION, PLAYLISTS, STREAMING_MODE, STORAGE_BACKEND, S3_ENDPOINT,
+// S3_REGION and S3_BUCKET and logs the effective configuration
+func loadConfig() {
+	maxDuration = envDuration("MAX_DURATION", fallbackMaxDuration)
+	inactivityLimit = envDuration("INACTIVITY_LIMIT", fallbackInactivityLimit)
+	gcsTimeout = envDuration("GCS_TIMEOUT", fallbackGCSTimeout)
+	deleteTimeout = envDuration("DELETE_TIMEOUT", fallbackDeleteTimeout)
+	maxFileBytes = envBytes("MAX_FILE_BYTES", fallbackMaxFileBytes)
+	// RIFF sizes are 32-bit, so a larger file would get a header that wraps around
+	if limit := int64(math.MaxUint32 - wavHeaderSize); maxFileBytes > limit {
+		slog.Warn("MAX_FILE_BYTES is more than a WAV header can describe, clamping it", "value", maxFileBytes, "max", limit)
+		maxFileBytes = limit
+	}
+
+	gcsMaxRetries = fallbackGCSMaxRetries
+	if value := os.Getenv("GCS_MAX_RETRIES"); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			slog.Warn("Invalid GCS_MAX_RETRIES, using the default", "value", value, "default", fallbackGCSMaxRetries)
+		} else {
+			gcsMaxRetries = retries
+		}
+	}
+
+	defaultSampleRate = fallbackSampleRate
+	if value := os.Getenv("DEFAULT_SAMPLE_RATE"); value != "" {
+		rate, err := strconv.Atoi(value)
+		if err != nil || !allowedSampleRates[rate] {
+			slog.Warn("Invalid DEFAULT_SAMPLE_RATE, using the default", "value", value, "default", fallbackSampleRate)
+		} else {
+			defaultSampleRate = rate
+		}
+	}
+
+	targetSampleRate = 0
+	if value := os.Getenv("TARGET_SAMPLE_RATE"); value != "" {
+		rate, err := strconv.Atoi(value)
+		if err != nil || !allowedSampleRates[rate] {
+			slog.Warn("Invalid TARGET_SAMPLE_RATE, resampling disabled", "value", value)
+		} else {
+			targetSampleRate = rate
+		}
+	}
+
+	pathTemplateValue := defaultPathTemplate
+	if value := os.Getenv("PATH_TEMPLATE"); value != "" {
+		if _, err := parsePathTemplate(value); err != nil {
+			slog.Warn("Invalid PATH_TEMPLATE, using the default", "error", err, "default", defaultPathTemplate)
+		} else {
+			pathTemplateValue = value
+		}
+	}
+	filePathTemplate, _ = parsePathTemplate(pathTemplateValue)
+
+	maxBodyBytes = envBytes("MAX_BODY_BYTES", fallbackMaxBodyBytes)
+	maxDecompressedBytes = envBytes("MAX_DECOMPRESSED_BYTES", defaultMaxDecompressedBytes)
+
+	rateLimitPerMin = 0
+	if value := os.Getenv("RATE_LIMIT_PER_MIN"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			slog.Warn("Invalid RATE_LIMIT_PER_MIN, rate limiting disabled", "value", value)
+		} else {
+			rateLimitPerMin = limit
+		}
+	}
+
+	allowedOrigins = envList("ALLOWED_ORIGINS")
+	allowedBuckets = envList("ALLOWED_BUCKETS")
+
+	finalizeFormat = "wav"
+	switch value := os.Getenv("FINALIZE_FORMAT"); value {
+	case "", "wav":
+	case "flac", "both":
+		finalizeFormat = value
+	default:
+		slog.Warn("Invalid FINALIZE_FORMAT, using wav", "value", value)
+	}
+
+	retentionClass = os.Getenv("RETENTION_CLASS")
+	cmekKey = os.Getenv("CMEK_KEY")
+	if cmekKey != "" && !strings.HasPrefix(cmekKey, "projects/") {
+		slog.Warn("CMEK_KEY does not look like a Cloud KMS key name", "value", cmekKey, "expected", "projects/{project}/locations/{location}/keyRings/{ring}/cryptoKeys/{key}")
+	}
+
+	outputFormat = "wav"
+	switch value := os.Getenv("OUTPUT_FORMAT"); value {
+	case "", "wav":
+	case "pcm", "both":
+		outputFormat = value
+	default:
+		slog.Warn("Invalid OUTPUT_FORMAT, using wav", "value", value)
+	}
+
+	allowEmptyBody = os.Getenv("ALLOW_EMPTY_BODY") == "true"
+	segmentOnSilence = os.Getenv("SEGMENT_ON_SILENCE") == "true"
+	writeLockTimeout = envDuration("WRITE_LOCK_TIMEOUT", 0)
+	pairMaxSkew = envDuration("PAIR_MAX_SKEW", fallbackPairMaxSkew)
+	writeBufferBytes = envBytes("WRITE_BUFFER_BYTES", 0)
+	maxOpenBuffers = int(envBytes("MAX_OPEN_BUFFERS", defaultMaxOpenBuffers))
+
+	lateChunkPolicy = "new"
+	switch value := os.Getenv("LATE_CHUNK_POLICY"); value {
+	case "", "new":
+	case "drop", "reopen":
+		lateChunkPolicy = value
+	default:
+		slog.Warn("Invalid LATE_CHUNK_POLICY, using new", "value", value)
+	}
+	lateChunkGrace = envDuration("LATE_CHUNK_GRACE", fallbackLateChunkGrace)
+
+	fingerprintOnFinalize = os.Getenv("FINGERPRINT") == "true"
+	fingerprintMaxDuration = envDuration("FINGERPRINT_MAX_DURATION", fallbackFingerprintMax)
+	playlistsEnabled = os.Getenv("PLAYLISTS") == "true"
+	streamingMode = "eager"
+	switch value := os.Getenv("STREAMING_MODE"); value {
+	case "", "eager":
+	case "lazy":
+		streamingMode = value
+	default:
+		slog.Warn("Invalid STREAMING_MODE, using eager", "value", value)
+	}
+
+	storageBackend = "gcs"
+	switch value := os.Getenv("STORAGE_BACKEND"); value {
+	case "", "gcs":
+	case "s3":
+		storageBackend = value
+	default:
+		slog.Warn("Invalid STORAGE_BACKEND, using gcs", "value", value)
+	}
+	s3Region = os.Getenv("S3_REGION")
+	if s3Region == "" {
+		s3Region = fallbackS3Region
+	}
+	s3Endpoint = strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/")
+	if s3Endpoint == "" {
+		s3Endpoint = "https://s3." + s3Region + ".amazonaws.com"
+	}
+	s3BucketName = os.Getenv("S3_BUCKET")
+
+	sttURL = os.Getenv("STT_URL")
+	sttDefaultLanguage = fallbackSTTLanguage
+	if value := os.Getenv("STT_DEFAULT_LANGUAGE"); value != "" {
+		if _, err := parseLanguage(value); err != nil {
+			slog.Warn("Invalid STT_DEFAULT_LANGUAGE, using the default", "value", value, "default", fallbackSTTLanguage)
+		} else {
+			sttDefaultLanguage = value
+		}
+	}
+
+	normalizeOnFinalize = os.Getenv("NORMALIZE") == "true"
+	normalizeTarget = fallbackNormalizeTarget
+	if value := os.Getenv("NORMALIZE_TARGET_DBFS"); value != "" {
+		target, err := strconv.ParseFloat(value, 64)
+		if err != nil || target > 0 || math.IsInf(target, 0) || math.IsNaN(target) {
+			slog.Warn("Invalid NORMALIZE_TARGET_DBFS, using the default", "value", value, "default", fallbackNormalizeTarget)
+		} else {
+			normalizeTarget = target
+		}
+	}
+
+	trimSilenceOnFinalize = os.Getenv("TRIM_SILENCE") == "true"
+	silenceThreshold = fallbackSilenceThreshold
+	if value := os.Getenv("SILENCE_THRESHOLD"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold <= 0 || threshold > math.MaxInt16 {
+			slog.Warn("Invalid SILENCE_THRESHOLD, using the default", "value", value, "default", fallbackSilenceThreshold)
+		} else {
+			silenceThreshold = threshold
+		}
+	}
+	minSilence = fallbackMinSilence
+	if value := os.Getenv("MIN_SILENCE_MS"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			slog.Warn("Invalid MIN_SILENCE_MS, using the default", "value", value, "default", fallbackMinSilence.Milliseconds())
+		} else {
+			minSilence = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	slog.Info("Effective configuration",
+		"MAX_DURATION", maxDuration.String(),
+		"INACTIVITY_LIMIT", inactivityLimit.String(),
+		"DEFAULT_SAMPLE_RATE", defaultSampleRate,
+		"TARGET_SAMPLE_RATE", targetSampleRate,
+		"PATH_TEMPLATE", pathTemplateValue,
+		"MAX_BODY_BYTES", maxBodyBytes,
+		"MAX_DECOMPRESSED_BYTES", maxDecompressedBytes,
+		"RATE_LIMIT_PER_MIN", rateLimitPerMin,
+		"ALLOWED_ORIGINS", strings.Join(allowedOrigins, ","),
+		"TRIM_SILENCE", trimSilenceOnFinalize,
+		"SILENCE_THRESHOLD", silenceThreshold,
+		"MIN_SILENCE_MS", minSilence.Milliseconds(),
+		"GCS_TIMEOUT", gcsTimeout.String(),
+		"DELETE_TIMEOUT", deleteTimeout.String(),
+		"MAX_FILE_BYTES", maxFileBytes,
+		"GCS_MAX_RETRIES", gcsMaxRetries,
+		"ALLOWED_BUCKETS", strings.Join(allowedBuckets, ","),
+		"FINALIZE_FORMAT", finalizeFormat,
+		"RETENTION_CLASS", retentionClass,
+		"OUTPUT_FORMAT", outputFormat,
+		"ALLOW_EMPTY_BODY", allowEmptyBody,
+		"SEGMENT_ON_SILENCE", segmentOnSilence,
+		"WRITE_LOCK_TIMEOUT", writeLockTimeout.String(),
+		"NORMALIZE", normalizeOnFinalize,
+		"NORMALIZE_TARGET_DBFS", normalizeTarget,
+		"CMEK_KEY", cmekKey,
+		"PAIR_MAX_SKEW", pairMaxSkew.String(),
+		"WRITE_BUFFER_BYTES", writeBufferBytes,
+		"MAX_OPEN_BUFFERS", maxOpenBuffers,
+		"LATE_CHUNK_POLICY", lateChunkPolicy,
+		"LATE_CHUNK_GRACE", lateChunkGrace.String(),
+		"STT_URL", sttURL,
+		"STT_DEFAULT_LANGUAGE", sttDefaultLanguage,
+		"FINGERPRINT", fingerprintOnFinalize,
+		"FINGERPRINT_MAX_DURATION", fingerprintMaxDuration.String(),
+		"PLAYLISTS", playlistsEnabled,
+		"STREAMING_MODE", streamingMode,
+		"STORAGE_BACKEND", storageBackend,
+		"S3_ENDPOINT", s3Endpoint,
+		"S3_REGION", s3Region,
+		"S3_BUCKET", s3BucketName)
+}
+
+// envDuration parses the named environment variable as a Go duration such as "5m",
+// returning fallback when it is unset, malformed, or not positive
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		slog.Warn("Invalid "+name+", using the default", "value", value, "default", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+// envBytes parses the named environment variable as a byte count, returning
+// fallback when it is unset, malformed, or not positive
+func envBytes(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		slog.Warn("Invalid "+name+", using the default", "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+// gcsContext derives the context for the GCS work of r, cancelled when the client
+// goes away or after GCS_TIMEOUT so a hung call can't keep the invocation alive
+func gcsContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), gcsTimeout)
+}
+
+// envList parses the named environment variable as a comma-separated list, dropping
+// blank entries
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,76 @@
+package function
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConfiguredRolloverBoundaries(t *testing.T) {
+	// Registered before t.Setenv, so the configuration is reloaded once the
+	// environment is restored
+	t.Cleanup(loadConfig)
+	t.Setenv("MAX_DURATION", "30s")
+	t.Setenv("INACTIVITY_LIMIT", "45s")
+	t.Setenv("DEFAULT_SAMPLE_RATE", "8000")
+	loadConfig()
+	clock := useFakeClock(t, testStart)
+
+	if maxDuration != 30*time.Second || inactivityLimit != 45*time.Second || defaultSampleRate != 8000 {
+		t.Fatalf("loadConfig = %v, %v, %d Hz, want 30s, 45s, 8000 Hz", maxDuration, inactivityLimit, defaultSampleRate)
+	}
+
+	second := 16000 * 2
+	below := &WAVMetadata{CurrentSize: 30*second - 2, SampleRate: 16000, LastWriteTime: testStart}
+	at := &WAVMetadata{CurrentSize: 30 * second, SampleRate: 16000, LastWriteTime: testStart}
+	if shouldCreateNewFile(below) || !shouldCreateNewFile(at) {
+		t.Fatal("rollover does not flip at MAX_DURATION")
+	}
+
+	clock.Advance(45*time.Second - time.Nanosecond)
+	if shouldCreateNewFile(below) {
+		t.Fatal("rollover before INACTIVITY_LIMIT")
+	}
+	clock.Advance(time.Nanosecond)
+	if !shouldCreateNewFile(below) {
+		t.Fatal("no rollover at INACTIVITY_LIMIT")
+	}
+}
+
+func TestInvalidConfigFallsBack(t *testing.T) {
+	t.Cleanup(loadConfig)
+	t.Setenv("MAX_DURATION", "soon")
+	t.Setenv("DEFAULT_SAMPLE_RATE", "22050")
+	loadConfig()
+
+	if maxDuration != fallbackMaxDuration || defaultSampleRate != fallbackSampleRate {
+		t.Fatalf("invalid config = %v, %d Hz, want the defaults %v, %d Hz", maxDuration, defaultSampleRate, fallbackMaxDuration, fallbackSampleRate)
+	}
+}
+
+func TestMaxFileBytesIsClamped(t *testing.T) {
+	t.Cleanup(loadConfig)
+	t.Setenv("MAX_FILE_BYTES", "8589934592")
+	loadConfig()
+
+	if want := int64(math.MaxUint32 - wavHeaderSize); maxFileBytes != want {
+		t.Fatalf("MAX_FILE_BYTES of 8 GiB = %d, want it clamped to %d", maxFileBytes, want)
+	}
+}
+
+func TestS3Config(t *testing.T) {
+	t.Cleanup(loadConfig)
+	t.Setenv("STORAGE_BACKEND", "s3")
+	t.Setenv("S3_REGION", "eu-west-1")
+	loadConfig()
+	if storageBackend != "s3" || s3Endpoint != "https://s3.eu-west-1.amazonaws.com" {
+		t.Fatalf("config = %s at %s, want s3 at the eu-west-1 endpoint", storageBackend, s3Endpoint)
+	}
+
+	t.Setenv("STORAGE_BACKEND", "azure")
+	t.Setenv("S3_ENDPOINT", "http://minio:9000/")
+	loadConfig()
+	if storageBackend != "gcs" || s3Endpoint != "http://minio:9000" {
+		t.Fatalf("config = %s at %s, want gcs and the endpoint without its slash", storageBackend, s3Endpoint)
+	}
+}
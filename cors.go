@@ -0,0 +1,57 @@
+package function
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// corsAllowedHeaders lists the request headers a browser client may send
+var corsAllowedHeaders = []string{"Content-Type", "Content-Encoding", "Idempotency-Key", "X-Signature", "X-Timestamp",
+	"X-Bucket", "X-Request-ID"}
+
+// corsExposedHeaders lists the response headers, beyond the CORS-safelisted ones, a
+// browser client may read
+var corsExposedHeaders = []string{"Location", "X-Audio-Duration-Seconds", "X-Request-ID"}
+
+// corsOriginAllowed reports whether origin is listed in ALLOWED_ORIGINS, where "*"
+// allows any origin
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCORS adds the CORS response headers for a request from an allowed origin and
+// reports whether the origin is allowed. Requests without an Origin header are not
+// cross-origin and are always allowed.
+func applyCORS(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	if !corsOriginAllowed(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+	return true
+}
+
+// handlePreflight answers an OPTIONS preflight request for a handler accepting
+// methods, refusing origins not listed in ALLOWED_ORIGINS
+func handlePreflight(w http.ResponseWriter, r *http.Request, methods ...string) {
+	if !applyCORS(w, r, methods...) {
+		slog.Warn("Rejecting preflight from disallowed origin", "origin", r.Header.Get("Origin"))
+		writeError(w, http.StatusForbidden, "Origin is not allowed")
+		return
+	}
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
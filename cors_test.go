@@ -0,0 +1,68 @@
+package function
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreflightAllowsClientHeaders(t *testing.T) {
+	setVar(t, &allowedOrigins, []string{"https://app.example"})
+	r := httptest.NewRequest(http.MethodOptions, "/?uid=alice", nil)
+	r.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight answered %d", w.Code)
+	}
+	allowed := w.Header().Get("Access-Control-Allow-Headers")
+	for _, header := range []string{"X-Signature", "X-Timestamp", "X-Bucket", "X-Request-ID"} {
+		if !strings.Contains(allowed, header) {
+			t.Errorf("Access-Control-Allow-Headers %q lacks %s", allowed, header)
+		}
+	}
+}
+
+func TestUploadExposesResponseHeaders(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &allowedOrigins, []string{"*"})
+	r := httptest.NewRequest(http.MethodPost, "/?uid=alice", strings.NewReader(string(tone(100*time.Millisecond, 16000))))
+	r.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload answered %d: %s", w.Code, w.Body)
+	}
+	exposed := w.Header().Get("Access-Control-Expose-Headers")
+	for _, header := range []string{"Location", "X-Audio-Duration-Seconds", "X-Request-ID"} {
+		if !strings.Contains(exposed, header) {
+			t.Errorf("Access-Control-Expose-Headers %q lacks %s", exposed, header)
+		}
+		if w.Header().Get(header) == "" {
+			t.Errorf("upload response lacks %s", header)
+		}
+	}
+}
+
+func TestPreflightRejectsDisallowedOrigin(t *testing.T) {
+	setVar(t, &allowedOrigins, []string{"https://app.example"})
+	r := httptest.NewRequest(http.MethodOptions, "/?uid=alice", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("preflight from a disallowed origin answered %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Fatalf("disallowed origin was granted Access-Control-Allow-Origin %q", origin)
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Origin") {
+		t.Fatal("response does not vary by Origin")
+	}
+}
@@ -0,0 +1,237 @@
+package function
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"cloud.google.com/go/storage"
+)
+
+// HandleGetCurrent streams the in-progress recording of uid as a WAV file so it can
+// be previewed before it is finalized. The header is generated for the audio
+// accumulated so far, including the segments not yet folded with STREAMING_MODE=lazy,
+// and Range requests are honored so players can seek. It returns 404 when uid has no
+// recording in progress. session_id selects a named session.
+// HEAD requests get the headers a GET would, Content-Length included, without the
+// audio, so clients can learn the size of the recording without downloading it.
+// A GET accepting gzip is compressed on the fly, unless it asks for a Range: a
+// compressed stream can't be seeked into.
+func HandleGetCurrent(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed, use GET or HEAD")
+		return
+	}
+
+	uid := r.URL.Query().Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received current recording request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting current recording request with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+	sessionID, err := parseSessionID(r.URL.Query())
+	if err != nil {
+		logger.Warn("Rejecting current recording request with invalid session_id")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sessionID != "" {
+		ctx, logger = logWith(ctx, "session_id", sessionID)
+	}
+	key := sessionKey(uid, sessionID)
+
+	// Downloads carry no body, so the signature covers only the session key and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, key, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated download", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	metadata, _, err := getCurrentMetadata(ctx, openStore(bucket), key)
+	if err != nil {
+		logger.Error("Failed to get metadata", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to get metadata: %v", err))
+		return
+	}
+	if metadata == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No recording in progress for uid %s", uid))
+		return
+	}
+
+	// Pin the generations so a concurrent append can't change the audio mid-download
+	accumulator := bucket.Object(pcmPath(metadata.Filename))
+	attrs, err := accumulator.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No recording in progress for uid %s", uid))
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read accumulator attributes", "accumulator", accumulator.ObjectName(), "error", err)
+		writeServerError(ctx, w, "Failed to read current recording")
+		return
+	}
+
+	sources := []pcmSource{{obj: accumulator.Generation(attrs.Generation), size: attrs.Size, updated: attrs.Updated}}
+	if streamingMode == "lazy" {
+		segments, err := listSegments(ctx, bucket, metadata.Filename, attrs.Size)
+		if err != nil {
+			logger.Error("Failed to list segments", "error", err)
+			writeServerError(ctx, w, "Failed to read current recording")
+			return
+		}
+		sources = append(sources, segments...)
+	}
+	modified := attrs.Updated
+	for _, source := range sources {
+		if source.updated.After(modified) {
+			modified = source.updated
+		}
+	}
+
+	// Streaming can legitimately outlast GCS_TIMEOUT, so it is bound to the request
+	// only. ServeContent answers HEAD from the size alone, never reading the objects.
+	content := newWAVReader(r.Context(), sources, metadata)
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", path.Base(metadata.Filename)))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		compressed := gzip.NewWriter(w)
+		_, err := io.Copy(compressed, content)
+		if err == nil {
+			err = compressed.Close()
+		}
+		if err != nil {
+			// The status is already sent, so the client sees a truncated stream
+			logger.Warn("Failed to stream compressed recording", "error", err)
+		}
+		return
+	}
+	http.ServeContent(w, r, path.Base(metadata.Filename), modified, content)
+}
+
+// wavReader presents a header followed by the PCM stored in one or more objects as
+// one seekable WAV file, reading the objects lazily from the current offset
+type wavReader struct {
+	ctx     context.Context
+	sources []pcmSource
+	header  []byte
+	pcm     int64
+	pad     []byte
+	offset  int64
+	body    io.ReadCloser
+	bodyAt  int64
+	bodyEnd int64
+}
+
+// newWAVReader returns a wavReader over the PCM of sources, in order, in the format
+// described by metadata
+func newWAVReader(ctx context.Context, sources []pcmSource, metadata *WAVMetadata) *wavReader {
+	var size int64
+	for _, source := range sources {
+		size += source.size
+	}
+	header, pad := createWAVHeader(int(size), metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits(), metadata.Float)
+	return &wavReader{ctx: ctx, sources: sources, header: header, pcm: size, pad: pad}
+}
+
+func (wr *wavReader) size() int64 {
+	return int64(len(wr.header)) + wr.pcm + int64(len(wr.pad))
+}
+
+func (wr *wavReader) Read(p []byte) (int, error) {
+	headerLen := int64(len(wr.header))
+	switch {
+	case wr.offset >= wr.size():
+		return 0, io.EOF
+	case wr.offset < headerLen:
+		n := copy(p, wr.header[wr.offset:])
+		wr.offset += int64(n)
+		return n, nil
+	case wr.offset >= headerLen+wr.pcm:
+		n := copy(p, wr.pad[wr.offset-headerLen-wr.pcm:])
+		wr.offset += int64(n)
+		return n, nil
+	}
+
+	// Reuse the open object reader while reads are sequential within its source
+	if wr.body == nil || wr.bodyAt != wr.offset || wr.offset >= wr.bodyEnd {
+		wr.Close()
+		start := headerLen
+		for _, source := range wr.sources {
+			if end := start + source.size; wr.offset < end {
+				body, err := source.obj.NewRangeReader(wr.ctx, wr.offset-start, end-wr.offset)
+				if err != nil {
+					return 0, err
+				}
+				wr.body, wr.bodyAt, wr.bodyEnd = body, wr.offset, end
+				break
+			}
+			start += source.size
+		}
+	}
+	if remaining := wr.bodyEnd - wr.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := wr.body.Read(p)
+	wr.offset += int64(n)
+	wr.bodyAt = wr.offset
+	if err == io.EOF && wr.offset < wr.size() {
+		// The pinned generation never shrinks, so running out early means a short read
+		err = nil
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (wr *wavReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += wr.offset
+	case io.SeekEnd:
+		offset += wr.size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	wr.offset = offset
+	return offset, nil
+}
+
+// Close releases the open object reader, if any
+func (wr *wavReader) Close() error {
+	if wr.body == nil {
+		return nil
+	}
+	err := wr.body.Close()
+	wr.body = nil
+	return err
+}
@@ -0,0 +1,170 @@
+package function
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getCurrent requests the in-progress recording of query, with rangeHeader if set
+func getCurrent(t *testing.T, query, rangeHeader string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	HandleGetCurrent(w, req)
+	return w
+}
+
+func TestGetCurrentFull(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(500*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", body)
+
+	w := getCurrent(t, "uid=alice", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET answered %d: %s", w.Code, w.Body)
+	}
+	header, _ := createWAVHeader(len(body), 16000, 1, 16, false)
+	if want := append(header, body...); !bytes.Equal(w.Body.Bytes(), want) {
+		t.Fatalf("GET returned %d bytes that differ from the %d byte WAV", w.Body.Len(), len(want))
+	}
+	if got := w.Header().Get("Content-Type"); got != "audio/wav" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+}
+
+func TestGetCurrentRange(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(500*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", body)
+	header, _ := createWAVHeader(len(body), 16000, 1, 16, false)
+	wav := append(header, body...)
+
+	tests := []struct {
+		rangeHeader string
+		want        []byte
+	}{
+		{"bytes=0-43", wav[:44]},
+		{"bytes=40-99", wav[40:100]},
+		{"bytes=1000-", wav[1000:]},
+		{"bytes=-10", wav[len(wav)-10:]},
+	}
+	for _, tt := range tests {
+		w := getCurrent(t, "uid=alice", tt.rangeHeader)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("%s answered %d", tt.rangeHeader, w.Code)
+		}
+		if !bytes.Equal(w.Body.Bytes(), tt.want) {
+			t.Errorf("%s returned %d bytes that differ from the %d expected", tt.rangeHeader, w.Body.Len(), len(tt.want))
+		}
+	}
+
+	if w := getCurrent(t, "uid=alice", "bytes=99999-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("range past the end answered %d, want %d", w.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+}
+
+func TestGetCurrentWithoutRecording(t *testing.T) {
+	newFakeGCS(t)
+	if w := getCurrent(t, "uid=alice", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET without a recording answered %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHeadCurrentMatchesGet(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	server := httptest.NewServer(http.HandlerFunc(HandleGetCurrent))
+	defer server.Close()
+
+	// The transport would otherwise ask for gzip, which HEAD does not describe
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/?uid=alice", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	get, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+
+	// HEAD is answered from the attributes, never downloading the audio
+	downloads := 0
+	f.fail = func(r *http.Request) int {
+		if !strings.HasPrefix(r.URL.Path, "/storage/v1/") && strings.HasSuffix(r.URL.Path, ".pcm") {
+			downloads++
+		}
+		return 0
+	}
+	head, err := http.Head(server.URL + "/?uid=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headBody, _ := io.ReadAll(head.Body)
+	head.Body.Close()
+	if head.StatusCode != http.StatusOK || len(headBody) != 0 || downloads != 0 {
+		t.Fatalf("HEAD answered %d with %d body bytes after %d downloads", head.StatusCode, len(headBody), downloads)
+	}
+	for _, name := range []string{"Content-Length", "Content-Type", "Accept-Ranges", "Last-Modified"} {
+		if got, want := head.Header.Get(name), get.Header.Get(name); got == "" || got != want {
+			t.Errorf("HEAD %s = %q, GET sent %q", name, got, want)
+		}
+	}
+	if length := head.Header.Get("Content-Length"); length != strconv.Itoa(len(body)) {
+		t.Errorf("HEAD Content-Length = %s, GET returned %d bytes", length, len(body))
+	}
+
+	if w := serve(t, HandleGetCurrent, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST answered %d with Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestGetCurrentGzip(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	plain := getCurrent(t, "uid=alice", "").Body.Bytes()
+	get := func(acceptEncoding, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?uid=alice", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		HandleGetCurrent(w, req)
+		return w
+	}
+
+	w := get("br, gzip;q=0.8", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("gzip download answered %d with Content-Encoding %q, Vary %q", w.Code, w.Header().Get("Content-Encoding"), w.Header().Get("Vary"))
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := io.ReadAll(reader); err != nil || !bytes.Equal(decoded, plain) {
+		t.Fatalf("gzip download decompresses to %d bytes (%v), want the %d byte WAV", len(decoded), err, len(plain))
+	}
+
+	// A Range is served uncompressed, as are clients that decline gzip
+	if w := get("gzip", "bytes=40-99"); w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), plain[40:100]) {
+		t.Errorf("gzip Range request answered %d with Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	for _, declined := range []string{"identity", "gzip;q=0", "*;q=1, gzip;q=0"} {
+		if w := get(declined, ""); w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), plain) {
+			t.Errorf("Accept-Encoding %q got Content-Encoding %q", declined, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
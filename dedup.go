@@ -0,0 +1,238 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	dedupPrefix     = "dedup/"
+	defaultDedupTTL = 10 * time.Minute
+	// dedupPendingType is the content type of a marker whose chunk is still being
+	// written. A confirmed marker is text/plain, as every marker used to be.
+	dedupPendingType = "text/plain; state=pending"
+	// dedupSweepInterval is how often the in-instance cache is cleared of expired
+	// entries, so remembering a chunk doesn't scan the whole cache every time
+	dedupSweepInterval = time.Minute
+)
+
+// A delivery of a chunk_id claims it with a pending marker before writing, and
+// confirms the marker once the chunk is stored. Until then other deliveries are told
+// to resend rather than that the chunk was processed, since the write may still fail
+// and give the claim up. A pending marker outlives no request: one older than
+// GCS_TIMEOUT was left by a delivery that died mid-write, and is claimed over.
+
+// chunkState is what the dedup store holds for a chunk_id
+type chunkState int
+
+const (
+	// chunkNew is a chunk_id without a live marker
+	chunkNew chunkState = iota
+	// chunkPending is a chunk_id claimed by a delivery that is still writing it
+	chunkPending
+	// chunkProcessed is a chunk_id stored within the TTL
+	chunkProcessed
+)
+
+// recentChunks is the in-instance front layer of the chunk dedup store. It only
+// short-circuits retries that land on the same instance, and only holds confirmed
+// chunks; the GCS markers are the source of truth across instances.
+var recentChunks = struct {
+	sync.Mutex
+	seen map[string]time.Time
+	// swept is when seen was last cleared of expired entries
+	swept time.Time
+}{seen: make(map[string]time.Time)}
+
+// dedupTTL returns how long a processed chunk_id is remembered, configured via DEDUP_TTL
+func dedupTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("DEDUP_TTL"))
+	if err != nil || ttl <= 0 {
+		return defaultDedupTTL
+	}
+	return ttl
+}
+
+// dedupKey returns the marker object name for a (uid, chunk_id) pair
+func dedupKey(uid, chunkID string) string {
+	return dedupPrefix + url.PathEscape(uid) + "/" + url.PathEscape(chunkID)
+}
+
+// markerState returns the state of the chunk whose marker has attrs
+func markerState(attrs *storage.ObjectAttrs, ttl time.Duration) chunkState {
+	age := nowFunc().Sub(attrs.Updated)
+	switch {
+	case attrs.ContentType == dedupPendingType && age < gcsTimeout:
+		return chunkPending
+	case attrs.ContentType != dedupPendingType && age < ttl:
+		return chunkProcessed
+	}
+	return chunkNew
+}
+
+// chunkStatus returns the state of chunkID for uid, checking the in-instance cache
+// before the shared marker in GCS. It claims nothing, so it suits dry runs; uploads
+// use claimChunk.
+func chunkStatus(ctx context.Context, store objectStore, uid, chunkID string) (chunkState, error) {
+	key := dedupKey(uid, chunkID)
+	ttl := dedupTTL()
+	if seenRecently(key, ttl) {
+		return chunkProcessed, nil
+	}
+
+	attrs, err := store.Attrs(ctx, key)
+	if err == storage.ErrObjectNotExist {
+		return chunkNew, nil
+	}
+	if err != nil {
+		return chunkNew, fmt.Errorf("failed to read dedup marker: %v", err)
+	}
+	state := markerState(attrs, ttl)
+	if state == chunkProcessed {
+		rememberChunk(key, attrs.Updated)
+	}
+	return state, nil
+}
+
+// chunkClaim is a delivery's pending claim on a chunk_id
+type chunkClaim struct {
+	store      objectStore
+	key        string
+	token      []byte
+	generation int64
+}
+
+// claimChunk claims chunkID for uid with a pending marker before it is written,
+// returning the claim when this delivery got it, and otherwise the state of the
+// delivery that did. The marker is created only if absent, so of two deliveries of
+// a chunk racing on different instances exactly one claims it. The claim is then
+// confirmed once the chunk is stored, or released if it failed to be, so its retry
+// is applied rather than skipped.
+func claimChunk(ctx context.Context, store objectStore, uid, chunkID string) (*chunkClaim, chunkState, error) {
+	key := dedupKey(uid, chunkID)
+	ttl := dedupTTL()
+	if seenRecently(key, ttl) {
+		return nil, chunkProcessed, nil
+	}
+
+	token := []byte(newRequestID())
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		generation, created, err := createOwned(ctx, store, key, dedupPendingType, token)
+		if err != nil {
+			return nil, chunkNew, fmt.Errorf("failed to write dedup marker: %v", err)
+		}
+		if created {
+			return &chunkClaim{store: store, key: key, token: token, generation: generation}, chunkNew, nil
+		}
+
+		attrs, err := store.Attrs(ctx, key)
+		if err == storage.ErrObjectNotExist {
+			// Released by a delivery whose write failed, so this one may claim it
+			continue
+		}
+		if err != nil {
+			return nil, chunkNew, fmt.Errorf("failed to read dedup marker: %v", err)
+		}
+		if state := markerState(attrs, ttl); state != chunkNew {
+			if state == chunkProcessed {
+				rememberChunk(key, attrs.Updated)
+			}
+			return nil, state, nil
+		}
+
+		// An expired marker is removed at the generation that was judged expired, so
+		// a delivery claiming it meanwhile keeps its claim
+		if err := store.Delete(ctx, key, attrs.Generation); err != nil && err != storage.ErrObjectNotExist && !isPreconditionFailed(err) {
+			return nil, chunkNew, fmt.Errorf("failed to delete expired dedup marker: %v", err)
+		}
+	}
+	return nil, chunkNew, fmt.Errorf("failed to claim chunk %s after %d attempts", chunkID, maxCASAttempts)
+}
+
+// confirm marks the claimed chunk as stored, so later deliveries are answered as
+// duplicates. A marker that fails to be confirmed stays pending until GCS_TIMEOUT,
+// after which a resend is stored again.
+func (c *chunkClaim) confirm(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+	defer cancel()
+	if _, err := c.store.Write(ctx, c.key, "text/plain", c.token, c.generation); err != nil {
+		loggerFrom(ctx).Warn("Failed to confirm dedup marker", "marker", c.key, "error", err)
+		return
+	}
+	rememberChunk(c.key, nowFunc())
+}
+
+// release gives the claim up, for a chunk that failed to be stored. A claim that
+// expired and was taken over is left to its new owner.
+func (c *chunkClaim) release(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+	defer cancel()
+	if err := c.store.Delete(ctx, c.key, c.generation); err != nil && err != storage.ErrObjectNotExist && !isPreconditionFailed(err) {
+		loggerFrom(ctx).Warn("Failed to release dedup marker", "marker", c.key, "error", err)
+	}
+}
+
+// sweepDedupMarkers deletes the markers of store that expired, pending or confirmed,
+// and returns how many it deleted. Each is deleted at the generation judged expired,
+// so a marker claimed again meanwhile is kept.
+func sweepDedupMarkers(ctx context.Context, store objectStore) (int, error) {
+	names, err := store.List(ctx, dedupPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list dedup markers: %v", err)
+	}
+	ttl := dedupTTL()
+	deleted := 0
+	for _, name := range names {
+		attrs, err := store.Attrs(ctx, name)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("failed to read dedup marker: %v", err)
+		}
+		if markerState(attrs, ttl) != chunkNew {
+			continue
+		}
+		err = store.Delete(ctx, name, attrs.Generation)
+		switch {
+		case err == nil:
+			deleted++
+		case err != storage.ErrObjectNotExist && !isPreconditionFailed(err):
+			return deleted, fmt.Errorf("failed to delete dedup marker %s: %v", name, err)
+		}
+	}
+	return deleted, nil
+}
+
+// seenRecently reports whether the in-instance cache holds key from within ttl
+func seenRecently(key string, ttl time.Duration) bool {
+	recentChunks.Lock()
+	seenAt, ok := recentChunks.seen[key]
+	recentChunks.Unlock()
+	return ok && nowFunc().Sub(seenAt) < ttl
+}
+
+// rememberChunk stores key in the in-instance cache, evicting expired entries once
+// every dedupSweepInterval
+func rememberChunk(key string, seenAt time.Time) {
+	ttl := dedupTTL()
+	now := nowFunc()
+
+	recentChunks.Lock()
+	defer recentChunks.Unlock()
+	if now.Sub(recentChunks.swept) >= dedupSweepInterval {
+		for k, t := range recentChunks.seen {
+			if now.Sub(t) >= ttl {
+				delete(recentChunks.seen, k)
+			}
+		}
+		recentChunks.swept = now
+	}
+	recentChunks.seen[key] = seenAt
+}
@@ -0,0 +1,222 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetRecentChunks empties the in-instance dedup cache for the test
+func resetRecentChunks(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		recentChunks.Lock()
+		recentChunks.seen = make(map[string]time.Time)
+		recentChunks.swept = time.Time{}
+		recentChunks.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+func TestDuplicateChunkIsSkipped(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	resetRecentChunks(t)
+	body := tone(100*time.Millisecond, 16000)
+
+	mustPost(t, "uid=alice&chunk_id=c1", body)
+	// Another instance doesn't share this one's cache
+	resetRecentChunks(t)
+	w := mustPost(t, "uid=alice&chunk_id=c1", body)
+	if !strings.Contains(w.Body.String(), "already processed") {
+		t.Fatalf("duplicate answered %s", w.Body)
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != len(body) {
+		t.Fatalf("session holds %d bytes after a duplicate, want %d", size, len(body))
+	}
+}
+
+func TestClaimChunkConcurrent(t *testing.T) {
+	store := newMemStore()
+	useFakeClock(t, testStart)
+	resetRecentChunks(t)
+
+	const deliveries = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := 0
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, state, err := claimChunk(context.Background(), store, "alice", "c1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if state == chunkNew {
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Fatalf("%d of %d concurrent deliveries claimed the chunk, want 1", claimed, deliveries)
+	}
+}
+
+func TestClaimChunkReleaseAndExpiry(t *testing.T) {
+	store := newMemStore()
+	clock := useFakeClock(t, testStart)
+	resetRecentChunks(t)
+	ctx := context.Background()
+
+	claim, state, err := claimChunk(ctx, store, "alice", "c1")
+	if err != nil || state != chunkNew {
+		t.Fatalf("first claim = %v, %v", state, err)
+	}
+	claim.release(ctx)
+	claim, state, err = claimChunk(ctx, store, "alice", "c1")
+	if err != nil || state != chunkNew {
+		t.Fatalf("claim after release = %v, %v, want it claimed again", state, err)
+	}
+	if _, state, _ := claimChunk(ctx, store, "alice", "c1"); state != chunkPending {
+		t.Fatalf("claim of a pending marker = %v, want pending", state)
+	}
+	claim.confirm(ctx)
+
+	resetRecentChunks(t)
+	if _, state, _ := claimChunk(ctx, store, "alice", "c1"); state != chunkProcessed {
+		t.Fatalf("claim of a confirmed marker = %v, want processed", state)
+	}
+	clock.Advance(dedupTTL())
+	if _, state, err := claimChunk(ctx, store, "alice", "c1"); err != nil || state != chunkNew {
+		t.Fatalf("claim of an expired marker = %v, %v, want it claimed", state, err)
+	}
+	if names := store.names(dedupPrefix); len(names) != 1 {
+		t.Fatalf("markers = %v, want one", names)
+	}
+	// The release of a claim that expired must not remove its successor's marker
+	claim.release(ctx)
+	if names := store.names(dedupPrefix); len(names) != 1 {
+		t.Fatalf("markers after a stale release = %v, want one", names)
+	}
+}
+
+func TestFailedUploadReleasesChunk(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	resetRecentChunks(t)
+	body := tone(100*time.Millisecond, 16000)
+
+	failed := false
+	f.fail = func(r *http.Request) int {
+		if !failed && strings.Contains(r.URL.Path, metadataPath("alice")) {
+			failed = true
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	if w := postAudio(t, "uid=alice&chunk_id=c1", body); w.Code < 500 {
+		t.Fatalf("upload with a failing read answered %d", w.Code)
+	}
+	if w := mustPost(t, "uid=alice&chunk_id=c1", body); w.Code != http.StatusCreated {
+		t.Fatalf("retry answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPendingChunkIsNotReportedProcessed(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	resetRecentChunks(t)
+	body := tone(100*time.Millisecond, 16000)
+
+	// A delivery still writing the chunk holds a pending claim
+	claim, _, err := claimChunk(context.Background(), newGCSStore(f.bucket()), "alice", "c1")
+	if err != nil || claim == nil {
+		t.Fatalf("claim = %v, %v", claim, err)
+	}
+	w := postAudio(t, "uid=alice&chunk_id=c1", body)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("delivery during a pending write answered %d: %s", w.Code, w.Body)
+	}
+
+	// The first write failed, so the resend is stored
+	claim.release(context.Background())
+	if w := mustPost(t, "uid=alice&chunk_id=c1", body); w.Code != http.StatusCreated {
+		t.Fatalf("resend answered %d: %s", w.Code, w.Body)
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != len(body) {
+		t.Fatalf("session holds %d bytes, want %d", size, len(body))
+	}
+
+	// A pending claim left by a delivery that died mid-write lapses with GCS_TIMEOUT
+	if _, _, err := claimChunk(context.Background(), newGCSStore(f.bucket()), "alice", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(gcsTimeout)
+	if w := mustPost(t, "uid=alice&chunk_id=c2", body); strings.Contains(w.Body.String(), "already processed") {
+		t.Fatalf("chunk of an abandoned claim was skipped: %s", w.Body)
+	}
+}
+
+func TestSweepDeletesExpiredMarkers(t *testing.T) {
+	store := useMemStore(t)
+	clock := useFakeClock(t, testStart)
+	resetRecentChunks(t)
+	ctx := context.Background()
+
+	claim, _, _ := claimChunk(ctx, store, "alice", "old")
+	claim.confirm(ctx)
+	claimChunk(ctx, store, "alice", "abandoned")
+	clock.Advance(dedupTTL())
+	claim, _, _ = claimChunk(ctx, store, "alice", "new")
+	claim.confirm(ctx)
+
+	deleted, err := sweepDedupMarkers(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := store.names(dedupPrefix); deleted != 2 || len(names) != 1 || names[0] != dedupKey("alice", "new") {
+		t.Fatalf("sweep deleted %d, left %v; want only the live marker kept", deleted, names)
+	}
+}
+
+func TestCreateOwned(t *testing.T) {
+	store := newMemStore()
+	ctx := context.Background()
+
+	// A retry whose first attempt landed finds its own token
+	generation := store.put(t, "locks/alice", []byte("token-a"))
+	got, created, err := createOwned(ctx, store, "locks/alice", "text/plain", []byte("token-a"))
+	if err != nil || !created || got != generation {
+		t.Fatalf("createOwned over its own write = %d, %v, %v", got, created, err)
+	}
+	if _, created, err := createOwned(ctx, store, "locks/alice", "text/plain", []byte("token-b")); err != nil || created {
+		t.Fatalf("createOwned over another's write = %v, %v, want not created", created, err)
+	}
+}
+
+func TestRememberChunkSweepsOncePerInterval(t *testing.T) {
+	clock := useFakeClock(t, testStart)
+	resetRecentChunks(t)
+
+	rememberChunk("old", clock.Now())
+	clock.Advance(dedupTTL())
+	rememberChunk("new", clock.Now())
+	if seenRecently("old", time.Hour) {
+		t.Fatal("expired entry survived the first sweep")
+	}
+
+	rememberChunk("older", clock.Now().Add(-dedupTTL()))
+	rememberChunk("newer", clock.Now())
+	if !seenRecently("older", time.Hour) {
+		t.Fatal("entries were swept again within dedupSweepInterval")
+	}
+}
@@ -0,0 +1,201 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// deletePageSize is how many objects are listed per page while erasing a user
+const deletePageSize = 500
+
+// deleteConcurrency is how many deletes erasing a user keeps in flight
+const deleteConcurrency = 16
+
+// deleteResponse is the JSON body returned by HandleDeleteUser
+type deleteResponse struct {
+	Status  string `json:"status"`
+	Deleted int    `json:"deleted"`
+}
+
+// HandleDeleteUser erases everything stored for uid: its recordings and their
+// sidecars, its recordings index, the metadata, sequence counters and locks of its
+// sessions, named or not, and its dedup markers, wherever STORAGE_BACKEND keeps them.
+// The response reports how many objects were deleted. Deleting a uid with nothing
+// stored returns 200 with a count of 0, so retries are safe. The objects are deleted
+// deleteConcurrency at a time under DELETE_TIMEOUT rather than GCS_TIMEOUT, so a uid
+// with years of recordings can be erased in one request.
+func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), deleteTimeout)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed, use DELETE")
+		return
+	}
+
+	uid := r.URL.Query().Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received delete request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting delete with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+
+	// Delete requests carry no body, so the signature covers only uid and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, uid, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated delete", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	dir, scoped := filePathTemplate.userDir(uid)
+	if !scoped {
+		writeError(w, http.StatusNotImplemented, "Deleting a user requires PATH_TEMPLATE to give {uid} a folder of its own")
+		return
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	// The session metadata goes first so a concurrent upload can't keep appending
+	// to a file whose folder is being emptied
+	store := openStore(bucket)
+	deleted := 0
+	for _, name := range []string{metadataPath(uid), sequencePath(uid), pairPath(uid), closedPath(uid), playlistPath(uid), lockPath(uid)} {
+		ok, err := deleteStored(ctx, store, name)
+		if err != nil {
+			logger.Error("Failed to delete object", "name", name, "error", err)
+			writeServerError(ctx, w, fmt.Sprintf("Failed to delete %s", name))
+			return
+		}
+		if ok {
+			deleted++
+		}
+	}
+
+	// Named sessions keep their bookkeeping under uid's folder of each prefix, and
+	// their metadata goes before their files for the same reason
+	for _, prefix := range []string{metadataPrefix + uid + "/", sequencePrefix + uid + "/", finalizedPrefix + uid + "/",
+		pairPrefix + uid + "/", closedPrefix + uid + "/", playlistPrefix + uid + "/", lockPrefix + uid + "/",
+		dedupPrefix + url.PathEscape(uid) + "/"} {
+		n, err := deleteStoredPrefix(ctx, store, prefix)
+		deleted += n
+		if err != nil {
+			logger.Error("Failed to delete objects", "prefix", prefix, "error", err)
+			writeServerError(ctx, w, fmt.Sprintf("Failed to delete objects under %s", prefix))
+			return
+		}
+	}
+	prefixes := []string{dir}
+	if index := uid + "/"; index != dir {
+		prefixes = append(prefixes, index)
+	}
+	for _, prefix := range prefixes {
+		n, err := deletePrefix(ctx, bucket, prefix)
+		deleted += n
+		if err != nil {
+			logger.Error("Failed to delete objects", "prefix", prefix, "error", err)
+			writeServerError(ctx, w, fmt.Sprintf("Failed to delete objects under %s", prefix))
+			return
+		}
+	}
+
+	logger.Info("Deleted user", "deleted", deleted)
+	writeJSON(w, http.StatusOK, deleteResponse{Status: "ok", Deleted: deleted})
+}
+
+// deletePrefix deletes every object whose name starts with prefix, listing them a
+// page at a time, and returns how many were deleted
+func deletePrefix(ctx context.Context, bucket *storage.BucketHandle, prefix string) (int, error) {
+	deleted := 0
+	pager := iterator.NewPager(bucket.Objects(ctx, &storage.Query{Prefix: prefix}), deletePageSize, "")
+	for {
+		var page []*storage.ObjectAttrs
+		token, err := pager.NextPage(&page)
+		if err != nil {
+			return deleted, err
+		}
+		names := make([]string, len(page))
+		for i, attrs := range page {
+			names[i] = attrs.Name
+		}
+		n, err := deleteAll(ctx, names, func(ctx context.Context, name string) (bool, error) {
+			return deleteIfExists(ctx, bucket.Object(name))
+		})
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		if token == "" {
+			return deleted, nil
+		}
+	}
+}
+
+// deleteStoredPrefix deletes every object of store whose name starts with prefix and
+// returns how many were deleted
+func deleteStoredPrefix(ctx context.Context, store objectStore, prefix string) (int, error) {
+	names, err := store.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	return deleteAll(ctx, names, func(ctx context.Context, name string) (bool, error) {
+		return deleteStored(ctx, store, name)
+	})
+}
+
+// deleteAll deletes every one of names with del, deleteConcurrency at a time, and
+// returns how many were there to delete. The first failure cancels the deletes
+// still to start and is returned.
+func deleteAll(ctx context.Context, names []string, del func(ctx context.Context, name string) (bool, error)) (int, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(deleteConcurrency)
+	var deleted atomic.Int64
+	for _, name := range names {
+		g.Go(func() error {
+			ok, err := del(ctx, name)
+			if err != nil {
+				return fmt.Errorf("failed to delete %s: %v", name, err)
+			}
+			if ok {
+				deleted.Add(1)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	return int(deleted.Load()), err
+}
+
+// deleteStored deletes name from store and reports whether it was there to delete
+func deleteStored(ctx context.Context, store objectStore, name string) (bool, error) {
+	err := store.Delete(ctx, name, 0)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteIfExists deletes obj and reports whether it was there to delete
+func deleteIfExists(ctx context.Context, obj *storage.ObjectHandle) (bool, error) {
+	err := obj.Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,99 @@
+package function
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeleteUserRejectsReservedUID(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put(metadataPath("alice"), []byte(`{}`))
+	f.put(metadataPath("bob"), []byte(`{}`))
+
+	for _, uid := range []string{"metadata", "sequences", "locks", "finalized", "dedup", ".", ".."} {
+		if w := serve(t, HandleDeleteUser, http.MethodDelete, "/?uid="+uid, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("delete of uid %q answered %d, want %d", uid, w.Code, http.StatusBadRequest)
+		}
+	}
+	if names := f.names(metadataPrefix); len(names) != 2 {
+		t.Fatalf("metadata left after rejected deletes: %v", names)
+	}
+}
+
+func TestDeleteUserErasesOnlyThatUID(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	mustPost(t, "uid=alice_bob", tone(250*time.Millisecond, 16000))
+
+	if w := serve(t, HandleDeleteUser, http.MethodDelete, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	if names := f.names("alice/"); len(names) != 0 {
+		t.Fatalf("alice's objects remain: %v", names)
+	}
+	if currentMetadata(t, f, "alice") != nil {
+		t.Fatal("alice's metadata remains")
+	}
+	if currentMetadata(t, f, "alice_bob") == nil || len(f.names("alice_bob/")) == 0 {
+		t.Fatal("alice_bob's objects were deleted along with alice's")
+	}
+}
+
+func TestDeleteUserErasesLocks(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	// Locks left behind by writes that died holding them
+	f.put(lockPath("alice"), []byte("held"))
+	f.put(lockPath("alice/s1"), []byte("held"))
+	f.put(lockPath("alice_bob"), []byte("held"))
+
+	if w := serve(t, HandleDeleteUser, http.MethodDelete, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	if names := f.names(lockPrefix); len(names) != 1 || names[0] != lockPath("alice_bob") {
+		t.Fatalf("locks after the delete = %v, want only alice_bob's", names)
+	}
+}
+
+func TestDeleteUserDeletesInParallelPastGCSTimeout(t *testing.T) {
+	f := newFakeGCS(t)
+	const recordings = 3 * deleteConcurrency
+	for i := 0; i < recordings; i++ {
+		f.put(fmt.Sprintf("alice/%03d.wav", i), []byte("RIFF"))
+	}
+	// Erasing the uid takes far longer than GCS_TIMEOUT allows a request
+	setVar(t, &gcsTimeout, 10*time.Millisecond)
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	f.fail = func(r *http.Request) int {
+		if r.Method != http.MethodDelete {
+			return 0
+		}
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return 0
+	}
+
+	w := serve(t, HandleDeleteUser, http.MethodDelete, "/?uid=alice", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	if names := f.names("alice/"); len(names) != 0 {
+		t.Fatalf("%d recordings remain", len(names))
+	}
+	if peak < 2 || peak > deleteConcurrency {
+		t.Fatalf("%d deletes were in flight at once, want 2 to %d", peak, deleteConcurrency)
+	}
+}
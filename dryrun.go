@@ -0,0 +1,74 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+// dryRunResponse is the JSON body returned for an upload with dry_run=true
+type dryRunResponse struct {
+	Status string `json:"status"`
+	DryRun bool   `json:"dry_run"`
+	// Action is "create" when the chunk would start a new file and "append" otherwise
+	Action          string  `json:"action"`
+	Filename        string  `json:"filename"`
+	CurrentSize     int     `json:"current_size"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// RolloverBytes is how much of the chunk would fill the current file up to its
+	// limit before the rest starts the new one
+	RolloverBytes int `json:"rollover_bytes,omitempty"`
+}
+
+// planChunk reports what writeChunk would do with body without writing anything:
+// whether it would start a new file or append, the file it would land in, and the
+// audio size of that file afterwards. Only the session metadata is read, so the plan
+// does not account for repairs reconcileMetadata would make first.
+func planChunk(ctx context.Context, bucket *storage.BucketHandle, uid string, params audioParams, body []byte) (dryRunResponse, error) {
+	metadata, _, err := getCurrentMetadata(ctx, openStore(bucket), uid)
+	if err != nil {
+		return dryRunResponse{}, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to get metadata: %v", err)}
+	}
+	prepared, err := prepareChunk(ctx, metadata, params, body)
+	if err != nil {
+		return dryRunResponse{}, err
+	}
+
+	plan := dryRunResponse{Status: "ok", DryRun: true}
+	if prepared.createNew {
+		plan.Action = "create"
+		if plan.Filename, err = plannedFilename(ctx, bucket, uid, metadata); err != nil {
+			return dryRunResponse{}, err
+		}
+		plan.CurrentSize = len(prepared.audio)
+		plan.RolloverBytes = len(prepared.rollover)
+	} else {
+		plan.Action = "append"
+		plan.Filename = metadata.Filename
+		plan.CurrentSize = metadata.CurrentSize + len(prepared.audio)
+	}
+	plan.DurationSeconds = calculateDuration(plan.CurrentSize, prepared.sampleRate, prepared.channels, prepared.bits).Seconds()
+	return plan, nil
+}
+
+// plannedFilename returns the name createAccumulator would give a new file of session
+// uid started now, taking any accumulator already under a name to be another file's
+func plannedFilename(ctx context.Context, bucket *storage.BucketHandle, uid string, metadata *WAVMetadata) (string, error) {
+	base := filePathTemplate.render(uid, nowFunc().Truncate(newFileWindow()))
+	for n := 0; n < maxNameAttempts; n++ {
+		filename := numberedFilename(base, n)
+		taken, err := filenameTaken(ctx, bucket, metadata, filename)
+		if err == nil && !taken {
+			_, err = bucket.Object(pcmPath(filename)).Attrs(ctx)
+			if err == storage.ErrObjectNotExist {
+				return filename, nil
+			}
+		}
+		if err != nil {
+			return "", &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to check the new file name: %v", err)}
+		}
+	}
+	return "", &chunkError{status: http.StatusConflict, message: fmt.Sprintf("Too many files were started at %s, please resend", base)}
+}
@@ -0,0 +1,60 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// dryRun posts body with dry_run=true, failing the test if the bucket is written to
+func dryRun(t *testing.T, f *fakeGCS, query string, body []byte) dryRunResponse {
+	t.Helper()
+	writes := 0
+	f.fail = func(r *http.Request) int {
+		if r.Method != http.MethodGet {
+			writes++
+		}
+		return 0
+	}
+	w := mustPost(t, query+"&dry_run=true", body)
+	f.fail = nil
+	if writes != 0 {
+		t.Fatalf("dry run made %d writes", writes)
+	}
+	var plan dryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &plan); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestDryRunMatchesRealUpload(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	body := tone(500*time.Millisecond, 16000)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		action  string
+	}{
+		{"first chunk", 0, "create"},
+		{"append", time.Second, "append"},
+		{"after the inactivity limit", inactivityLimit, "create"},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		plan := dryRun(t, f, "uid=alice", body)
+		if plan.Action != step.action || !plan.DryRun {
+			t.Fatalf("%s: dry run planned %+v, want %s", step.name, plan, step.action)
+		}
+
+		mustPost(t, "uid=alice", body)
+		metadata := currentMetadata(t, f, "alice")
+		if plan.Filename != metadata.Filename || plan.CurrentSize != metadata.CurrentSize {
+			t.Fatalf("%s: dry run planned %s of %d bytes, the upload made %s of %d", step.name,
+				plan.Filename, plan.CurrentSize, metadata.Filename, metadata.CurrentSize)
+		}
+	}
+}
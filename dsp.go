@@ -0,0 +1,311 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// sample16 returns channel c of frame i from interleaved 16-bit little-endian PCM
+func sample16(pcm []byte, i, c, channels int) int16 {
+	offset := (i*channels + c) * 2
+	return int16(binary.LittleEndian.Uint16(pcm[offset:]))
+}
+
+// resample converts interleaved 16-bit little-endian PCM from one sample rate to
+// another using linear interpolation. The output length scales by to/from.
+func resample(pcm []byte, from, to, channels int) []byte {
+	if from == to || len(pcm) == 0 {
+		return pcm
+	}
+
+	frameSize := 2 * channels
+	inFrames := len(pcm) / frameSize
+	outFrames := int(int64(inFrames) * int64(to) / int64(from))
+	out := make([]byte, outFrames*frameSize)
+
+	step := float64(from) / float64(to)
+	for i := 0; i < outFrames; i++ {
+		pos := float64(i) * step
+		j := int(pos)
+		frac := pos - float64(j)
+		for c := 0; c < channels; c++ {
+			a := float64(sample16(pcm, j, c, channels))
+			b := a
+			if j+1 < inFrames {
+				b = float64(sample16(pcm, j+1, c, channels))
+			}
+			v := math.Round(a + (b-a)*frac)
+			binary.LittleEndian.PutUint16(out[(i*channels+c)*2:], uint16(int16(v)))
+		}
+	}
+	return out
+}
+
+// silenceWindow is the span over which trimSilence measures loudness
+const silenceWindow = 20 * time.Millisecond
+
+// trimSilence removes runs of quiet audio from interleaved 16-bit little-endian PCM.
+// The audio is scanned in silenceWindow steps, and every run of windows whose RMS
+// amplitude stays below silenceThreshold for at least minSilence is dropped. Shorter
+// pauses are kept so speech keeps its natural rhythm.
+func trimSilence(pcm []byte, rate, channels int) []byte {
+	var out bytes.Buffer
+	trimmer := newSilenceTrimmer(&out, rate, channels)
+	trimmer.Write(pcm)
+	trimmer.Close()
+	return out.Bytes()
+}
+
+// silenceTrimmer is trimSilence for PCM written to it a piece at a time, writing the
+// audio it keeps to out as it goes. It holds no more than minSilence of audio, the
+// quiet run that may yet be kept, so audio of any length is trimmed in bounded
+// memory. Close flushes what it holds after the last write.
+type silenceTrimmer struct {
+	out         io.Writer
+	frameSize   int
+	windowBytes int
+	// dropBytes is how long a quiet run must last to be dropped
+	dropBytes int
+	// window holds the audio of the window being filled
+	window []byte
+	// quiet holds the current quiet run while it is too short to drop, and quietLen
+	// is its length
+	quiet    []byte
+	quietLen int
+	// written counts the bytes written to the trimmer
+	written int64
+}
+
+// newSilenceTrimmer returns a silenceTrimmer of PCM at rate with channels, writing
+// to out
+func newSilenceTrimmer(out io.Writer, rate, channels int) *silenceTrimmer {
+	frameSize := 2 * channels
+	windowBytes := int(int64(rate)*int64(silenceWindow)/int64(time.Second)) * frameSize
+	minWindows := int((minSilence + silenceWindow - 1) / silenceWindow)
+	return &silenceTrimmer{
+		out:         out,
+		frameSize:   frameSize,
+		windowBytes: windowBytes,
+		dropBytes:   minWindows * windowBytes,
+		window:      make([]byte, 0, windowBytes),
+	}
+}
+
+func (t *silenceTrimmer) Write(p []byte) (int, error) {
+	t.written += int64(len(p))
+	// Audio too slow to fill a window is kept as is
+	if t.windowBytes == 0 {
+		return t.out.Write(p)
+	}
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), t.windowBytes-len(t.window))
+		t.window, p = append(t.window, p[:take]...), p[take:]
+		if len(t.window) == t.windowBytes {
+			if err := t.scan(t.window); err != nil {
+				return n - len(p), err
+			}
+			t.window = t.window[:0]
+		}
+	}
+	return n, nil
+}
+
+// Close scans the final window, cut to whole frames, and ends the quiet run. Audio
+// shorter than a frame is kept as is.
+func (t *silenceTrimmer) Close() error {
+	if t.windowBytes == 0 {
+		return nil
+	}
+	if t.written < int64(t.frameSize) {
+		_, err := t.out.Write(t.window)
+		return err
+	}
+	if last := t.window[:len(t.window)/t.frameSize*t.frameSize]; len(last) > 0 {
+		if err := t.scan(last); err != nil {
+			return err
+		}
+	}
+	t.window = t.window[:0]
+	return t.endQuiet()
+}
+
+// scan adds window to the quiet run when it is quiet, and otherwise ends the run and
+// writes it out
+func (t *silenceTrimmer) scan(window []byte) error {
+	if windowRMS(window) < float64(silenceThreshold) {
+		t.quietLen += len(window)
+		if t.quietLen >= t.dropBytes {
+			t.quiet = t.quiet[:0]
+		} else {
+			t.quiet = append(t.quiet, window...)
+		}
+		return nil
+	}
+	if err := t.endQuiet(); err != nil {
+		return err
+	}
+	_, err := t.out.Write(window)
+	return err
+}
+
+// endQuiet ends the quiet run, writing it out if it was too short to drop
+func (t *silenceTrimmer) endQuiet() error {
+	quiet := t.quiet
+	keep := t.quietLen < t.dropBytes && len(quiet) > 0
+	t.quiet, t.quietLen = t.quiet[:0], 0
+	if !keep {
+		return nil
+	}
+	_, err := t.out.Write(quiet)
+	return err
+}
+
+// silenceGap scans interleaved 16-bit little-endian PCM in silenceWindow steps, as
+// trimSilence does, continuing a run of quiet audio quiet bytes long that ended the
+// audio before pcm. It returns the offset of the first loud window following a
+// quiet run of at least minSilence, or -1 when speech never resumes after such a
+// gap, along with the length of the quiet run that ends pcm.
+func silenceGap(pcm []byte, rate, channels, quiet int) (split, trailing int) {
+	frameSize := 2 * channels
+	windowFrames := int(int64(rate) * int64(silenceWindow) / int64(time.Second))
+	if windowFrames == 0 {
+		return -1, quiet + len(pcm)
+	}
+	windowBytes := windowFrames * frameSize
+	minQuiet := int(int64(rate) * int64(minSilence) / int64(time.Second) * int64(frameSize))
+
+	split = -1
+	for start := 0; start < len(pcm); start += windowBytes {
+		end := min(start+windowBytes, len(pcm)/frameSize*frameSize)
+		if end <= start {
+			break
+		}
+		if windowRMS(pcm[start:end]) < float64(silenceThreshold) {
+			quiet += end - start
+			continue
+		}
+		if split < 0 && quiet >= minQuiet {
+			split = start
+		}
+		quiet = 0
+	}
+	return split, quiet
+}
+
+// normalizePCM scales 16-bit little-endian PCM so its loudest sample peaks at
+// targetDBFS, returning the scaled audio and the gain applied. Scaled samples are
+// rounded and clamped to the 16-bit range, so rounding can never clip. Silent audio
+// is returned as is with a gain of 1.
+func normalizePCM(pcm []byte, targetDBFS float64) ([]byte, float64) {
+	gain := normalizeGain(pcmPeak(pcm), targetDBFS)
+	if gain == 1 {
+		return pcm, 1
+	}
+	out := make([]byte, len(pcm))
+	copy(out, pcm)
+	applyGain(out, gain)
+	return out, gain
+}
+
+// pcmPeak returns the largest magnitude of the 16-bit little-endian samples in pcm
+func pcmPeak(pcm []byte) int {
+	peak := 0
+	for i := 0; i+1 < len(pcm); i += 2 {
+		v := int(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		if v < 0 {
+			v = -v
+		}
+		peak = max(peak, v)
+	}
+	return peak
+}
+
+// normalizeGain returns the gain that makes audio peaking at peak peak at
+// targetDBFS instead, or 1 for silent audio
+func normalizeGain(peak int, targetDBFS float64) float64 {
+	if peak == 0 {
+		return 1
+	}
+	return math.MaxInt16 * math.Pow(10, targetDBFS/20) / float64(peak)
+}
+
+// applyGain scales the 16-bit little-endian samples of pcm by gain in place,
+// rounding and clamping them to the 16-bit range. A trailing odd byte is left as is.
+func applyGain(pcm []byte, gain float64) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		v := math.Round(float64(int16(binary.LittleEndian.Uint16(pcm[i:]))) * gain)
+		v = math.Max(math.MinInt16, math.Min(math.MaxInt16, v))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(v)))
+	}
+}
+
+// pcmBlockSize is how many bytes of PCM finalizing reads at a time
+const pcmBlockSize = 1 << 20
+
+// copyPCM copies src to dst pcmBlockSize bytes at a time, so every write but the
+// last holds whole 16-bit samples
+func copyPCM(dst io.Writer, src io.Reader) error {
+	block := make([]byte, pcmBlockSize)
+	for {
+		n, err := io.ReadFull(src, block)
+		if n > 0 {
+			if _, err := dst.Write(block[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// peakMeter is an io.Writer measuring the 16-bit little-endian PCM written to it,
+// which must come in whole samples but for the last write
+type peakMeter struct {
+	peak int
+	size int64
+}
+
+func (m *peakMeter) Write(p []byte) (int, error) {
+	m.peak = max(m.peak, pcmPeak(p))
+	m.size += int64(len(p))
+	return len(p), nil
+}
+
+// gainWriter writes the 16-bit little-endian PCM written to it on to out, scaled by
+// gain as applyGain does. Writes must come in whole samples but for the last.
+type gainWriter struct {
+	out  io.Writer
+	gain float64
+	buf  []byte
+}
+
+func (g *gainWriter) Write(p []byte) (int, error) {
+	if g.gain == 1 {
+		return g.out.Write(p)
+	}
+	g.buf = append(g.buf[:0], p...)
+	applyGain(g.buf, g.gain)
+	return g.out.Write(g.buf)
+}
+
+// windowRMS returns the root mean square amplitude of 16-bit little-endian samples
+func windowRMS(pcm []byte) float64 {
+	samples := len(pcm) / 2
+	if samples == 0 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < samples; i++ {
+		v := float64(int16(binary.LittleEndian.Uint16(pcm[i*2:])))
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(samples))
+}
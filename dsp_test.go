@@ -0,0 +1,242 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// sine returns frames of 16-bit mono PCM holding a sine wave of freq Hz at rate
+func sine(freq float64, rate, frames int, amplitude float64) []byte {
+	pcm := make([]byte, frames*2)
+	for i := 0; i < frames; i++ {
+		v := amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(int16(math.Round(v))))
+	}
+	return pcm
+}
+
+// concat joins slices of PCM
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+func TestResampleLength(t *testing.T) {
+	tests := []struct {
+		from, to, channels, frames, want int
+	}{
+		{16000, 8000, 1, 1600, 800},
+		{8000, 16000, 1, 800, 1600},
+		{44100, 16000, 2, 4410, 1600},
+		{16000, 16000, 1, 100, 100},
+	}
+	for _, tt := range tests {
+		out := resample(make([]byte, tt.frames*2*tt.channels), tt.from, tt.to, tt.channels)
+		if got := len(out) / (2 * tt.channels); got != tt.want {
+			t.Errorf("resample %d frames from %d to %d Hz gave %d frames, want %d", tt.frames, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestResampleRoundTrip(t *testing.T) {
+	original := sine(440, 16000, 1600, 8000)
+	back := resample(resample(original, 16000, 48000, 1), 48000, 16000, 1)
+	if len(back) != len(original) {
+		t.Fatalf("round trip gave %d bytes, want %d", len(back), len(original))
+	}
+	for i := 0; i < len(original)/2; i++ {
+		want := int16(binary.LittleEndian.Uint16(original[i*2:]))
+		got := int16(binary.LittleEndian.Uint16(back[i*2:]))
+		if diff := math.Abs(float64(got) - float64(want)); diff > 2 {
+			t.Fatalf("sample %d is %d after the round trip, want %d within 2", i, got, want)
+		}
+	}
+}
+
+func TestPostResamplesToTargetRate(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &targetSampleRate, 16000)
+
+	mustPost(t, "uid=alice&sample_rate=8000", tone(100*time.Millisecond, 8000))
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.fileSampleRate() != 16000 || metadata.CurrentSize != 3200 {
+		t.Fatalf("stored %d bytes at %d Hz, want 3200 bytes at 16000 Hz", metadata.CurrentSize, metadata.fileSampleRate())
+	}
+}
+
+func TestSilenceGap(t *testing.T) {
+	setVar(t, &silenceThreshold, fallbackSilenceThreshold)
+	setVar(t, &minSilence, time.Second)
+	speech, pause, gap := tone(500*time.Millisecond, 16000), make([]byte, 16000), make([]byte, 32000)
+
+	tests := []struct {
+		name         string
+		pcm          []byte
+		quiet        int
+		wantSplit    int
+		wantTrailing int
+	}{
+		{"speech only", speech, 0, -1, 0},
+		{"short pause", concat(speech, pause, speech), 0, -1, 0},
+		{"gap", concat(speech, gap, speech), 0, 48000, 0},
+		{"gap carried over", speech, 32000, 0, 0},
+		{"trailing gap", concat(speech, gap), 0, -1, 32000},
+	}
+	for _, tt := range tests {
+		split, trailing := silenceGap(tt.pcm, 16000, 1, tt.quiet)
+		if split != tt.wantSplit || trailing != tt.wantTrailing {
+			t.Errorf("%s: silenceGap = %d, %d, want %d, %d", tt.name, split, trailing, tt.wantSplit, tt.wantTrailing)
+		}
+	}
+}
+
+func TestPostSegmentsOnSilence(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &segmentOnSilence, true)
+	setVar(t, &silenceThreshold, fallbackSilenceThreshold)
+	setVar(t, &minSilence, time.Second)
+	speech, pause, gap := tone(500*time.Millisecond, 16000), make([]byte, 16000), make([]byte, 32000)
+
+	// A short pause stays in the segment, a gap of MIN_SILENCE_MS ends it
+	mustPost(t, "uid=alice", concat(speech, pause, speech, gap))
+	clock.Advance(3 * time.Second)
+	w := mustPost(t, "uid=alice", speech)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("speech after a gap answered %d, want %d", w.Code, http.StatusCreated)
+	}
+	first := "alice/2024-05-01T12-00-00Z.wav"
+	if _, dataLen := storedWAV(t, f, first); dataLen != 80000 {
+		t.Fatalf("first segment holds %d bytes, want the speech, pause and gap", dataLen)
+	}
+
+	// The gap is found within a chunk too
+	clock.Advance(time.Second)
+	mustPost(t, "uid=alice", concat(speech, gap, speech))
+	metadata := currentMetadata(t, f, "alice")
+	if pcm, _ := f.get(pcmPath(metadata.Filename)); !bytes.Equal(pcm, speech) {
+		t.Fatalf("latest segment holds %d bytes, want the %d bytes of speech after the gap", len(pcm), len(speech))
+	}
+}
+
+func TestNormalizePCM(t *testing.T) {
+	quiet := concat(sine(440, 16000, 1600, 1000), []byte{0x18, 0xfc}) // ends on -1000
+	want := math.MaxInt16 * math.Pow(10, -1.0/20) / 1000
+
+	scaled, gain := normalizePCM(quiet, -1)
+	if math.Abs(gain-want) > 1e-9 {
+		t.Fatalf("gain = %v, want %v", gain, want)
+	}
+	peak := 0
+	for i := 0; i < len(scaled)/2; i++ {
+		in := float64(int16(binary.LittleEndian.Uint16(quiet[i*2:])))
+		out := int(int16(binary.LittleEndian.Uint16(scaled[i*2:])))
+		if float64(out) != math.Round(in*gain) {
+			t.Fatalf("sample %d scaled to %d, want %v", i, out, math.Round(in*gain))
+		}
+		peak = max(peak, out, -out)
+	}
+	if target := int(math.Round(math.MaxInt16 * math.Pow(10, -1.0/20))); peak != target {
+		t.Errorf("peak = %d, want %d", peak, target)
+	}
+
+	// Full scale in both directions stays within range at 0 dBFS
+	loud := []byte{0x00, 0x80, 0xff, 0x7f}
+	scaled, _ = normalizePCM(loud, 0)
+	if got := []int16{int16(binary.LittleEndian.Uint16(scaled)), int16(binary.LittleEndian.Uint16(scaled[2:]))}; got[0] != -32767 || got[1] != 32766 {
+		t.Errorf("full scale audio normalized to %v", got)
+	}
+
+	if silent, gain := normalizePCM(make([]byte, 64), -1); gain != 1 || !bytes.Equal(silent, make([]byte, 64)) {
+		t.Errorf("silence normalized with gain %v", gain)
+	}
+}
+
+func TestSilenceTrimmerStreams(t *testing.T) {
+	// 20ms windows of 16 kHz mono audio are 320 frames
+	speech := sine(440, 16000, 8000, 8000)
+	short, long := make([]byte, 1600*2), make([]byte, 32000*2)
+	pcm := concat(speech, short, speech, long, speech, []byte{0x01})
+	want := concat(speech, short, speech, speech)
+
+	if got := trimSilence(pcm, 16000, 1); !bytes.Equal(got, want) {
+		t.Fatalf("trimmed to %d bytes, want %d", len(got), len(want))
+	}
+	for _, piece := range []int{1, 7, 333, 4099} {
+		var out bytes.Buffer
+		trimmer := newSilenceTrimmer(&out, 16000, 1)
+		for rest := pcm; len(rest) > 0; rest = rest[min(piece, len(rest)):] {
+			trimmer.Write(rest[:min(piece, len(rest))])
+		}
+		if err := trimmer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("trimmed in %d byte writes to %d bytes, want %d", piece, out.Len(), len(want))
+		}
+	}
+}
+
+func TestFinalizeProcessesLargeFilesInBlocks(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &trimSilenceOnFinalize, true)
+	setVar(t, &normalizeOnFinalize, true)
+	setVar(t, &normalizeTarget, -3.0)
+	setVar(t, &finalizeFormat, "both")
+
+	// More audio than pcmBlockSize, with a long pause across a block boundary
+	speech := sine(440, 16000, 160000, 2000)
+	chunks := [][]byte{speech, speech, speech, concat(make([]byte, 3*32000), speech)}
+	var all []byte
+	for _, chunk := range chunks {
+		mustPost(t, "uid=alice", chunk)
+		all = append(all, chunk...)
+	}
+	if len(all) <= pcmBlockSize {
+		t.Fatalf("test audio of %d bytes fits a single block", len(all))
+	}
+	filename := currentMetadata(t, f, "alice").Filename
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	want, _ := normalizePCM(trimSilence(all, 16000, 1), -3)
+	if data, _ := f.get(filename); !bytes.Equal(data[wavHeaderSize:], want) {
+		t.Fatalf("finalized WAV holds %d bytes, want the %d bytes trimmed and normalized", len(data)-wavHeaderSize, len(want))
+	}
+	data, _ := f.get(flacPath(filename))
+	if pcm, _, _, _ := decodeFLAC(t, data); !bytes.Equal(pcm, want) {
+		t.Fatalf("FLAC decodes to %d bytes, want the %d bytes trimmed and normalized", len(pcm), len(want))
+	}
+}
+
+func TestFinalizeNormalizes(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &normalizeOnFinalize, true)
+	setVar(t, &normalizeTarget, -6.0)
+	quiet := sine(440, 16000, 1600, 1000)
+
+	mustPost(t, "uid=alice", quiet)
+	filename := currentMetadata(t, f, "alice").Filename
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	data, _ := f.get(filename)
+	want, _ := normalizePCM(quiet, -6)
+	if format, dataLen := storedWAV(t, f, filename); format.sampleRate != 16000 || format.bits != 16 || dataLen != len(want) {
+		t.Fatalf("normalized file declares %+v with %d bytes", format, dataLen)
+	}
+	if !bytes.Equal(data[wavHeaderSize:], want) {
+		t.Fatal("finalized audio is not normalized to -6 dBFS")
+	}
+}
@@ -0,0 +1,92 @@
+package function
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxDecompressedBytes caps how large a compressed body may grow when decoded,
+// guarding against decompression bombs
+const defaultMaxDecompressedBytes = 50 << 20
+
+// errDecompressedTooLarge is returned when a compressed body expands past the
+// configured limit
+var errDecompressedTooLarge = errors.New("decompressed body is too large")
+
+// normalizeContentEncoding returns the Content-Encoding of a request in canonical
+// form, with "" standing for an uncompressed body, or an error when the server
+// cannot decode it
+func normalizeContentEncoding(header string) (string, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header))
+	switch encoding {
+	case "", "identity":
+		return "", nil
+	case "gzip", "x-gzip":
+		return "gzip", nil
+	case "deflate":
+		return "deflate", nil
+	}
+	return "", fmt.Errorf("unsupported Content-Encoding %q, expected gzip or deflate", header)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header admits a gzip response:
+// gzip or x-gzip is listed with a nonzero q, or else * is
+func acceptsGzip(header string) bool {
+	gzipWeight, anyWeight := -1.0, -1.0
+	for _, item := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		weight := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				weight = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipWeight = max(gzipWeight, weight)
+		case "*":
+			anyWeight = max(anyWeight, weight)
+		}
+	}
+	if gzipWeight >= 0 {
+		return gzipWeight > 0
+	}
+	return anyWeight > 0
+}
+
+// decodeContentEncoding decompresses body according to encoding, failing with
+// errDecompressedTooLarge once the output exceeds limit bytes
+func decodeContentEncoding(encoding string, body []byte, limit int64) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// HTTP deflate is zlib-wrapped DEFLATE (RFC 9110)
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %v", encoding, err)
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %v", encoding, err)
+	}
+	if int64(len(decoded)) > limit {
+		return nil, errDecompressedTooLarge
+	}
+	return decoded, nil
+}
@@ -0,0 +1,100 @@
+package function
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// postEncoded sends body to HandlePostAudio compressed with encoding
+func postEncoded(t *testing.T, query, encoding string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&compressed)
+	case "deflate":
+		writer = zlib.NewWriter(&compressed)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	writer.Write(body)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/?"+query, &compressed)
+	req.Header.Set("Content-Encoding", encoding)
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, req)
+	return w
+}
+
+func TestPostCompressedAudio(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			f := newFakeGCS(t)
+			useFakeClock(t, testStart)
+			body := tone(500*time.Millisecond, 16000)
+
+			if w := postEncoded(t, "uid=alice", encoding, body); w.Code >= 300 {
+				t.Fatalf("POST answered %d: %s", w.Code, w.Body)
+			}
+			got, _ := f.get(pcmPath(currentMetadata(t, f, "alice").Filename))
+			if !bytes.Equal(got, body) {
+				t.Fatalf("stored %d bytes that differ from the %d decompressed bytes", len(got), len(body))
+			}
+		})
+	}
+}
+
+func TestPostCompressedAudioPastLimit(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &maxDecompressedBytes, 1000)
+
+	// A kilobyte of zeros per compressed byte is what a decompression bomb looks like
+	w := postEncoded(t, "uid=alice", "gzip", make([]byte, 1002))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST answered %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("rejected upload wrote %v", names)
+	}
+}
+
+func TestPostUnsupportedEncoding(t *testing.T) {
+	newFakeGCS(t)
+	req := httptest.NewRequest(http.MethodPost, "/?uid=alice", bytes.NewReader([]byte{1, 2}))
+	req.Header.Set("Content-Encoding", "br")
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("POST with br answered %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"x-gzip", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0, *", false},
+		{"identity, *;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
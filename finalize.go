@@ -0,0 +1,164 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+// HandleFinalize closes the current recording for uid, or for the session named by
+// session_id when given.
+//
+// The expected call order is: POST audio chunks to HandlePostAudio for as long as
+// the recording lasts, then call HandleFinalize once. Finalizing writes the WAV header
+// with the accumulated data size and clears the session metadata, so the next
+// HandlePostAudio for that uid starts a fresh file. Finalizing a session that was
+// already finalized, or never existed, returns 200 with a message so retries are safe.
+// A named session stays closed: later chunks for it are refused with a 409. A chunk
+// arriving within LATE_CHUNK_GRACE of the finalize is handled by LATE_CHUNK_POLICY.
+func HandleFinalize(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	uid := r.URL.Query().Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received finalize request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting finalize with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+	sessionID, err := parseSessionID(r.URL.Query())
+	if err != nil {
+		logger.Warn("Rejecting finalize with invalid session_id")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sessionID != "" {
+		ctx, logger = logWith(ctx, "session_id", sessionID)
+	}
+	key := sessionKey(uid, sessionID)
+
+	// Finalize requests carry no body, so the signature covers only the session key and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, key, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated finalize", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	metadata, size, err := finalizeSession(ctx, bucket, key)
+	if errors.Is(err, errLockBusy) {
+		writeError(w, http.StatusServiceUnavailable, "Session is busy with another write, please retry")
+		return
+	}
+	if isPreconditionFailed(err) {
+		logger.Warn("Session changed during finalize", "error", err)
+		writeError(w, http.StatusConflict, "Session changed during finalize, please retry")
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to finalize session", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to finalize session: %v", err))
+		return
+	}
+	if metadata == nil {
+		logger.Info("No active session to finalize")
+		writeJSON(w, http.StatusOK, audioResponse{
+			Status:  "ok",
+			Message: fmt.Sprintf("No active session for uid %s", uid),
+		})
+		return
+	}
+
+	filename := recordingPath(metadata)
+
+	logger.Info("Successfully finalized file", "file", filename)
+	writeJSON(w, http.StatusOK, audioResponse{
+		Status:          "ok",
+		Message:         "Finalized",
+		Filename:        filename,
+		CurrentSize:     size,
+		DurationSeconds: calculateDuration(size, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()).Seconds(),
+	})
+}
+
+// finalizeSession closes the current recording of session key and clears its
+// metadata, returning the metadata of the recording that was closed and the size of
+// its finalized audio data, or nil when there was no session. A 412 error means the
+// session changed while it was closed, and errLockBusy that another write held the
+// session's lock throughout.
+func finalizeSession(ctx context.Context, bucket *storage.BucketHandle, key string) (*WAVMetadata, int, error) {
+	if err := flushBuffer(ctx, key); err != nil {
+		return nil, 0, fmt.Errorf("failed to flush buffered audio: %w", err)
+	}
+	store := openStore(bucket)
+	release, err := acquireLock(ctx, store, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	metadata, metadataGeneration, err := getCurrentMetadata(ctx, store, key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	if metadata == nil {
+		return nil, 0, nil
+	}
+
+	ctx, _ = logWith(ctx, "object", metadata.Filename)
+	size, err := closeSession(ctx, bucket, store, key, metadata, metadataGeneration)
+	if err != nil {
+		return nil, 0, err
+	}
+	return metadata, size, nil
+}
+
+// closeSession closes the recording metadata describes, that of session key, whose
+// metadata is at generation, records it for LATE_CHUNK_POLICY and clears the
+// metadata, returning the size of its finalized audio data. Every finalize takes
+// this path, whether requested or swept. A 412 error means the session changed
+// meanwhile. The caller holds the session's lock.
+func closeSession(ctx context.Context, bucket *storage.BucketHandle, store objectStore, key string, metadata *WAVMetadata, generation int64) (int, error) {
+	size, err := closeRecording(ctx, bucket, key, metadata)
+	if err != nil {
+		return 0, fmt.Errorf("failed to finalize WAV file: %w", err)
+	}
+	// Without the record, a late chunk is handled as though the session never existed
+	if err := recordClosed(ctx, store, key, metadata); err != nil {
+		loggerFrom(ctx).Warn("Failed to record closed recording", "error", err)
+	}
+	if err := clearMetadata(ctx, store, key, generation); err != nil {
+		return 0, fmt.Errorf("failed to clear metadata: %w", err)
+	}
+	return size, nil
+}
+
+// clearMetadata deletes the metadata for session key, provided it is still at
+// generation, along with its pairing buffer, whose unmatched audio is dropped. A
+// named session is marked finalized first, so it can't be reopened once its
+// metadata is gone.
+func clearMetadata(ctx context.Context, store objectStore, key string, generation int64) error {
+	if err := markSessionFinalized(ctx, store, key); err != nil {
+		return fmt.Errorf("failed to mark session finalized: %w", err)
+	}
+	if err := store.Delete(ctx, metadataPath(key), generation); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	if err := store.Delete(ctx, pairPath(key), 0); err != nil && err != storage.ErrObjectNotExist {
+		loggerFrom(ctx).Warn("Failed to delete pairing buffer", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFinalizeReportsTrimmedSize(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &trimSilenceOnFinalize, true)
+	setVar(t, &silenceThreshold, fallbackSilenceThreshold)
+	setVar(t, &minSilence, fallbackMinSilence)
+
+	audio := append(tone(500*time.Millisecond, 16000), make([]byte, 2*16000*2)...)
+	audio = append(audio, tone(500*time.Millisecond, 16000)...)
+	mustPost(t, "uid=alice", audio)
+	filename := currentMetadata(t, f, "alice").Filename
+
+	w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	var response audioResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	_, dataLen := storedWAV(t, f, filename)
+	if dataLen >= len(audio) {
+		t.Fatalf("finalized %d bytes of %d, want the silence trimmed", dataLen, len(audio))
+	}
+	if response.CurrentSize != dataLen {
+		t.Fatalf("finalize reported %d bytes, the stored file holds %d", response.CurrentSize, dataLen)
+	}
+	if want := calculateDuration(dataLen, 16000, 1, 16).Seconds(); response.DurationSeconds != want {
+		t.Fatalf("finalize reported %vs, want %vs", response.DurationSeconds, want)
+	}
+}
+
+func TestFinalizeWithoutSession(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("finalize without a session answered %d: %s", w.Code, w.Body)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("finalize without a session wrote %v", names)
+	}
+}
+
+func TestDoubleFinalize(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(500*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", body)
+	filename := currentMetadata(t, f, "alice").Filename
+
+	for i := 0; i < 2; i++ {
+		if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+			t.Fatalf("finalize %d answered %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	if _, dataLen := storedWAV(t, f, filename); dataLen != len(body) {
+		t.Fatalf("finalized file holds %d bytes, want %d", dataLen, len(body))
+	}
+	if _, ok := f.get(pcmPath(filename)); ok {
+		t.Fatal("accumulator left behind after finalize")
+	}
+	index, _ := f.get(indexPath("alice"))
+	var recordings recordingIndex
+	if err := json.Unmarshal(index, &recordings); err != nil || len(recordings.Recordings) != 1 {
+		t.Fatalf("index after a double finalize = %s, want one recording", index)
+	}
+
+	// The next chunk starts a new file rather than reopening the finalized one
+	mustPost(t, "uid=alice", body)
+	if next := currentMetadata(t, f, "alice").Filename; next == filename {
+		t.Fatalf("chunk after finalize reopened %s", filename)
+	}
+}
+
+func TestFinalizeOutputFormats(t *testing.T) {
+	const filename = "alice/2024-05-01T12-00-00Z.wav"
+	tests := []struct {
+		format           string
+		wantWAV, wantRaw bool
+		wantFilename     string
+	}{
+		{"wav", true, false, filename},
+		{"pcm", false, true, rawPath(filename)},
+		{"both", true, true, filename},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f := newFakeGCS(t)
+			useFakeClock(t, testStart)
+			setVar(t, &outputFormat, tt.format)
+			body := tone(500*time.Millisecond, 16000)
+
+			mustPost(t, "uid=alice", body)
+			w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil)
+			var response audioResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+			}
+			if response.Filename != tt.wantFilename || response.DurationSeconds != 0.5 {
+				t.Fatalf("finalize reported %s of %vs, want %s of 0.5s", response.Filename, response.DurationSeconds, tt.wantFilename)
+			}
+
+			wav, hasWAV := f.get(filename)
+			if hasWAV != tt.wantWAV {
+				t.Fatalf("WAV written = %v, want %v", hasWAV, tt.wantWAV)
+			}
+			if hasWAV && (string(wav[:4]) != "RIFF" || !bytes.Equal(wav[wavHeaderSize:], body)) {
+				t.Fatal("WAV is not the header followed by the audio")
+			}
+			raw, hasRaw := f.get(rawPath(filename))
+			if hasRaw != tt.wantRaw {
+				t.Fatalf("raw PCM written = %v, want %v", hasRaw, tt.wantRaw)
+			}
+			if hasRaw && !bytes.Equal(raw, body) {
+				t.Fatal("raw PCM is not exactly the audio, without a header")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package function
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"cloud.google.com/go/storage"
+)
+
+// With FINGERPRINT on, finalizing a recording computes an acoustic fingerprint of its
+// first FINGERPRINT_MAX_DURATION and keeps it in the recording's index entry, so
+// duplicates and similar recordings can be found later by comparing fingerprints
+// rather than audio. The fingerprint is a spectral hash: the audio is cut into frames
+// of 1/fingerprintFrameRate of a second, the energy of each frame is measured in
+// fingerprintBands bands spaced logarithmically across the speech range, and each
+// frame is hashed to 32 bits, one per pair of adjacent bands, set when the upper
+// band holds more energy. Identical audio hashes identically, and audio that differs
+// in a frame differs in about half of its bits. Like normalizing, it works on 16-bit
+// integer samples only.
+
+const (
+	// fingerprintFrameRate is how many frames each second of audio is hashed as
+	fingerprintFrameRate = 8
+	// fingerprintBands is how many frequency bands each frame is measured in, one
+	// more than the bits of a frame's hash
+	fingerprintBands = 33
+	// fingerprintLowHz and fingerprintHighHz bound the bands, the upper bound being
+	// lowered for audio sampled too slowly to hold it
+	fingerprintLowHz  = 100.0
+	fingerprintHighHz = 4000.0
+)
+
+// fingerprintRecording returns the fingerprint of the finalized recording metadata
+// describes, read from its WAV or headerless PCM, or "" when FINGERPRINT is off or
+// the recording can't be fingerprinted
+func fingerprintRecording(ctx context.Context, bucket *storage.BucketHandle, metadata *WAVMetadata) (string, error) {
+	if !fingerprintOnFinalize {
+		return "", nil
+	}
+	if metadata.fileBits() != 16 || metadata.Float {
+		loggerFrom(ctx).Info("Not fingerprinting audio that is not 16-bit PCM", "file", metadata.Filename, "bits", metadata.fileBits())
+		return "", nil
+	}
+	frameSize := metadata.fileChannels() * 2
+	limit := int64(fingerprintMaxDuration.Seconds()*float64(metadata.fileSampleRate())) * int64(frameSize)
+
+	name, offset := metadata.Filename, int64(wavHeaderSize)
+	switch {
+	case flacOnly(metadata):
+		loggerFrom(ctx).Info("Not fingerprinting a recording kept as FLAC only", "file", metadata.Filename)
+		return "", nil
+	case outputFormat == "pcm":
+		name, offset = rawPath(metadata.Filename), 0
+	}
+	reader, err := bucket.Object(name).NewRangeReader(ctx, 0, offset+limit)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	pcm := data
+	if offset > 0 {
+		if _, pcm, err = stripWAVHeader(data); err != nil {
+			return "", fmt.Errorf("failed to parse %s: %v", name, err)
+		}
+	}
+	pcm = pcm[:len(pcm)-len(pcm)%frameSize]
+	return fingerprintPCM(pcm, metadata.fileSampleRate(), metadata.fileChannels()), nil
+}
+
+// fingerprintPCM returns the spectral hash of 16-bit little-endian pcm, as 8 hex
+// digits per frame, downmixing its channels first. A trailing partial frame is not
+// hashed.
+func fingerprintPCM(pcm []byte, sampleRate, channels int) string {
+	frameLen := sampleRate / fingerprintFrameRate
+	frames := len(pcm) / (2 * channels) / frameLen
+
+	// The bands' Goertzel coefficients, for centers spread evenly in log frequency
+	high := min(fingerprintHighHz, 0.45*float64(sampleRate))
+	coefficients := make([]float64, fingerprintBands)
+	for band := range coefficients {
+		center := fingerprintLowHz * math.Pow(high/fingerprintLowHz, float64(band)/(fingerprintBands-1))
+		coefficients[band] = 2 * math.Cos(2*math.Pi*center/float64(sampleRate))
+	}
+
+	mono := make([]float64, frameLen)
+	energy := make([]float64, fingerprintBands)
+	hash := make([]byte, 0, frames*8)
+	for frame := 0; frame < frames; frame++ {
+		for i := range mono {
+			sum := 0
+			for c := 0; c < channels; c++ {
+				offset := ((frame*frameLen+i)*channels + c) * 2
+				sum += int(int16(binary.LittleEndian.Uint16(pcm[offset:])))
+			}
+			mono[i] = float64(sum) / float64(channels)
+		}
+		for band, coefficient := range coefficients {
+			var s1, s2 float64
+			for _, sample := range mono {
+				s1, s2 = sample+coefficient*s1-s2, s1
+			}
+			energy[band] = s1*s1 + s2*s2 - coefficient*s1*s2
+		}
+		var bits uint32
+		for band := 0; band < fingerprintBands-1; band++ {
+			if energy[band+1] > energy[band] {
+				bits |= 1 << band
+			}
+		}
+		hash = fmt.Appendf(hash, "%08x", bits)
+	}
+	return string(hash)
+}
@@ -0,0 +1,78 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFingerprintPCM(t *testing.T) {
+	voice := concat(sine(440, 16000, 8000, 8000), sine(880, 16000, 8000, 4000))
+	other := concat(sine(660, 16000, 8000, 8000), sine(330, 16000, 8000, 4000))
+
+	fingerprint := fingerprintPCM(voice, 16000, 1)
+	if len(fingerprint) != 8*fingerprintFrameRate {
+		t.Fatalf("a second of audio hashed to %d hex digits, want 8 per frame", len(fingerprint))
+	}
+	if again := fingerprintPCM(concat(voice), 16000, 1); again != fingerprint {
+		t.Fatalf("identical audio hashed to %s and %s", fingerprint, again)
+	}
+	if different := fingerprintPCM(other, 16000, 1); different == fingerprint {
+		t.Fatalf("different audio hashed identically to %s", fingerprint)
+	}
+	// A stereo copy of the audio downmixes to the same hash
+	if stereo := fingerprintPCM(interleave(voice, voice, 2), 16000, 2); stereo != fingerprint {
+		t.Fatalf("stereo copy hashed to %s, want %s", stereo, fingerprint)
+	}
+}
+
+func TestFinalizeRecordsFingerprint(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &fingerprintOnFinalize, true)
+	setVar(t, &fingerprintMaxDuration, time.Second)
+	voice := concat(sine(440, 16000, 16000, 8000), sine(880, 16000, 16000, 4000))
+
+	fingerprints := map[string]string{}
+	for uid, audio := range map[string][]byte{"alice": voice, "bob": voice, "carol": sine(660, 16000, 32000, 8000)} {
+		mustPost(t, "uid="+uid, audio)
+		if w := serve(t, HandleFinalize, http.MethodPost, "/?uid="+uid, nil); w.Code != http.StatusOK {
+			t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+		}
+		data, _ := f.get(indexPath(uid))
+		var index recordingIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			t.Fatal(err)
+		}
+		fingerprints[uid] = index.Recordings[0].Fingerprint
+	}
+
+	// Only the first second of each two-second recording is hashed
+	if want := fingerprintPCM(voice[:32000], 16000, 1); fingerprints["alice"] != want {
+		t.Fatalf("alice's recording has fingerprint %q, want %q", fingerprints["alice"], want)
+	}
+	if fingerprints["bob"] != fingerprints["alice"] {
+		t.Fatal("identical recordings have different fingerprints")
+	}
+	if fingerprints["carol"] == fingerprints["alice"] {
+		t.Fatal("different recordings have identical fingerprints")
+	}
+}
+
+func TestFingerprintOffByDefault(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	data, _ := f.get(indexPath("alice"))
+	var index recordingIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.Recordings[0].Fingerprint != "" {
+		t.Fatalf("fingerprint %q recorded with FINGERPRINT off", index.Recordings[0].Fingerprint)
+	}
+}
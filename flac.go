@@ -0,0 +1,110 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// flacBlockSize is the number of inter-channel samples encoded per FLAC frame
+const flacBlockSize = 4096
+
+// flacPath returns the name of the FLAC rendition of filename
+func flacPath(filename string) string {
+	return strings.TrimSuffix(filename, ".wav") + ".flac"
+}
+
+// flacSupported reports whether encodeFLAC can encode the format of metadata's file.
+// FLAC stores integer samples only.
+func flacSupported(metadata *WAVMetadata) bool {
+	bits := metadata.fileBits()
+	return !metadata.Float && (bits == 16 || bits == 24)
+}
+
+// encodeFLAC losslessly encodes interleaved little-endian integer PCM as a FLAC
+// stream. The encoder picks the best fixed predictor for each subframe.
+func encodeFLAC(pcm []byte, sampleRate, channels, bits int) ([]byte, error) {
+	var out bytes.Buffer
+	if err := streamFLAC(&out, bytes.NewReader(pcm), int64(len(pcm)), sampleRate, channels, bits); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// streamFLAC is encodeFLAC for the size bytes of PCM read from r, encoded onto w a
+// block at a time so the audio is never held whole
+func streamFLAC(w io.Writer, r io.Reader, size int64, sampleRate, channels, bits int) error {
+	sampleSize := bits / 8
+	frameSize := sampleSize * channels
+	nsamples := size / int64(frameSize)
+
+	info := &meta.StreamInfo{
+		BlockSizeMin:  flacBlockSize,
+		BlockSizeMax:  flacBlockSize,
+		SampleRate:    uint32(sampleRate),
+		NChannels:     uint8(channels),
+		BitsPerSample: uint8(bits),
+		NSamples:      uint64(nsamples),
+	}
+	// The encoder closes a writer that is an io.Closer, which is the caller's to close
+	enc, err := flac.NewEncoder(struct{ io.Writer }{w}, info)
+	if err != nil {
+		return fmt.Errorf("failed to start FLAC stream: %v", err)
+	}
+
+	layout := frame.ChannelsMono
+	if channels == 2 {
+		layout = frame.ChannelsLR
+	}
+	block := make([]byte, flacBlockSize*frameSize)
+	for start := int64(0); start < nsamples; start += flacBlockSize {
+		blockSize := int(min(flacBlockSize, nsamples-start))
+		if _, err := io.ReadFull(r, block[:blockSize*frameSize]); err != nil {
+			return fmt.Errorf("failed to read PCM: %v", err)
+		}
+		f := &frame.Frame{
+			Header: frame.Header{
+				HasFixedBlockSize: true,
+				BlockSize:         uint16(blockSize),
+				SampleRate:        uint32(sampleRate),
+				Channels:          layout,
+				BitsPerSample:     uint8(bits),
+			},
+			Subframes: make([]*frame.Subframe, channels),
+		}
+		for c := 0; c < channels; c++ {
+			samples := make([]int32, blockSize)
+			for i := range samples {
+				offset := i*frameSize + c*sampleSize
+				samples[i] = pcmSample(block[offset:offset+sampleSize], bits)
+			}
+			f.Subframes[c] = &frame.Subframe{
+				SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+				Samples:   samples,
+				NSamples:  blockSize,
+			}
+		}
+		if err := enc.WriteFrame(f); err != nil {
+			return fmt.Errorf("failed to encode FLAC frame: %v", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("failed to finish FLAC stream: %v", err)
+	}
+	return nil
+}
+
+// pcmSample decodes one little-endian signed integer sample of the given depth
+func pcmSample(b []byte, bits int) int32 {
+	if bits == 16 {
+		return int32(int16(binary.LittleEndian.Uint16(b)))
+	}
+	// Sign-extend the 24-bit value through the top byte of an int32
+	return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+}
@@ -0,0 +1,96 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mewkiz/flac"
+)
+
+// decodeFLAC decodes a FLAC stream back to interleaved little-endian PCM
+func decodeFLAC(t *testing.T, data []byte) (pcm []byte, sampleRate, channels, bits int) {
+	t.Helper()
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid FLAC stream: %v", err)
+	}
+	defer stream.Close()
+	info := stream.Info
+	bits = int(info.BitsPerSample)
+	for {
+		f, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid FLAC frame: %v", err)
+		}
+		for i := 0; i < int(f.BlockSize); i++ {
+			for _, subframe := range f.Subframes {
+				sample := uint32(subframe.Samples[i])
+				pcm = binary.LittleEndian.AppendUint16(pcm, uint16(sample))
+				if bits == 24 {
+					pcm = append(pcm, byte(sample>>16))
+				}
+			}
+		}
+	}
+	return pcm, int(info.SampleRate), int(info.NChannels), bits
+}
+
+func TestEncodeFLACRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		channels   int
+		bits       int
+		pcm        []byte
+	}{
+		// Neither length is a whole number of FLAC blocks
+		{"16-bit mono", 16000, 1, 16, tone(700*time.Millisecond, 16000)},
+		{"16-bit stereo", 48000, 2, 16, sine(440, 48000, 5000, 0.5)},
+		{"24-bit mono", 16000, 1, 24, []byte{0x01, 0x00, 0x80, 0xff, 0xff, 0x7f, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeFLAC(tt.pcm, tt.sampleRate, tt.channels, tt.bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pcm, sampleRate, channels, bits := decodeFLAC(t, encoded)
+			if sampleRate != tt.sampleRate || channels != tt.channels || bits != tt.bits {
+				t.Fatalf("decoded %d Hz, %d channels, %d bits", sampleRate, channels, bits)
+			}
+			if !bytes.Equal(pcm, tt.pcm) {
+				t.Fatalf("decoded %d bytes that differ from the %d encoded", len(pcm), len(tt.pcm))
+			}
+		})
+	}
+}
+
+func TestFinalizeAsFLAC(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &finalizeFormat, "flac")
+	body := tone(time.Second, 16000)
+
+	mustPost(t, "uid=alice", body)
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	data, ok := f.get("alice/2024-05-01T12-00-00Z.flac")
+	if !ok {
+		t.Fatalf("no FLAC was written, objects %v", f.names(""))
+	}
+	if pcm, _, _, _ := decodeFLAC(t, data); !bytes.Equal(pcm, body) {
+		t.Fatal("stored FLAC does not decode to the uploaded audio")
+	}
+	if len(data) >= len(body) {
+		t.Fatalf("FLAC of %d bytes is no smaller than the %d bytes of PCM", len(data), len(body))
+	}
+}
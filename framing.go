@@ -0,0 +1,26 @@
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// splitLengthPrefixed splits a framing=lp body into its frames. Such a body lets a
+// client flush several buffered packets in one request: each frame is preceded by
+// its length in bytes as a little-endian uint32.
+func splitLengthPrefixed(body []byte) ([][]byte, error) {
+	var frames [][]byte
+	for offset := 0; offset < len(body); {
+		if len(body)-offset < 4 {
+			return nil, fmt.Errorf("truncated length prefix at byte %d", offset)
+		}
+		n := binary.LittleEndian.Uint32(body[offset:])
+		offset += 4
+		if uint64(n) > uint64(len(body)-offset) {
+			return nil, fmt.Errorf("frame %d declares %d bytes but only %d remain", len(frames), n, len(body)-offset)
+		}
+		frames = append(frames, body[offset:offset+int(n)])
+		offset += int(n)
+	}
+	return frames, nil
+}
@@ -0,0 +1,45 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds the bucket lookup made by HandleHealth so a probe fails
+// fast instead of hanging on an unreachable GCS
+const healthCheckTimeout = 5 * time.Second
+
+// healthResponse is the JSON body returned by a passing health check
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// HandleHealth reports whether the function can reach its bucket, for monitoring and
+// load-balancer probes. It probes the bucket the way the first request to it does, by
+// listing it, so probing never creates or modifies objects and needs no more than the
+// object roles the function runs with. A reachable bucket returns 200; missing or
+// malformed configuration and an unreachable bucket return 503, with the detail left
+// to the logs.
+func HandleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	bucket, err := openBucket("")
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	// A bucket reached once is trusted by later requests, but a health check has to
+	// reach it every time
+	probedBuckets.Delete(bucket.BucketName())
+	if err := probeBucket(ctx, bucket); err != nil {
+		logger.Error("Health check failed: bucket unreachable", "error", err)
+		writeError(w, http.StatusServiceUnavailable, "Bucket unreachable, see the function logs")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
@@ -0,0 +1,36 @@
+package function
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	f := newFakeGCS(t)
+	// The function's object roles can't read the bucket's attributes
+	denied := false
+	f.fail = func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/b/"+testBucket) {
+			return http.StatusForbidden
+		}
+		if denied {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+
+	if w := serve(t, HandleHealth, http.MethodGet, "/", nil); w.Code != http.StatusOK {
+		t.Fatalf("health answered %d: %s", w.Code, w.Body)
+	}
+
+	// A later outage is noticed even though the bucket was reached before
+	denied = true
+	w := serve(t, HandleHealth, http.MethodGet, "/", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("health of a denied bucket answered %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(w.Body.String(), "403") || strings.Contains(w.Body.String(), testBucket) {
+		t.Fatalf("health returned the error detail to the client: %s", w.Body)
+	}
+}
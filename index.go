@@ -0,0 +1,144 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// recordingEntry describes one completed recording in a uid's index
+type recordingEntry struct {
+	Filename        string    `json:"filename"`
+	StartTime       time.Time `json:"start_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Size            int       `json:"size"`
+	// Fingerprint is the recording's spectral hash, when FINGERPRINT is on
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// recordingIndex is the manifest of completed recordings stored at {uid}/index.json
+type recordingIndex struct {
+	Recordings []recordingEntry `json:"recordings"`
+}
+
+// indexPath returns the name of the recordings index object for uid
+func indexPath(uid string) string {
+	return uid + "/index.json"
+}
+
+// readIndex returns uid's recordings index and the generation of the index object.
+// A missing index is returned as empty with generation 0.
+func readIndex(ctx context.Context, bucket *storage.BucketHandle, uid string) (*recordingIndex, int64, error) {
+	index := &recordingIndex{Recordings: []recordingEntry{}}
+
+	r, err := bucket.Object(indexPath(uid)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return index, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read index: %v", err)
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(index); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode index: %v", err)
+	}
+	return index, r.Attrs.Generation, nil
+}
+
+// appendIndexEntry adds entry to uid's recordings index. The index is rewritten with
+// a generation precondition and retried when another request updates it first, so
+// concurrent writers never lose entries. An entry already present is not duplicated,
+// but replaced when its recording has grown since, as when a late chunk reopened it.
+func appendIndexEntry(ctx context.Context, bucket *storage.BucketHandle, uid string, entry recordingEntry) error {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(casBackoff(attempt))
+		}
+
+		index, generation, err := readIndex(ctx, bucket, uid)
+		if err != nil {
+			return err
+		}
+		// A recording reopened by a late chunk is finalized again, longer
+		found := false
+		for i, existing := range index.Recordings {
+			if existing.Filename == entry.Filename {
+				if existing.Size == entry.Size {
+					return nil
+				}
+				index.Recordings[i], found = entry, true
+			}
+		}
+		if !found {
+			index.Recordings = append(index.Recordings, entry)
+		}
+
+		conds := storage.Conditions{DoesNotExist: true}
+		if generation != 0 {
+			conds = storage.Conditions{GenerationMatch: generation}
+		}
+		writer := bucket.Object(indexPath(uid)).If(conds).NewWriter(ctx)
+		writer.ContentType = "application/json"
+		writer.KMSKeyName = cmekKey
+		if err := json.NewEncoder(writer).Encode(index); err != nil {
+			writer.Close()
+			return fmt.Errorf("failed to encode index: %v", err)
+		}
+		err = writer.Close()
+		if isPreconditionFailed(err) {
+			loggerFrom(ctx).Info("Recordings index changed concurrently, retrying")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write index: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to update index for uid %s after %d attempts", uid, maxCASAttempts)
+}
+
+// HandleListRecordings returns the index of completed recordings for uid as JSON,
+// projected by the fields param and gzipped as writeQueryJSON describes
+func HandleListRecordings(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	uid := r.URL.Query().Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received list request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting list with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+
+	// List requests carry no body, so the signature covers only uid and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, uid, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated list", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	index, _, err := readIndex(ctx, bucket, uid)
+	if err != nil {
+		logger.Error("Failed to read recordings index", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to read recordings index: %v", err))
+		return
+	}
+
+	writeQueryJSON(ctx, w, r, index)
+}
@@ -0,0 +1,66 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListRecordingsRequiresSignature(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	t.Setenv("AUTH_SECRET", testSecret)
+
+	if w := serve(t, HandleListRecordings, http.MethodGet, "/?uid=alice", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unsigned list answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serveSigned(t, HandleListRecordings, http.MethodGet, "/?uid=alice", "alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("signed list answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestListRecordingsAfterFinalize(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	w := serve(t, HandleListRecordings, http.MethodGet, "/?uid=alice", nil)
+	var index recordingIndex
+	if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Recordings) != 1 {
+		t.Fatalf("index holds %d recordings, want 1", len(index.Recordings))
+	}
+	got := index.Recordings[0]
+	if got.Filename != "alice/2024-05-01T12-00-00Z.wav" || got.DurationSeconds != 0.5 || got.Size != wavObjectSize(16000) {
+		t.Fatalf("indexed %+v", got)
+	}
+}
+
+func TestRolloverAppendsIndexEntry(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	first := currentMetadata(t, f, "alice").Filename
+	clock.Advance(inactivityLimit)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+
+	data, _ := f.get(indexPath("alice"))
+	var index recordingIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Recordings) != 1 || index.Recordings[0].Filename != first || index.Recordings[0].DurationSeconds != 0.25 {
+		t.Fatalf("index after rollover = %+v, want only %s of 0.25s", index.Recordings, first)
+	}
+	if !index.Recordings[0].StartTime.Equal(testStart) {
+		t.Fatalf("indexed start time %v, want %v", index.Recordings[0].StartTime, testStart)
+	}
+}
@@ -0,0 +1,95 @@
+package function
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sessionInfoResponse is the JSON body returned by HandleSessionInfo: the file's
+// effective format, the size and duration of the audio accumulated so far, and the
+// time of the last write. The field names are those of the session metadata, of
+// which nothing else is exposed.
+type sessionInfoResponse struct {
+	Status          string    `json:"status"`
+	SampleRate      int       `json:"sample_rate"`
+	Channels        int       `json:"channels"`
+	BitsPerSample   int       `json:"bits_per_sample"`
+	CurrentSize     int       `json:"current_size"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	LastWriteTime   time.Time `json:"last_write_time"`
+}
+
+// HandleSessionInfo returns the metadata of uid's active session, or of the session
+// named by session_id, so clients can check its format, size and last write without
+// downloading audio. Only the metadata object is read, so the size is the one last
+// recorded rather than reconciled with the stored audio. It returns 404 when there
+// is no active session. HEAD requests get the same status without the body. The
+// fields param and gzip are handled by writeQueryJSON.
+func HandleSessionInfo(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed, use GET or HEAD")
+		return
+	}
+
+	uid := r.URL.Query().Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received session info request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting session info request with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+	sessionID, err := parseSessionID(r.URL.Query())
+	if err != nil {
+		logger.Warn("Rejecting session info request with invalid session_id")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sessionID != "" {
+		ctx, logger = logWith(ctx, "session_id", sessionID)
+	}
+	key := sessionKey(uid, sessionID)
+
+	// Info requests carry no body, so the signature covers only the session key and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, key, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated session info request", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	metadata, _, err := getCurrentMetadata(ctx, openStore(bucket), key)
+	if err != nil {
+		logger.Error("Failed to get metadata", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to get metadata: %v", err))
+		return
+	}
+	if metadata == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No active session for uid %s", uid))
+		return
+	}
+
+	rate, channels, bits := metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()
+	writeQueryJSON(ctx, w, r, sessionInfoResponse{
+		Status:          "ok",
+		SampleRate:      rate,
+		Channels:        channels,
+		BitsPerSample:   bits,
+		CurrentSize:     metadata.CurrentSize,
+		DurationSeconds: calculateDuration(metadata.CurrentSize, rate, channels, bits).Seconds(),
+		LastWriteTime:   metadata.LastWriteTime,
+	})
+}
@@ -0,0 +1,123 @@
+package function
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionInfo(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	mustPost(t, "uid=alice&session_id=walk", tone(250*time.Millisecond, 16000))
+
+	tests := []struct {
+		query    string
+		duration float64
+	}{
+		{"uid=alice", 0.5},
+		{"uid=alice&session_id=walk", 0.25},
+	}
+	for _, tt := range tests {
+		w := serve(t, HandleSessionInfo, http.MethodGet, "/?"+tt.query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET ?%s answered %d: %s", tt.query, w.Code, w.Body)
+		}
+		var info sessionInfoResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.SampleRate != 16000 || info.Channels != 1 || info.BitsPerSample != 16 {
+			t.Errorf("?%s reported format %+v", tt.query, info)
+		}
+		if !info.LastWriteTime.Equal(testStart) || info.CurrentSize != int(tt.duration*32000) {
+			t.Errorf("?%s reported %d bytes last written at %v", tt.query, info.CurrentSize, info.LastWriteTime)
+		}
+		if info.DurationSeconds != tt.duration {
+			t.Errorf("?%s reported %vs, want %vs", tt.query, info.DurationSeconds, tt.duration)
+		}
+	}
+}
+
+func TestSessionInfoMissingSession(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+
+	for _, query := range []string{"uid=bob", "uid=alice&session_id=walk"} {
+		if w := serve(t, HandleSessionInfo, http.MethodGet, "/?"+query, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET ?%s answered %d, want %d", query, w.Code, http.StatusNotFound)
+		}
+	}
+	w := serve(t, HandleSessionInfo, http.MethodPost, "/?uid=alice", nil)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST answered %d with Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestSessionInfoHead(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	server := httptest.NewServer(http.HandlerFunc(HandleSessionInfo))
+	defer server.Close()
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"uid=alice", http.StatusOK},
+		{"uid=bob", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, err := http.Head(server.URL + "/?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want || len(body) != 0 {
+			t.Errorf("HEAD ?%s answered %d with %d body bytes, want %d and none", tt.query, resp.StatusCode, len(body), tt.want)
+		}
+	}
+}
+
+func TestSessionInfoProjectsFields(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+
+	w := serve(t, HandleSessionInfo, http.MethodGet, "/?uid=alice&fields=current_size,duration_seconds", nil)
+	var info map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 2 || info["current_size"] != 8000.0 || info["duration_seconds"] != 0.25 {
+		t.Fatalf("projected info = %v, want only current_size and duration_seconds", info)
+	}
+}
+
+func TestSessionInfoHidesInternalMetadata(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice&seq=1", tone(250*time.Millisecond, 16000))
+
+	w := serve(t, HandleSessionInfo, http.MethodGet, "/?uid=alice", nil)
+	var info map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"status", "sample_rate", "channels", "bits_per_sample", "current_size", "duration_seconds", "last_write_time"}
+	if len(info) != len(want) {
+		t.Fatalf("info = %v, want only %v", info, want)
+	}
+	for _, field := range want {
+		if _, ok := info[field]; !ok {
+			t.Errorf("info lacks %s", field)
+		}
+	}
+}
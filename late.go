@@ -0,0 +1,131 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// closedPrefix holds a record of the recording each session last finalized, kept
+// when LATE_CHUNK_POLICY is drop or reopen
+const closedPrefix = "closed/"
+
+// A chunk still in flight when its client finalizes the session arrives after the
+// recording was closed. LATE_CHUNK_POLICY decides what becomes of a chunk that
+// arrives within LATE_CHUNK_GRACE of the finalize: "new", the default, handles it
+// like any chunk, so it starts a new file, or is refused with a 409 by a named
+// session; "drop" acknowledges it without storing it and logs a warning; "reopen"
+// appends it to the finalized recording, which stays open until it is finalized
+// again. Past the grace window, every policy handles a chunk as "new" does.
+
+// closedRecording records the recording a session last finalized
+type closedRecording struct {
+	ClosedAt time.Time    `json:"closed_at"`
+	Metadata *WAVMetadata `json:"metadata"`
+}
+
+// closedPath returns the name of the record of the recording session key last
+// finalized
+func closedPath(key string) string {
+	return closedPrefix + key + ".json"
+}
+
+// recordClosed records that session key finalized the recording metadata describes,
+// so a late chunk can find it, unless LATE_CHUNK_POLICY is new. The caller holds the
+// session's lock.
+func recordClosed(ctx context.Context, store objectStore, key string, metadata *WAVMetadata) error {
+	if lateChunkPolicy == "new" {
+		return nil
+	}
+	data, err := json.Marshal(closedRecording{ClosedAt: nowFunc(), Metadata: metadata})
+	if err != nil {
+		return fmt.Errorf("failed to encode closed recording: %v", err)
+	}
+	if err := store.Delete(ctx, closedPath(key), 0); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	_, err = store.Write(ctx, closedPath(key), "application/json", data, 0)
+	return err
+}
+
+// lateChunk applies LATE_CHUNK_POLICY to a chunk for session key, which has no
+// recording open. It returns the metadata of the recording the chunk reopens, or
+// reports that the chunk is to be dropped; when it does neither, the chunk is not
+// late and is handled as usual. The caller holds the session's lock. Failures are
+// returned as a *chunkError.
+func lateChunk(ctx context.Context, bucket *storage.BucketHandle, store objectStore, key string) (*WAVMetadata, bool, error) {
+	if lateChunkPolicy == "new" {
+		return nil, false, nil
+	}
+	logger := loggerFrom(ctx)
+	data, generation, err := store.Read(ctx, closedPath(key))
+	if err == storage.ErrObjectNotExist {
+		return nil, false, nil
+	}
+	if err != nil {
+		countGCSError("read_metadata")
+		logger.Error("Failed to read closed recording", "error", err)
+		return nil, false, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to read closed recording: %v", err)}
+	}
+	var closed closedRecording
+	if err := json.Unmarshal(data, &closed); err != nil || closed.Metadata == nil {
+		logger.Warn("Ignoring corrupt closed recording", "error", err)
+		return nil, false, nil
+	}
+	since := nowFunc().Sub(closed.ClosedAt)
+	if since > lateChunkGrace {
+		return nil, false, nil
+	}
+
+	if lateChunkPolicy == "drop" {
+		logger.Warn("Dropping chunk that arrived after the session was finalized", "file", closed.Metadata.Filename, "since_finalize", since.String())
+		return nil, true, nil
+	}
+	if wavSkipped(closed.Metadata) {
+		logger.Warn("Finalized recording has no WAV to reopen, starting a new file", "file", recordingPath(closed.Metadata))
+		return nil, false, nil
+	}
+	metadata, err := reopenRecording(ctx, bucket, closed.Metadata)
+	if err != nil {
+		countGCSError("reopen")
+		logger.Error("Failed to reopen finalized recording", "file", closed.Metadata.Filename, "error", err)
+		return nil, false, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to reopen finalized recording: %v", err)}
+	}
+	// Only the first late chunk reopens the recording; the metadata is found after it
+	if err := store.Delete(ctx, closedPath(key), generation); err != nil && err != storage.ErrObjectNotExist {
+		logger.Warn("Failed to delete closed recording", "error", err)
+	}
+	logger.Info("Reopened finalized recording for a late chunk", "file", metadata.Filename, "since_finalize", since.String())
+	return metadata, false, nil
+}
+
+// reopenRecording restores the accumulator of the finalized WAV metadata describes
+// from the WAV's audio and returns metadata updated to match it. The audio is
+// streamed from the WAV's data section, past its header and short of any pad byte.
+func reopenRecording(ctx context.Context, bucket *storage.BucketHandle, metadata *WAVMetadata) (*WAVMetadata, error) {
+	wav := bucket.Object(metadata.Filename)
+	_, dataLen, err := readWAVHeader(ctx, wav)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", metadata.Filename, err)
+	}
+
+	accumulator := bucket.Object(pcmPath(metadata.Filename)).If(storage.Conditions{DoesNotExist: true})
+	attrs, err := streamObject(ctx, accumulator, "application/octet-stream", func() (io.ReadCloser, error) {
+		return wav.NewRangeReader(ctx, wavHeaderSize, int64(dataLen))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %v", pcmPath(metadata.Filename), err)
+	}
+
+	reopened := *metadata
+	reopened.CurrentSize = int(attrs.Size)
+	reopened.Checksum = attrs.CRC32C
+	reopened.ObjectGeneration = attrs.Generation
+	reopened.PendingBytes = nil
+	return &reopened, nil
+}
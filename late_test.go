@@ -0,0 +1,154 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// finalizeThenPostLate records a chunk for alice, finalizes it and posts a second
+// chunk a second later, returning the finalized file and the late chunk's response
+func finalizeThenPostLate(t *testing.T, f *fakeGCS, clock *fakeClock, first, late []byte) (string, int) {
+	t.Helper()
+	mustPost(t, "uid=alice", first)
+	filename := currentMetadata(t, f, "alice").Filename
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	clock.Advance(time.Second)
+	w := postAudio(t, "uid=alice", late)
+	if w.Code >= 300 {
+		t.Fatalf("late chunk answered %d: %s", w.Code, w.Body)
+	}
+	return filename, w.Code
+}
+
+func TestLateChunkStartsNewFile(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	first, late := tone(500*time.Millisecond, 16000), tone(250*time.Millisecond, 16000)
+
+	filename, status := finalizeThenPostLate(t, f, clock, first, late)
+	if status != http.StatusCreated {
+		t.Fatalf("late chunk answered %d, want %d", status, http.StatusCreated)
+	}
+	if current := currentMetadata(t, f, "alice"); current.Filename == filename || current.CurrentSize != len(late) {
+		t.Fatalf("late chunk went to %s holding %d bytes, want a new file", current.Filename, current.CurrentSize)
+	}
+	if _, dataLen := storedWAV(t, f, filename); dataLen != len(first) {
+		t.Fatalf("finalized file holds %d bytes, want %d", dataLen, len(first))
+	}
+}
+
+func TestLateChunkDropped(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &lateChunkPolicy, "drop")
+	setVar(t, &lateChunkGrace, 5*time.Second)
+	first, late := tone(500*time.Millisecond, 16000), tone(250*time.Millisecond, 16000)
+
+	filename, status := finalizeThenPostLate(t, f, clock, first, late)
+	if status != http.StatusOK || currentMetadata(t, f, "alice") != nil {
+		t.Fatalf("late chunk answered %d and left a session open, want it dropped", status)
+	}
+	if _, dataLen := storedWAV(t, f, filename); dataLen != len(first) {
+		t.Fatalf("finalized file holds %d bytes, want %d", dataLen, len(first))
+	}
+
+	// Past the grace window a chunk starts the next recording
+	clock.Advance(5 * time.Second)
+	if w := mustPost(t, "uid=alice", late); w.Code != http.StatusCreated {
+		t.Fatalf("chunk after the grace window answered %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestLateChunkReopens(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &lateChunkPolicy, "reopen")
+	setVar(t, &lateChunkGrace, 5*time.Second)
+	first, late := sine(440, 16000, 8000, 8000), sine(660, 16000, 4000, 8000)
+
+	filename, status := finalizeThenPostLate(t, f, clock, first, late)
+	if status != http.StatusOK {
+		t.Fatalf("late chunk answered %d, want %d", status, http.StatusOK)
+	}
+	if current := currentMetadata(t, f, "alice"); current == nil || current.Filename != filename || current.CurrentSize != len(first)+len(late) {
+		t.Fatalf("late chunk left session %+v, want %s reopened", current, filename)
+	}
+
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("second finalize answered %d: %s", w.Code, w.Body)
+	}
+	data, _ := f.get(filename)
+	if _, dataLen := storedWAV(t, f, filename); dataLen != len(first)+len(late) || !bytes.Equal(data[wavHeaderSize:], concat(first, late)) {
+		t.Fatalf("reopened file holds %d bytes, want the first and the late chunk", dataLen)
+	}
+	stored, _ := f.get(indexPath("alice"))
+	var index recordingIndex
+	if err := json.Unmarshal(stored, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Recordings) != 1 || index.Recordings[0].DurationSeconds != 0.75 {
+		t.Fatalf("index lists %+v, want the reopened recording once at 0.75s", index.Recordings)
+	}
+}
+
+// BenchmarkReopenRecording compares the memory taken to reopen a five minute
+// recording by streaming its audio into the accumulator with that taken by reading
+// the whole WAV into memory first, as reopening used to. The fake GCS allocates in
+// the same process, so the difference between the two is what streaming saves.
+func BenchmarkReopenRecording(b *testing.B) {
+	f := newFakeGCS(b)
+	ctx, bucket := context.Background(), f.bucket()
+	metadata := &WAVMetadata{Filename: "alice/2024-05-01T12-00-00Z.wav"}
+	pcm := tone(5*time.Minute, 16000)
+	header, _ := createWAVHeader(len(pcm), 16000, 1, 16, false)
+	f.put(metadata.Filename, concat(header, pcm))
+
+	buffered := func() error {
+		reader, err := bucket.Object(metadata.Filename).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		wav, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		_, data, err := stripWAVHeader(wav)
+		if err != nil {
+			return err
+		}
+		_, err = writeObject(ctx, bucket.Object(pcmPath(metadata.Filename)), "application/octet-stream", data)
+		return err
+	}
+	streamed := func() error {
+		_, err := reopenRecording(ctx, bucket, metadata)
+		return err
+	}
+
+	for _, bm := range []struct {
+		name   string
+		reopen func() error
+	}{
+		{"buffered", buffered},
+		{"streamed", streamed},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				f.mu.Lock()
+				delete(f.objects, pcmPath(metadata.Filename))
+				f.mu.Unlock()
+				if err := bm.reopen(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package function
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// listPageSize is how many objects are listed per page by HandleList
+const listPageSize = 100
+
+// listedRecording describes one finalized recording found by HandleList
+type listedRecording struct {
+	Filename        string    `json:"filename"`
+	CreatedAt       time.Time `json:"created_at"`
+	Size            int64     `json:"size"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+}
+
+// listResponse is the JSON body returned by HandleList
+type listResponse struct {
+	Status     string            `json:"status"`
+	Recordings []listedRecording `json:"recordings"`
+	// NextPageToken is passed back as page_token to fetch the next page, and is
+	// empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// HandleList lists the finalized recordings of uid by iterating the bucket, unlike
+// HandleListRecordings which reads the index, so it also finds recordings that were
+// never indexed. Results come one page of listed objects at a time: pass the
+// returned next_page_token as page_token to continue. The optional from and to
+// params, RFC 3339 timestamps, keep only recordings created in [from, to); since
+// they filter each page after it is listed, a page may hold fewer recordings than
+// listPageSize, or none, while more pages remain. The fields param and gzip are
+// handled by writeQueryJSON.
+func HandleList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	query := r.URL.Query()
+	uid := query.Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received bucket list request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting bucket list with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+
+	from, err := parseListTime(query.Get("from"), "from")
+	if err != nil {
+		logger.Warn("Invalid query parameter", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseListTime(query.Get("to"), "to")
+	if err != nil {
+		logger.Warn("Invalid query parameter", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// List requests carry no body, so the signature covers only uid and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, uid, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated bucket list", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	prefix, scoped := filePathTemplate.prefix(uid)
+	if !scoped {
+		writeError(w, http.StatusNotImplemented, "Listing requires PATH_TEMPLATE to place {uid} before any time token")
+		return
+	}
+
+	bucket, err := openBucket(bucketOverride(query, r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	var page []*storage.ObjectAttrs
+	token, err := iterator.NewPager(it, listPageSize, query.Get("page_token")).NextPage(&page)
+	if err != nil {
+		logger.Error("Failed to list objects", "prefix", prefix, "error", err)
+		writeServerError(ctx, w, "Failed to list objects")
+		return
+	}
+
+	response := listResponse{Status: "ok", Recordings: []listedRecording{}, NextPageToken: token}
+	for _, attrs := range page {
+		if recording, ok := uidRecording(attrs, uid, from, to); ok {
+			response.Recordings = append(response.Recordings, recording)
+		}
+	}
+
+	logger.Info("Listed recordings", "count", len(response.Recordings), "more", token != "")
+	writeQueryJSON(ctx, w, r, response)
+}
+
+// parseListTime parses the RFC 3339 timestamp in the param named name, returning the
+// zero time when it is absent
+func parseListTime(param, name string) (time.Time, error) {
+	if param == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, expected an RFC 3339 timestamp", name, param)
+	}
+	return t, nil
+}
+
+// uidRecording describes the object attrs, listed under the prefix of uid's files,
+// reporting whether it is a finalized recording of uid created in [from, to), where
+// a zero bound is open
+func uidRecording(attrs *storage.ObjectAttrs, uid string, from, to time.Time) (listedRecording, bool) {
+	switch path.Ext(attrs.Name) {
+	case ".wav", ".flac", ".raw":
+	default:
+		return listedRecording{}, false
+	}
+	// A prefix such as "{uid}_" is shared with longer uids, whose recordings are
+	// told apart by their uid tag
+	if owner, ok := attrs.Metadata["uid"]; ok && owner != uid {
+		return listedRecording{}, false
+	}
+	recording := listRecording(attrs)
+	if (!from.IsZero() && recording.CreatedAt.Before(from)) || (!to.IsZero() && !recording.CreatedAt.Before(to)) {
+		return listedRecording{}, false
+	}
+	return recording, true
+}
+
+// listRecording describes the recording stored as attrs. The creation time is taken
+// from the created_at tag of recordingTags, then from a name in isoFilenameLayout,
+// then from the object's creation. The duration is only known for WAV and raw PCM
+// files.
+func listRecording(attrs *storage.ObjectAttrs) listedRecording {
+	recording := listedRecording{Filename: attrs.Name, Size: attrs.Size, CreatedAt: attrs.Created}
+
+	base := strings.TrimSuffix(path.Base(attrs.Name), path.Ext(attrs.Name))
+	if t, err := time.Parse(time.RFC3339, attrs.Metadata["created_at"]); err == nil {
+		recording.CreatedAt = t
+	} else if t, err := time.Parse(isoFilenameLayout, base); err == nil {
+		recording.CreatedAt = t
+	}
+
+	sampleRate, channels, bits := tagInt(attrs, "sample_rate", defaultSampleRate), tagInt(attrs, "channels", defaultChannels), tagInt(attrs, "bits", defaultBitsPerSample)
+	switch path.Ext(attrs.Name) {
+	case ".wav":
+		recording.DurationSeconds = calculateDuration(wavDataSize(attrs.Size), sampleRate, channels, bits).Seconds()
+	case ".raw":
+		recording.DurationSeconds = calculateDuration(int(attrs.Size), sampleRate, channels, bits).Seconds()
+	}
+	return recording
+}
+
+// tagInt returns the integer custom metadata named key of attrs, or fallback when it
+// is absent or not a positive number
+func tagInt(attrs *storage.ObjectAttrs, key string, fallback int) int {
+	if n, err := strconv.Atoi(attrs.Metadata[key]); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
@@ -0,0 +1,146 @@
+package function
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// putRecordings stores n one-second WAV recordings of alice started a minute apart
+// from testStart, along with bookkeeping objects that the listing must skip
+func putRecordings(t *testing.T, f *fakeGCS, n int) {
+	t.Helper()
+	pcm := tone(time.Second, 16000)
+	header, _ := createWAVHeader(len(pcm), 16000, 1, 16, false)
+	for i := 0; i < n; i++ {
+		filename := filePathTemplate.render("alice", testStart.Add(time.Duration(i)*time.Minute))
+		f.put(filename, append(header, pcm...))
+		f.put(sidecarPath(filename), []byte("{}"))
+	}
+	f.put(pcmPath(filePathTemplate.render("alice", testStart.Add(-time.Hour))), pcm)
+}
+
+// list calls HandleList with query and decodes its page
+func list(t *testing.T, query url.Values) listResponse {
+	t.Helper()
+	w := serve(t, HandleList, http.MethodGet, "/?"+query.Encode(), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d: %s", w.Code, w.Body)
+	}
+	var page listResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestListPagination(t *testing.T) {
+	f := newFakeGCS(t)
+	putRecordings(t, f, 60)
+
+	// Each recording has a sidecar, so 60 recordings span more than one page
+	query := url.Values{"uid": {"alice"}}
+	var listed []listedRecording
+	pages := 0
+	for {
+		page := list(t, query)
+		listed = append(listed, page.Recordings...)
+		pages++
+		if page.NextPageToken == "" {
+			break
+		}
+		query.Set("page_token", page.NextPageToken)
+	}
+
+	if pages < 2 || len(listed) != 60 {
+		t.Fatalf("listed %d recordings over %d pages, want 60 over several", len(listed), pages)
+	}
+	for i, recording := range listed {
+		if want := testStart.Add(time.Duration(i) * time.Minute); !recording.CreatedAt.Equal(want) {
+			t.Fatalf("recording %d created at %v, want %v", i, recording.CreatedAt, want)
+		}
+		if recording.DurationSeconds != 1 || recording.Size != int64(wavObjectSize(32000)) {
+			t.Fatalf("recording %d = %+v", i, recording)
+		}
+	}
+}
+
+func TestListDateRange(t *testing.T) {
+	f := newFakeGCS(t)
+	putRecordings(t, f, 10)
+
+	page := list(t, url.Values{
+		"uid":  {"alice"},
+		"from": {testStart.Add(3 * time.Minute).Format(time.RFC3339)},
+		"to":   {testStart.Add(6 * time.Minute).Format(time.RFC3339)},
+	})
+	if len(page.Recordings) != 3 {
+		t.Fatalf("listed %d recordings in [3m, 6m), want 3", len(page.Recordings))
+	}
+	for i, recording := range page.Recordings {
+		if want := testStart.Add(time.Duration(3+i) * time.Minute); !recording.CreatedAt.Equal(want) {
+			t.Fatalf("recording %d created at %v, want %v", i, recording.CreatedAt, want)
+		}
+	}
+
+	if w := serve(t, HandleList, http.MethodGet, "/?uid=alice&from=yesterday", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid from answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListProjectsFields(t *testing.T) {
+	f := newFakeGCS(t)
+	putRecordings(t, f, 2)
+
+	w := serve(t, HandleList, http.MethodGet, "/?uid=alice&fields=recordings.filename,missing", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d: %s", w.Code, w.Body)
+	}
+	var page map[string][]map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("projected list %s: %v", w.Body, err)
+	}
+	if len(page) != 1 || len(page["recordings"]) != 2 {
+		t.Fatalf("projected list = %s, want only the two recordings", w.Body)
+	}
+	for _, recording := range page["recordings"] {
+		if _, ok := recording["filename"].(string); !ok || len(recording) != 1 {
+			t.Errorf("projected recording = %v, want only its filename", recording)
+		}
+	}
+}
+
+func TestListGzip(t *testing.T) {
+	f := newFakeGCS(t)
+	putRecordings(t, f, 3)
+	server := httptest.NewServer(http.HandlerFunc(HandleList))
+	defer server.Close()
+
+	// Setting Accept-Encoding stops the transport from decompressing transparently
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/?uid=alice", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("response has Content-Encoding %q and Vary %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	body, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page listResponse
+	if err := json.NewDecoder(body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if want := list(t, url.Values{"uid": {"alice"}}); !reflect.DeepEqual(page, want) {
+		t.Fatalf("gzipped list = %+v, want %+v", page, want)
+	}
+}
@@ -0,0 +1,105 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// lockPrefix holds the lock object of each session being written while
+// WRITE_LOCK_TIMEOUT is set
+const lockPrefix = "locks/"
+
+// lockReleaseTimeout bounds releasing a lock, which runs after the request's own
+// context may have expired
+const lockReleaseTimeout = 5 * time.Second
+
+// errLockBusy is returned by acquireLock when another request held the lock for the
+// whole of WRITE_LOCK_TIMEOUT
+var errLockBusy = errors.New("session is locked by another write")
+
+// Generation preconditions keep each single object consistent, but a chunk touches
+// several: the metadata, the accumulator, the sequence counter and, on rollover, the
+// finished file. With WRITE_LOCK_TIMEOUT set, writes to a session also take a lock
+// object, created only if absent, so a second instance waits for the first to finish
+// instead of interleaving with it. A lock outlives its holder only until it is older
+// than GCS_TIMEOUT, the longest a holder can still be working, after which the next
+// request breaks it.
+
+// lockPath returns the name of the lock object of session key
+func lockPath(key string) string {
+	return lockPrefix + key
+}
+
+// acquireLock takes the lock of session key, waiting up to WRITE_LOCK_TIMEOUT for
+// its holder to release it, and returns the function that releases it. With no
+// WRITE_LOCK_TIMEOUT it takes nothing.
+func acquireLock(ctx context.Context, store objectStore, key string) (release func(), err error) {
+	if writeLockTimeout == 0 {
+		return func() {}, nil
+	}
+
+	logger := loggerFrom(ctx)
+	name := lockPath(key)
+	deadline := time.Now().Add(writeLockTimeout)
+	// The lock holds a token of its own, so a retried write that finds the lock taken
+	// can tell whether its own first attempt took it
+	owner := []byte(nowFunc().UTC().Format(time.RFC3339Nano) + " " + newRequestID())
+	for attempt := 0; ; attempt++ {
+		generation, created, err := createOwned(ctx, store, name, "text/plain", owner)
+		if err != nil {
+			return nil, fmt.Errorf("failed to take session lock: %v", err)
+		}
+		if created {
+			return func() {
+				releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+				defer cancel()
+				if err := store.Delete(releaseCtx, name, generation); err != nil && err != storage.ErrObjectNotExist {
+					logger.Warn("Failed to release session lock", "lock", name, "error", err)
+				}
+			}, nil
+		}
+
+		attrs, err := store.Attrs(ctx, name)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return nil, fmt.Errorf("failed to read session lock: %v", err)
+		}
+		if err == nil && nowFunc().Sub(attrs.Created) > gcsTimeout {
+			logger.Warn("Breaking a stale session lock", "lock", name, "created", attrs.Created)
+			if err := store.Delete(ctx, name, attrs.Generation); err != nil && err != storage.ErrObjectNotExist && !isPreconditionFailed(err) {
+				return nil, fmt.Errorf("failed to break stale session lock: %v", err)
+			}
+			continue
+		}
+
+		wait := casBackoff(attempt + 1)
+		if time.Now().Add(wait).After(deadline) {
+			logger.Warn("Session lock is busy", "lock", name, "waited", writeLockTimeout.String())
+			return nil, errLockBusy
+		}
+		time.Sleep(wait)
+	}
+}
+
+// acquireLocks takes the locks of every session in keys, in order, and returns the
+// function that releases them all. On failure the locks already taken are released.
+func acquireLocks(ctx context.Context, store objectStore, keys []string) (release func(), err error) {
+	var releases []func()
+	release = func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	for _, key := range keys {
+		r, err := acquireLock(ctx, store, key)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
@@ -0,0 +1,79 @@
+package function
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Logs are written to stdout as one JSON object per line, which Cloud Logging turns
+// into structured entries that can be filtered by severity and by any attribute. Each
+// request logs through its own logger, carried in its context, so every line it
+// writes shares the same request_id, uid and, once known, object.
+
+// maxRequestIDLength bounds the client-supplied X-Request-ID that is adopted
+const maxRequestIDLength = 128
+
+// loggerKey is the context key under which the request's logger is stored
+type loggerKey struct{}
+
+// initLogging makes a JSON handler using Cloud Logging's field names the default, so
+// both slog and the standard log package emit structured lines
+func initLogging() {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{ReplaceAttr: cloudLoggingAttr})
+	slog.SetDefault(slog.New(handler))
+}
+
+// cloudLoggingAttr renames the level and message attributes to the severity and
+// message fields Cloud Logging recognizes
+func cloudLoggingAttr(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return attr
+	}
+	switch attr.Key {
+	case slog.LevelKey:
+		attr.Key = "severity"
+		if level, ok := attr.Value.Any().(slog.Level); ok && level == slog.LevelWarn {
+			attr.Value = slog.StringValue("WARNING")
+		}
+	case slog.MessageKey:
+		attr.Key = "message"
+	}
+	return attr
+}
+
+// startRequestLog returns ctx carrying a logger tagged with the request ID of r, taken
+// from X-Request-ID when the client sent one and generated otherwise. The ID is echoed
+// in the X-Request-ID response header so clients can quote it.
+func startRequestLog(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, *slog.Logger) {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return logWith(ctx, "request_id", id)
+}
+
+// logWith returns ctx carrying its logger extended with args, along with that logger
+func logWith(ctx context.Context, args ...any) (context.Context, *slog.Logger) {
+	logger := loggerFrom(ctx).With(args...)
+	return context.WithValue(ctx, loggerKey{}, logger), logger
+}
+
+// loggerFrom returns the logger carried by ctx, or the default logger outside a request
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// newRequestID returns a random 16-character hex request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
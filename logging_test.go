@@ -0,0 +1,80 @@
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the default logger's JSON lines to the returned buffer for the
+// rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: cloudLoggingAttr})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+// logLines decodes each JSON line written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestRequestIDOnEveryLogLine(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	buf := captureLogs(t)
+
+	w := mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	id := w.Header().Get("X-Request-ID")
+	if len(id) != 16 {
+		t.Fatalf("X-Request-ID = %q, want a generated 16-character ID", id)
+	}
+	lines := logLines(t, buf)
+	if len(lines) < 2 {
+		t.Fatalf("request logged %d lines, want several", len(lines))
+	}
+	for _, entry := range lines {
+		if entry["request_id"] != id {
+			t.Errorf("line %v has request_id %v, want %s", entry["message"], entry["request_id"], id)
+		}
+		if entry["severity"] == nil || entry["message"] == nil {
+			t.Errorf("line %v lacks the Cloud Logging severity or message field", entry)
+		}
+	}
+}
+
+func TestRequestIDFromClient(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	buf := captureLogs(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/?uid=alice", bytes.NewReader(tone(100*time.Millisecond, 16000)))
+	req.Header.Set("X-Request-ID", "trace-1234")
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, req)
+
+	if got := w.Header().Get("X-Request-ID"); got != "trace-1234" {
+		t.Fatalf("X-Request-ID = %q, want the client's", got)
+	}
+	for _, entry := range logLines(t, buf) {
+		if entry["request_id"] != "trace-1234" {
+			t.Fatalf("line %v has request_id %v, want the client's", entry["message"], entry["request_id"])
+		}
+	}
+}
@@ -1,98 +1,601 @@
 package function
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 const (
-	numChannels      = 1    // Mono audio
-	sampleRate       = 16000
-	bitsPerSample    = 16   // 16 bits per sample
-	maxDuration      = 60 * time.Minute
-	inactivityLimit  = 2 * time.Minute
-	metadataFile     = "current_wav_metadata.json"
+	defaultChannels          = 1 // Mono audio
+	fallbackSampleRate       = 16000
+	defaultBitsPerSample     = 16 // 16 bits per sample
+	fallbackMaxDuration      = 60 * time.Minute
+	fallbackInactivityLimit  = 2 * time.Minute
+	fallbackMaxBodyBytes     = 10 << 20
+	fallbackSilenceThreshold = 500
+	fallbackMinSilence       = time.Second
+	fallbackGCSTimeout       = 30 * time.Second
+	fallbackDeleteTimeout    = 10 * time.Minute
+	fallbackMaxFileBytes     = math.MaxUint32 - 1024 // RIFF sizes are 32-bit
+	fallbackGCSMaxRetries    = 3
+	fallbackNormalizeTarget  = -1.0
+	fallbackPairMaxSkew      = 2 * time.Second
+	fallbackLateChunkGrace   = 30 * time.Second
+	fallbackFingerprintMax   = time.Minute
+	fallbackS3Region         = "us-east-1"
+	metadataPrefix           = "metadata/"
+	sequencePrefix           = "sequences/"
 )
 
+// maxCASAttempts bounds the compare-and-swap retries against GCS generation preconditions
+const maxCASAttempts = 10
+
+// defaultNewFileWindow is used when NEW_FILE_WINDOW is unset or invalid
+const defaultNewFileWindow = 10 * time.Second
+
 type WAVMetadata struct {
 	Filename      string    `json:"filename"`
+	StartTime     time.Time `json:"start_time"`
 	LastWriteTime time.Time `json:"last_write_time"`
 	CurrentSize   int       `json:"current_size"`
+	SampleRate    int       `json:"sample_rate"`
+	Channels      int       `json:"channels"`
+	BitsPerSample int       `json:"bits_per_sample"`
+	Sequence      int64     `json:"sequence"`
+	// Float marks 32-bit samples as IEEE float rather than integer PCM
+	Float bool `json:"float,omitempty"`
+	// DeviceID identifies the capturing device, when the client supplied one
+	DeviceID string `json:"device_id,omitempty"`
+	// ObjectGeneration is the GCS generation of the WAV object CurrentSize describes
+	ObjectGeneration int64 `json:"object_generation"`
+	// PendingBytes holds a trailing partial sample carried over to the next chunk
+	PendingBytes []byte `json:"pending_bytes,omitempty"`
+	// LastClientSeq is the last client-supplied seq applied to this session
+	LastClientSeq *int64 `json:"last_client_seq,omitempty"`
+	// Checksum is the running CRC32C of the PCM stored for the file
+	Checksum uint32 `json:"crc32c,omitempty"`
+	// TrailingSilence is how many bytes of quiet audio end the file, tracked while
+	// SEGMENT_ON_SILENCE is on so a gap can span several chunks
+	TrailingSilence int `json:"trailing_silence,omitempty"`
+	// Language is the BCP-47 tag of the spoken language the client hinted with lang
+	Language string `json:"language,omitempty"`
+}
+
+// fileSampleRate returns the sample rate of the file, treating metadata written
+// before the rate was recorded as the original hardcoded rate
+func (m *WAVMetadata) fileSampleRate() int {
+	if m.SampleRate == 0 {
+		return fallbackSampleRate
+	}
+	return m.SampleRate
 }
 
-// calculateDuration returns the duration of audio based on size in bytes
-func calculateDuration(sizeInBytes int) time.Duration {
-	bytesPerSecond := sampleRate * numChannels * bitsPerSample / 8
+// fileChannels returns the channel count of the file, treating metadata written
+// before channels were recorded as mono
+func (m *WAVMetadata) fileChannels() int {
+	if m.Channels == 0 {
+		return defaultChannels
+	}
+	return m.Channels
+}
+
+// fileBits returns the bits per sample of the file, treating metadata written before
+// the depth was recorded as 16-bit
+func (m *WAVMetadata) fileBits() int {
+	if m.BitsPerSample == 0 {
+		return defaultBitsPerSample
+	}
+	return m.BitsPerSample
+}
+
+// format returns the sample format of the file, as its WAV header records it
+func (m *WAVMetadata) format() wavFormat {
+	return wavFormat{sampleRate: m.fileSampleRate(), channels: m.fileChannels(), bits: m.fileBits(), float: m.Float}
+}
+
+// sequenceCounter is the shared per-file chunk counter stored in GCS
+type sequenceCounter struct {
+	Filename string `json:"filename"`
+	Sequence int64  `json:"sequence"`
+}
+
+// nowFunc reads the clock for every decision that depends on the time of day or on
+// the age of stored state, such as rollover, naming and expiry, so it can be replaced
+// by a fixed clock. Latency measurements and I/O deadlines use time.Now directly.
+var nowFunc = time.Now
+
+// appendStats tracks how many existing bytes the append path re-reads for each
+// new byte it stores, accumulated over the lifetime of this instance
+var appendStats struct {
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+// recordAppend adds one append to appendStats and logs its read amplification
+func recordAppend(ctx context.Context, bytesRead, bytesWritten int) {
+	totalRead := appendStats.bytesRead.Add(int64(bytesRead))
+	totalWritten := appendStats.bytesWritten.Add(int64(bytesWritten))
+	loggerFrom(ctx).Info("Append read amplification",
+		"bytes_read", bytesRead,
+		"bytes_written", bytesWritten,
+		"ratio", readAmplification(int64(bytesRead), int64(bytesWritten)),
+		"instance_ratio", readAmplification(totalRead, totalWritten))
+}
+
+// readAmplification returns bytes read per new byte written
+func readAmplification(bytesRead, bytesWritten int64) float64 {
+	if bytesWritten == 0 {
+		return 0
+	}
+	return float64(bytesRead) / float64(bytesWritten)
+}
+
+// calculateDuration returns the duration of sizeInBytes of audio data in the given
+// format. sizeInBytes counts samples only; for a stored WAV object, subtract
+// wavHeaderSize first, as wavDataSize does.
+func calculateDuration(sizeInBytes, sampleRate, channels, bits int) time.Duration {
+	bytesPerSecond := sampleRate * channels * bits / 8
 	seconds := float64(sizeInBytes) / float64(bytesPerSecond)
 	return time.Duration(seconds * float64(time.Second))
 }
 
-// getStorageClient creates a new Google Cloud Storage client
-func getStorageClient(ctx context.Context) (*storage.Client, error) {
+// storageClient caches the GCS client across warm invocations, along with the
+// encoded credentials it was built from so a credential change builds a new one
+var storageClient struct {
+	sync.Mutex
+	client *storage.Client
+	creds  string
+}
+
+// getStorageClient returns the shared Google Cloud Storage client, creating it on
+// first use or when the credentials have changed since it was created
+func getStorageClient() (*storage.Client, error) {
 	credsEnv := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")
 	if credsEnv == "" {
-		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS_JSON environment variable is not set")
+		return nil, fmt.Errorf("%w: GOOGLE_APPLICATION_CREDENTIALS_JSON environment variable is not set", errStorageNotConfigured)
 	}
 
+	storageClient.Lock()
+	defer storageClient.Unlock()
+	if storageClient.client != nil && storageClient.creds == credsEnv {
+		return storageClient.client, nil
+	}
+
+	client, err := newStorageClient(credsEnv)
+	if err != nil {
+		return nil, err
+	}
+	// The previous client is left open since in-flight requests may still be using it
+	storageClient.client = client
+	storageClient.creds = credsEnv
+	return client, nil
+}
+
+// newStorageClient creates a Google Cloud Storage client from base64-encoded
+// service account credentials, passed to the client directly so the key never
+// touches disk. The client outlives the request that triggered its creation, so it
+// is not tied to the request context.
+func newStorageClient(credsEnv string) (*storage.Client, error) {
 	creds, err := base64.StdEncoding.DecodeString(credsEnv)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode credentials: %v", err)
+		return nil, fmt.Errorf("%w: GOOGLE_APPLICATION_CREDENTIALS_JSON is not valid base64: %v", errStorageNotConfigured, err)
+	}
+
+	client, err := storage.NewClient(context.Background(), option.WithCredentialsJSON(creds))
+	if err != nil {
+		return nil, fmt.Errorf("%w: GOOGLE_APPLICATION_CREDENTIALS_JSON does not hold usable credentials: %v", errStorageNotConfigured, err)
 	}
+	return client, nil
+}
 
-	credsFile, err := os.CreateTemp("", "gcs-creds-*.json")
+// checkStorageConfig logs the problem with GCS_BUCKET_NAME or
+// GOOGLE_APPLICATION_CREDENTIALS_JSON, if any, at cold start, so a misconfigured
+// deployment shows up in the logs before its first request fails
+func checkStorageConfig() {
+	if os.Getenv("GCS_BUCKET_NAME") == "" {
+		slog.Error("Storage is not configured: GCS_BUCKET_NAME environment variable is not set")
+	}
+	credsEnv := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")
+	if credsEnv == "" {
+		slog.Error("Storage is not configured: GOOGLE_APPLICATION_CREDENTIALS_JSON environment variable is not set")
+		return
+	}
+	if _, err := base64.StdEncoding.DecodeString(credsEnv); err != nil {
+		slog.Error("Storage is not configured: GOOGLE_APPLICATION_CREDENTIALS_JSON is not valid base64", "error", err)
+	}
+}
+
+// errStorageNotConfigured is returned by openBucket when the environment does not
+// configure access to GCS: the bucket name or credentials are missing or malformed
+var errStorageNotConfigured = errors.New("storage is not configured")
+
+// errBucketNotAllowed is returned by openBucket for an override outside ALLOWED_BUCKETS
+var errBucketNotAllowed = errors.New("bucket is not allowed")
+
+// bucketOverride returns the destination bucket requested through the bucket param
+// or the X-Bucket header, or "" when the request did not ask for one
+func bucketOverride(query url.Values, header http.Header) string {
+	if name := query.Get("bucket"); name != "" {
+		return name
+	}
+	return header.Get("X-Bucket")
+}
+
+// openBucket returns the bucket named by override on the shared storage client,
+// falling back to GCS_BUCKET_NAME when override is empty. Overrides must be listed
+// in ALLOWED_BUCKETS so tenants can't direct writes at arbitrary buckets.
+func openBucket(override string) (*storage.BucketHandle, error) {
+	bucketName := os.Getenv("GCS_BUCKET_NAME")
+	if override != "" && override != bucketName {
+		if !slices.Contains(allowedBuckets, override) {
+			return nil, fmt.Errorf("%w: %s", errBucketNotAllowed, override)
+		}
+		bucketName = override
+	}
+	if bucketName == "" {
+		return nil, fmt.Errorf("%w: GCS_BUCKET_NAME environment variable is not set", errStorageNotConfigured)
+	}
+
+	client, err := getStorageClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file for credentials: %v", err)
+		return nil, fmt.Errorf("Failed to create storage client: %w", err)
+	}
+	return client.Bucket(bucketName), nil
+}
+
+// writeBucketError answers a failed openBucket or probeBucket: 403 for a disallowed
+// bucket, 502 for a bucket that is missing or denied to the function and 503 when
+// storage is not configured. Configuration details are meant for operators, so they
+// are logged rather than returned to the client.
+func writeBucketError(ctx context.Context, w http.ResponseWriter, err error) {
+	logger := loggerFrom(ctx)
+	switch {
+	case errors.Is(err, errBucketNotAllowed):
+		logger.Warn("Rejecting request for a disallowed bucket", "error", err)
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, errStorageNotConfigured):
+		logger.Error("Storage is not configured", "error", err)
+		writeError(w, http.StatusServiceUnavailable, "Storage is not configured, see the function logs")
+	case errors.Is(err, errBucketNotFound):
+		logger.Error("Bucket is unreachable", "error", err)
+		writeError(w, http.StatusBadGateway, "Bucket unreachable: the bucket does not exist, see the function logs")
+	case errors.Is(err, errBucketAccessDenied):
+		logger.Error("Bucket is unreachable", "error", err)
+		writeError(w, http.StatusBadGateway, "Bucket unreachable: permission denied, see the function logs")
+	default:
+		logger.Error("Failed to open bucket", "error", err)
+		writeServerError(ctx, w, "Failed to open bucket")
+	}
+}
+
+// errBucketNotFound is returned by probeBucket when the bucket does not exist
+var errBucketNotFound = errors.New("bucket does not exist")
+
+// errBucketAccessDenied is returned by probeBucket when the function's credentials
+// may not list the bucket
+var errBucketAccessDenied = errors.New("bucket is not accessible")
+
+// probedBuckets holds the name of each bucket probeBucket has reached on this instance
+var probedBuckets sync.Map
+
+// probeBucket checks that bucket exists and that the function may use it, so a
+// misconfigured GCS_BUCKET_NAME or bucket override fails with a clear error instead
+// of a generic one deep in a write. Listing is probed rather than the bucket's
+// attributes, which the object roles a function usually runs with cannot read. A
+// bucket is probed until it is first reached, then trusted for the instance's life.
+func probeBucket(ctx context.Context, bucket *storage.BucketHandle) error {
+	name := bucket.BucketName()
+	if _, ok := probedBuckets.Load(name); ok {
+		return nil
 	}
-	defer os.Remove(credsFile.Name())
 
-	if _, err := credsFile.Write(creds); err != nil {
-		return nil, fmt.Errorf("failed to write credentials to temp file: %v", err)
+	_, err := bucket.Objects(ctx, &storage.Query{Prefix: metadataPrefix}).Next()
+	var gErr *googleapi.Error
+	switch {
+	case err == nil || err == iterator.Done:
+		probedBuckets.Store(name, true)
+		return nil
+	case err == storage.ErrBucketNotExist:
+		return fmt.Errorf("%w: %s", errBucketNotFound, name)
+	case errors.As(err, &gErr) && (gErr.Code == http.StatusForbidden || gErr.Code == http.StatusUnauthorized):
+		return fmt.Errorf("%w: %s: %v", errBucketAccessDenied, name, err)
 	}
-	credsFile.Close()
+	return fmt.Errorf("failed to probe bucket %s: %w", name, err)
+}
+
+// reservedUIDs are the names a uid can't take: the folders holding the function's
+// own bookkeeping, which the files and deletes of such a uid would reach into, and
+// the relative path segments
+var reservedUIDs = map[string]bool{
+	".":                                      true,
+	"..":                                     true,
+	strings.TrimSuffix(metadataPrefix, "/"):  true,
+	strings.TrimSuffix(sequencePrefix, "/"):  true,
+	strings.TrimSuffix(lockPrefix, "/"):      true,
+	strings.TrimSuffix(finalizedPrefix, "/"): true,
+	strings.TrimSuffix(dedupPrefix, "/"):     true,
+	strings.TrimSuffix(pairPrefix, "/"):      true,
+	strings.TrimSuffix(closedPrefix, "/"):    true,
+	strings.TrimSuffix(playlistPrefix, "/"):  true,
+}
 
-	return storage.NewClient(ctx, option.WithCredentialsFile(credsFile.Name()))
+// validUID reports whether uid can be used as an object name prefix
+func validUID(uid string) bool {
+	return uid != "" && !strings.Contains(uid, "/") && !reservedUIDs[uid]
 }
 
-// getCurrentMetadata retrieves the current WAV metadata from GCS
-func getCurrentMetadata(ctx context.Context, bucket *storage.BucketHandle) (*WAVMetadata, error) {
-	obj := bucket.Object(metadataFile)
-	r, err := obj.NewReader(ctx)
+// metadataPath returns the name of the metadata object for uid
+func metadataPath(uid string) string {
+	return metadataPrefix + uid + ".json"
+}
+
+// sequencePath returns the name of the sequence counter object for uid
+func sequencePath(uid string) string {
+	return sequencePrefix + uid + ".json"
+}
+
+// getCurrentMetadata retrieves the current WAV metadata for uid from GCS along with
+// the generation of the metadata object (0 when it does not exist)
+func getCurrentMetadata(ctx context.Context, store objectStore, uid string) (*WAVMetadata, int64, error) {
+	data, generation, err := store.Read(ctx, metadataPath(uid))
 	if err == storage.ErrObjectNotExist {
-		return nil, nil
+		return nil, 0, nil
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata: %v", err)
+		return nil, 0, fmt.Errorf("failed to read metadata: %v", err)
 	}
-	defer r.Close()
 
 	var metadata WAVMetadata
-	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
-		return nil, fmt.Errorf("failed to decode metadata: %v", err)
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode metadata: %v", err)
 	}
 
-	return &metadata, nil
+	return &metadata, generation, nil
 }
 
-// updateMetadata saves the current WAV metadata to GCS
-func updateMetadata(ctx context.Context, bucket *storage.BucketHandle, metadata *WAVMetadata) error {
-	obj := bucket.Object(metadataFile)
-	writer := obj.NewWriter(ctx)
-	if err := json.NewEncoder(writer).Encode(metadata); err != nil {
-		writer.Close()
+// reconcileMetadata checks decoded metadata against the PCM accumulator it describes
+// and repairs obviously-bad state. METADATA_RECOVERY=reset discards inconsistent metadata
+// so a fresh file is started; the default "repair" mode fixes the offending fields.
+// Returns nil when the metadata should be treated as absent.
+func reconcileMetadata(ctx context.Context, bucket *storage.BucketHandle, metadata *WAVMetadata) (*WAVMetadata, error) {
+	if metadata == nil {
+		return nil, nil
+	}
+	resetOnError := os.Getenv("METADATA_RECOVERY") == "reset"
+	logger := loggerFrom(ctx)
+
+	accumulator := pcmPath(metadata.Filename)
+	attrs, err := bucket.Object(accumulator).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		if err := recoverCorruptWAV(ctx, bucket, metadata.Filename); err != nil {
+			return nil, err
+		}
+		logger.Warn("Metadata recovery: accumulator does not exist, resetting metadata", "accumulator", accumulator, "before", fmt.Sprintf("%+v", *metadata))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attributes of %s: %v", accumulator, err)
+	}
+	if frameSize := int64(metadata.fileChannels() * metadata.fileBits() / 8); attrs.Size%frameSize != 0 {
+		// A torn accumulator cannot be appended to without misaligning every later
+		// sample, so it is set aside and the next chunk starts a new file
+		logger.Warn("Metadata recovery: accumulator is not a whole number of frames, archiving it and starting a new file", "accumulator", accumulator, "size", attrs.Size, "frame_size", frameSize)
+		if err := archiveCorrupt(ctx, bucket, accumulator); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	repaired := *metadata
+	changed := false
+	if repaired.CurrentSize < 0 {
+		logger.Warn("Metadata recovery: negative current_size", "file", repaired.Filename, "before", repaired.CurrentSize, "after", 0)
+		repaired.CurrentSize = 0
+		changed = true
+	}
+	if now := nowFunc(); repaired.LastWriteTime.After(now) {
+		logger.Warn("Metadata recovery: future last_write_time", "file", repaired.Filename, "before", repaired.LastWriteTime, "after", now)
+		repaired.LastWriteTime = now
+		changed = true
+	}
+	// With STREAMING_MODE=lazy the file continues past the accumulator in segments,
+	// and the metadata is taken to be current up to its size. Eager appends compose
+	// onto the accumulator, so segments stored before the mode changed are folded in.
+	actualSize, checksum := int(attrs.Size), attrs.CRC32C
+	if streamingMode == "lazy" && repaired.CurrentSize >= actualSize {
+		unrecorded, err := unrecordedSegments(ctx, bucket, metadata.Filename, int64(repaired.CurrentSize))
+		if err != nil {
+			return nil, err
+		}
+		actualSize, checksum = repaired.CurrentSize+int(unrecorded), 0
+	} else if streamingMode == "eager" && repaired.CurrentSize > actualSize {
+		if attrs, err = foldSegments(ctx, bucket, metadata.Filename, attrs); err != nil {
+			return nil, err
+		}
+		actualSize, checksum = int(attrs.Size), attrs.CRC32C
+	}
+	if repaired.CurrentSize != actualSize {
+		logger.Warn("Metadata recovery: current_size does not match the stored audio", "accumulator", accumulator, "before", repaired.CurrentSize, "after", actualSize)
+		repaired.CurrentSize = actualSize
+		repaired.Checksum = checksum
+		changed = true
+	}
+
+	if changed && resetOnError {
+		logger.Warn("Metadata recovery: METADATA_RECOVERY=reset, discarding metadata", "file", metadata.Filename, "before", fmt.Sprintf("%+v", *metadata))
+		return nil, nil
+	}
+
+	// Appends compose against the generation actually stored, which may be ahead of
+	// the metadata when a concurrent request's metadata write was dropped
+	repaired.ObjectGeneration = attrs.Generation
+	return &repaired, nil
+}
+
+// updateMetadata saves the current WAV metadata for uid to store, provided the metadata
+// object is still at generation (or still absent when generation is 0)
+func updateMetadata(ctx context.Context, store objectStore, uid string, metadata *WAVMetadata, generation int64) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
 		return fmt.Errorf("failed to encode metadata: %v", err)
 	}
-	return writer.Close()
+	_, err = store.Write(ctx, metadataPath(uid), "application/json", data, generation)
+	return err
+}
+
+// commitMetadata saves metadata with updateMetadata. If another request updated the
+// metadata first, the stored copy is compared with ours: when it already describes the
+// same or a newer object generation (or a newer file), our write arrived out of order
+// and is dropped so the metadata never falls behind the object it describes.
+func commitMetadata(ctx context.Context, store objectStore, uid string, metadata *WAVMetadata, generation int64) error {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(casBackoff(attempt))
+		}
+
+		err := updateMetadata(ctx, store, uid, metadata, generation)
+		if !isPreconditionFailed(err) {
+			return err
+		}
+		loggerFrom(ctx).Info("Metadata changed concurrently", "attempt", attempt+1, "max_attempts", maxCASAttempts)
+
+		stored, storedGeneration, err := getCurrentMetadata(ctx, store, uid)
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			sameFileNewer := stored.Filename == metadata.Filename && stored.ObjectGeneration >= metadata.ObjectGeneration
+			otherFileNewer := stored.Filename != metadata.Filename && stored.LastWriteTime.After(metadata.LastWriteTime)
+			if sameFileNewer || otherFileNewer {
+				loggerFrom(ctx).Warn("Dropping out-of-order metadata update",
+					"file", metadata.Filename, "generation", metadata.ObjectGeneration,
+					"stored_file", stored.Filename, "stored_generation", stored.ObjectGeneration)
+				return nil
+			}
+		}
+		generation = storedGeneration
+	}
+	return fmt.Errorf("failed to update metadata for %s after %d attempts", metadata.Filename, maxCASAttempts)
+}
+
+// casBackoff returns how long to wait before compare-and-swap retry attempt. GCS
+// limits updates to a single object to about one per second, so the delay grows
+// exponentially and carries jitter to keep concurrent retries from colliding again.
+func casBackoff(attempt int) time.Duration {
+	d := 50 * time.Millisecond << attempt
+	if d > 2*time.Second {
+		d = 2 * time.Second
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// isPreconditionFailed reports whether err is a GCS 412 response
+func isPreconditionFailed(err error) bool {
+	var gErr *googleapi.Error
+	return errors.As(err, &gErr) && gErr.Code == http.StatusPreconditionFailed
+}
+
+// assignSequence atomically reserves the next chunk sequence number for uid's filename.
+// The counter is updated with a generation precondition and the update is retried
+// when another request wins the race, so concurrent chunks never share a sequence.
+func assignSequence(ctx context.Context, store objectStore, uid, filename string) (int64, error) {
+	name := sequencePath(uid)
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(casBackoff(attempt))
+		}
+
+		var counter sequenceCounter
+		data, generation, err := store.Read(ctx, name)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return 0, fmt.Errorf("failed to read sequence counter: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &counter); err != nil {
+				return 0, fmt.Errorf("failed to decode sequence counter: %v", err)
+			}
+		}
+
+		// Sequences restart whenever a new file is started
+		if counter.Filename != filename {
+			counter = sequenceCounter{Filename: filename}
+		}
+		counter.Sequence++
+
+		data, err = json.Marshal(&counter)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode sequence counter: %v", err)
+		}
+		_, err = store.Write(ctx, name, "application/json", data, generation)
+		if isPreconditionFailed(err) {
+			loggerFrom(ctx).Info("Sequence counter changed concurrently, retrying", "file", filename)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write sequence counter: %v", err)
+		}
+		return counter.Sequence, nil
+	}
+	return 0, fmt.Errorf("failed to assign sequence for %s after %d attempts", filename, maxCASAttempts)
+}
+
+// crc32cVerificationEnabled reports whether VERIFY_CRC32C opts in to post-write checks
+func crc32cVerificationEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("VERIFY_CRC32C"))
+	return err == nil && enabled
+}
+
+// verifyCRC32C compares the CRC32C stored by GCS for obj against the bytes we wrote.
+// This costs an extra attrs round trip, so callers only use it when enabled.
+func verifyCRC32C(ctx context.Context, obj *storage.ObjectHandle, written ...[]byte) error {
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read object attributes: %v", err)
+	}
+
+	var local uint32
+	for _, data := range written {
+		local = crc32.Update(local, crc32cTable, data)
+	}
+
+	if attrs.CRC32C != local {
+		return fmt.Errorf("CRC32C mismatch for %s: stored %08x, computed %08x", attrs.Name, attrs.CRC32C, local)
+	}
+	return nil
+}
+
+// newFileWindow returns the window, configured via NEW_FILE_WINDOW, within which
+// new-file names are identical so retried creations don't produce duplicates
+func newFileWindow() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("NEW_FILE_WINDOW"))
+	if err != nil || window <= 0 {
+		return defaultNewFileWindow
+	}
+	return window
 }
 
 // shouldCreateNewFile determines if we need to create a new WAV file
@@ -101,187 +604,519 @@ func shouldCreateNewFile(metadata *WAVMetadata) bool {
 		return true
 	}
 
-	currentDuration := calculateDuration(metadata.CurrentSize)
-	timeSinceLastWrite := time.Since(metadata.LastWriteTime)
+	currentDuration := calculateDuration(metadata.CurrentSize, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits())
+	timeSinceLastWrite := nowFunc().Sub(metadata.LastWriteTime)
+
+	// The byte cap applies regardless of format, so it still holds when the
+	// duration estimate is off
+	return currentDuration >= maxDuration || timeSinceLastWrite >= inactivityLimit || int64(metadata.CurrentSize) >= maxFileBytes
+}
 
-	return currentDuration >= maxDuration || timeSinceLastWrite >= inactivityLimit
+// swapByteOrder reverses the bytes of each sampleSize-byte sample in place,
+// converting between big- and little-endian PCM
+func swapByteOrder(data []byte, sampleSize int) {
+	for i := 0; i+sampleSize <= len(data); i += sampleSize {
+		sample := data[i : i+sampleSize]
+		for j, k := 0, sampleSize-1; j < k; j, k = j+1, k-1 {
+			sample[j], sample[k] = sample[k], sample[j]
+		}
+	}
 }
 
-// createWAVHeader generates a WAV header for the given data length
-func createWAVHeader(dataLength int) []byte {
-	byteRate := sampleRate * numChannels * bitsPerSample / 8
-	blockAlign := numChannels * bitsPerSample / 8
-	header := make([]byte, 44)
+// alignFrames prepends pending to body and splits the result into a prefix holding
+// whole frames of frameSize bytes and the partial frame left over at the end
+func alignFrames(pending, body []byte, frameSize int) (aligned, rest []byte) {
+	data := make([]byte, 0, len(pending)+len(body))
+	data = append(data, pending...)
+	data = append(data, body...)
+
+	n := len(data) - len(data)%frameSize
+	return data[:n], data[n:]
+}
+
+// wavHeaderSize is the size of the header written by createWAVHeader
+const wavHeaderSize = 44
+
+// wavObjectSize returns the size of the WAV object holding dataSize bytes of audio,
+// counting the header and the pad byte of an odd-sized data chunk
+func wavObjectSize(dataSize int) int {
+	return wavHeaderSize + dataSize + dataSize%2
+}
+
+// wavDataSize returns the bytes of audio held by a WAV object of objectSize bytes
+// with a header written by createWAVHeader. The pad byte of an odd-sized data chunk
+// is counted as audio, which is off by at most one sample.
+func wavDataSize(objectSize int64) int {
+	if objectSize <= wavHeaderSize {
+		return 0
+	}
+	return int(objectSize - wavHeaderSize)
+}
+
+// createWAVHeader generates a WAV header for the given data length and format.
+// RIFF chunks must have an even size, so for odd data lengths it also returns the
+// pad byte that has to follow the data; the pad is counted in the RIFF size but
+// not in the data chunk size.
+func createWAVHeader(dataLength, sampleRate, channels, bits int, float bool) (header, pad []byte) {
+	byteRate := sampleRate * channels * bits / 8
+	blockAlign := channels * bits / 8
+	formatTag := uint16(1) // integer PCM
+	if float {
+		formatTag = 3 // IEEE float
+	}
+	header = make([]byte, wavHeaderSize)
+	if dataLength%2 != 0 {
+		pad = []byte{0}
+	}
 
 	copy(header[0:4], []byte("RIFF"))
-	binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataLength))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataLength+len(pad)))
 	copy(header[8:12], []byte("WAVE"))
 
 	copy(header[12:16], []byte("fmt "))
 	binary.LittleEndian.PutUint32(header[16:20], 16)
-	binary.LittleEndian.PutUint16(header[20:22], 1)
-	binary.LittleEndian.PutUint16(header[22:24], uint16(numChannels))
+	binary.LittleEndian.PutUint16(header[20:22], formatTag)
+	binary.LittleEndian.PutUint16(header[22:24], uint16(channels))
 	binary.LittleEndian.PutUint32(header[24:28], uint32(sampleRate))
 	binary.LittleEndian.PutUint32(header[28:32], uint32(byteRate))
 	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
-	binary.LittleEndian.PutUint16(header[34:36], bitsPerSample)
+	binary.LittleEndian.PutUint16(header[34:36], uint16(bits))
 
 	copy(header[36:40], []byte("data"))
 	binary.LittleEndian.PutUint32(header[40:44], uint32(dataLength))
 
-	return header
+	return header, pad
 }
 
 // HandlePostAudio is the Cloud Function entrypoint
 func HandlePostAudio(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	// Only uploads may reach the write path, so probes and crawlers issuing GETs
+	// cannot create empty files
+	methods := []string{http.MethodPost, http.MethodPut, http.MethodOptions}
+	if r.Method == http.MethodOptions {
+		handlePreflight(w, r, methods...)
+		return
+	}
+	applyCORS(w, r, methods...)
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		logger.Warn("Rejecting request with a disallowed method", "method", r.Method)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s is not allowed, use POST or PUT", r.Method))
+		return
+	}
+
+	contentEncoding, err := normalizeContentEncoding(r.Header.Get("Content-Encoding"))
+	if err != nil {
+		logger.Warn("Rejecting request with an unsupported encoding", "error", err)
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+
+	// Read request body, refusing to buffer more than MAX_BODY_BYTES
+	rawBody, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logger.Warn("Rejecting oversized body", "limit", tooLarge.Limit)
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		logger.Warn("Failed to read request body", "error", err)
+		writeError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+	// A truncated upload must be retransmitted rather than appended short. Chunked
+	// bodies declare no length, which the request reports as -1.
+	if r.ContentLength >= 0 && !slices.Contains(r.TransferEncoding, "chunked") && int64(len(rawBody)) != r.ContentLength {
+		logger.Warn("Rejecting body that does not match Content-Length", "content_length", r.ContentLength, "bytes", len(rawBody))
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Received %d bytes but Content-Length declares %d", len(rawBody), r.ContentLength))
+		return
+	}
+	audioBytesReceived.Add(float64(len(rawBody)))
+
+	// The signature covers the body as sent, while everything else works on the
+	// decompressed body
+	body, err := decodeContentEncoding(contentEncoding, rawBody, maxDecompressedBytes)
+	if err == errDecompressedTooLarge {
+		logger.Warn("Rejecting body that decompresses past the limit", "encoding", contentEncoding, "limit", maxDecompressedBytes)
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Decompressed body exceeds %d bytes", maxDecompressedBytes))
+		return
+	}
+	if err != nil {
+		logger.Warn("Failed to decompress request body", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
+	// Form uploads carry the parameters as fields alongside the audio part
 	query := r.URL.Query()
+	if boundary, ok := multipartBoundary(r.Header.Get("Content-Type")); ok {
+		body, err = readMultipartAudio(body, boundary, query)
+		if err != nil {
+			logger.Warn("Invalid multipart upload", "error", err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
 	sampleRateParam := query.Get("sample_rate")
 	uid := query.Get("uid")
+	chunkID := query.Get("chunk_id")
+	if chunkID == "" {
+		chunkID = r.Header.Get("Idempotency-Key")
+	}
 
-	log.Printf("Received request from uid: %s", uid)
-	log.Printf("Requested sample rate: %s", sampleRateParam)
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received audio", "sample_rate", sampleRateParam, "bytes", len(body))
 
-	// Get bucket name from environment variable
-	bucketName := os.Getenv("GCS_BUCKET_NAME")
-	if bucketName == "" {
-		log.Printf("GCS_BUCKET_NAME environment variable is not set")
-		http.Error(w, "GCS_BUCKET_NAME environment variable is not set", http.StatusInternalServerError)
+	// Each uid gets its own metadata and file prefix, so an anonymous request
+	// would collide with every other anonymous request
+	if !validUID(uid) {
+		logger.Warn("Rejecting request with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
 		return
 	}
-
-	// Create storage client
-	client, err := getStorageClient(ctx)
+	sessionID, err := parseSessionID(query)
 	if err != nil {
-		log.Printf("Failed to create storage client: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to create storage client: %v", err), http.StatusInternalServerError)
+		logger.Warn("Rejecting request with invalid session_id")
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer client.Close()
+	if sessionID != "" {
+		ctx, logger = logWith(ctx, "session_id", sessionID)
+	}
+	key := sessionKey(uid, sessionID)
 
-	bucket := client.Bucket(bucketName)
+	// An upload without audio, such as a keep-alive ping, would otherwise start a
+	// file holding nothing but a header
+	if len(body) == 0 && !allowEmptyBody {
+		logger.Info("Ignoring upload with an empty body")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
+	// Every numeric param is validated up front, before anything is read or written
+	params, err := parseAudioParams(query)
 	if err != nil {
-		log.Printf("Failed to read request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		logger.Warn("Invalid query parameter", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer r.Body.Close()
 
-	// Get current metadata
-	metadata, err := getCurrentMetadata(ctx, bucket)
-	if err != nil {
-		log.Printf("Failed to get metadata: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to get metadata: %v", err), http.StatusInternalServerError)
+	if unknown := unknownParams(query); len(unknown) > 0 {
+		if strictParamsEnabled() {
+			logger.Warn("Rejecting unknown query parameters", "params", unknown)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown query parameters: %s (accepted: %s)",
+				strings.Join(unknown, ", "), strings.Join(acceptedParams, ", ")))
+			return
+		}
+		logger.Warn("Ignoring unknown query parameters", "params", unknown)
+	}
+
+	codec := query.Get("codec")
+	if codec == "" {
+		codec = "pcm"
+	}
+	if !supportedCodecs[codec] {
+		logger.Warn("Unsupported codec", "codec", codec)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported codec %q, expected pcm, opus, mulaw or alaw", codec))
+		return
+	}
+	if codec != "pcm" && (params.bits != 16 || params.float) {
+		logger.Warn("Rejecting compressed request with a sample format", "codec", codec, "bits", params.bits, "float", params.float)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("codec=%s decodes to 16-bit PCM and cannot be combined with bits or format", codec))
 		return
 	}
 
-	if shouldCreateNewFile(metadata) {
-		// Create new WAV file
-		currentTime := time.Now()
-		filename := fmt.Sprintf("%02d_%02d_%04d_%02d_%02d_%02d.wav",
-			currentTime.Day(),
-			currentTime.Month(),
-			currentTime.Year(),
-			currentTime.Hour(),
-			currentTime.Minute(),
-			currentTime.Second())
-
-		log.Printf("Creating new WAV file: %s", filename)
-
-		// Create new file in GCS
-		obj := bucket.Object(filename)
-		writer := obj.NewWriter(ctx)
-		writer.ContentType = "audio/wav"
-
-		// Write header and body
-		header := createWAVHeader(len(body))
-		if _, err := writer.Write(header); err != nil {
-			writer.Close()
-			log.Printf("Failed to write header: %v", err)
-			http.Error(w, "Failed to write header", http.StatusInternalServerError)
+	byteOrder := query.Get("byte_order")
+	if byteOrder == "" {
+		byteOrder = "le"
+	}
+	if byteOrder != "le" && byteOrder != "be" {
+		logger.Warn("Unsupported byte order", "byte_order", byteOrder)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported byte_order %q, expected le or be", byteOrder))
+		return
+	}
+	// Decoded audio is always little-endian, so byte_order only describes raw PCM
+	if byteOrder == "be" && codec != "pcm" {
+		logger.Warn("Rejecting byte_order for a compressed codec", "codec", codec)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("byte_order=be only applies to codec=pcm, not %s", codec))
+		return
+	}
+
+	// A client that produces WAV files may post one whole: its header describes the
+	// audio in place of the format params and only its data chunk is stored
+	if codec == "pcm" && looksLikeWAV(body) {
+		if query.Get("framing") == "lp" || byteOrder == "be" {
+			logger.Warn("Rejecting WAV body with framing or byte_order")
+			writeError(w, http.StatusBadRequest, "A WAV body cannot be combined with framing=lp or byte_order=be")
 			return
 		}
-		if _, err := writer.Write(body); err != nil {
-			writer.Close()
-			log.Printf("Failed to write audio data: %v", err)
-			http.Error(w, "Failed to write audio data", http.StatusInternalServerError)
+		format, data, err := stripWAVHeader(body)
+		if err == nil {
+			err = applyWAVFormat(&params, query, format)
+		}
+		if err != nil {
+			logger.Warn("Invalid WAV body", "error", err)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid WAV body: %v", err))
 			return
 		}
-		if err := writer.Close(); err != nil {
-			log.Printf("Failed to close writer: %v", err)
-			http.Error(w, "Failed to close writer", http.StatusInternalServerError)
+		logger.Info("Stripped WAV header from body", "sample_rate", format.sampleRate, "channels", format.channels, "bits", format.bits, "bytes", len(data))
+		body = data
+	}
+
+	// A framing=lp body carries several buffered packets, each preceded by its length.
+	// Opus packets are decoded one by one; other codecs are simply concatenated.
+	frames := [][]byte{body}
+	switch framing := query.Get("framing"); framing {
+	case "", "none":
+	case "lp":
+		frames, err = splitLengthPrefixed(body)
+		if err != nil {
+			logger.Warn("Invalid length-prefixed body", "error", err)
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		if codec == "pcm" {
+			frameSize := params.bits / 8 * params.channels
+			for i, frame := range frames {
+				if len(frame)%frameSize != 0 {
+					logger.Warn("Rejecting misaligned length-prefixed frame", "frame", i, "bytes", len(frame), "frame_size", frameSize)
+					writeError(w, http.StatusBadRequest, fmt.Sprintf("Frame %d holds %d bytes, not a whole number of %d-byte samples", i, len(frame), frameSize))
+					return
+				}
+			}
+		}
+		body = bytes.Join(frames, nil)
+	default:
+		logger.Warn("Unsupported framing", "framing", framing)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported framing %q, expected none or lp", framing))
+		return
+	}
 
-		// Update metadata
-		metadata = &WAVMetadata{
-			Filename:      filename,
-			LastWriteTime: currentTime,
-			CurrentSize:   len(body),
+	// A client bug posting an error page or JSON would otherwise be stored as noise
+	if codec == "pcm" {
+		if kind := textSignature(body); kind != "" {
+			logger.Warn("Rejecting non-audio body", "kind", kind)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Body looks like %s rather than PCM audio", kind))
+			return
 		}
-	} else {
-		log.Printf("Appending to existing WAV file: %s", metadata.Filename)
+	}
+
+	if authEnabled() {
+		if err := verifySignature(r, key, rawBody); err != nil {
+			logger.Warn("Rejecting unauthenticated request", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Only signed requests spend a uid's tokens, so forged ones can't throttle it
+	if ok, retryAfter := allowRequest(uid); !ok {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		logger.Warn("Rate limiting uid", "retry_after_seconds", seconds)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("Rate limit of %d requests per minute exceeded", rateLimitPerMin))
+		return
+	}
 
-		// Read existing file content
-		oldObj := bucket.Object(metadata.Filename)
-		reader, err := oldObj.NewReader(ctx)
+	bucket, err := openBucket(bucketOverride(query, r.Header))
+	if err == nil {
+		err = probeBucket(ctx, bucket)
+	}
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	// Skip chunks that were already processed, possibly by another instance. An
+	// upload claims its chunk_id before writing, so of two concurrent deliveries only
+	// one writes, and confirms the claim once the chunk was applied or gives it up
+	// otherwise, so a retry of a failed upload is not mistaken for a duplicate. A
+	// delivery arriving while the claim is pending is asked to resend.
+	applied := false
+	if chunkID != "" {
+		var state chunkState
+		if params.dryRun {
+			state, err = chunkStatus(ctx, openStore(bucket), uid, chunkID)
+		} else {
+			var claim *chunkClaim
+			claim, state, err = claimChunk(ctx, openStore(bucket), uid, chunkID)
+			if claim != nil {
+				defer func() {
+					if applied {
+						claim.confirm(ctx)
+					} else {
+						claim.release(ctx)
+					}
+				}()
+			}
+		}
 		if err != nil {
-			log.Printf("Failed to read existing file: %v", err)
-			http.Error(w, "Failed to read existing file", http.StatusInternalServerError)
+			countGCSError("dedup")
+			logger.Error("Failed to check chunk for duplicates", "chunk_id", chunkID, "error", err)
+			writeServerError(ctx, w, "Failed to check chunk for duplicates")
+			return
+		}
+		switch state {
+		case chunkPending:
+			logger.Info("Chunk is being written by another request", "chunk_id", chunkID)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("Chunk %s is still being written by another request, please resend", chunkID))
+			return
+		case chunkProcessed:
+			logger.Info("Skipping duplicate chunk", "chunk_id", chunkID)
+			writeJSON(w, http.StatusOK, audioResponse{
+				Status:  "ok",
+				Message: fmt.Sprintf("Chunk %s was already processed", chunkID),
+			})
 			return
 		}
+	}
 
-		existingContent, err := io.ReadAll(reader)
-		reader.Close()
+	// Compressed input is decoded to PCM at the declared format before anything else
+	switch codec {
+	case "opus":
+		decoder, err := newOpusDecoder(params.sampleRate, params.channels)
 		if err != nil {
-			log.Printf("Failed to read existing content: %v", err)
-			http.Error(w, "Failed to read existing content", http.StatusInternalServerError)
+			logger.Warn("Failed to decode Opus body", "error", err)
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		var decoded []byte
+		for _, packet := range frames {
+			pcm, err := decoder.decode(packet)
+			if err != nil {
+				logger.Warn("Failed to decode Opus body", "error", err)
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			decoded = append(decoded, pcm...)
+		}
+		body = decoded
+	case "mulaw":
+		body = decodeMulaw(body)
+	case "alaw":
+		body = decodeALaw(body)
+	}
 
-		// Create new content with updated header
-		newSize := metadata.CurrentSize + len(body)
-		header := createWAVHeader(newSize)
-		
-		// Combine header, existing audio data (excluding old header), and new audio data
-		newContent := make([]byte, 0, len(header)+newSize)
-		newContent = append(newContent, header...)
-		newContent = append(newContent, existingContent[44:]...)
-		newContent = append(newContent, body...)
-
-		// Write new content
-		writer := oldObj.NewWriter(ctx)
-		writer.ContentType = "audio/wav"
-		
-		if _, err := writer.Write(newContent); err != nil {
-			writer.Close()
-			log.Printf("Failed to write new content: %v", err)
-			http.Error(w, "Failed to write new content", http.StatusInternalServerError)
+	// WAV data is little-endian, so big-endian sources are converted before writing
+	if byteOrder == "be" {
+		sampleSize := params.bits / 8
+		if len(body)%sampleSize != 0 {
+			logger.Warn("Body length is not a multiple of the sample size", "bytes", len(body), "sample_size", sampleSize)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Body length %d is not a multiple of the %d-byte sample size", len(body), sampleSize))
 			return
 		}
-		if err := writer.Close(); err != nil {
-			log.Printf("Failed to close writer: %v", err)
-			http.Error(w, "Failed to close writer", http.StatusInternalServerError)
+		swapByteOrder(body, sampleSize)
+	}
+
+	if params.dryRun {
+		plan, err := planChunk(ctx, bucket, key, params, body)
+		if err != nil {
+			writeChunkError(ctx, w, err)
 			return
 		}
+		logger.Info("Planned dry run", "action", plan.Action, "file", plan.Filename, "current_size", plan.CurrentSize)
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
 
-		// Update metadata
-		metadata.CurrentSize = newSize
-		metadata.LastWriteTime = time.Now()
+	// One ear of a stereo pair only reaches the file as far as the other ear matches it
+	if params.pairChannel != "" {
+		stereo, err := pairChunk(ctx, openStore(bucket), key, params, body)
+		if err != nil {
+			writeChunkError(ctx, w, err)
+			return
+		}
+		if len(stereo) == 0 {
+			applied = true
+			logger.Info("Buffered chunk until the other ear matches it", "pair_channel", params.pairChannel, "bytes", len(body))
+			writeJSON(w, http.StatusOK, audioResponse{
+				Status:  "ok",
+				Message: "Buffered until the other ear of the pair catches up",
+			})
+			return
+		}
+		body = stereo
+		params.channels, params.channelsDeclared = 2, true
 	}
 
-	// Save metadata
-	if err := updateMetadata(ctx, bucket, metadata); err != nil {
-		log.Printf("Failed to update metadata: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to update metadata: %v", err), http.StatusInternalServerError)
+	var result chunkResult
+	buffered := false
+	if bufferingEnabled(params) {
+		result, buffered, err = bufferChunk(ctx, bucket, key, params, query.Get("device_id"), body)
+	} else {
+		// What this instance buffered for the session goes before the chunk
+		err = flushBuffer(ctx, key)
+		if err == nil {
+			result, err = writeChunk(ctx, bucket, key, params, query.Get("device_id"), body)
+		}
+	}
+	if err != nil {
+		writeChunkError(ctx, w, err)
+		return
+	}
+	applied = true
+	if buffered {
+		logger.Info("Buffered chunk", "bytes", len(body))
+		writeJSON(w, http.StatusOK, audioResponse{
+			Status:  "ok",
+			Message: "Buffered, to be stored with the chunks that follow",
+		})
 		return
 	}
+	if result.dropped {
+		writeJSON(w, http.StatusOK, audioResponse{
+			Status:  "ok",
+			Message: "Dropped, the session was already finalized",
+		})
+		return
+	}
+	metadata, createNew := result.metadata, result.created
+	if result.stale {
+		writeJSON(w, http.StatusOK, audioResponse{
+			Status:          "ok",
+			Message:         fmt.Sprintf("Chunk seq %d was already applied", *params.clientSeq),
+			Filename:        metadata.Filename,
+			CurrentSize:     metadata.CurrentSize,
+			DurationSeconds: calculateDuration(metadata.CurrentSize, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()).Seconds(),
+		})
+		return
+	}
+
+	// The duration covers the file after this chunk was appended
+	durationSeconds := calculateDuration(metadata.CurrentSize, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()).Seconds()
+	w.Header().Set("X-Audio-Duration-Seconds", strconv.FormatFloat(durationSeconds, 'f', -1, 64))
+
+	// Starting a file answers 201 with the new object path in Location; appends
+	// answer 200 without it, since the file is unchanged. Audio stored without its
+	// metadata answers 202, which clients must not retry.
+	status := http.StatusOK
+	message := ""
+	if createNew {
+		status = http.StatusCreated
+		w.Header().Set("Location", metadata.Filename)
+	}
+	if result.unrecorded {
+		status = http.StatusAccepted
+		message = "Audio was stored but the session could not be updated; it will be reconciled by the next chunk, do not resend this one"
+	}
 
-	log.Printf("Successfully processed audio for file: %s", metadata.Filename)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Audio bytes processed for file %s", metadata.Filename)))
+	logger.Info("Successfully processed audio", "file", metadata.Filename, "sequence", metadata.Sequence, "current_size", metadata.CurrentSize)
+	writeJSON(w, status, audioResponse{
+		Status:          "ok",
+		Message:         message,
+		Filename:        metadata.Filename,
+		CurrentSize:     metadata.CurrentSize,
+		DurationSeconds: durationSeconds,
+		Sequence:        metadata.Sequence,
+		Created:         createNew,
+		CRC32C:          formatChecksum(metadata.Checksum),
+	})
 }
\ No newline at end of file
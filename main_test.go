@@ -0,0 +1,987 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStart is when the fake clock of most tests starts
+var testStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeClock is a nowFunc that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// useFakeClock makes nowFunc read a fakeClock set to start for the rest of the test
+func useFakeClock(t *testing.T, start time.Time) *fakeClock {
+	t.Helper()
+	clock := &fakeClock{now: start}
+	setVar(t, &nowFunc, clock.Now)
+	return clock
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// tone returns d of 16-bit mono PCM at rate holding a square wave, so no sample is
+// silent
+func tone(d time.Duration, rate int) []byte {
+	samples := int(d.Seconds() * float64(rate))
+	pcm := make([]byte, samples*2)
+	for i := 0; i < samples; i++ {
+		sample := int16(8000)
+		if i/20%2 == 1 {
+			sample = -8000
+		}
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	return pcm
+}
+
+// postAudio sends body to HandlePostAudio with query
+func postAudio(t *testing.T, query string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/?"+query, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, req)
+	return w
+}
+
+// serve sends a request for target to handler
+func serve(t *testing.T, handler http.HandlerFunc, method, target string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// mustPost is postAudio failing the test unless the upload succeeds
+func mustPost(t *testing.T, query string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	w := postAudio(t, query, body)
+	if w.Code >= 300 {
+		t.Fatalf("POST ?%s answered %d: %s", query, w.Code, w.Body)
+	}
+	return w
+}
+
+// currentMetadata returns the stored metadata of session key
+func currentMetadata(t *testing.T, f *fakeGCS, key string) *WAVMetadata {
+	t.Helper()
+	metadata, _, err := getCurrentMetadata(context.Background(), newGCSStore(f.bucket()), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+// storedWAV returns the format and data size declared by the header of the WAV
+// object name, failing the test unless the declared sizes match the object
+func storedWAV(t *testing.T, f *fakeGCS, name string) (wavFormat, int) {
+	t.Helper()
+	data, ok := f.get(name)
+	if !ok {
+		t.Fatalf("%s was not written", name)
+	}
+	format, dataLen, err := parseWAVHeader(data)
+	if err != nil {
+		t.Fatalf("%s has an invalid header: %v", name, err)
+	}
+	if riff := int(binary.LittleEndian.Uint32(data[4:8])); riff != len(data)-8 {
+		t.Fatalf("%s declares a RIFF size of %d, want %d", name, riff, len(data)-8)
+	}
+	if dataLen != len(data)-wavHeaderSize-dataLen%2 {
+		t.Fatalf("%s declares %d bytes of data but holds %d", name, dataLen, len(data)-wavHeaderSize)
+	}
+	return format, dataLen
+}
+
+func TestShouldCreateNewFile(t *testing.T) {
+	clock := useFakeClock(t, testStart)
+	setVar(t, &maxDuration, time.Minute)
+	setVar(t, &inactivityLimit, 2*time.Minute)
+	setVar(t, &maxFileBytes, 1<<20)
+
+	oneSecond := 16000 * 2
+	tests := []struct {
+		name     string
+		metadata *WAVMetadata
+		advance  time.Duration
+		want     bool
+	}{
+		{"no file", nil, 0, true},
+		{"fresh file", &WAVMetadata{CurrentSize: oneSecond, LastWriteTime: testStart}, 0, false},
+		{"just inside inactivity limit", &WAVMetadata{CurrentSize: oneSecond, LastWriteTime: testStart}, 2*time.Minute - time.Nanosecond, false},
+		{"inactivity limit reached", &WAVMetadata{CurrentSize: oneSecond, LastWriteTime: testStart}, 2 * time.Minute, true},
+		{"max duration reached", &WAVMetadata{CurrentSize: 60 * oneSecond, LastWriteTime: testStart}, 0, true},
+		{"byte cap reached", &WAVMetadata{CurrentSize: 1 << 20, SampleRate: 48000, Channels: 2, LastWriteTime: testStart}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.now = testStart.Add(tt.advance)
+			if got := shouldCreateNewFile(tt.metadata); got != tt.want {
+				t.Fatalf("shouldCreateNewFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostAudioRollsOverAfterInactivity(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &inactivityLimit, 2*time.Minute)
+
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	clock.Advance(time.Second)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	first := currentMetadata(t, f, "alice")
+	if first.Filename != "alice/2024-05-01T12-00-00Z.wav" || first.CurrentSize != 32000 {
+		t.Fatalf("after two chunks metadata = %s of %d bytes", first.Filename, first.CurrentSize)
+	}
+
+	clock.Advance(2 * time.Minute)
+	w := mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("chunk after the inactivity limit answered %d, want %d", w.Code, http.StatusCreated)
+	}
+	second := currentMetadata(t, f, "alice")
+	if second.Filename != "alice/2024-05-01T12-02-00Z.wav" || second.CurrentSize != 8000 {
+		t.Fatalf("after rollover metadata = %s of %d bytes", second.Filename, second.CurrentSize)
+	}
+	if _, dataLen := storedWAV(t, f, first.Filename); dataLen != 32000 {
+		t.Fatalf("rolled over file holds %d bytes of audio, want 32000", dataLen)
+	}
+	if _, ok := f.get(pcmPath(first.Filename)); ok {
+		t.Fatalf("accumulator of the rolled over file was left behind")
+	}
+}
+
+func TestRolloverAtInactivityBoundaryFinalizesHeader(t *testing.T) {
+	for _, mode := range []string{"eager", "lazy"} {
+		t.Run(mode, func(t *testing.T) {
+			f := newFakeGCS(t)
+			clock := useFakeClock(t, testStart)
+			setVar(t, &inactivityLimit, 2*time.Minute)
+			setVar(t, &streamingMode, mode)
+
+			first, second := sine(440, 16000, 4000, 8000), sine(660, 16000, 6000, 8000)
+			mustPost(t, "uid=alice", first)
+			clock.Advance(time.Second)
+			mustPost(t, "uid=alice", second)
+			old := currentMetadata(t, f, "alice").Filename
+
+			// A chunk arriving exactly at the limit starts the next file
+			clock.Advance(2 * time.Minute)
+			if w := mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000)); w.Code != http.StatusCreated {
+				t.Fatalf("chunk at the inactivity limit answered %d, want %d", w.Code, http.StatusCreated)
+			}
+
+			data, _ := f.get(old)
+			dataLen := len(first) + len(second)
+			if riff := binary.LittleEndian.Uint32(data[4:8]); riff != uint32(36+dataLen) {
+				t.Fatalf("rolled over file declares a RIFF size of %d, want %d", riff, 36+dataLen)
+			}
+			if declared := binary.LittleEndian.Uint32(data[40:44]); declared != uint32(dataLen) || !bytes.Equal(data[wavHeaderSize:], concat(first, second)) {
+				t.Fatalf("rolled over file declares %d bytes of data and holds %d, want both %d", declared, len(data)-wavHeaderSize, dataLen)
+			}
+		})
+	}
+}
+
+func TestPostAudioRollsOverAtMaxDuration(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &maxDuration, time.Second)
+
+	mustPost(t, "uid=alice", tone(750*time.Millisecond, 16000))
+	clock.Advance(time.Second)
+	mustPost(t, "uid=alice", tone(750*time.Millisecond, 16000))
+
+	// The second chunk fills the first file to exactly MAX_DURATION and starts the
+	// next with the rest
+	if _, dataLen := storedWAV(t, f, "alice/2024-05-01T12-00-00Z.wav"); dataLen != 32000 {
+		t.Fatalf("first file holds %d bytes of audio, want 32000", dataLen)
+	}
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.CurrentSize != 16000 {
+		t.Fatalf("second file holds %d bytes, want 16000", metadata.CurrentSize)
+	}
+	if metadata.StartTime != clock.Now() {
+		t.Fatalf("second file started at %v, want the fake clock's %v", metadata.StartTime, clock.Now())
+	}
+}
+
+func TestValidUID(t *testing.T) {
+	tests := []struct {
+		uid  string
+		want bool
+	}{
+		{"alice", true},
+		{"alice_bob", true},
+		{"metadata.json", true},
+		{"", false},
+		{"alice/bob", false},
+		{".", false},
+		{"..", false},
+		{"metadata", false},
+		{"sequences", false},
+		{"locks", false},
+		{"finalized", false},
+		{"dedup", false},
+	}
+	for _, tt := range tests {
+		if got := validUID(tt.uid); got != tt.want {
+			t.Errorf("validUID(%q) = %v, want %v", tt.uid, got, tt.want)
+		}
+	}
+}
+
+func TestReconcileMetadata(t *testing.T) {
+	pcm := tone(100*time.Millisecond, 16000)
+	tests := []struct {
+		name     string
+		metadata WAVMetadata
+		reset    bool
+		want     *WAVMetadata
+	}{
+		{"consistent", WAVMetadata{CurrentSize: len(pcm), LastWriteTime: testStart}, false,
+			&WAVMetadata{CurrentSize: len(pcm), LastWriteTime: testStart}},
+		{"negative size", WAVMetadata{CurrentSize: -5, LastWriteTime: testStart}, false,
+			&WAVMetadata{CurrentSize: len(pcm), LastWriteTime: testStart}},
+		{"future timestamp", WAVMetadata{CurrentSize: len(pcm), LastWriteTime: testStart.Add(time.Hour)}, false,
+			&WAVMetadata{CurrentSize: len(pcm), LastWriteTime: testStart}},
+		{"size mismatch", WAVMetadata{CurrentSize: 10, LastWriteTime: testStart}, false,
+			&WAVMetadata{CurrentSize: len(pcm), LastWriteTime: testStart}},
+		{"size mismatch with reset", WAVMetadata{CurrentSize: 10, LastWriteTime: testStart}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGCS(t)
+			useFakeClock(t, testStart)
+			if tt.reset {
+				t.Setenv("METADATA_RECOVERY", "reset")
+			}
+			const filename = "alice/2024-05-01T12-00-00Z.wav"
+			f.put(pcmPath(filename), pcm)
+			metadata := tt.metadata
+			metadata.Filename = filename
+
+			got, err := reconcileMetadata(context.Background(), f.bucket(), &metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("reconcileMetadata = %+v, want the metadata discarded", got)
+				}
+				return
+			}
+			if got == nil || got.CurrentSize != tt.want.CurrentSize || !got.LastWriteTime.Equal(tt.want.LastWriteTime) {
+				t.Fatalf("reconcileMetadata = %+v, want size %d and last write %v", got, tt.want.CurrentSize, tt.want.LastWriteTime)
+			}
+		})
+	}
+}
+
+func TestReconcileMetadataArchivesTornAccumulator(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	const filename = "alice/2024-05-01T12-00-00Z.wav"
+	f.put(pcmPath(filename), make([]byte, 101))
+
+	metadata := &WAVMetadata{Filename: filename, CurrentSize: 101, LastWriteTime: testStart}
+	got, err := reconcileMetadata(context.Background(), f.bucket(), metadata)
+	if err != nil || got != nil {
+		t.Fatalf("reconcileMetadata of a torn accumulator = %+v, %v, want it discarded", got, err)
+	}
+	if _, ok := f.get(pcmPath(filename) + corruptSuffix); !ok {
+		t.Fatalf("torn accumulator was not archived, objects %v", f.names(""))
+	}
+}
+
+func TestAppendReadAmplification(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	read, written := appendStats.bytesRead.Load(), appendStats.bytesWritten.Load()
+
+	// The first chunk starts the file; only the two after it are appends
+	sizes := []int{3200, 1600, 640}
+	for _, size := range sizes {
+		mustPost(t, "uid=alice", tone(time.Duration(size/2)*time.Second/16000, 16000))
+	}
+
+	if got := appendStats.bytesWritten.Load() - written; got != int64(sizes[1]+sizes[2]) {
+		t.Fatalf("appends recorded %d bytes written, want %d", got, sizes[1]+sizes[2])
+	}
+	if got := appendStats.bytesRead.Load() - read; got != 0 {
+		t.Fatalf("appends recorded %d bytes read, want none since audio is composed", got)
+	}
+	if got := readAmplification(0, 100); got != 0 {
+		t.Fatalf("readAmplification(0, 100) = %v, want 0", got)
+	}
+	if got := readAmplification(300, 100); got != 3 {
+		t.Fatalf("readAmplification(300, 100) = %v, want 3", got)
+	}
+}
+
+func TestPostBigEndianAudio(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	le := tone(100*time.Millisecond, 16000)
+	be := append([]byte(nil), le...)
+	swapByteOrder(be, 2)
+
+	mustPost(t, "uid=alice&byte_order=be", be)
+	stored, _ := f.get(pcmPath(currentMetadata(t, f, "alice").Filename))
+	if !bytes.Equal(stored, le) {
+		t.Fatal("big-endian samples were not stored little-endian")
+	}
+
+	if w := postAudio(t, "uid=alice&byte_order=be", be[:3]); w.Code != http.StatusBadRequest {
+		t.Fatalf("big-endian body of a partial sample answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSwapByteOrder(t *testing.T) {
+	tests := []struct {
+		sampleSize int
+		in, want   []byte
+	}{
+		{2, []byte{1, 2, 3, 4}, []byte{2, 1, 4, 3}},
+		{3, []byte{1, 2, 3, 4, 5, 6}, []byte{3, 2, 1, 6, 5, 4}},
+		{4, []byte{1, 2, 3, 4}, []byte{4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		data := append([]byte(nil), tt.in...)
+		swapByteOrder(data, tt.sampleSize)
+		if !bytes.Equal(data, tt.want) {
+			t.Errorf("swapByteOrder(%v, %d) = %v, want %v", tt.in, tt.sampleSize, data, tt.want)
+		}
+	}
+}
+
+func TestConcurrentAppendsKeepMetadataInStep(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(50*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", body)
+
+	const writers = 6
+	var wg sync.WaitGroup
+	codes := make(chan int, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postAudio(t, "uid=alice", body).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	applied := 1
+	for code := range codes {
+		if code == http.StatusOK {
+			applied++
+		}
+	}
+
+	metadata := currentMetadata(t, f, "alice")
+	stored, _ := f.get(pcmPath(metadata.Filename))
+	if metadata.CurrentSize != len(stored) {
+		t.Fatalf("metadata records %d bytes, the accumulator holds %d", metadata.CurrentSize, len(stored))
+	}
+	if len(stored) != applied*len(body) {
+		t.Fatalf("accumulator holds %d bytes, want %d for the %d chunks acknowledged", len(stored), applied*len(body), applied)
+	}
+}
+
+func TestUIDsHaveIndependentFiles(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	alice, bob := tone(100*time.Millisecond, 16000), tone(200*time.Millisecond, 16000)
+
+	mustPost(t, "uid=alice", alice)
+	mustPost(t, "uid=bob", bob)
+
+	aliceMeta, bobMeta := currentMetadata(t, f, "alice"), currentMetadata(t, f, "bob")
+	if aliceMeta.Filename == bobMeta.Filename {
+		t.Fatalf("both uids write to %s", aliceMeta.Filename)
+	}
+	for _, tt := range []struct {
+		metadata *WAVMetadata
+		want     []byte
+	}{{aliceMeta, alice}, {bobMeta, bob}} {
+		if stored, _ := f.get(pcmPath(tt.metadata.Filename)); !bytes.Equal(stored, tt.want) {
+			t.Fatalf("%s holds %d bytes, want only its own uid's %d", tt.metadata.Filename, len(stored), len(tt.want))
+		}
+	}
+}
+
+func TestSplitSampleIsCarriedOver(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	audio := tone(100*time.Millisecond, 16000)
+
+	// The first chunk ends halfway through a sample, which the second completes
+	mustPost(t, "uid=alice", audio[:101])
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.CurrentSize != 100 || !bytes.Equal(metadata.PendingBytes, audio[100:101]) {
+		t.Fatalf("after a split sample size = %d, pending = %v, want 100 and %v", metadata.CurrentSize, metadata.PendingBytes, audio[100:101])
+	}
+	mustPost(t, "uid=alice", audio[101:])
+
+	metadata = currentMetadata(t, f, "alice")
+	stored, _ := f.get(pcmPath(metadata.Filename))
+	if !bytes.Equal(stored, audio) || len(metadata.PendingBytes) != 0 {
+		t.Fatalf("stored %d bytes with %d pending, want the %d bytes sent and none pending", len(stored), len(metadata.PendingBytes), len(audio))
+	}
+}
+
+func TestAlignFrames(t *testing.T) {
+	aligned, rest := alignFrames([]byte{1}, []byte{2, 3, 4, 5, 6}, 4)
+	if !bytes.Equal(aligned, []byte{1, 2, 3, 4}) || !bytes.Equal(rest, []byte{5, 6}) {
+		t.Fatalf("alignFrames = %v, %v, want [1 2 3 4], [5 6]", aligned, rest)
+	}
+}
+
+func TestCreateWAVHeaderChannels(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels int
+		want     []byte
+	}{
+		{"mono", 1, []byte{1, 0, 1, 0, 0x80, 0x3e, 0, 0, 0, 0x7d, 0, 0, 2, 0, 16, 0}},
+		{"stereo", 2, []byte{1, 0, 2, 0, 0x80, 0x3e, 0, 0, 0, 0xfa, 0, 0, 4, 0, 16, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, _ := createWAVHeader(0, 16000, tt.channels, 16, false)
+			if got := header[20:36]; !bytes.Equal(got, tt.want) {
+				t.Fatalf("fmt chunk = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateWAVHeaderPadding(t *testing.T) {
+	tests := []struct {
+		dataLength int
+		wantRIFF   uint32
+		wantPad    []byte
+	}{
+		{0, 36, nil},
+		{1, 38, []byte{0}},
+		{2, 38, nil},
+		{3, 40, []byte{0}},
+		{32000, 32036, nil},
+		{32001, 32038, []byte{0}},
+	}
+	for _, tt := range tests {
+		header, pad := createWAVHeader(tt.dataLength, 16000, 1, 16, false)
+		if len(header) != wavHeaderSize {
+			t.Fatalf("header of %d bytes, want %d", len(header), wavHeaderSize)
+		}
+		if got := binary.LittleEndian.Uint32(header[4:8]); got != tt.wantRIFF {
+			t.Errorf("data of %d bytes: RIFF size %d, want %d", tt.dataLength, got, tt.wantRIFF)
+		}
+		if got := binary.LittleEndian.Uint32(header[40:44]); got != uint32(tt.dataLength) {
+			t.Errorf("data of %d bytes: data size %d, want %d", tt.dataLength, got, tt.dataLength)
+		}
+		if !bytes.Equal(pad, tt.wantPad) {
+			t.Errorf("data of %d bytes: pad %v, want %v", tt.dataLength, pad, tt.wantPad)
+		}
+		// The RIFF size counts everything after its own 8-byte chunk header
+		if total := wavHeaderSize + tt.dataLength + len(pad); uint32(total-8) != tt.wantRIFF || total != wavObjectSize(tt.dataLength) {
+			t.Errorf("data of %d bytes: object of %d bytes disagrees with the header or wavObjectSize", tt.dataLength, total)
+		}
+		if string(header[0:4]) != "RIFF" || string(header[8:16]) != "WAVEfmt " || string(header[36:40]) != "data" {
+			t.Errorf("data of %d bytes: header magic is %q", tt.dataLength, header)
+		}
+	}
+}
+
+func TestNewStorageClientRejectsBadCredentials(t *testing.T) {
+	for _, creds := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("hunter2"))} {
+		if _, err := newStorageClient(creds); !errors.Is(err, errStorageNotConfigured) {
+			t.Errorf("newStorageClient(%q) = %v, want %v", creds, err, errStorageNotConfigured)
+		}
+	}
+}
+
+func TestStorageNotConfigured(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket string
+		creds  string
+	}{
+		{"no bucket", "", base64.StdEncoding.EncodeToString([]byte("{}"))},
+		{"no credentials", testBucket, ""},
+		{"malformed base64", testBucket, "not base64!"},
+		{"not credentials", testBucket, base64.StdEncoding.EncodeToString([]byte("hunter2"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GCS_BUCKET_NAME", tt.bucket)
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS_JSON", tt.creds)
+
+			if _, err := openBucket(""); !errors.Is(err, errStorageNotConfigured) {
+				t.Fatalf("openBucket = %v, want %v", err, errStorageNotConfigured)
+			}
+			w := postAudio(t, "uid=alice", tone(100*time.Millisecond, 16000))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("POST answered %d, want %d", w.Code, http.StatusServiceUnavailable)
+			}
+			for _, detail := range []string{"GCS_BUCKET_NAME", "GOOGLE_APPLICATION_CREDENTIALS_JSON", "base64", "hunter2"} {
+				if strings.Contains(w.Body.String(), detail) {
+					t.Fatalf("response leaks %q: %s", detail, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestPostBodyLimit(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &maxBodyBytes, 3200)
+
+	w := postAudio(t, "uid=alice", make([]byte, 3202))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST of 3202 bytes answered %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("rejected upload wrote %v", names)
+	}
+
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+}
+
+func TestPostRejectsShortBody(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	pcm := tone(100*time.Millisecond, 16000)
+	post := func(contentLength int64, transferEncoding ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/?uid=alice", bytes.NewReader(pcm))
+		req.ContentLength, req.TransferEncoding = contentLength, transferEncoding
+		w := httptest.NewRecorder()
+		HandlePostAudio(w, req)
+		return w
+	}
+
+	// The connection closed before the declared body arrived
+	if w := post(int64(len(pcm)) + 1000); w.Code != http.StatusBadRequest {
+		t.Fatalf("short body answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("short body wrote %v", names)
+	}
+
+	// Chunked bodies declare no length to compare against
+	if w := post(-1, "chunked"); w.Code != http.StatusCreated {
+		t.Fatalf("chunked body answered %d: %s", w.Code, w.Body)
+	}
+	if w := post(int64(len(pcm))); w.Code != http.StatusOK {
+		t.Fatalf("body matching Content-Length answered %d: %s", w.Code, w.Body)
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != 2*len(pcm) {
+		t.Fatalf("file holds %d bytes, want %d", size, 2*len(pcm))
+	}
+}
+
+func TestPostAudioRejectsOtherMethods(t *testing.T) {
+	f := newFakeGCS(t)
+	requests := 0
+	f.fail = func(r *http.Request) int {
+		requests++
+		return 0
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete} {
+		w := serve(t, HandlePostAudio, method, "/?uid=alice", nil)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("%s answered %d, want %d", method, w.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := w.Header().Get("Allow"); !strings.Contains(allow, http.MethodPost) {
+			t.Fatalf("%s got Allow %q", method, allow)
+		}
+	}
+	if requests != 0 {
+		t.Fatalf("rejected requests made %d calls to GCS", requests)
+	}
+}
+
+func TestPostReportsAccumulatedDuration(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	chunks := []struct {
+		length time.Duration
+		want   string
+	}{
+		{500 * time.Millisecond, "0.5"},
+		{250 * time.Millisecond, "0.75"},
+	}
+	for _, chunk := range chunks {
+		w := mustPost(t, "uid=alice", tone(chunk.length, 16000))
+		if got := w.Header().Get("X-Audio-Duration-Seconds"); got != chunk.want {
+			t.Fatalf("X-Audio-Duration-Seconds = %q, want %q", got, chunk.want)
+		}
+	}
+
+	// The duration follows the file's format, here 8 kHz mono
+	w := mustPost(t, "uid=bob&sample_rate=8000", tone(time.Second, 8000))
+	if got := w.Header().Get("X-Audio-Duration-Seconds"); got != "1" {
+		t.Fatalf("X-Audio-Duration-Seconds of one second at 8 kHz = %q", got)
+	}
+}
+
+// fmtChunk returns the 16 bytes of a PCM fmt chunk body as the WAV spec lays them out
+func fmtChunk(formatTag, channels, sampleRate, bits int) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint16(b[0:], uint16(formatTag))
+	binary.LittleEndian.PutUint16(b[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(b[4:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(b[8:], uint32(sampleRate*channels*bits/8))
+	binary.LittleEndian.PutUint16(b[12:], uint16(channels*bits/8))
+	binary.LittleEndian.PutUint16(b[14:], uint16(bits))
+	return b
+}
+
+func TestCreateWAVHeaderSampleFormats(t *testing.T) {
+	tests := []struct {
+		bits      int
+		float     bool
+		formatTag int
+	}{
+		{16, false, 1},
+		{24, false, 1},
+		{32, false, 1},
+		{32, true, 3},
+	}
+	for _, tt := range tests {
+		header, _ := createWAVHeader(0, 48000, 2, tt.bits, tt.float)
+		if want := fmtChunk(tt.formatTag, 2, 48000, tt.bits); !bytes.Equal(header[20:36], want) {
+			t.Errorf("%d-bit float=%v fmt chunk = % x, want % x", tt.bits, tt.float, header[20:36], want)
+		}
+	}
+}
+
+func TestPostStoresSampleFormat(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	// Half a second of 24-bit mono at 16 kHz
+	mustPost(t, "uid=alice&bits=24", make([]byte, 8000*3))
+	mustPost(t, "uid=bob&bits=32&format=float", make([]byte, 8000*4))
+	for _, uid := range []string{"alice", "bob"} {
+		if w := serve(t, HandleFinalize, http.MethodPost, "/?uid="+uid, nil); w.Code != http.StatusOK {
+			t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+		}
+	}
+
+	alice, _ := f.get("alice/2024-05-01T12-00-00Z.wav")
+	if want := fmtChunk(1, 1, 16000, 24); !bytes.Equal(alice[20:36], want) {
+		t.Errorf("24-bit file has fmt chunk % x, want % x", alice[20:36], want)
+	}
+	bob, _ := f.get("bob/2024-05-01T12-00-00Z.wav")
+	if want := fmtChunk(3, 1, 16000, 32); !bytes.Equal(bob[20:36], want) {
+		t.Errorf("float file has fmt chunk % x, want % x", bob[20:36], want)
+	}
+}
+
+func TestPostAudioTimesOut(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &gcsTimeout, 100*time.Millisecond)
+	// The bucket hangs until the client gives up
+	f.fail = func(r *http.Request) int {
+		<-r.Context().Done()
+		return http.StatusServiceUnavailable
+	}
+
+	start := time.Now()
+	w := postAudio(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("POST to a hanging bucket answered %d, want %d: %s", w.Code, http.StatusGatewayTimeout, w.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("POST took %v despite a GCS_TIMEOUT of %v", elapsed, gcsTimeout)
+	}
+}
+
+func TestPostAudioRollsOverAtMaxFileBytes(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	// Well short of MAX_DURATION, and not a whole number of frames
+	setVar(t, &maxFileBytes, 16001)
+
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	clock.Advance(time.Second)
+	w := mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("chunk after MAX_FILE_BYTES answered %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	if _, dataLen := storedWAV(t, f, "alice/2024-05-01T12-00-00Z.wav"); dataLen != 16000 {
+		t.Fatalf("first file holds %d bytes of audio, want 16000", dataLen)
+	}
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.Filename == "alice/2024-05-01T12-00-00Z.wav" || metadata.CurrentSize != 8000 {
+		t.Fatalf("after rollover metadata = %s of %d bytes", metadata.Filename, metadata.CurrentSize)
+	}
+}
+
+func TestPostAudioLocation(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	w := mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "alice/2024-05-01T12-00-00Z.wav" {
+		t.Fatalf("first chunk answered %d with Location %q, want 201 and the new file", w.Code, w.Header().Get("Location"))
+	}
+	w = mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+		t.Fatalf("append answered %d with Location %q, want 200 and none", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestPostAudioBucketOverride(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	// The fake only serves testBucket, so it must be reached through the override
+	t.Setenv("GCS_BUCKET_NAME", "default-bucket")
+	setVar(t, &allowedBuckets, []string{testBucket})
+
+	mustPost(t, "uid=alice&bucket="+testBucket, tone(100*time.Millisecond, 16000))
+	req := httptest.NewRequest(http.MethodPost, "/?uid=bob", bytes.NewReader(tone(100*time.Millisecond, 16000)))
+	req.Header.Set("X-Bucket", testBucket)
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, req)
+	if w.Code >= 300 {
+		t.Fatalf("POST with X-Bucket answered %d: %s", w.Code, w.Body)
+	}
+	for _, uid := range []string{"alice", "bob"} {
+		if currentMetadata(t, f, uid) == nil {
+			t.Fatalf("%s's upload did not reach the override bucket", uid)
+		}
+	}
+
+	before := len(f.names(""))
+	w = postAudio(t, "uid=carol&bucket=someone-elses-bucket", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST to a disallowed bucket answered %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if after := len(f.names("")); after != before {
+		t.Fatalf("disallowed override wrote %d objects", after-before)
+	}
+}
+
+func TestPostAudioUnreachableBucket(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	denied := true
+	f.fail = func(r *http.Request) int {
+		if denied && r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/"+testBucket+"/o") {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+
+	w := postAudio(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "permission denied") {
+		t.Fatalf("POST to a denied bucket answered %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), testBucket) || strings.Contains(w.Body.String(), "403") {
+		t.Fatalf("response leaks the error detail: %s", w.Body)
+	}
+
+	// The fake serves no other bucket, so GCS answers ErrBucketNotExist
+	t.Setenv("GCS_BUCKET_NAME", "missing-bucket")
+	w = postAudio(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "does not exist") {
+		t.Fatalf("POST to a missing bucket answered %d: %s", w.Code, w.Body)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("unreachable buckets were written %v", names)
+	}
+
+	// A failed probe is not remembered, so the bucket is usable once access is granted
+	t.Setenv("GCS_BUCKET_NAME", testBucket)
+	denied = false
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+}
+
+func TestPostAudioRejectsSampleRateMismatch(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	mustPost(t, "uid=alice&sample_rate=16000", tone(500*time.Millisecond, 16000))
+
+	w := postAudio(t, "uid=alice&sample_rate=8000", tone(500*time.Millisecond, 8000))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("8 kHz append to a 16 kHz file answered %d, want %d", w.Code, http.StatusConflict)
+	}
+	if !strings.Contains(w.Body.String(), "16000") {
+		t.Fatalf("conflict does not name the file's rate: %s", w.Body)
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != 16000 {
+		t.Fatalf("rejected append changed the file to %d bytes", size)
+	}
+
+	// Once the file would roll over anyway, the new rate starts a new file
+	clock.Advance(inactivityLimit)
+	if w := mustPost(t, "uid=alice&sample_rate=8000", tone(500*time.Millisecond, 8000)); w.Code != http.StatusCreated {
+		t.Fatalf("8 kHz chunk after the inactivity limit answered %d, want %d", w.Code, http.StatusCreated)
+	}
+	if rate := currentMetadata(t, f, "alice").SampleRate; rate != 8000 {
+		t.Fatalf("new file is %d Hz, want 8000", rate)
+	}
+}
+
+func TestCalculateDuration(t *testing.T) {
+	tests := []struct {
+		size, sampleRate, channels, bits int
+		want                             time.Duration
+	}{
+		{32000, 16000, 1, 16, time.Second},
+		{16000, 8000, 1, 16, time.Second},
+		{192000, 48000, 2, 16, time.Second},
+		{44100, 44100, 1, 16, 500 * time.Millisecond},
+		{144000, 48000, 1, 24, time.Second},
+		{64000, 16000, 1, 32, time.Second},
+		{8000, 8000, 1, 8, time.Second},
+		{0, 16000, 1, 16, 0},
+	}
+	for _, tt := range tests {
+		if got := calculateDuration(tt.size, tt.sampleRate, tt.channels, tt.bits); got != tt.want {
+			t.Errorf("calculateDuration(%d, %d Hz, %d ch, %d bits) = %v, want %v", tt.size, tt.sampleRate, tt.channels, tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataWriteFailureIsNotAppendedTwice(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	chunk := tone(250*time.Millisecond, 16000)
+	mustPost(t, "uid=alice&chunk_id=c1", chunk)
+
+	f.fail = func(r *http.Request) int {
+		if r.Method != http.MethodGet && r.URL.Query().Get("name") == metadataPath("alice") {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	w := mustPost(t, "uid=alice&chunk_id=c2", chunk)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("chunk whose metadata update failed answered %d, want %d", w.Code, http.StatusAccepted)
+	}
+	f.fail = nil
+
+	// A client that resends anyway has its chunk recognized, and the next chunk
+	// accounts for the one the metadata missed
+	mustPost(t, "uid=alice&chunk_id=c2", chunk)
+	mustPost(t, "uid=alice&chunk_id=c3", chunk)
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.CurrentSize != 3*len(chunk) {
+		t.Fatalf("file records %d bytes after three distinct chunks, want %d", metadata.CurrentSize, 3*len(chunk))
+	}
+	if pcm, _ := f.get(pcmPath(metadata.Filename)); len(pcm) != 3*len(chunk) {
+		t.Fatalf("accumulator holds %d bytes after three distinct chunks, want %d", len(pcm), 3*len(chunk))
+	}
+}
+
+func TestPostSplitsBodyLargerThanRemainingCapacity(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &maxDuration, time.Second)
+
+	first := tone(750*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", first)
+	clock.Advance(time.Second)
+	// 1.25 s of audio against 0.25 s of room
+	body := sine(440, 16000, 20000, 0.5)
+	w := mustPost(t, "uid=alice", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("overflowing chunk answered %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	data, _ := f.get("alice/2024-05-01T12-00-00Z.wav")
+	if _, dataLen := storedWAV(t, f, "alice/2024-05-01T12-00-00Z.wav"); dataLen != 32000 {
+		t.Fatalf("first file holds %d bytes of audio, want exactly MAX_DURATION", dataLen)
+	}
+	if !bytes.Equal(data[wavHeaderSize:], append(first, body[:8000]...)) {
+		t.Fatal("first file does not end with the head of the chunk")
+	}
+	metadata := currentMetadata(t, f, "alice")
+	pcm, _ := f.get(pcmPath(metadata.Filename))
+	if !bytes.Equal(pcm, body[8000:]) {
+		t.Fatalf("new file holds %d bytes, want the %d byte remainder", len(pcm), len(body)-8000)
+	}
+}
+
+func TestEmptyPostCreatesNothing(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	if w := postAudio(t, "uid=alice", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("empty POST answered %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("empty POST wrote %v", names)
+	}
+
+	// An empty POST to an open file leaves it as it was
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	before := currentMetadata(t, f, "alice")
+	if w := postAudio(t, "uid=alice", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("empty POST answered %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if after := currentMetadata(t, f, "alice"); !reflect.DeepEqual(after, before) {
+		t.Fatalf("empty POST changed the metadata from %+v to %+v", before, after)
+	}
+}
+
+func TestPostForceNew(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	first := currentMetadata(t, f, "alice").Filename
+
+	clock.Advance(time.Second)
+	w := mustPost(t, "uid=alice&force_new=true", tone(250*time.Millisecond, 16000))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("force_new answered %d, want %d", w.Code, http.StatusCreated)
+	}
+	second := currentMetadata(t, f, "alice")
+	if second.Filename == first || second.CurrentSize != 8000 {
+		t.Fatalf("force_new left metadata at %s of %d bytes", second.Filename, second.CurrentSize)
+	}
+	if _, dataLen := storedWAV(t, f, first); dataLen != 16000 {
+		t.Fatalf("forced rollover finalized %d bytes, want 16000", dataLen)
+	}
+
+	if w := postAudio(t, "uid=alice&force_new=maybe", tone(250*time.Millisecond, 16000)); w.Code != http.StatusBadRequest {
+		t.Fatalf("force_new=maybe answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,43 @@
+package function
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	audioBytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "audio_bytes_received_total",
+		Help: "Bytes of audio received in request bodies, before decoding.",
+	})
+	wavFilesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wav_files_created_total",
+		Help: "WAV files started.",
+	})
+	appendDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "append_duration_seconds",
+		Help:    "Time taken to compose a chunk onto an open WAV file.",
+		Buckets: prometheus.DefBuckets,
+	})
+	gcsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcs_errors_total",
+		Help: "Failed GCS operations, by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(audioBytesReceived, wavFilesCreated, appendDuration, gcsErrors)
+}
+
+// countGCSError records a failed GCS operation
+func countGCSError(operation string) {
+	gcsErrors.WithLabelValues(operation).Inc()
+}
+
+// HandleMetrics serves the Prometheus metrics of this instance. It is separate from
+// the audio handlers and never touches GCS, so scraping is cheap.
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
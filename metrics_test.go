@@ -0,0 +1,51 @@
+package function
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetric returns the value HandleMetrics reports for the sample named name,
+// labels included, or 0 when it is absent
+func scrapeMetric(t *testing.T, name string) float64 {
+	t.Helper()
+	w := serve(t, HandleMetrics, http.MethodGet, "/", nil)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		sample, value, ok := strings.Cut(scanner.Text(), " ")
+		if ok && sample == name {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountUploads(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(100*time.Millisecond, 16000)
+	received := scrapeMetric(t, "audio_bytes_received_total")
+	created := scrapeMetric(t, "wav_files_created_total")
+	appends := scrapeMetric(t, "append_duration_seconds_count")
+
+	mustPost(t, "uid=alice", body)
+	mustPost(t, "uid=alice", body)
+
+	if got := scrapeMetric(t, "audio_bytes_received_total") - received; got != float64(2*len(body)) {
+		t.Fatalf("audio_bytes_received_total advanced by %v, want %d", got, 2*len(body))
+	}
+	if got := scrapeMetric(t, "wav_files_created_total") - created; got != 1 {
+		t.Fatalf("wav_files_created_total advanced by %v, want 1", got)
+	}
+	if got := scrapeMetric(t, "append_duration_seconds_count") - appends; got != 1 {
+		t.Fatalf("append_duration_seconds_count advanced by %v, want 1", got)
+	}
+}
@@ -0,0 +1,63 @@
+package function
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+// audioFormField is the multipart field carrying the audio of a form upload
+const audioFormField = "audio"
+
+// multipartBoundary returns the boundary of a multipart/form-data Content-Type
+func multipartBoundary(contentType string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// readMultipartAudio parses a multipart/form-data body and returns the contents of
+// its audio field. Every other field is added to query as a parameter, unless the
+// query string already sets it, so form uploads flow through the same parsing as
+// query parameters.
+func readMultipartAudio(body []byte, boundary string, query url.Values) ([]byte, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var audio []byte
+	found := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart body: %v", err)
+		}
+
+		data, err := io.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart field %q: %v", part.FormName(), err)
+		}
+
+		name := part.FormName()
+		switch {
+		case name == audioFormField:
+			if found {
+				return nil, errors.New("multipart body has more than one audio field")
+			}
+			audio, found = data, true
+		case name != "" && !query.Has(name):
+			query.Set(name, string(data))
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("multipart body has no %q field", audioFormField)
+	}
+	return audio, nil
+}
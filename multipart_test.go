@@ -0,0 +1,78 @@
+package function
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// postMultipart sends fields and, unless audio is nil, an audio file part to
+// HandlePostAudio as multipart/form-data
+func postMultipart(t *testing.T, query string, fields map[string]string, audio []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if audio != nil {
+		part, _ := form.CreateFormFile(audioFormField, "chunk.pcm")
+		part.Write(audio)
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/?"+query, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	HandlePostAudio(w, req)
+	return w
+}
+
+func TestPostMultipartAudio(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	audio := tone(500*time.Millisecond, 8000)
+
+	w := postMultipart(t, "", map[string]string{"uid": "alice", "sample_rate": "8000"}, audio)
+	if w.Code >= 300 {
+		t.Fatalf("multipart POST answered %d: %s", w.Code, w.Body)
+	}
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.SampleRate != 8000 {
+		t.Fatalf("form field sample_rate was ignored, file is %d Hz", metadata.SampleRate)
+	}
+	got, _ := f.get(pcmPath(metadata.Filename))
+	if !bytes.Equal(got, audio) {
+		t.Fatalf("stored %d bytes that differ from the %d byte audio part", len(got), len(audio))
+	}
+}
+
+func TestPostMultipartQueryWins(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	w := postMultipart(t, "uid=alice", map[string]string{"uid": "mallory"}, tone(100*time.Millisecond, 16000))
+	if w.Code >= 300 {
+		t.Fatalf("multipart POST answered %d: %s", w.Code, w.Body)
+	}
+	if _, ok := f.get(metadataPath("mallory")); ok {
+		t.Fatal("form field overrode the uid query parameter")
+	}
+	if currentMetadata(t, f, "alice") == nil {
+		t.Fatal("upload was not recorded under the query uid")
+	}
+}
+
+func TestPostMultipartWithoutAudio(t *testing.T) {
+	f := newFakeGCS(t)
+	w := postMultipart(t, "", map[string]string{"uid": "alice"}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("multipart POST without audio answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if names := f.names(""); len(names) != 0 {
+		t.Fatalf("rejected upload wrote %v", names)
+	}
+}
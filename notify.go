@@ -0,0 +1,95 @@
+package function
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// finalizedMessage is the Pub/Sub message published when a recording is finalized
+type finalizedMessage struct {
+	Filename        string  `json:"filename"`
+	UID             string  `json:"uid"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Size            int     `json:"size"`
+}
+
+// pubsubService caches the Pub/Sub client across warm invocations, along with the
+// encoded credentials it was built from
+var pubsubService struct {
+	sync.Mutex
+	service *pubsub.Service
+	creds   string
+}
+
+// getPubSubService returns the shared Pub/Sub client, built from the same
+// credentials as the storage client
+func getPubSubService() (*pubsub.Service, error) {
+	credsEnv := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")
+	if credsEnv == "" {
+		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS_JSON environment variable is not set")
+	}
+
+	pubsubService.Lock()
+	defer pubsubService.Unlock()
+	if pubsubService.service != nil && pubsubService.creds == credsEnv {
+		return pubsubService.service, nil
+	}
+
+	creds, err := base64.StdEncoding.DecodeString(credsEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode credentials: %v", err)
+	}
+	service, err := pubsub.NewService(context.Background(), option.WithCredentialsJSON(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %v", err)
+	}
+	pubsubService.service = service
+	pubsubService.creds = credsEnv
+	return service, nil
+}
+
+// notifyFinalized publishes entry to the topic named by PUBSUB_TOPIC, in the form
+// projects/{project}/topics/{topic}, so downstream pipelines need not poll the
+// bucket. Publishing is opt-in and best effort: failures are logged and never fail
+// the request that finalized the recording.
+func notifyFinalized(ctx context.Context, uid string, entry recordingEntry) {
+	topic := os.Getenv("PUBSUB_TOPIC")
+	if topic == "" {
+		return
+	}
+	logger := loggerFrom(ctx).With("file", entry.Filename, "topic", topic)
+
+	data, err := json.Marshal(finalizedMessage{
+		Filename:        entry.Filename,
+		UID:             uid,
+		DurationSeconds: entry.DurationSeconds,
+		Size:            entry.Size,
+	})
+	if err != nil {
+		logger.Error("Failed to encode finalized notification", "error", err)
+		return
+	}
+
+	service, err := getPubSubService()
+	if err != nil {
+		logger.Error("Failed to publish finalized notification", "error", err)
+		return
+	}
+	request := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{{
+		Data:       base64.StdEncoding.EncodeToString(data),
+		Attributes: map[string]string{"uid": uid},
+	}}}
+	if _, err := service.Projects.Topics.Publish(topic, request).Context(ctx).Do(); err != nil {
+		countGCSError("publish")
+		logger.Error("Failed to publish finalized notification", "error", err)
+		return
+	}
+	logger.Info("Published finalized notification")
+}
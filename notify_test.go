@@ -0,0 +1,111 @@
+package function
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// fakePublisher is a Pub/Sub endpoint recording every published message
+type fakePublisher struct {
+	mu       sync.Mutex
+	topics   []string
+	messages []*pubsub.PubsubMessage
+	// status, when non-zero, is returned instead of accepting the publish
+	status int
+}
+
+// newFakePublisher starts a fakePublisher and points the shared Pub/Sub client and
+// PUBSUB_TOPIC at it for the rest of the test
+func newFakePublisher(t *testing.T, topic string) *fakePublisher {
+	t.Helper()
+	p := &fakePublisher{}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+
+	service, err := pubsub.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create Pub/Sub client: %v", err)
+	}
+	t.Setenv("PUBSUB_TOPIC", topic)
+	pubsubService.Lock()
+	oldService, oldCreds := pubsubService.service, pubsubService.creds
+	pubsubService.service, pubsubService.creds = service, "fake"
+	pubsubService.Unlock()
+	t.Cleanup(func() {
+		pubsubService.Lock()
+		pubsubService.service, pubsubService.creds = oldService, oldCreds
+		pubsubService.Unlock()
+	})
+	return p
+}
+
+func (p *fakePublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status != 0 {
+		http.Error(w, http.StatusText(p.status), p.status)
+		return
+	}
+	var request pubsub.PublishRequest
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.topics = append(p.topics, r.URL.Path)
+	p.messages = append(p.messages, request.Messages...)
+	json.NewEncoder(w).Encode(pubsub.PublishResponse{MessageIds: []string{"1"}})
+}
+
+func TestFinalizePublishesNotification(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	p := newFakePublisher(t, "projects/omi/topics/recordings")
+
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	if len(p.messages) != 1 {
+		t.Fatalf("published %d messages, want 1", len(p.messages))
+	}
+	if p.topics[0] != "/v1/projects/omi/topics/recordings:publish" {
+		t.Fatalf("published to %s", p.topics[0])
+	}
+	data, err := base64.StdEncoding.DecodeString(p.messages[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got finalizedMessage
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := finalizedMessage{Filename: "alice/2024-05-01T12-00-00Z.wav", UID: "alice", DurationSeconds: 0.5, Size: wavObjectSize(16000)}
+	if got != want || p.messages[0].Attributes["uid"] != "alice" {
+		t.Fatalf("published %+v with attributes %v, want %+v", got, p.messages[0].Attributes, want)
+	}
+}
+
+func TestFinalizeSucceedsWhenPublishFails(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	p := newFakePublisher(t, "projects/omi/topics/recordings")
+	p.status = http.StatusForbidden
+
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize with a failing publisher answered %d: %s", w.Code, w.Body)
+	}
+	storedWAV(t, f, "alice/2024-05-01T12-00-00Z.wav")
+}
@@ -0,0 +1,162 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// pairPrefix holds the pairing buffer of each session recording a stereo pair
+const pairPrefix = "pairs/"
+
+// Two devices worn one per ear can record a session as a stereo pair: each posts its
+// own mono chunks with pair_channel=left or right, and the session's file is stereo.
+// A chunk only reaches the file once the other ear has sent audio for the same
+// stretch of time, so until then it waits in the session's pairing buffer. An ear
+// that joins late is aligned by when its audio began, with silence before it, and an
+// ear that falls more than PAIR_MAX_SKEW behind the other is padded with silence, so
+// a device that drops out doesn't hold back its partner's audio forever.
+
+// pairEar is the buffered state of one ear of a pair
+type pairEar struct {
+	// Joined is set once the ear has sent audio
+	Joined bool `json:"joined,omitempty"`
+	// Pending is the ear's audio the other ear has not matched yet
+	Pending []byte `json:"pending,omitempty"`
+}
+
+// pairState is the pairing buffer of a session, in the format both ears send
+type pairState struct {
+	// Start is when the audio of the first ear to join began
+	Start      time.Time `json:"start"`
+	SampleRate int       `json:"sample_rate"`
+	Bits       int       `json:"bits"`
+	Float      bool      `json:"float,omitempty"`
+	// Released counts the frames of each ear already written to the file as stereo
+	Released int64   `json:"released"`
+	Left     pairEar `json:"left"`
+	Right    pairEar `json:"right"`
+}
+
+// pairPath returns the name of the pairing buffer object of session key
+func pairPath(key string) string {
+	return pairPrefix + key + ".json"
+}
+
+// pairChunk adds mono, the audio one ear of session key sent, to the session's
+// pairing buffer and returns the stereo audio now matched by both ears, which may be
+// empty. The buffer is updated under a generation precondition, retried up to
+// maxCASAttempts times when the other ear updates it first.
+//
+// The buffer is updated before the returned audio is written, so if that write fails
+// the audio is lost rather than stored twice: a resent chunk is buffered again.
+// Failures are returned as a *chunkError.
+func pairChunk(ctx context.Context, store objectStore, key string, params audioParams, mono []byte) ([]byte, error) {
+	if params.channels != 1 {
+		return nil, &chunkError{status: http.StatusBadRequest, message: fmt.Sprintf("pair_channel requires mono audio, got %d channels", params.channels)}
+	}
+	frameSize := params.bits / 8
+	if len(mono)%frameSize != 0 {
+		return nil, &chunkError{status: http.StatusBadRequest, message: fmt.Sprintf("Body length %d is not a multiple of the %d-byte sample size", len(mono), frameSize)}
+	}
+
+	name := pairPath(key)
+	for attempt := 1; ; attempt++ {
+		var state *pairState
+		data, generation, err := store.Read(ctx, name)
+		switch {
+		case err == storage.ErrObjectNotExist:
+			generation = 0
+		case err != nil:
+			return nil, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to read pairing buffer: %v", err)}
+		default:
+			state = &pairState{}
+			if err := json.Unmarshal(data, state); err != nil {
+				loggerFrom(ctx).Warn("Discarding corrupt pairing buffer", "error", err)
+				state = nil
+			}
+		}
+
+		stereo, state, err := pairAudio(state, params, mono, nowFunc())
+		if err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(state)
+		if err != nil {
+			return nil, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to encode pairing buffer: %v", err)}
+		}
+		_, err = store.Write(ctx, name, "application/json", data, generation)
+		if err == nil {
+			return stereo, nil
+		}
+		if !isPreconditionFailed(err) || attempt >= maxCASAttempts {
+			countGCSError("pair")
+			return nil, &chunkError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to update pairing buffer: %v", err)}
+		}
+		loggerFrom(ctx).Info("Pairing buffer changed concurrently, retrying", "attempt", attempt, "max_attempts", maxCASAttempts)
+		time.Sleep(casBackoff(attempt))
+	}
+}
+
+// pairAudio adds mono, received at now from the ear params.pairChannel names, to
+// state, which is nil for a pair that has not started, and returns the stereo audio
+// both ears now cover along with the updated state. Audio in another format than the
+// buffered audio is refused with a 409; once the buffer is empty, the pair restarts
+// in the new format.
+func pairAudio(state *pairState, params audioParams, mono []byte, now time.Time) ([]byte, *pairState, error) {
+	frameSize := params.bits / 8
+	began := now.Add(-calculateDuration(len(mono), params.sampleRate, 1, params.bits))
+	if state != nil && (state.SampleRate != params.sampleRate || state.Bits != params.bits || state.Float != params.float) {
+		if len(state.Left.Pending) > 0 || len(state.Right.Pending) > 0 {
+			return nil, nil, &chunkError{status: http.StatusConflict, message: fmt.Sprintf("Audio at %d Hz, %d bits does not match the %d Hz, %d-bit audio the other ear is sending",
+				params.sampleRate, params.bits, state.SampleRate, state.Bits)}
+		}
+		state = nil
+	}
+	if state == nil {
+		state = &pairState{Start: began, SampleRate: params.sampleRate, Bits: params.bits, Float: params.float}
+	}
+
+	ear, other := &state.Left, &state.Right
+	if params.pairChannel == "right" {
+		ear, other = other, ear
+	}
+
+	// An ear joining late starts with the silence it missed since the pair began
+	if !ear.Joined {
+		ear.Joined = true
+		offset := int64(began.Sub(state.Start).Seconds() * float64(state.SampleRate))
+		if position := state.Released + int64(len(ear.Pending)/frameSize); offset > position {
+			ear.Pending = append(ear.Pending, make([]byte, (offset-position)*int64(frameSize))...)
+		}
+	}
+	ear.Pending = append(ear.Pending, mono...)
+
+	// Past PAIR_MAX_SKEW, the other ear is taken to have dropped out for that stretch
+	maxSkew := int(pairMaxSkew.Seconds()*float64(state.SampleRate)) * frameSize
+	if lag := len(ear.Pending) - len(other.Pending); lag > maxSkew {
+		other.Pending = append(other.Pending, make([]byte, lag-maxSkew)...)
+	}
+
+	frames := min(len(state.Left.Pending), len(state.Right.Pending)) / frameSize
+	stereo := interleave(state.Left.Pending[:frames*frameSize], state.Right.Pending[:frames*frameSize], frameSize)
+	state.Left.Pending = state.Left.Pending[frames*frameSize:]
+	state.Right.Pending = state.Right.Pending[frames*frameSize:]
+	state.Released += int64(frames)
+	return stereo, state, nil
+}
+
+// interleave joins left and right, mono audio of equal length in samples of
+// sampleSize bytes, into stereo
+func interleave(left, right []byte, sampleSize int) []byte {
+	stereo := make([]byte, 0, len(left)+len(right))
+	for i := 0; i < len(left); i += sampleSize {
+		stereo = append(stereo, left[i:i+sampleSize]...)
+		stereo = append(stereo, right[i:i+sampleSize]...)
+	}
+	return stereo
+}
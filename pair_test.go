@@ -0,0 +1,124 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// samples returns 16-bit little-endian PCM holding values
+func samples(values ...int16) []byte {
+	pcm := make([]byte, 0, len(values)*2)
+	for _, v := range values {
+		pcm = binary.LittleEndian.AppendUint16(pcm, uint16(v))
+	}
+	return pcm
+}
+
+func TestPairAudio(t *testing.T) {
+	setVar(t, &pairMaxSkew, 2*time.Second)
+	// At 4 Hz a sample lasts 250ms, which keeps the arithmetic readable
+	left := audioParams{sampleRate: 4, channels: 1, bits: 16, pairChannel: "left"}
+	right := left
+	right.pairChannel = "right"
+
+	stereo, state, err := pairAudio(nil, left, samples(1, 2, 3), testStart)
+	if err != nil || len(stereo) != 0 {
+		t.Fatalf("first ear released %v, %v", stereo, err)
+	}
+	// Both ears' audio began 750ms before testStart
+	stereo, state, _ = pairAudio(state, right, samples(-1, -2), testStart.Add(-250*time.Millisecond))
+	if want := samples(1, -1, 2, -2); !bytes.Equal(stereo, want) {
+		t.Fatalf("matched audio = %v, want %v", stereo, want)
+	}
+	stereo, state, _ = pairAudio(state, right, samples(-3, -4), testStart.Add(250*time.Millisecond))
+	if want := samples(3, -3); !bytes.Equal(stereo, want) || !bytes.Equal(state.Right.Pending, samples(-4)) {
+		t.Fatalf("matched audio = %v with %v pending, want %v", stereo, state.Right.Pending, want)
+	}
+
+	// A format change waits for the buffer to drain
+	wide := left
+	wide.sampleRate = 8
+	if _, _, err := pairAudio(state, wide, samples(5), testStart); err == nil {
+		t.Fatal("audio in another format was paired with buffered audio")
+	}
+}
+
+func TestPairAudioAlignsLateEar(t *testing.T) {
+	setVar(t, &pairMaxSkew, 2*time.Second)
+	left := audioParams{sampleRate: 4, channels: 1, bits: 16, pairChannel: "left"}
+	right := left
+	right.pairChannel = "right"
+
+	// Left's audio began at testStart; right's began 500ms, two samples, later
+	_, state, _ := pairAudio(nil, left, samples(1, 2, 3, 4), testStart.Add(time.Second))
+	stereo, _, _ := pairAudio(state, right, samples(-3, -4), testStart.Add(time.Second))
+	if want := samples(1, 0, 2, 0, 3, -3, 4, -4); !bytes.Equal(stereo, want) {
+		t.Fatalf("late ear paired as %v, want %v", stereo, want)
+	}
+}
+
+func TestPairAudioPadsStalledEar(t *testing.T) {
+	setVar(t, &pairMaxSkew, 500*time.Millisecond)
+	left := audioParams{sampleRate: 4, channels: 1, bits: 16, pairChannel: "left"}
+
+	// Only two samples may wait for the silent right ear
+	stereo, state, _ := pairAudio(nil, left, samples(1, 2, 3, 4, 5), testStart)
+	if want := samples(1, 0, 2, 0, 3, 0); !bytes.Equal(stereo, want) {
+		t.Fatalf("stalled pair released %v, want %v", stereo, want)
+	}
+	if !bytes.Equal(state.Left.Pending, samples(4, 5)) {
+		t.Fatalf("left ear kept %v pending", state.Left.Pending)
+	}
+}
+
+func TestPostPairedEars(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	left, right := sine(440, 16000, 4000, 8000), sine(660, 16000, 4000, 8000)
+
+	// Each ear sends two chunks of 250ms, the left one's arriving first
+	clock.Advance(250 * time.Millisecond)
+	w := mustPost(t, "uid=alice&pair_channel=left", left[:4000])
+	if currentMetadata(t, f, "alice") != nil {
+		t.Fatalf("unmatched ear started a file: %s", w.Body)
+	}
+	mustPost(t, "uid=alice&pair_channel=right", right[:4000])
+	clock.Advance(250 * time.Millisecond)
+	mustPost(t, "uid=alice&pair_channel=left", left[4000:])
+	mustPost(t, "uid=alice&pair_channel=right", right[4000:])
+
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.fileChannels() != 2 {
+		t.Fatalf("paired recording has %d channels", metadata.fileChannels())
+	}
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	if format, _ := storedWAV(t, f, metadata.Filename); format.channels != 2 {
+		t.Fatalf("finalized recording declares %d channels", format.channels)
+	}
+	data, _ := f.get(metadata.Filename)
+	if want := interleave(left, right, 2); !bytes.Equal(data[wavHeaderSize:], want) {
+		t.Fatal("stereo recording does not interleave the two ears")
+	}
+	if _, ok := f.get(pairPath("alice")); ok {
+		t.Fatal("finalize left the pairing buffer behind")
+	}
+}
+
+func TestPostPairRejectsInvalidParams(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	for _, query := range []string{
+		"uid=alice&pair_channel=left&channels=2",
+		"uid=alice&pair_channel=middle",
+		"uid=alice&pair_channel=left&seq=1",
+	} {
+		if w := postAudio(t, query, tone(100*time.Millisecond, 16000)); w.Code != http.StatusBadRequest {
+			t.Errorf("POST ?%s answered %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package function
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptedParams is the registry of query parameters HandlePostAudio understands.
+// New parameters must be added here or strict mode will reject them.
+var acceptedParams = []string{
+	"uid",
+	"sample_rate",
+	"byte_order",
+	"chunk_id",
+	"channels",
+	"seq",
+	"codec",
+	"bits",
+	"format",
+	"device_id",
+	"bucket",
+	"dry_run",
+	"framing",
+	"profile",
+	"session_id",
+	"force_new",
+	"pair_channel",
+	"lang",
+}
+
+// strictParamsEnabled reports whether STRICT_PARAMS asks for unknown params to be rejected
+func strictParamsEnabled() bool {
+	strict, err := strconv.ParseBool(os.Getenv("STRICT_PARAMS"))
+	return err == nil && strict
+}
+
+// unknownParams returns the sorted names in query that are not in acceptedParams
+func unknownParams(query url.Values) []string {
+	accepted := make(map[string]bool, len(acceptedParams))
+	for _, name := range acceptedParams {
+		accepted[name] = true
+	}
+
+	var unknown []string
+	for name := range query {
+		if !accepted[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// allowedSampleRates are the sample rates accepted in the sample_rate param
+var allowedSampleRates = map[int]bool{
+	8000:  true,
+	16000: true,
+	44100: true,
+	48000: true,
+}
+
+// audioProfile is a named audio format a client can select with the profile param
+// instead of passing sample_rate, channels and bits separately
+type audioProfile struct {
+	sampleRate int
+	channels   int
+	bits       int
+}
+
+// audioProfiles are the presets accepted in the profile param
+var audioProfiles = map[string]audioProfile{
+	"omi_default": {sampleRate: 16000, channels: 1, bits: 16},
+	"phone":       {sampleRate: 8000, channels: 1, bits: 16},
+	"hifi":        {sampleRate: 48000, channels: 2, bits: 16},
+}
+
+// audioParams holds the numeric query params of an upload once validated
+type audioParams struct {
+	sampleRate       int
+	clientSeq        *int64
+	channels         int
+	channelsDeclared bool
+	bits             int
+	float            bool
+	formatDeclared   bool
+	// dryRun asks for the planned outcome of the upload without writing it
+	dryRun bool
+	// forceNew asks for the chunk to start a new file whatever shouldCreateNewFile says
+	forceNew bool
+	// pairChannel names the ear of a stereo pair the chunk was recorded by, "left" or
+	// "right", or is "" for a chunk that is the session's audio on its own
+	pairChannel string
+	// lang is the BCP-47 tag of the session's spoken language, or "" when the chunk
+	// gives no hint
+	lang string
+}
+
+// parseAudioParams parses and bounds-checks every numeric query param of an upload
+// so a malformed or absurd value is rejected before it can reach a WAV header or a
+// duration calculation. The error names the offending param. A profile fills in the
+// sample_rate, channels and bits params that are absent, so explicit params override it.
+func parseAudioParams(query url.Values) (params audioParams, err error) {
+	sampleRate, channels, bits := query.Get("sample_rate"), query.Get("channels"), query.Get("bits")
+	if name := query.Get("profile"); name != "" {
+		profile, ok := audioProfiles[name]
+		if !ok {
+			return audioParams{}, fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(profileNames(), ", "))
+		}
+		if sampleRate == "" {
+			sampleRate = strconv.Itoa(profile.sampleRate)
+		}
+		if channels == "" {
+			channels = strconv.Itoa(profile.channels)
+		}
+		if bits == "" {
+			bits = strconv.Itoa(profile.bits)
+		}
+	}
+
+	if params.sampleRate, err = parseSampleRate(sampleRate); err != nil {
+		return audioParams{}, err
+	}
+	if params.clientSeq, err = parseClientSeq(query.Get("seq")); err != nil {
+		return audioParams{}, err
+	}
+	if params.channels, params.channelsDeclared, err = parseChannels(channels); err != nil {
+		return audioParams{}, err
+	}
+	if params.bits, params.float, params.formatDeclared, err = parseSampleFormat(bits, query.Get("format")); err != nil {
+		return audioParams{}, err
+	}
+	if value := query.Get("dry_run"); value != "" {
+		if params.dryRun, err = strconv.ParseBool(value); err != nil {
+			return audioParams{}, fmt.Errorf("invalid dry_run %q, expected true or false", value)
+		}
+	}
+	if value := query.Get("force_new"); value != "" {
+		if params.forceNew, err = strconv.ParseBool(value); err != nil {
+			return audioParams{}, fmt.Errorf("invalid force_new %q, expected true or false", value)
+		}
+	}
+	switch params.pairChannel = query.Get("pair_channel"); {
+	case params.pairChannel == "":
+	case params.pairChannel != "left" && params.pairChannel != "right":
+		return audioParams{}, fmt.Errorf("invalid pair_channel %q, expected left or right", params.pairChannel)
+	case params.dryRun:
+		return audioParams{}, fmt.Errorf("dry_run is not supported with pair_channel")
+	case params.clientSeq != nil:
+		// The two ears of a pair each count their own chunks
+		return audioParams{}, fmt.Errorf("seq is not supported with pair_channel")
+	}
+	if params.lang, err = parseLanguage(query.Get("lang")); err != nil {
+		return audioParams{}, err
+	}
+	// Resampling interpolates 16-bit integer samples only
+	if targetSampleRate != 0 && targetSampleRate != params.sampleRate && (params.bits != 16 || params.float) {
+		return audioParams{}, fmt.Errorf("resampling to %d Hz is only supported for 16-bit PCM, got bits=%d", targetSampleRate, params.bits)
+	}
+	return params, nil
+}
+
+// applyWAVFormat describes an upload with the format read from the header of a WAV
+// body in place of the format params. A format param that was passed explicitly must
+// agree with the header, so a client cannot silently store audio in a format other
+// than the one it asked for.
+func applyWAVFormat(params *audioParams, query url.Values, format wavFormat) error {
+	if query.Get("sample_rate") != "" && params.sampleRate != format.sampleRate {
+		return fmt.Errorf("sample_rate=%d does not match the %d Hz WAV header", params.sampleRate, format.sampleRate)
+	}
+	if params.channelsDeclared && params.channels != format.channels {
+		return fmt.Errorf("channels=%d does not match the %d channels of the WAV header", params.channels, format.channels)
+	}
+	if params.formatDeclared && (params.bits != format.bits || params.float != format.float) {
+		return fmt.Errorf("bits=%d does not match the %d-bit samples of the WAV header", params.bits, format.bits)
+	}
+
+	if !allowedSampleRates[format.sampleRate] {
+		return fmt.Errorf("unsupported WAV sample rate %d, expected one of 8000, 16000, 44100, 48000", format.sampleRate)
+	}
+	if format.channels != 1 && format.channels != 2 {
+		return fmt.Errorf("unsupported WAV channels %d, expected 1 or 2", format.channels)
+	}
+	if format.bits != 16 && format.bits != 24 && format.bits != 32 {
+		return fmt.Errorf("unsupported WAV bits %d, expected 16, 24 or 32", format.bits)
+	}
+	if format.float && format.bits != 32 {
+		return fmt.Errorf("unsupported WAV format: float samples must be 32-bit, got %d", format.bits)
+	}
+	if targetSampleRate != 0 && targetSampleRate != format.sampleRate && (format.bits != 16 || format.float) {
+		return fmt.Errorf("resampling to %d Hz is only supported for 16-bit PCM, got bits=%d", targetSampleRate, format.bits)
+	}
+
+	params.sampleRate = format.sampleRate
+	params.channels, params.channelsDeclared = format.channels, true
+	params.bits, params.float, params.formatDeclared = format.bits, format.float, true
+	return nil
+}
+
+// profileNames returns the sorted names of audioProfiles
+func profileNames() []string {
+	names := make([]string, 0, len(audioProfiles))
+	for name := range audioProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseSampleRate parses the sample_rate param, falling back to the default rate
+// when it is missing and rejecting values that are not a number or are outside the
+// allow-list
+func parseSampleRate(param string) (int, error) {
+	if param == "" {
+		return defaultSampleRate, nil
+	}
+	rate, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sample_rate %q, expected a number", param)
+	}
+	if !allowedSampleRates[rate] {
+		return 0, fmt.Errorf("unsupported sample_rate %d, expected one of 8000, 16000, 44100, 48000", rate)
+	}
+	return rate, nil
+}
+
+// parseChannels parses the channels param, which may be 1 or 2. declared reports
+// whether the param was present; when absent the default of mono is returned.
+func parseChannels(param string) (channels int, declared bool, err error) {
+	if param == "" {
+		return defaultChannels, false, nil
+	}
+	channels, err = strconv.Atoi(param)
+	if err != nil || (channels != 1 && channels != 2) {
+		return 0, true, fmt.Errorf("unsupported channels %q, expected 1 or 2", param)
+	}
+	return channels, true, nil
+}
+
+// parseSampleFormat parses the bits param, which may be 16, 24 or 32, and the format
+// param, which may be pcm or float and selects IEEE float for 32-bit samples.
+// declared reports whether either param was present; when absent 16-bit integer PCM
+// is returned.
+func parseSampleFormat(bitsParam, formatParam string) (bits int, float bool, declared bool, err error) {
+	bits = defaultBitsPerSample
+	if bitsParam != "" {
+		bits, err = strconv.Atoi(bitsParam)
+		if err != nil || (bits != 16 && bits != 24 && bits != 32) {
+			return 0, false, true, fmt.Errorf("unsupported bits %q, expected 16, 24 or 32", bitsParam)
+		}
+	}
+	switch formatParam {
+	case "", "pcm":
+	case "float":
+		if bits != 32 {
+			return 0, false, true, fmt.Errorf("format=float requires bits=32, got %d", bits)
+		}
+		float = true
+	default:
+		return 0, false, true, fmt.Errorf("unsupported format %q, expected pcm or float", formatParam)
+	}
+	return bits, float, bitsParam != "" || formatParam != "", nil
+}
+
+// parseClientSeq parses the optional seq param, returning nil when it is absent
+func parseClientSeq(param string) (*int64, error) {
+	if param == "" {
+		return nil, nil
+	}
+	seq, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || seq < 0 {
+		return nil, fmt.Errorf("invalid seq %q, expected a non-negative integer", param)
+	}
+	return &seq, nil
+}
@@ -0,0 +1,137 @@
+package function
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnknownParams(t *testing.T) {
+	query := url.Values{"uid": {"alice"}, "sampel_rate": {"8000"}, "chanels": {"2"}}
+	if got, want := unknownParams(query), []string{"chanels", "sampel_rate"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unknownParams = %v, want %v", got, want)
+	}
+}
+
+func TestTypoParam(t *testing.T) {
+	body := tone(100*time.Millisecond, 16000)
+	tests := []struct {
+		strict string
+		want   int
+	}{
+		{"", http.StatusCreated},
+		{"true", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run("STRICT_PARAMS="+tt.strict, func(t *testing.T) {
+			f := newFakeGCS(t)
+			useFakeClock(t, testStart)
+			t.Setenv("STRICT_PARAMS", tt.strict)
+
+			w := postAudio(t, "uid=alice&sampel_rate=8000", body)
+			if w.Code != tt.want {
+				t.Fatalf("upload with a typo answered %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusCreated {
+				if names := f.names(""); len(names) != 0 {
+					t.Fatalf("rejected upload wrote %v", names)
+				}
+				return
+			}
+			// Leniently the typo is ignored, so the default rate applies
+			if rate := currentMetadata(t, f, "alice").SampleRate; rate != defaultSampleRate {
+				t.Fatalf("lenient upload stored %d Hz, want the default %d", rate, defaultSampleRate)
+			}
+		})
+	}
+}
+
+func TestInvalidNumericParams(t *testing.T) {
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"sample_rate=fast", "sample_rate"},
+		{"sample_rate=0", "sample_rate"},
+		{"sample_rate=-16000", "sample_rate"},
+		{"sample_rate=10000000", "sample_rate"},
+		{"sample_rate=22050", "sample_rate"},
+		{"channels=0", "channels"},
+		{"channels=3", "channels"},
+		{"bits=12", "bits"},
+		{"seq=-1", "seq"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f := newFakeGCS(t)
+			w := postAudio(t, "uid=alice&"+tt.query, tone(100*time.Millisecond, 16000))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("answered %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if !strings.Contains(w.Body.String(), tt.field) {
+				t.Fatalf("error does not name %s: %s", tt.field, w.Body)
+			}
+			if names := f.names(""); len(names) != 0 {
+				t.Fatalf("rejected upload wrote %v", names)
+			}
+		})
+	}
+}
+
+func TestAllowedSampleRates(t *testing.T) {
+	for _, rate := range []int{8000, 16000, 44100, 48000} {
+		if got, err := parseSampleRate(strconv.Itoa(rate)); got != rate || err != nil {
+			t.Errorf("parseSampleRate(%d) = %d, %v", rate, got, err)
+		}
+	}
+	if got, err := parseSampleRate(""); got != defaultSampleRate || err != nil {
+		t.Errorf("parseSampleRate without a value = %d, %v, want the default %d", got, err, defaultSampleRate)
+	}
+}
+
+func TestProfilesProduceHeader(t *testing.T) {
+	tests := []struct {
+		query                      string
+		sampleRate, channels, bits int
+	}{
+		{"profile=omi_default", 16000, 1, 16},
+		{"profile=phone", 8000, 1, 16},
+		{"profile=hifi", 48000, 2, 16},
+		// Explicit params override the profile
+		{"profile=hifi&channels=1", 48000, 1, 16},
+		{"profile=phone&bits=24", 8000, 1, 24},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f := newFakeGCS(t)
+			useFakeClock(t, testStart)
+
+			frameSize := tt.channels * tt.bits / 8
+			mustPost(t, "uid=alice&"+tt.query, make([]byte, tt.sampleRate/10*frameSize))
+			metadata := currentMetadata(t, f, "alice")
+			if metadata.SampleRate != tt.sampleRate || metadata.Channels != tt.channels || metadata.BitsPerSample != tt.bits {
+				t.Fatalf("metadata records %d Hz, %d ch, %d bits", metadata.SampleRate, metadata.Channels, metadata.BitsPerSample)
+			}
+			if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+				t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+			}
+			data, _ := f.get(metadata.Filename)
+			if want := fmtChunk(1, tt.channels, tt.sampleRate, tt.bits); !bytes.Equal(data[20:36], want) {
+				t.Fatalf("fmt chunk = % x, want % x", data[20:36], want)
+			}
+		})
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+	newFakeGCS(t)
+	w := postAudio(t, "uid=alice&profile=studio", tone(100*time.Millisecond, 16000))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "omi_default") {
+		t.Fatalf("unknown profile answered %d: %s, want 400 listing the profiles", w.Code, w.Body)
+	}
+}
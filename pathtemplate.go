@@ -0,0 +1,132 @@
+package function
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultPathTemplate stores one folder per uid holding files named by their UTC
+// start time in a form that sorts chronologically, e.g. 2024-03-05T07-08-09Z.wav.
+// Files named by the earlier DD_MM_YYYY_HH_MM_SS layout are left as they are.
+const defaultPathTemplate = "{uid}/{iso}.wav"
+
+// isoFilenameLayout is an ISO 8601 timestamp with the colons, which are awkward in
+// object names, replaced by dashes
+const isoFilenameLayout = "2006-01-02T15-04-05Z"
+
+// pathTokens maps each PATH_TEMPLATE token to the text it expands to
+var pathTokens = map[string]func(uid string, t time.Time) string{
+	"uid":  func(uid string, t time.Time) string { return uid },
+	"iso":  func(uid string, t time.Time) string { return t.Format(isoFilenameLayout) },
+	"yyyy": func(uid string, t time.Time) string { return fmt.Sprintf("%04d", t.Year()) },
+	"mm":   func(uid string, t time.Time) string { return fmt.Sprintf("%02d", int(t.Month())) },
+	"dd":   func(uid string, t time.Time) string { return fmt.Sprintf("%02d", t.Day()) },
+	"HH":   func(uid string, t time.Time) string { return fmt.Sprintf("%02d", t.Hour()) },
+	"MM":   func(uid string, t time.Time) string { return fmt.Sprintf("%02d", t.Minute()) },
+	"SS":   func(uid string, t time.Time) string { return fmt.Sprintf("%02d", t.Second()) },
+	"HH_MM_SS": func(uid string, t time.Time) string {
+		return fmt.Sprintf("%02d_%02d_%02d", t.Hour(), t.Minute(), t.Second())
+	},
+}
+
+// pathSegment is either literal text or a token of a parsed path template
+type pathSegment struct {
+	literal string
+	token   string
+}
+
+// pathTemplate is a parsed PATH_TEMPLATE
+type pathTemplate []pathSegment
+
+// parsePathTemplate parses a template such as "{uid}/{yyyy}/{mm}/{dd}/{HH_MM_SS}.wav".
+// The template must contain {uid} so every uid keeps its own files, and a ".wav"
+// extension is added when missing.
+func parsePathTemplate(template string) (pathTemplate, error) {
+	if !strings.HasSuffix(template, ".wav") {
+		template += ".wav"
+	}
+
+	var parsed pathTemplate
+	hasUID := false
+	rest := template
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			parsed = append(parsed, pathSegment{literal: rest})
+			break
+		}
+		if open > 0 {
+			parsed = append(parsed, pathSegment{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated token in path template %q", template)
+		}
+		token := rest[open+1 : open+end]
+		if _, ok := pathTokens[token]; !ok {
+			return nil, fmt.Errorf("unknown token {%s} in path template %q", token, template)
+		}
+		hasUID = hasUID || token == "uid"
+		parsed = append(parsed, pathSegment{token: token})
+		rest = rest[open+end+1:]
+	}
+	if !hasUID {
+		return nil, fmt.Errorf("path template %q must contain {uid}", template)
+	}
+	return parsed, nil
+}
+
+// render returns the object path of a file for uid started at t, with every time
+// token expanded in UTC
+func (p pathTemplate) render(uid string, t time.Time) string {
+	t = t.UTC()
+	var b strings.Builder
+	for _, segment := range p {
+		if segment.token == "" {
+			b.WriteString(segment.literal)
+		} else {
+			b.WriteString(pathTokens[segment.token](uid, t))
+		}
+	}
+	return b.String()
+}
+
+// prefix returns the longest object name prefix shared by every file of uid, and
+// whether that prefix includes the uid, i.e. whether it scopes a listing to uid's
+// files alone
+func (p pathTemplate) prefix(uid string) (string, bool) {
+	var b strings.Builder
+	for _, segment := range p {
+		switch segment.token {
+		case "":
+			b.WriteString(segment.literal)
+		case "uid":
+			b.WriteString(uid)
+		default:
+			return b.String(), strings.Contains(b.String(), uid)
+		}
+	}
+	return b.String(), strings.Contains(b.String(), uid)
+}
+
+// userDir returns the folder holding every file of uid, and whether the template
+// gives uid a folder of its own. Unlike prefix, a prefix such as "{uid}_" is not
+// accepted, since it would also match the files of any uid starting with uid + "_".
+func (p pathTemplate) userDir(uid string) (string, bool) {
+	var b strings.Builder
+	for i, segment := range p {
+		switch segment.token {
+		case "":
+			b.WriteString(segment.literal)
+		case "uid":
+			if i+1 < len(p) && strings.HasPrefix(p[i+1].literal, "/") {
+				return b.String() + uid + "/", true
+			}
+			return "", false
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
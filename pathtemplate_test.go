@@ -0,0 +1,103 @@
+package function
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestPathTemplateRender(t *testing.T) {
+	start := time.Date(2024, 3, 5, 7, 8, 9, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{defaultPathTemplate, "alice/2024-03-05T06-08-09Z.wav"},
+		{"{uid}/{yyyy}/{mm}/{dd}/{HH_MM_SS}.wav", "alice/2024/03/05/06_08_09.wav"},
+		{"recordings/{uid}_{yyyy}{mm}{dd}-{HH}{MM}{SS}", "recordings/alice_20240305-060809.wav"},
+	}
+	for _, tt := range tests {
+		parsed, err := parsePathTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("parsePathTemplate(%q) = %v", tt.template, err)
+		}
+		if got := parsed.render("alice", start); got != tt.want {
+			t.Errorf("%q renders %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestPathTemplateRejectsInvalid(t *testing.T) {
+	for _, template := range []string{"{iso}.wav", "{uid}/{when}.wav", "{uid}/{iso"} {
+		if _, err := parsePathTemplate(template); err == nil {
+			t.Errorf("parsePathTemplate(%q) accepted an invalid template", template)
+		}
+	}
+}
+
+func TestPathTemplateUserDir(t *testing.T) {
+	tests := []struct {
+		template string
+		dir      string
+		ok       bool
+	}{
+		{defaultPathTemplate, "alice/", true},
+		{"audio/{uid}/{iso}.wav", "audio/alice/", true},
+		{"{uid}_{iso}.wav", "", false},
+		{"{yyyy}/{uid}/{iso}.wav", "", false},
+	}
+	for _, tt := range tests {
+		parsed, _ := parsePathTemplate(tt.template)
+		if dir, ok := parsed.userDir("alice"); dir != tt.dir || ok != tt.ok {
+			t.Errorf("%q userDir = %q, %v, want %q, %v", tt.template, dir, ok, tt.dir, tt.ok)
+		}
+	}
+}
+
+func TestPostUsesConfiguredPathTemplate(t *testing.T) {
+	t.Cleanup(loadConfig)
+	t.Setenv("PATH_TEMPLATE", "{uid}/{yyyy}/{mm}/{dd}/{HH_MM_SS}")
+	loadConfig()
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if got := currentMetadata(t, f, "alice").Filename; got != "alice/2024/05/01/12_00_00.wav" {
+		t.Fatalf("recording is named %q", got)
+	}
+}
+
+func TestISOFilenamesSortChronologically(t *testing.T) {
+	parsed, _ := parsePathTemplate(defaultPathTemplate)
+	times := []time.Time{
+		time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 10, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 1; i < len(times); i++ {
+		earlier, later := parsed.render("alice", times[i-1]), parsed.render("alice", times[i])
+		if earlier >= later {
+			t.Errorf("%q does not sort before %q", earlier, later)
+		}
+	}
+}
+
+func TestLegacyFilenameLayoutIsNumeric(t *testing.T) {
+	// The earlier layout, whose month was once at risk of rendering as its name
+	parsed, err := parsePathTemplate("{uid}/{dd}_{mm}_{yyyy}_{HH_MM_SS}.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := regexp.MustCompile(`^alice/\d{2}_\d{2}_\d{4}_\d{2}_\d{2}_\d{2}\.wav$`)
+	for month := time.January; month <= time.December; month++ {
+		start := time.Date(2024, month, 5, 7, 8, 9, 0, time.UTC)
+		got := parsed.render("alice", start)
+		if want := fmt.Sprintf("alice/05_%02d_2024_07_08_09.wav", int(month)); got != want || !layout.MatchString(got) {
+			t.Errorf("%s renders %q, want %q", month, got, want)
+		}
+	}
+}
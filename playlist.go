@@ -0,0 +1,263 @@
+package function
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// playlistPrefix holds the playlist of each session, kept when PLAYLISTS is on
+const playlistPrefix = "playlists/"
+
+// playlistURLExpiry is how long the signed URLs of a downloaded playlist stay valid
+const playlistURLExpiry = time.Hour
+
+// A session that runs past MAX_DURATION or MAX_FILE_BYTES, or pauses past
+// INACTIVITY_LIMIT, is split across several files. With PLAYLISTS on, each session
+// keeps a playlist of its files in the order they were closed, along with their
+// durations, so the session can be played back as a whole. The playlist is started
+// by the first file of a session, which replaces the playlist of the session the key
+// last held, and each file is added once it is closed, by rolling over or finalizing;
+// the file still being recorded is not listed. HandleGetPlaylist downloads it.
+
+// playlist is the stored playlist of a session
+type playlist struct {
+	StartedAt time.Time        `json:"started_at"`
+	Files     []recordingEntry `json:"files"`
+}
+
+// playlistFile is a file of a downloaded playlist, with the URL it is played from
+type playlistFile struct {
+	recordingEntry
+	URL string `json:"url"`
+}
+
+// playlistResponse is the JSON body returned by HandleGetPlaylist with format=json
+type playlistResponse struct {
+	Status    string         `json:"status"`
+	StartedAt time.Time      `json:"started_at"`
+	Files     []playlistFile `json:"files"`
+}
+
+// playlistPath returns the name of the playlist object of session key
+func playlistPath(key string) string {
+	return playlistPrefix + key + ".json"
+}
+
+// startPlaylist starts an empty playlist for session key, whose first file began at
+// start, unless PLAYLISTS is off
+func startPlaylist(ctx context.Context, store objectStore, key string, start time.Time) error {
+	if !playlistsEnabled {
+		return nil
+	}
+	data, err := json.Marshal(playlist{StartedAt: start, Files: []recordingEntry{}})
+	if err != nil {
+		return fmt.Errorf("failed to encode playlist: %v", err)
+	}
+	if err := store.Delete(ctx, playlistPath(key), 0); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	_, err = store.Write(ctx, playlistPath(key), "application/json", data, 0)
+	return err
+}
+
+// addToPlaylist adds the closed file entry describes to the playlist of session key,
+// replacing the entry of a file listed already, unless PLAYLISTS is off. The
+// playlist is updated under a generation precondition, retried up to maxCASAttempts
+// times. A session without a playlist, started before PLAYLISTS was on, gets one.
+func addToPlaylist(ctx context.Context, store objectStore, key string, entry recordingEntry) error {
+	if !playlistsEnabled {
+		return nil
+	}
+	name := playlistPath(key)
+	for attempt := 1; ; attempt++ {
+		list := playlist{StartedAt: entry.StartTime}
+		data, generation, err := store.Read(ctx, name)
+		switch {
+		case err == storage.ErrObjectNotExist:
+			generation = 0
+		case err != nil:
+			return fmt.Errorf("failed to read playlist: %v", err)
+		default:
+			if err := json.Unmarshal(data, &list); err != nil {
+				return fmt.Errorf("failed to decode playlist: %v", err)
+			}
+		}
+
+		replaced := false
+		for i, listed := range list.Files {
+			if listed.Filename == entry.Filename {
+				list.Files[i], replaced = entry, true
+			}
+		}
+		if !replaced {
+			list.Files = append(list.Files, entry)
+		}
+		if data, err = json.Marshal(list); err != nil {
+			return fmt.Errorf("failed to encode playlist: %v", err)
+		}
+		_, err = store.Write(ctx, name, "application/json", data, generation)
+		if err == nil {
+			return nil
+		}
+		if !isPreconditionFailed(err) || attempt >= maxCASAttempts {
+			return fmt.Errorf("failed to write playlist: %v", err)
+		}
+		loggerFrom(ctx).Info("Playlist changed concurrently, retrying", "attempt", attempt, "max_attempts", maxCASAttempts)
+		time.Sleep(casBackoff(attempt))
+	}
+}
+
+// HandleGetPlaylist downloads the playlist of uid's current or last session, or of
+// the session named by session_id, as an extended M3U, or as JSON with format=json.
+// Each file is linked by its https://storage.googleapis.com URL, which needs the
+// caller to be authorized to read the bucket, or with signed=true by a URL signed
+// with the function's service account key that is valid for an hour. It returns 404
+// when the session has no playlist.
+func HandleGetPlaylist(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed, use GET")
+		return
+	}
+
+	query := r.URL.Query()
+	uid := query.Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received playlist request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting playlist request with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+	sessionID, err := parseSessionID(query)
+	if err != nil {
+		logger.Warn("Rejecting playlist request with invalid session_id")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sessionID != "" {
+		ctx, logger = logWith(ctx, "session_id", sessionID)
+	}
+	key := sessionKey(uid, sessionID)
+
+	format := query.Get("format")
+	if format == "" {
+		format = "m3u"
+	}
+	if format != "m3u" && format != "json" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported format %q, expected m3u or json", format))
+		return
+	}
+	signed := false
+	if value := query.Get("signed"); value != "" {
+		if signed, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid signed %q, expected true or false", value))
+			return
+		}
+	}
+
+	// Playlist requests carry no body, so the signature covers only the session key and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, key, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated playlist request", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	bucket, err := openBucket(bucketOverride(query, r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	data, _, err := openStore(bucket).Read(ctx, playlistPath(key))
+	if err == storage.ErrObjectNotExist {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No playlist for uid %s", uid))
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read playlist", "error", err)
+		writeServerError(ctx, w, fmt.Sprintf("Failed to read playlist: %v", err))
+		return
+	}
+	var list playlist
+	if err := json.Unmarshal(data, &list); err != nil {
+		logger.Error("Failed to decode playlist", "error", err)
+		writeServerError(ctx, w, "Failed to decode playlist")
+		return
+	}
+
+	response := playlistResponse{Status: "ok", StartedAt: list.StartedAt, Files: []playlistFile{}}
+	for _, entry := range list.Files {
+		link, err := fileURL(bucket.BucketName(), entry.Filename, signed)
+		if err != nil {
+			logger.Error("Failed to sign playlist URL", "error", err)
+			writeServerError(ctx, w, fmt.Sprintf("Failed to sign playlist URL: %v", err))
+			return
+		}
+		response.Files = append(response.Files, playlistFile{recordingEntry: entry, URL: link})
+	}
+
+	logger.Info("Serving playlist", "files", len(response.Files), "format", format, "signed", signed)
+	if format == "json" {
+		writeQueryJSON(ctx, w, r, response)
+		return
+	}
+	var m3u strings.Builder
+	m3u.WriteString("#EXTM3U\n")
+	for _, file := range response.Files {
+		fmt.Fprintf(&m3u, "#EXTINF:%.3f,%s\n%s\n", file.DurationSeconds, file.Filename, file.URL)
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(m3u.String())); err != nil {
+		logger.Warn("Failed to write playlist", "error", err)
+	}
+}
+
+// fileURL returns the https URL of the object name in bucketName, signed for GET
+// with the service account key in GOOGLE_APPLICATION_CREDENTIALS_JSON when signed is
+// set
+func fileURL(bucketName, name string, signed bool) (string, error) {
+	if !signed {
+		return (&url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + bucketName + "/" + name}).String(), nil
+	}
+	creds, err := base64.StdEncoding.DecodeString(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON"))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode credentials: %v", err)
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(creds, &key); err != nil {
+		return "", fmt.Errorf("failed to decode credentials: %v", err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return "", errors.New("credentials hold no service account key to sign with")
+	}
+	// Signatures are checked against the real time, so the expiry ignores nowFunc
+	return storage.SignedURL(bucketName, name, &storage.SignedURLOptions{
+		GoogleAccessID: key.ClientEmail,
+		PrivateKey:     []byte(key.PrivateKey),
+		Method:         http.MethodGet,
+		Expires:        time.Now().Add(playlistURLExpiry),
+		Scheme:         storage.SigningSchemeV4,
+	})
+}
@@ -0,0 +1,134 @@
+package function
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordRotatedSession records a session of alice split across three files, of
+// 250ms, 500ms and 750ms, by pausing past INACTIVITY_LIMIT, and finalizes it,
+// returning the names of its files
+func recordRotatedSession(t *testing.T, f *fakeGCS, clock *fakeClock) []string {
+	t.Helper()
+	var files []string
+	for i, d := range []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond} {
+		if i > 0 {
+			clock.Advance(inactivityLimit + time.Second)
+		}
+		mustPost(t, "uid=alice", tone(d, 16000))
+		files = append(files, currentMetadata(t, f, "alice").Filename)
+	}
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	return files
+}
+
+// useSigningKey puts a service account key in GOOGLE_APPLICATION_CREDENTIALS_JSON
+// for the rest of the test, keeping the fake's storage client
+func useSigningKey(t *testing.T) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "recorder@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+	})
+	encoded := base64.StdEncoding.EncodeToString(creds)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS_JSON", encoded)
+	storageClient.Lock()
+	storageClient.creds = encoded
+	storageClient.Unlock()
+}
+
+func TestPlaylistListsSessionFiles(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &playlistsEnabled, true)
+	files := recordRotatedSession(t, f, clock)
+
+	w := serve(t, HandleGetPlaylist, http.MethodGet, "/?uid=alice&format=json", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("playlist answered %d: %s", w.Code, w.Body)
+	}
+	var list playlistResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != len(files) || !list.StartedAt.Equal(testStart) {
+		t.Fatalf("playlist started at %v lists %d files, want %d from %v", list.StartedAt, len(list.Files), len(files), testStart)
+	}
+	for i, file := range list.Files {
+		want := 0.25 * float64(i+1)
+		link := "https://storage.googleapis.com/" + testBucket + "/" + files[i]
+		if file.Filename != files[i] || file.DurationSeconds != want || file.URL != link {
+			t.Errorf("entry %d = %s of %vs at %s, want %s of %vs at %s", i, file.Filename, file.DurationSeconds, file.URL, files[i], want, link)
+		}
+	}
+
+	w = serve(t, HandleGetPlaylist, http.MethodGet, "/?uid=alice", nil)
+	want := "#EXTM3U\n"
+	for i, file := range files {
+		want += fmt.Sprintf("#EXTINF:%.3f,%s\nhttps://storage.googleapis.com/%s/%s\n", 0.25*float64(i+1), file, testBucket, file)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "audio/x-mpegurl" || w.Body.String() != want {
+		t.Fatalf("M3U playlist answered %d with %q:\n%s\nwant:\n%s", w.Code, w.Header().Get("Content-Type"), w.Body, want)
+	}
+}
+
+func TestPlaylistRestartsWithSession(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &playlistsEnabled, true)
+	recordRotatedSession(t, f, clock)
+
+	// The next session replaces the playlist, which lists nothing until a file closes
+	clock.Advance(time.Hour)
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	var list playlistResponse
+	json.Unmarshal(serve(t, HandleGetPlaylist, http.MethodGet, "/?uid=alice&format=json", nil).Body.Bytes(), &list)
+	if len(list.Files) != 0 || !list.StartedAt.Equal(testStart.Add(2*(inactivityLimit+time.Second)+time.Hour)) {
+		t.Fatalf("new session's playlist started at %v lists %+v", list.StartedAt, list.Files)
+	}
+
+	if w := serve(t, HandleGetPlaylist, http.MethodGet, "/?uid=bob", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("playlist of a uid without sessions answered %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPlaylistSignedURLs(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	setVar(t, &playlistsEnabled, true)
+	files := recordRotatedSession(t, f, clock)
+	useSigningKey(t)
+
+	w := serve(t, HandleGetPlaylist, http.MethodGet, "/?uid=alice&format=json&signed=true", nil)
+	var list playlistResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Files) != len(files) {
+		t.Fatalf("signed playlist answered %d: %s", w.Code, w.Body)
+	}
+	for i, file := range list.Files {
+		link, err := url.Parse(file.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Host != "storage.googleapis.com" || link.Path != "/"+testBucket+"/"+files[i] || link.Query().Get("X-Goog-Signature") == "" ||
+			!strings.HasPrefix(link.Query().Get("X-Goog-Credential"), "recorder@example.iam.gserviceaccount.com/") {
+			t.Errorf("entry %d links to %s, want a V4 signed URL of %s", i, file.URL, files[i])
+		}
+	}
+}
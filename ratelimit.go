@@ -0,0 +1,69 @@
+package function
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// uidLimiters holds one token bucket per uid. Each instance keeps its own buckets, so
+// with N warm instances a uid can reach up to N times RATE_LIMIT_PER_MIN; the limit
+// is a per-instance approximation meant to stop runaway clients, not exact metering.
+var uidLimiters = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	// swept is when buckets was last cleared of full buckets
+	swept time.Time
+}{buckets: make(map[string]*tokenBucket)}
+
+// limiterSweepInterval is how often allowRequest clears out full buckets. An empty
+// bucket refills completely within a minute, so a sweep finds every bucket left
+// untouched since the previous one.
+const limiterSweepInterval = time.Minute
+
+// tokenBucket allows bursts of up to its capacity and refills continuously
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allowRequest takes a token from uid's bucket when rateLimitPerMin is set. When the
+// bucket is empty it returns false with how long until a token is available.
+func allowRequest(uid string) (bool, time.Duration) {
+	if rateLimitPerMin <= 0 {
+		return true, 0
+	}
+	capacity := float64(rateLimitPerMin)
+	perSecond := capacity / 60
+	now := nowFunc()
+
+	uidLimiters.Lock()
+	defer uidLimiters.Unlock()
+
+	// Buckets that have refilled completely carry no state worth keeping. They are
+	// cleared out once per interval rather than on every request, which would scan
+	// every uid seen by the instance each time.
+	if now.Sub(uidLimiters.swept) >= limiterSweepInterval {
+		for key, b := range uidLimiters.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*perSecond >= capacity {
+				delete(uidLimiters.buckets, key)
+			}
+		}
+		uidLimiters.swept = now
+	}
+
+	b, ok := uidLimiters.buckets[uid]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, updated: now}
+		uidLimiters.buckets[uid] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
@@ -0,0 +1,96 @@
+package function
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resetLimiters gives the test empty rate limiter buckets
+func resetLimiters(t *testing.T) {
+	t.Helper()
+	uidLimiters.Lock()
+	uidLimiters.buckets = make(map[string]*tokenBucket)
+	uidLimiters.swept = time.Time{}
+	uidLimiters.Unlock()
+	t.Cleanup(func() {
+		uidLimiters.Lock()
+		uidLimiters.buckets = make(map[string]*tokenBucket)
+		uidLimiters.swept = time.Time{}
+		uidLimiters.Unlock()
+	})
+}
+
+func TestAllowRequest(t *testing.T) {
+	clock := useFakeClock(t, testStart)
+	setVar(t, &rateLimitPerMin, 2)
+	resetLimiters(t)
+
+	steps := []struct {
+		advance  time.Duration
+		uid      string
+		want     bool
+		wantWait time.Duration
+	}{
+		{0, "alice", true, 0},
+		{0, "alice", true, 0},
+		{0, "alice", false, 30 * time.Second},
+		{0, "bob", true, 0},
+		{10 * time.Second, "alice", false, 20 * time.Second},
+		{20 * time.Second, "alice", true, 0},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		ok, wait := allowRequest(step.uid)
+		if ok != step.want || wait.Round(time.Millisecond) != step.wantWait {
+			t.Fatalf("step %d: allowRequest(%s) = %v, %v, want %v, %v", i, step.uid, ok, wait, step.want, step.wantWait)
+		}
+	}
+}
+
+func TestAllowRequestSweepsFullBuckets(t *testing.T) {
+	clock := useFakeClock(t, testStart)
+	setVar(t, &rateLimitPerMin, 60)
+	resetLimiters(t)
+
+	allowRequest("alice")
+	clock.Advance(30 * time.Second)
+	allowRequest("bob")
+	uidLimiters.Lock()
+	count := len(uidLimiters.buckets)
+	uidLimiters.Unlock()
+	if count != 2 {
+		t.Fatalf("%d buckets within the sweep interval, want 2", count)
+	}
+
+	clock.Advance(limiterSweepInterval)
+	allowRequest("carol")
+	uidLimiters.Lock()
+	_, hasAlice := uidLimiters.buckets["alice"]
+	count = len(uidLimiters.buckets)
+	uidLimiters.Unlock()
+	if hasAlice || count != 1 {
+		t.Fatalf("%d buckets after the sweep, want only carol's", count)
+	}
+}
+
+func TestUnsignedUploadsDoNotSpendTokens(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	t.Setenv("AUTH_SECRET", testSecret)
+	setVar(t, &rateLimitPerMin, 1)
+	resetLimiters(t)
+
+	body := tone(100*time.Millisecond, 16000)
+	for i := 0; i < 3; i++ {
+		if w := postAudio(t, "uid=alice", body); w.Code != http.StatusUnauthorized {
+			t.Fatalf("unsigned upload answered %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	}
+	if w := serveSigned(t, HandlePostAudio, http.MethodPost, "/?uid=alice", "alice", body); w.Code != http.StatusCreated {
+		t.Fatalf("signed upload answered %d: %s", w.Code, w.Body)
+	}
+	if w := serveSigned(t, HandlePostAudio, http.MethodPost, "/?uid=alice", "alice", body); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second signed upload answered %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
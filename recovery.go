@@ -0,0 +1,227 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// corruptSuffix is appended to the name of an object that was set aside because it
+// could not be a valid WAV file or PCM accumulator
+const corruptSuffix = ".corrupt"
+
+// errInvalidWAVHeader is returned by readWAVHeader for a stored WAV whose header does
+// not parse
+var errInvalidWAVHeader = errors.New("invalid WAV header")
+
+// wavFormat is the sample format recorded in a WAV header
+type wavFormat struct {
+	sampleRate int
+	channels   int
+	bits       int
+	float      bool
+}
+
+// parseWAVHeader validates a header as written by createWAVHeader, checking the RIFF,
+// WAVE, fmt and data magic and that the format is one the function can store, and
+// returns the format and the data length it records
+func parseWAVHeader(header []byte) (format wavFormat, dataLen int, err error) {
+	if len(header) < wavHeaderSize {
+		return wavFormat{}, 0, fmt.Errorf("header is truncated at %d bytes", len(header))
+	}
+	if !bytes.Equal(header[0:4], []byte("RIFF")) || !bytes.Equal(header[8:12], []byte("WAVE")) {
+		return wavFormat{}, 0, errors.New("missing RIFF/WAVE magic")
+	}
+	if !bytes.Equal(header[12:16], []byte("fmt ")) || binary.LittleEndian.Uint32(header[16:20]) != 16 {
+		return wavFormat{}, 0, errors.New("missing 16-byte fmt chunk")
+	}
+	if !bytes.Equal(header[36:40], []byte("data")) {
+		return wavFormat{}, 0, errors.New("missing data chunk")
+	}
+
+	format, err = parseWAVFormat(header[20:36])
+	if err != nil {
+		return wavFormat{}, 0, err
+	}
+	return format, int(binary.LittleEndian.Uint32(header[40:44])), nil
+}
+
+// readWAVHeader reads and parses the header of the stored WAV obj, returning
+// storage.ErrObjectNotExist when there is none. A WAV cut short by an interrupted
+// write holds less data than its header records, so the data length returned is
+// capped by the object's actual size.
+func readWAVHeader(ctx context.Context, obj *storage.ObjectHandle) (wavFormat, int, error) {
+	reader, err := obj.NewRangeReader(ctx, 0, wavHeaderSize)
+	if err == storage.ErrObjectNotExist {
+		return wavFormat{}, 0, err
+	}
+	if err != nil {
+		return wavFormat{}, 0, fmt.Errorf("failed to read %s: %v", obj.ObjectName(), err)
+	}
+	header, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return wavFormat{}, 0, fmt.Errorf("failed to read %s: %v", obj.ObjectName(), err)
+	}
+	format, dataLen, err := parseWAVHeader(header)
+	if err != nil {
+		return wavFormat{}, 0, fmt.Errorf("%w in %s: %v", errInvalidWAVHeader, obj.ObjectName(), err)
+	}
+	if stored := wavDataSize(reader.Attrs.Size); dataLen > stored {
+		dataLen = stored
+	}
+	return format, dataLen, nil
+}
+
+// recoverCorruptWAV checks the stored WAV named filename, if any, and archives it under
+// corruptSuffix when its header is truncated or invalid, as happens when a write was
+// interrupted part way through
+func recoverCorruptWAV(ctx context.Context, bucket *storage.BucketHandle, filename string) error {
+	_, _, err := readWAVHeader(ctx, bucket.Object(filename))
+	if err == nil || err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if !errors.Is(err, errInvalidWAVHeader) {
+		return err
+	}
+
+	loggerFrom(ctx).Warn("Recovery: file has no valid WAV header, archiving it", "file", filename, "error", err)
+	return archiveCorrupt(ctx, bucket, filename)
+}
+
+// archiveCorrupt moves the object name to name+corruptSuffix so it is kept for
+// inspection without being appended to or served as a recording
+func archiveCorrupt(ctx context.Context, bucket *storage.BucketHandle, name string) error {
+	src := bucket.Object(name)
+	copier := bucket.Object(name + corruptSuffix).CopierFrom(src)
+	copier.DestinationKMSKeyName = cmekKey
+	if _, err := copier.Run(ctx); err != nil {
+		return fmt.Errorf("failed to archive %s: %v", name, err)
+	}
+	deleteObject(ctx, src)
+	loggerFrom(ctx).Warn("Recovery: archived object", "name", name, "archive", name+corruptSuffix)
+	return nil
+}
+
+// recoverParts reconciles the chunk parts left under metadata's file by appends that
+// were interrupted mid-compose against the accumulator, and returns metadata repaired
+// to match. An append uploads its part, composes it onto the accumulator, deletes it
+// and only then writes the metadata, so a part still present once GCS_TIMEOUT has
+// passed belongs to a request that died along the way. When the accumulator already
+// ends with the part, the compose went through and the metadata is brought up to
+// date, including the seq of the chunk, so a client resending it is not stored twice;
+// the repaired metadata, stored at generation, is saved before the part is deleted,
+// and its new generation returned. Otherwise the chunk was never composed or
+// acknowledged, and the part is pruned rather than recomposed, since the client
+// resends it. The caller holds the session key's lock.
+//
+// Listing the parts is kept off the path of a steady stream of chunks: they are only
+// listed when the metadata was last written over GCS_TIMEOUT ago. A part is only
+// recovered once settled anyway, and an append that died leaves the session
+// unwritten until the client resends. A part outlived by a later write is accounted
+// for by reconcileMetadata and left for HandleCompact once its file is closed.
+func recoverParts(ctx context.Context, bucket *storage.BucketHandle, store objectStore, key string, metadata *WAVMetadata, generation int64) (*WAVMetadata, int64, error) {
+	settled := nowFunc().Add(-gcsTimeout)
+	if metadata == nil || !metadata.LastWriteTime.Before(settled) {
+		return metadata, generation, nil
+	}
+	logger := loggerFrom(ctx)
+	prefix := strings.TrimSuffix(metadata.Filename, ".wav") + "/parts/"
+
+	var parts []*storage.ObjectAttrs
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list parts of %s: %v", metadata.Filename, err)
+		}
+		if attrs.Updated.Before(settled) {
+			parts = append(parts, attrs)
+		}
+	}
+	if len(parts) == 0 {
+		return metadata, generation, nil
+	}
+	// Parts are numbered by assignSequence as they are appended, so this is append order
+	sort.Slice(parts, func(i, j int) bool {
+		return partSeq(parts[i].Name) < partSeq(parts[j].Name)
+	})
+
+	accumulator, err := bucket.Object(pcmPath(metadata.Filename)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		// reconcileMetadata resets metadata without an accumulator, so the parts can go
+		for _, attrs := range parts {
+			deleteObject(ctx, bucket.Object(attrs.Name))
+		}
+		return metadata, generation, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read attributes of %s: %v", pcmPath(metadata.Filename), err)
+	}
+
+	repaired := *metadata
+	recovered := false
+	for _, attrs := range parts {
+		reader, err := bucket.Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read %s: %v", attrs.Name, err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read %s: %v", attrs.Name, err)
+		}
+
+		checksum := crc32.Update(repaired.Checksum, crc32cTable, data)
+		if int64(repaired.CurrentSize+len(data)) == accumulator.Size && checksum == accumulator.CRC32C {
+			repaired.CurrentSize += len(data)
+			repaired.Checksum = checksum
+			recovered = true
+			if seq, err := strconv.ParseInt(attrs.Metadata["client_seq"], 10, 64); err == nil {
+				repaired.LastClientSeq = &seq
+			}
+			logger.Warn("Recovery: part was composed but not recorded, updating metadata", "part", attrs.Name, "size", len(data), "client_seq", attrs.Metadata["client_seq"])
+		} else {
+			logger.Warn("Recovery: part was never composed, pruning it", "part", attrs.Name, "size", len(data))
+		}
+	}
+	repaired.ObjectGeneration = accumulator.Generation
+
+	if recovered {
+		data, err := json.Marshal(&repaired)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode metadata: %v", err)
+		}
+		if generation, err = store.Write(ctx, metadataPath(key), "application/json", data, generation); err != nil {
+			return nil, 0, fmt.Errorf("failed to save recovered metadata: %v", err)
+		}
+	}
+	for _, attrs := range parts {
+		deleteObject(ctx, bucket.Object(attrs.Name))
+	}
+	return &repaired, generation, nil
+}
+
+// partSeq returns the seq of the part object name, or -1 when it has none
+func partSeq(name string) int64 {
+	_, file, _ := strings.Cut(name, "/parts/")
+	seq, err := strconv.ParseInt(strings.TrimSuffix(file, ".pcm"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return seq
+}
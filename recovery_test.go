@@ -0,0 +1,212 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverCorruptWAV(t *testing.T) {
+	header, _ := createWAVHeader(4, 16000, 1, 16, false)
+	valid := append(header, 1, 2, 3, 4)
+	tests := []struct {
+		name        string
+		data        []byte
+		wantArchive bool
+	}{
+		{"truncated", []byte("RIFF\x00\x00\x00\x00WA"), true},
+		{"garbage", bytes.Repeat([]byte{0xde, 0xad}, 50), true},
+		{"valid", valid, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGCS(t)
+			const filename = "alice/2024-05-01T12-00-00Z.wav"
+			f.put(filename, tt.data)
+
+			if err := recoverCorruptWAV(context.Background(), f.bucket(), filename); err != nil {
+				t.Fatal(err)
+			}
+			archived, _ := f.get(filename + corruptSuffix)
+			_, kept := f.get(filename)
+			if tt.wantArchive && (!bytes.Equal(archived, tt.data) || kept) {
+				t.Fatalf("corrupt file was not moved to %s", filename+corruptSuffix)
+			}
+			if !tt.wantArchive && (archived != nil || !kept) {
+				t.Fatal("valid file was archived")
+			}
+		})
+	}
+}
+
+func TestPostAfterCorruptWAVStartsNewFile(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	body := tone(100*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", body)
+	filename := currentMetadata(t, f, "alice").Filename
+
+	// An interrupted finalize left a 10-byte WAV and no accumulator
+	f.mu.Lock()
+	delete(f.objects, pcmPath(filename))
+	f.mu.Unlock()
+	f.put(filename, []byte("RIFF\x00\x00\x00\x00WA"))
+
+	mustPost(t, "uid=alice", body)
+	if _, ok := f.get(filename + corruptSuffix); !ok {
+		t.Fatalf("corrupt file was not archived, objects %v", f.names(""))
+	}
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != len(body) {
+		t.Fatalf("new file holds %d bytes, want %d", size, len(body))
+	}
+}
+
+func TestParseWAVHeader(t *testing.T) {
+	valid, _ := createWAVHeader(32000, 48000, 2, 24, false)
+	format, dataLen, err := parseWAVHeader(valid)
+	if err != nil || format != (wavFormat{sampleRate: 48000, channels: 2, bits: 24}) || dataLen != 32000 {
+		t.Fatalf("parseWAVHeader of a valid header = %+v, %d, %v", format, dataLen, err)
+	}
+	float, _ := createWAVHeader(0, 16000, 1, 32, true)
+	if format, _, err := parseWAVHeader(float); err != nil || !format.float {
+		t.Fatalf("parseWAVHeader of a float header = %+v, %v", format, err)
+	}
+
+	// corrupt returns a valid header with change applied
+	corrupt := func(change func(h []byte)) []byte {
+		h := append([]byte(nil), valid...)
+		change(h)
+		return h
+	}
+	invalid := map[string][]byte{
+		"truncated":         valid[:40],
+		"wrong RIFF magic":  corrupt(func(h []byte) { copy(h[0:4], "RIFX") }),
+		"wrong WAVE magic":  corrupt(func(h []byte) { copy(h[8:12], "AVI ") }),
+		"extended fmt":      corrupt(func(h []byte) { h[16] = 18 }),
+		"missing data":      corrupt(func(h []byte) { copy(h[36:40], "LIST") }),
+		"compressed format": corrupt(func(h []byte) { h[20] = 2 }),
+		"zero channels":     corrupt(func(h []byte) { h[22] = 0 }),
+		"wrong block align": corrupt(func(h []byte) { h[32] = 4 }),
+	}
+	for name, header := range invalid {
+		if _, _, err := parseWAVHeader(header); err == nil {
+			t.Errorf("%s: parseWAVHeader accepted an invalid header", name)
+		}
+	}
+}
+
+// interruptAppend leaves the part of an append of audio to alice's open file that died
+// mid-compose, composed onto the accumulator or not, and lets it settle
+func interruptAppend(t *testing.T, f *fakeGCS, clock *fakeClock, audio []byte, clientSeq string, composed bool) string {
+	t.Helper()
+	filename := currentMetadata(t, f, "alice").Filename
+	if composed {
+		stored, _ := f.get(pcmPath(filename))
+		f.put(pcmPath(filename), append(stored, audio...))
+	}
+	part := partPath(filename, 99)
+	f.mu.Lock()
+	f.store(part, &fakeObject{data: append([]byte(nil), audio...), contentType: "application/octet-stream", metadata: map[string]string{"client_seq": clientSeq}})
+	f.mu.Unlock()
+	clock.Advance(gcsTimeout + time.Second)
+	return part
+}
+
+func TestRecoverComposedPart(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	a, b, c := tone(100*time.Millisecond, 16000), tone(200*time.Millisecond, 16000), tone(300*time.Millisecond, 16000)
+	mustPost(t, "uid=alice&seq=1", a)
+	filename := currentMetadata(t, f, "alice").Filename
+	part := interruptAppend(t, f, clock, b, "2", true)
+
+	// The client never saw the chunk acknowledged, so it resends it
+	if w := postAudio(t, "uid=alice&seq=2", b); w.Code != http.StatusOK {
+		t.Fatalf("resent chunk answered %d: %s", w.Code, w.Body)
+	}
+	if _, ok := f.get(part); ok {
+		t.Fatalf("part %s was not removed", part)
+	}
+	metadata := currentMetadata(t, f, "alice")
+	if metadata.CurrentSize != len(a)+len(b) || metadata.LastClientSeq == nil || *metadata.LastClientSeq != 2 {
+		t.Fatalf("metadata holds %d bytes up to seq %v, want %d bytes up to seq 2", metadata.CurrentSize, metadata.LastClientSeq, len(a)+len(b))
+	}
+
+	mustPost(t, "uid=alice&seq=3", c)
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	wav, _ := f.get(filename)
+	if want := concat(a, b, c); !bytes.Equal(wav[wavHeaderSize:], want) {
+		t.Fatalf("recording holds %d bytes of audio, want %d without the resent chunk", len(wav)-wavHeaderSize, len(want))
+	}
+}
+
+func TestRecoverUncomposedPart(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	a, b := tone(100*time.Millisecond, 16000), tone(200*time.Millisecond, 16000)
+	mustPost(t, "uid=alice&seq=1", a)
+	filename := currentMetadata(t, f, "alice").Filename
+	part := interruptAppend(t, f, clock, b, "2", false)
+
+	mustPost(t, "uid=alice&seq=2", b)
+	if _, ok := f.get(part); ok {
+		t.Fatalf("part %s was not pruned", part)
+	}
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	wav, _ := f.get(filename)
+	if want := concat(a, b); !bytes.Equal(wav[wavHeaderSize:], want) {
+		t.Fatalf("recording holds %d bytes of audio, want %d", len(wav)-wavHeaderSize, len(want))
+	}
+}
+
+func TestRecoverPartsLeavesFreshParts(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	metadata := currentMetadata(t, f, "alice")
+
+	// A part younger than GCS_TIMEOUT may belong to a request still composing it
+	part := partPath(metadata.Filename, 99)
+	f.put(part, []byte("ab"))
+	recovered, _, err := recoverParts(context.Background(), f.bucket(), openStore(f.bucket()), "alice", metadata, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.get(part); !ok || recovered.CurrentSize != metadata.CurrentSize {
+		t.Fatalf("fresh part was recovered, metadata holds %d bytes", recovered.CurrentSize)
+	}
+}
+
+func TestSteadyStreamDoesNotListParts(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	listed := 0
+	f.fail = func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Query().Get("prefix"), "/parts/") {
+			listed++
+		}
+		return 0
+	}
+	for i := 0; i < 3; i++ {
+		mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+		clock.Advance(time.Second)
+	}
+	if listed != 0 {
+		t.Fatalf("chunks of a steady stream listed parts %d times", listed)
+	}
+
+	// A session left unwritten for GCS_TIMEOUT may hold the part of an append that died
+	clock.Advance(gcsTimeout)
+	mustPost(t, "uid=alice", tone(100*time.Millisecond, 16000))
+	if listed != 1 {
+		t.Fatalf("chunk after an idle GCS_TIMEOUT listed parts %d times, want once", listed)
+	}
+}
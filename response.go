@@ -0,0 +1,148 @@
+package function
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// audioResponse is the JSON body returned on success
+type audioResponse struct {
+	Status          string  `json:"status"`
+	Message         string  `json:"message,omitempty"`
+	Filename        string  `json:"filename,omitempty"`
+	CurrentSize     int     `json:"current_size"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Sequence        int64   `json:"sequence,omitempty"`
+	// Created is set when the request started a new file
+	Created bool `json:"created,omitempty"`
+	// CRC32C is the running checksum of the file's audio data, as 8 hex digits
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// errorResponse is the JSON body returned on failure
+type errorResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// writeJSON writes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
+
+// writeError writes an error response with the given status code and message
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Status: "error", Message: message})
+}
+
+// writeServerError writes a 500 error response, or a 504 when the failure was
+// caused by ctx running out of time waiting on GCS
+func writeServerError(ctx context.Context, w http.ResponseWriter, message string) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, fmt.Sprintf("Timed out waiting for storage after %s: %s", gcsTimeout, message))
+		return
+	}
+	writeError(w, http.StatusInternalServerError, message)
+}
+
+// writeQueryJSON writes v as the 200 response to a list or status request r. The
+// fields query param, a comma-separated list of dotted field paths such as
+// recordings.filename, keeps only those fields, a path stepping through arrays into
+// each of their elements; unknown fields are ignored. The body is gzipped when the
+// client accepts it, since these responses can be long lists.
+func writeQueryJSON(ctx context.Context, w http.ResponseWriter, r *http.Request, v any) {
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		projected, err := projectFields(v, fields)
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to project response fields", "error", err)
+			writeServerError(ctx, w, "Failed to project response fields")
+			return
+		}
+		v = projected
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	compressed := gzip.NewWriter(w)
+	err := json.NewEncoder(compressed).Encode(v)
+	if err == nil {
+		err = compressed.Close()
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to write response", "error", err)
+	}
+}
+
+// projectFields returns v as generic JSON holding only the comma-separated dotted
+// field paths in fields
+func projectFields(v any, fields string) (any, error) {
+	var paths [][]string
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			paths = append(paths, strings.Split(field, "."))
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic any
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return project(generic, paths), nil
+}
+
+// project keeps the fields of value named by paths, descending into every element
+// of arrays along the way
+func project(value any, paths [][]string) any {
+	switch value := value.(type) {
+	case []any:
+		projected := make([]any, len(value))
+		for i, element := range value {
+			projected[i] = project(element, paths)
+		}
+		return projected
+	case map[string]any:
+		projected := make(map[string]any)
+		nested := make(map[string][][]string)
+		for _, p := range paths {
+			field, ok := value[p[0]]
+			switch {
+			case !ok:
+			case len(p) == 1:
+				projected[p[0]] = field
+			default:
+				nested[p[0]] = append(nested[p[0]], p[1:])
+			}
+		}
+		for name, rest := range nested {
+			// A whole field also requested by a shorter path stays whole
+			if _, whole := projected[name]; !whole {
+				projected[name] = project(value[name], rest)
+			}
+		}
+		return projected
+	}
+	return value
+}
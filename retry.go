@@ -0,0 +1,52 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// isTransientGCSError reports whether err is worth retrying: throttling, server
+// errors and network timeouts. Missing objects and failed preconditions are
+// answers, not failures, and are never retried.
+func isTransientGCSError(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		switch gErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// withGCSRetry runs fn, retrying transient failures up to GCS_MAX_RETRIES times
+// with exponential backoff and jitter. Only operations that are safe to repeat may
+// be wrapped: a conditional write whose first attempt landed fails its
+// precondition on retry rather than writing twice.
+func withGCSRetry(ctx context.Context, operation string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientGCSError(err) || attempt > gcsMaxRetries {
+			return err
+		}
+		wait := casBackoff(attempt)
+		loggerFrom(ctx).Warn("Transient GCS error, retrying", "operation", operation, "attempt", attempt, "max_attempts", gcsMaxRetries+1, "wait", wait.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
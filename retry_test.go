@@ -0,0 +1,37 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestWithGCSRetry(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"fails twice then succeeds", []error{unavailable, unavailable, nil}, 3, nil},
+		{"missing object is not retried", []error{storage.ErrObjectNotExist}, 1, storage.ErrObjectNotExist},
+		{"gives up after the retries", []error{unavailable, unavailable, unavailable, nil}, 3, unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &gcsMaxRetries, 2)
+			calls := 0
+			err := withGCSRetry(context.Background(), "test", func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.wantCalls || err != tt.wantErr {
+				t.Fatalf("withGCSRetry made %d calls and returned %v, want %d calls and %v", calls, err, tt.wantCalls, tt.wantErr)
+			}
+		})
+	}
+}
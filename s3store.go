@@ -0,0 +1,366 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// With STORAGE_BACKEND=s3 the session bookkeeping kept through objectStore, which is
+// the metadata, sequence counters, locks, dedup markers and finalize, pairing,
+// late-chunk and playlist records, lives in an S3-compatible bucket rather than in
+// GCS. Recordings are still assembled by composing GCS objects, which S3 has no
+// equivalent for, so GCS_BUCKET_NAME and its credentials remain required. Requests
+// go to S3_ENDPOINT with path-style addressing, signed with Signature Version 4 for
+// S3_REGION using AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and, for temporary
+// credentials, AWS_SESSION_TOKEN.
+//
+// S3 has no object generations, so each object's generation is derived from its
+// ETag, and conditional writes and deletes check it against the stored ETag and
+// then send that ETag as If-Match, which makes them atomic. Creating an object
+// sends If-None-Match. Both need a service that honors conditional writes.
+
+// s3Store is the objectStore backed by an S3-compatible bucket
+type s3Store struct {
+	client       *http.Client
+	endpoint     string
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Store returns an objectStore over the S3 bucket named bucket, at S3_ENDPOINT
+func newS3Store(bucket string) objectStore {
+	return s3Store{
+		client:       http.DefaultClient,
+		endpoint:     s3Endpoint,
+		region:       s3Region,
+		bucket:       bucket,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// etagGeneration maps an S3 ETag to the generation it is reported as, never 0,
+// which stands for an absent object
+func etagGeneration(etag string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(etag))
+	if generation := int64(h.Sum64() & math.MaxInt64); generation != 0 {
+		return generation
+	}
+	return 1
+}
+
+// s3Error converts the response to a failed S3 request into the error GCS would
+// return: storage.ErrObjectNotExist for a missing object, a 412 googleapi.Error for
+// a failed precondition, including the 409 S3 answers to a conflicting conditional
+// write, and otherwise a googleapi.Error with the status, so withGCSRetry retries
+// the same transient failures
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return storage.ErrObjectNotExist
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet", Body: string(body)}
+	}
+	return &googleapi.Error{Code: resp.StatusCode, Message: http.StatusText(resp.StatusCode), Body: string(body)}
+}
+
+// do sends a signed request for name, "" for the bucket itself, with the query,
+// headers and body given, and returns the response to a successful one
+func (s s3Store) do(ctx context.Context, method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	target := s.endpoint + "/" + s3Escape(s.bucket, false)
+	if name != "" {
+		target += "/" + s3Escape(name, false)
+	}
+	if len(query) > 0 {
+		target += "?" + s3Query(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	sum := sha256.Sum256(body)
+	signS3(req, hex.EncodeToString(sum[:]), s.accessKey, s.secretKey, s.sessionToken, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp, nil
+}
+
+// head returns the ETag of name and the response describing it
+func (s s3Store) head(ctx context.Context, name string) (string, *http.Response, error) {
+	var resp *http.Response
+	err := withGCSRetry(ctx, "stat "+name, func() (err error) {
+		resp, err = s.do(ctx, http.MethodHead, name, nil, nil, nil)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), resp, nil
+}
+
+// matching returns the ETag of name provided name is at generation, and a
+// precondition failure otherwise
+func (s s3Store) matching(ctx context.Context, name string, generation int64) (string, error) {
+	etag, _, err := s.head(ctx, name)
+	if err == storage.ErrObjectNotExist {
+		return "", &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+	}
+	if err != nil {
+		return "", err
+	}
+	if etagGeneration(etag) != generation {
+		return "", &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+	}
+	return etag, nil
+}
+
+func (s s3Store) Read(ctx context.Context, name string) (data []byte, generation int64, err error) {
+	err = withGCSRetry(ctx, "read "+name, func() error {
+		resp, err := s.do(ctx, http.MethodGet, name, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = io.ReadAll(resp.Body)
+		generation = etagGeneration(resp.Header.Get("ETag"))
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, generation, nil
+}
+
+func (s s3Store) Write(ctx context.Context, name, contentType string, data []byte, generation int64) (int64, error) {
+	header := http.Header{"Content-Type": {contentType}}
+	if generation == 0 {
+		header.Set("If-None-Match", "*")
+	} else {
+		etag, err := s.matching(ctx, name, generation)
+		if err != nil {
+			return 0, err
+		}
+		header.Set("If-Match", etag)
+	}
+
+	var written int64
+	err := withGCSRetry(ctx, "write "+name, func() error {
+		resp, err := s.do(ctx, http.MethodPut, name, nil, header, data)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		written = etagGeneration(resp.Header.Get("ETag"))
+		return nil
+	})
+	return written, err
+}
+
+func (s s3Store) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	etag, resp, err := s.head(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	attrs := &storage.ObjectAttrs{
+		Name:        name,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		Generation:  etagGeneration(etag),
+		Etag:        etag,
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		attrs.Created, attrs.Updated = modified, modified
+	}
+	for key, values := range resp.Header {
+		if tag, ok := strings.CutPrefix(strings.ToLower(key), "x-amz-meta-"); ok && len(values) > 0 {
+			if attrs.Metadata == nil {
+				attrs.Metadata = map[string]string{}
+			}
+			attrs.Metadata[tag] = values[0]
+		}
+	}
+	return attrs, nil
+}
+
+// Delete reports a missing object as storage.ErrObjectNotExist, as GCS does, which
+// S3, answering 204 either way, would not, so the object is looked up first
+func (s s3Store) Delete(ctx context.Context, name string, generation int64) error {
+	etag, _, err := s.head(ctx, name)
+	if err != nil {
+		return err
+	}
+	var header http.Header
+	if generation != 0 {
+		if etagGeneration(etag) != generation {
+			return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+		}
+		header = http.Header{"If-Match": {etag}}
+	}
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response List reads
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var page s3ListResult
+		err := withGCSRetry(ctx, "list "+prefix, func() error {
+			resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			page = s3ListResult{}
+			return xml.NewDecoder(resp.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			names = append(names, object.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return names, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// s3Escape percent-encodes value as Signature Version 4 requires, leaving only the
+// unreserved characters as they are, and "/" too unless escapeSlash is set
+func s3Escape(value string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Query encodes query in the canonical form Signature Version 4 signs: sorted by
+// key, with keys and values escaped by s3Escape
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// signS3 signs req, whose body hashes to payloadHash, with Signature Version 4 for
+// the s3 service in region at now. The host and every header already set on req
+// are signed.
+func signS3(req *http.Request, payloadHash, accessKey, secretKey, sessionToken, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(key)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
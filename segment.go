@@ -0,0 +1,143 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// maxComposeSources is how many objects GCS composes in one request
+const maxComposeSources = 32
+
+// With STREAMING_MODE=eager, the default, each chunk is composed onto the end of its
+// file's accumulator as it arrives. With STREAMING_MODE=lazy a chunk is only
+// uploaded, as a segment named by the offset in the file's PCM it starts at, so
+// storing it costs one write however long the file has grown. HandleGetCurrent
+// assembles the file on read from the accumulator, which holds the first chunk, and
+// the segments continuing it, and finalizing folds the segments into the accumulator
+// before composing the WAV, which comes out byte for byte as the eager mode writes
+// it. The mode can change while a session is open: an eager append folds the
+// session's segments in first.
+
+// segmentPath returns the name of the segment holding the audio of filename stored
+// from byte offset of its PCM
+func segmentPath(filename string, offset int64) string {
+	return fmt.Sprintf("%s/segments/%d.pcm", strings.TrimSuffix(filename, ".wav"), offset)
+}
+
+// segmentBase returns the base name, without extension, of the file whose segment
+// is name, and whether name is a segment as segmentPath names them
+func segmentBase(name string) (string, bool) {
+	return pieceBase(name, "/segments/")
+}
+
+// pcmSource is a stored piece of a file's PCM
+type pcmSource struct {
+	obj     *storage.ObjectHandle
+	size    int64
+	updated time.Time
+}
+
+// appendSegment uploads body as the segment of filename starting at offset. The
+// upload fails its precondition when another request stored that segment first.
+func appendSegment(ctx context.Context, bucket *storage.BucketHandle, filename string, offset int64, body []byte) (*storage.ObjectAttrs, error) {
+	segment := bucket.Object(segmentPath(filename, offset))
+	attrs, err := writeObject(ctx, segment.If(storage.Conditions{DoesNotExist: true}), "application/octet-stream", body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write segment: %w", err)
+	}
+	if crc32cVerificationEnabled() {
+		if err := verifyCRC32C(ctx, segment, body); err != nil {
+			deleteObject(ctx, segment.If(storage.Conditions{GenerationMatch: attrs.Generation}))
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// listSegments returns the segments of filename continuing its PCM from byte offset,
+// in order and each pinned to its listed generation. A segment past a gap in the
+// offsets is not part of the file, nor is one left behind an offset already folded.
+func listSegments(ctx context.Context, bucket *storage.BucketHandle, filename string, offset int64) ([]pcmSource, error) {
+	prefix := strings.TrimSuffix(filename, ".wav") + "/segments/"
+	stored := map[int64]*storage.ObjectAttrs{}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list segments of %s: %v", filename, err)
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(attrs.Name, prefix), ".pcm"), 10, 64)
+		if err == nil {
+			stored[start] = attrs
+		}
+	}
+
+	var segments []pcmSource
+	for attrs := stored[offset]; attrs != nil && attrs.Size > 0; attrs = stored[offset] {
+		segments = append(segments, pcmSource{obj: bucket.Object(attrs.Name).Generation(attrs.Generation), size: attrs.Size, updated: attrs.Updated})
+		offset += attrs.Size
+	}
+	return segments, nil
+}
+
+// unrecordedSegments returns the total size of the segments of filename continuing
+// its PCM from byte offset, which were stored by appends whose metadata was never
+// written. Unlike listSegments it looks each up by name, so when the metadata is
+// current, as it nearly always is, it costs a single request.
+func unrecordedSegments(ctx context.Context, bucket *storage.BucketHandle, filename string, offset int64) (int64, error) {
+	var size int64
+	for {
+		attrs, err := bucket.Object(segmentPath(filename, offset+size)).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read attributes of %s: %v", segmentPath(filename, offset+size), err)
+		}
+		if attrs.Size == 0 {
+			return size, nil
+		}
+		size += attrs.Size
+	}
+}
+
+// foldSegments composes the segments continuing the accumulator of filename, whose
+// attributes are attrs, onto its end and deletes them, returning the attributes of
+// the accumulator holding them. The composes are conditional on the generation
+// they extend, so an append racing them fails rather than being lost.
+func foldSegments(ctx context.Context, bucket *storage.BucketHandle, filename string, attrs *storage.ObjectAttrs) (*storage.ObjectAttrs, error) {
+	segments, err := listSegments(ctx, bucket, filename, attrs.Size)
+	if err != nil || len(segments) == 0 {
+		return attrs, err
+	}
+
+	accumulator := bucket.Object(pcmPath(filename))
+	folded := len(segments)
+	for len(segments) > 0 {
+		batch := segments[:min(len(segments), maxComposeSources-1)]
+		sources := []*storage.ObjectHandle{accumulator.Generation(attrs.Generation)}
+		for _, segment := range batch {
+			sources = append(sources, segment.obj)
+		}
+		composer := accumulator.If(storage.Conditions{GenerationMatch: attrs.Generation}).ComposerFrom(sources...)
+		composer.ContentType = "application/octet-stream"
+		if attrs, err = composer.Run(ctx); err != nil {
+			return nil, fmt.Errorf("failed to fold segments into %s: %w", accumulator.ObjectName(), err)
+		}
+		for _, segment := range batch {
+			deleteObject(ctx, segment.obj)
+		}
+		segments = segments[len(batch):]
+	}
+	loggerFrom(ctx).Info("Folded segments into accumulator", "accumulator", accumulator.ObjectName(), "segments", folded, "bytes", attrs.Size)
+	return attrs, nil
+}
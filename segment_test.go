@@ -0,0 +1,122 @@
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordInMode streams chunks to alice with STREAMING_MODE set to mode, returning
+// the in-progress WAV downloaded before finalizing and the finalized WAV
+func recordInMode(t *testing.T, mode string, chunks [][]byte) (current, finalized []byte) {
+	t.Helper()
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &streamingMode, mode)
+	for i, chunk := range chunks {
+		mustPost(t, fmt.Sprintf("uid=alice&seq=%d", i+1), chunk)
+	}
+	filename := currentMetadata(t, f, "alice").Filename
+
+	w := getCurrent(t, "uid=alice", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: GET answered %d: %s", mode, w.Code, w.Body)
+	}
+	current = w.Body.Bytes()
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("%s: finalize answered %d: %s", mode, w.Code, w.Body)
+	}
+	finalized, _ = f.get(filename)
+	if leftover := f.names(strings.TrimSuffix(filename, ".wav") + "/"); len(leftover) > 0 {
+		t.Fatalf("%s: finalize left %v", mode, leftover)
+	}
+	return current, finalized
+}
+
+func TestLazyAssemblyMatchesEager(t *testing.T) {
+	// More chunks than one compose can fold, of uneven lengths
+	var chunks [][]byte
+	for i := 0; i < 40; i++ {
+		chunks = append(chunks, sine(float64(200+10*i), 16000, 160+7*i, 8000))
+	}
+	eagerCurrent, eagerWAV := recordInMode(t, "eager", chunks)
+	lazyCurrent, lazyWAV := recordInMode(t, "lazy", chunks)
+
+	header, _ := createWAVHeader(len(concat(chunks...)), 16000, 1, 16, false)
+	want := concat(header, concat(chunks...))
+	if !bytes.Equal(eagerWAV, want) {
+		t.Fatalf("eager WAV holds %d bytes that differ from the %d expected", len(eagerWAV), len(want))
+	}
+	if !bytes.Equal(lazyCurrent, eagerCurrent) {
+		t.Fatalf("lazily assembled download holds %d bytes that differ from the %d eager ones", len(lazyCurrent), len(eagerCurrent))
+	}
+	if !bytes.Equal(lazyWAV, eagerWAV) {
+		t.Fatalf("lazily assembled WAV holds %d bytes that differ from the %d eager ones", len(lazyWAV), len(eagerWAV))
+	}
+}
+
+func TestLazyAppendStoresSegments(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &streamingMode, "lazy")
+	first, second := tone(100*time.Millisecond, 16000), tone(200*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", first)
+	mustPost(t, "uid=alice", second)
+	metadata := currentMetadata(t, f, "alice")
+
+	// The accumulator is left as the first chunk created it
+	if stored, _ := f.get(pcmPath(metadata.Filename)); len(stored) != len(first) {
+		t.Fatalf("accumulator holds %d bytes, want %d", len(stored), len(first))
+	}
+	if stored, ok := f.get(segmentPath(metadata.Filename, int64(len(first)))); !ok || !bytes.Equal(stored, second) {
+		t.Fatalf("second chunk was not stored as a segment, objects %v", f.names(""))
+	}
+	if metadata.CurrentSize != len(first)+len(second) {
+		t.Fatalf("metadata holds %d bytes, want %d", metadata.CurrentSize, len(first)+len(second))
+	}
+}
+
+func TestLazyRecoversUnrecordedSegment(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &streamingMode, "lazy")
+	a, b, c := tone(100*time.Millisecond, 16000), tone(200*time.Millisecond, 16000), tone(300*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", a)
+	filename := currentMetadata(t, f, "alice").Filename
+
+	// A request stored b but died before writing the metadata
+	f.put(segmentPath(filename, int64(len(a))), b)
+
+	mustPost(t, "uid=alice", c)
+	if size := currentMetadata(t, f, "alice").CurrentSize; size != len(a)+len(b)+len(c) {
+		t.Fatalf("metadata holds %d bytes, want %d", size, len(a)+len(b)+len(c))
+	}
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	if wav, _ := f.get(filename); !bytes.Equal(wav[wavHeaderSize:], concat(a, b, c)) {
+		t.Fatalf("recording holds %d bytes of audio, want %d", len(wav)-wavHeaderSize, len(a)+len(b)+len(c))
+	}
+}
+
+func TestSwitchingToEagerFoldsSegments(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &streamingMode, "lazy")
+	a, b, c := tone(100*time.Millisecond, 16000), tone(200*time.Millisecond, 16000), tone(300*time.Millisecond, 16000)
+	mustPost(t, "uid=alice", a)
+	mustPost(t, "uid=alice", b)
+	filename := currentMetadata(t, f, "alice").Filename
+
+	streamingMode = "eager"
+	mustPost(t, "uid=alice", c)
+	if stored, _ := f.get(pcmPath(filename)); !bytes.Equal(stored, concat(a, b, c)) {
+		t.Fatalf("accumulator holds %d bytes, want the %d of every chunk in order", len(stored), len(a)+len(b)+len(c))
+	}
+	if segments := f.names(strings.TrimSuffix(filename, ".wav") + "/segments/"); len(segments) > 0 {
+		t.Fatalf("segments %v were not folded", segments)
+	}
+}
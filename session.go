@@ -0,0 +1,91 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// finalizedPrefix holds a marker per named session that has been finalized
+const finalizedPrefix = "finalized/"
+
+// A client may name its session with the session_id param to hold several recordings
+// open under one uid and to reopen exactly the one it was streaming to after a
+// reconnect. A named session is keyed by {uid}/{session_id} wherever an unnamed one
+// is keyed by uid alone: its metadata, its sequence counter and the path of its files.
+// Once finalized, a named session is closed for good, so later chunks for it are
+// refused instead of starting a new file under the same name.
+
+// sessionKey returns the key under which the session of uid named sessionID is
+// stored, which is uid itself for the unnamed session
+func sessionKey(uid, sessionID string) string {
+	if sessionID == "" {
+		return uid
+	}
+	return uid + "/" + sessionID
+}
+
+// parseSessionID returns the optional session_id param, which like uid must not
+// contain '/', be a relative path segment or be a reserved name
+func parseSessionID(query url.Values) (string, error) {
+	sessionID := query.Get("session_id")
+	if strings.Contains(sessionID, "/") {
+		return "", errors.New("session_id must not contain '/'")
+	}
+	if sessionID == "." || sessionID == ".." {
+		return "", errors.New("session_id must not be '.' or '..'")
+	}
+	if reservedSessionIDs[sessionID] {
+		return "", fmt.Errorf("session_id must not be %q, a reserved name", sessionID)
+	}
+	return sessionID, nil
+}
+
+// reservedSessionIDs are the names a session_id can't take: the folders holding the
+// parts and segments of a file, which a session's files would be mistaken for
+var reservedSessionIDs = map[string]bool{
+	"parts":    true,
+	"segments": true,
+}
+
+// splitSessionKey returns the uid and session ID that key was made from
+func splitSessionKey(key string) (uid, sessionID string) {
+	uid, sessionID, _ = strings.Cut(key, "/")
+	return uid, sessionID
+}
+
+// finalizedPath returns the name of the marker recording that the named session key
+// was finalized
+func finalizedPath(key string) string {
+	return finalizedPrefix + key
+}
+
+// markSessionFinalized records that the session key was finalized, so later chunks
+// for it are refused. The unnamed session is reopened by its next chunk, so it is
+// never marked.
+func markSessionFinalized(ctx context.Context, store objectStore, key string) error {
+	if _, sessionID := splitSessionKey(key); sessionID == "" {
+		return nil
+	}
+	_, err := store.Write(ctx, finalizedPath(key), "text/plain", nil, 0)
+	if isPreconditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// sessionFinalized reports whether the named session key was finalized
+func sessionFinalized(ctx context.Context, store objectStore, key string) (bool, error) {
+	if _, sessionID := splitSessionKey(key); sessionID == "" {
+		return false, nil
+	}
+	_, err := store.Attrs(ctx, finalizedPath(key))
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
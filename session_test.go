@@ -0,0 +1,85 @@
+package function
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseSessionID(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"session_id=s1", "s1", false},
+		{"session_id=a/b", "", true},
+		{"session_id=.", "", true},
+		{"session_id=..", "", true},
+		{"session_id=parts", "", true},
+		{"session_id=segments", "", true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := parseSessionID(query)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSessionID(%q) = %q, %v, want %q, error %v", tt.query, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSessionKeyRoundTrip(t *testing.T) {
+	tests := []struct{ uid, sessionID, key string }{
+		{"alice", "", "alice"},
+		{"alice", "s1", "alice/s1"},
+	}
+	for _, tt := range tests {
+		key := sessionKey(tt.uid, tt.sessionID)
+		if key != tt.key {
+			t.Errorf("sessionKey(%q, %q) = %q, want %q", tt.uid, tt.sessionID, key, tt.key)
+		}
+		if uid, sessionID := splitSessionKey(key); uid != tt.uid || sessionID != tt.sessionID {
+			t.Errorf("splitSessionKey(%q) = %q, %q", key, uid, sessionID)
+		}
+	}
+}
+
+func TestSessionsAreIndependentAndResumable(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	walk, call := tone(250*time.Millisecond, 16000), sine(440, 16000, 4000, 0.5)
+
+	// Interleaved chunks of two sessions started at the same instant
+	for i := 0; i < 2; i++ {
+		mustPost(t, "uid=alice&session_id=walk", walk)
+		mustPost(t, "uid=alice&session_id=call", call)
+		clock.Advance(time.Minute)
+	}
+	walkFile, callFile := currentMetadata(t, f, "alice/walk").Filename, currentMetadata(t, f, "alice/call").Filename
+	if walkFile == callFile {
+		t.Fatalf("both sessions write to %s", walkFile)
+	}
+
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice&session_id=walk", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	data, _ := f.get(walkFile)
+	if !bytes.Equal(data[wavHeaderSize:], append(walk, walk...)) {
+		t.Fatal("walk recording holds audio from another session")
+	}
+
+	// The other session resumes where it left off, while the finalized one is closed
+	if w := mustPost(t, "uid=alice&session_id=call", call); w.Code != http.StatusOK {
+		t.Fatalf("resumed session answered %d, want an append", w.Code)
+	}
+	pcm, _ := f.get(pcmPath(callFile))
+	if !bytes.Equal(pcm, bytes.Repeat(call, 3)) {
+		t.Fatal("call recording does not hold its own three chunks")
+	}
+	if w := postAudio(t, "uid=alice&session_id=walk", walk); w.Code != http.StatusConflict {
+		t.Fatalf("chunk for the finalized session answered %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,90 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// sidecar is the capture metadata stored as JSON next to each WAV file so downstream
+// processing knows whose audio it is and how it was recorded
+type sidecar struct {
+	UID        string    `json:"uid"`
+	SessionID  string    `json:"session_id,omitempty"`
+	Filename   string    `json:"filename"`
+	SampleRate int       `json:"sample_rate"`
+	Channels   int       `json:"channels"`
+	Bits       int       `json:"bits"`
+	Float      bool      `json:"float,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	DeviceID   string    `json:"device_id,omitempty"`
+	// The remaining fields are filled in once the file is finalized
+	Size            int        `json:"size,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+	FinalizedAt     *time.Time `json:"finalized_at,omitempty"`
+}
+
+// sidecarPath returns the name of the sidecar object of filename
+func sidecarPath(filename string) string {
+	return strings.TrimSuffix(filename, ".wav") + ".json"
+}
+
+// recordingTags returns the custom metadata set on a finalized recording, so
+// lifecycle rules and listings can select recordings without reading them. The
+// retention_class tag is only set when RETENTION_CLASS is configured, and the
+// session_id tag only for a named session.
+func recordingTags(key string, metadata *WAVMetadata) map[string]string {
+	uid, sessionID := splitSessionKey(key)
+	tags := map[string]string{
+		"uid":         uid,
+		"sample_rate": strconv.Itoa(metadata.fileSampleRate()),
+		"channels":    strconv.Itoa(metadata.fileChannels()),
+		"bits":        strconv.Itoa(metadata.fileBits()),
+		"created_at":  metadata.StartTime.UTC().Format(time.RFC3339),
+	}
+	if retentionClass != "" {
+		tags["retention_class"] = retentionClass
+	}
+	if sessionID != "" {
+		tags["session_id"] = sessionID
+	}
+	return tags
+}
+
+// writeSidecar writes the sidecar of the file described by metadata, recorded in
+// session key. A positive dataSize marks the file as finalized with that many bytes
+// of audio.
+func writeSidecar(ctx context.Context, bucket *storage.BucketHandle, key string, metadata *WAVMetadata, dataSize int) error {
+	uid, sessionID := splitSessionKey(key)
+	info := sidecar{
+		UID:        uid,
+		SessionID:  sessionID,
+		Filename:   metadata.Filename,
+		SampleRate: metadata.fileSampleRate(),
+		Channels:   metadata.fileChannels(),
+		Bits:       metadata.fileBits(),
+		Float:      metadata.Float,
+		CreatedAt:  metadata.StartTime,
+		DeviceID:   metadata.DeviceID,
+	}
+	if dataSize > 0 {
+		now := nowFunc()
+		info.Size = wavObjectSize(dataSize)
+		info.DurationSeconds = calculateDuration(dataSize, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()).Seconds()
+		info.FinalizedAt = &now
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode sidecar: %v", err)
+	}
+	if _, err := writeObject(ctx, bucket.Object(sidecarPath(metadata.Filename)), "application/json", data); err != nil {
+		return fmt.Errorf("failed to write sidecar for %s: %v", metadata.Filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package function
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// readSidecar returns the sidecar stored for filename
+func readSidecar(t *testing.T, f *fakeGCS, filename string) sidecar {
+	t.Helper()
+	data, ok := f.get(sidecarPath(filename))
+	if !ok {
+		t.Fatalf("%s has no sidecar", filename)
+	}
+	var info sidecar
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestSidecarContent(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice&session_id=walk&sample_rate=8000&device_id=omi-42", tone(500*time.Millisecond, 8000))
+	filename := currentMetadata(t, f, "alice/walk").Filename
+	want := sidecar{
+		UID:        "alice",
+		SessionID:  "walk",
+		Filename:   filename,
+		SampleRate: 8000,
+		Channels:   1,
+		Bits:       16,
+		CreatedAt:  testStart,
+		DeviceID:   "omi-42",
+	}
+	if got := readSidecar(t, f, filename); got != want {
+		t.Fatalf("sidecar of the open file = %+v, want %+v", got, want)
+	}
+
+	clock.Advance(time.Minute)
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice&session_id=walk", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	got := readSidecar(t, f, filename)
+	if got.Size != wavObjectSize(8000) || got.DurationSeconds != 0.5 || got.FinalizedAt == nil || !got.FinalizedAt.Equal(testStart.Add(time.Minute)) {
+		t.Fatalf("sidecar of the finalized file = %+v", got)
+	}
+}
+
+func TestFinalizedRecordingTags(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	setVar(t, &retentionClass, "short")
+
+	mustPost(t, "uid=alice&session_id=walk&sample_rate=8000&channels=2", tone(500*time.Millisecond, 8000))
+	filename := currentMetadata(t, f, "alice/walk").Filename
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice&session_id=walk", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	obj, ok := f.object(filename)
+	if !ok {
+		t.Fatal("recording was not finalized")
+	}
+	want := map[string]string{
+		"uid":             "alice",
+		"session_id":      "walk",
+		"sample_rate":     "8000",
+		"channels":        "2",
+		"bits":            "16",
+		"created_at":      "2024-05-01T12:00:00Z",
+		"retention_class": "short",
+	}
+	if !maps.Equal(obj.metadata, want) {
+		t.Fatalf("recording carries metadata %v, want %v", obj.metadata, want)
+	}
+}
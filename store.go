@@ -0,0 +1,144 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// objectStore is the narrow set of object operations the session bookkeeping
+// (metadata and sequence counters) needs, so that logic can run against an
+// in-memory implementation, or an S3-compatible bucket with STORAGE_BACKEND=s3,
+// instead of GCS. Missing objects are reported as storage.ErrObjectNotExist and
+// failed generation checks as a 412 googleapi.Error, matching what GCS returns, so
+// callers handle every implementation alike.
+type objectStore interface {
+	// Read returns the contents of name along with its generation
+	Read(ctx context.Context, name string) ([]byte, int64, error)
+	// Write stores data as name provided name is still at generation, or still
+	// absent when generation is 0, and returns the new generation
+	Write(ctx context.Context, name, contentType string, data []byte, generation int64) (int64, error)
+	// Attrs returns the attributes of name
+	Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error)
+	// Delete removes name provided it is still at generation, or unconditionally when
+	// generation is 0
+	Delete(ctx context.Context, name string, generation int64) error
+	// List returns the names of the objects under prefix in lexical order
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// gcsStore is the objectStore backed by a GCS bucket
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+// newGCSStore returns an objectStore over bucket
+func newGCSStore(bucket *storage.BucketHandle) objectStore {
+	return gcsStore{bucket: bucket}
+}
+
+// openStore returns the objectStore the handlers keep session bookkeeping in for
+// bucket. It is a variable so tests can swap in an in-memory store.
+var openStore = openConfiguredStore
+
+// openConfiguredStore returns the objectStore of STORAGE_BACKEND for bucket: bucket
+// itself, or the S3 bucket named by S3_BUCKET, or by bucket's name when that is unset
+func openConfiguredStore(bucket *storage.BucketHandle) objectStore {
+	if storageBackend == "s3" {
+		name := s3BucketName
+		if name == "" {
+			name = bucket.BucketName()
+		}
+		return newS3Store(name)
+	}
+	return newGCSStore(bucket)
+}
+
+// createOwned creates name holding data, provided name is absent, and reports
+// whether this call created it. data must be unique to the caller, such as a random
+// token: writes are retried on transient errors, so a first attempt that landed
+// without its response makes the retry fail the precondition, and the object's
+// content is what tells the caller's own write apart from another's.
+func createOwned(ctx context.Context, store objectStore, name, contentType string, data []byte) (generation int64, created bool, err error) {
+	generation, err = store.Write(ctx, name, contentType, data, 0)
+	if err == nil {
+		return generation, true, nil
+	}
+	if !isPreconditionFailed(err) {
+		return 0, false, err
+	}
+	existing, generation, err := store.Read(ctx, name)
+	if err == storage.ErrObjectNotExist {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if bytes.Equal(existing, data) {
+		return generation, true, nil
+	}
+	return 0, false, nil
+}
+
+func (s gcsStore) Read(ctx context.Context, name string) (data []byte, generation int64, err error) {
+	err = withGCSRetry(ctx, "read "+name, func() error {
+		r, err := s.bucket.Object(name).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err = io.ReadAll(r)
+		generation = r.Attrs.Generation
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, generation, nil
+}
+
+func (s gcsStore) Write(ctx context.Context, name, contentType string, data []byte, generation int64) (int64, error) {
+	conds := storage.Conditions{DoesNotExist: true}
+	if generation != 0 {
+		conds = storage.Conditions{GenerationMatch: generation}
+	}
+	attrs, err := writeObject(ctx, s.bucket.Object(name).If(conds), contentType, data)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+func (s gcsStore) Attrs(ctx context.Context, name string) (attrs *storage.ObjectAttrs, err error) {
+	err = withGCSRetry(ctx, "stat "+name, func() error {
+		attrs, err = s.bucket.Object(name).Attrs(ctx)
+		return err
+	})
+	return attrs, err
+}
+
+func (s gcsStore) Delete(ctx context.Context, name string, generation int64) error {
+	obj := s.bucket.Object(name)
+	if generation != 0 {
+		obj = obj.If(storage.Conditions{GenerationMatch: generation})
+	}
+	return obj.Delete(ctx)
+}
+
+func (s gcsStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
@@ -0,0 +1,437 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// memObject is one object held by memStore
+type memObject struct {
+	data        []byte
+	contentType string
+	generation  int64
+	created     time.Time
+}
+
+// memStore is an in-memory objectStore with the same generation semantics as GCS
+type memStore struct {
+	mu         sync.Mutex
+	objects    map[string]memObject
+	generation int64
+	// failWrite, when set, is consulted before each Write and its error returned
+	failWrite func(name string) error
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: map[string]memObject{}}
+}
+
+// useMemStore makes the handlers keep their bookkeeping in a fresh memStore for the
+// rest of the test
+func useMemStore(t *testing.T) *memStore {
+	t.Helper()
+	store := newMemStore()
+	old := openStore
+	openStore = func(*storage.BucketHandle) objectStore { return store }
+	t.Cleanup(func() { openStore = old })
+	return store
+}
+
+func preconditionFailed() error {
+	return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+}
+
+func (s *memStore) Read(_ context.Context, name string) ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, 0, storage.ErrObjectNotExist
+	}
+	return append([]byte(nil), obj.data...), obj.generation, nil
+}
+
+func (s *memStore) Write(_ context.Context, name, contentType string, data []byte, generation int64) (int64, error) {
+	if s.failWrite != nil {
+		if err := s.failWrite(name); err != nil {
+			return 0, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if (generation == 0 && ok) || (generation != 0 && (!ok || obj.generation != generation)) {
+		return 0, preconditionFailed()
+	}
+	s.generation++
+	s.objects[name] = memObject{data: append([]byte(nil), data...), contentType: contentType, generation: s.generation, created: nowFunc()}
+	return s.generation, nil
+}
+
+func (s *memStore) Attrs(_ context.Context, name string) (*storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return &storage.ObjectAttrs{Name: name, ContentType: obj.contentType, Size: int64(len(obj.data)), Generation: obj.generation, Created: obj.created, Updated: obj.created}, nil
+}
+
+func (s *memStore) Delete(_ context.Context, name string, generation int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return storage.ErrObjectNotExist
+	}
+	if generation != 0 && obj.generation != generation {
+		return preconditionFailed()
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memStore) List(_ context.Context, prefix string) ([]string, error) {
+	return s.names(prefix), nil
+}
+
+// names returns the names of the stored objects under prefix, sorted
+func (s *memStore) names(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// put stores data as name unconditionally and returns its generation
+func (s *memStore) put(t *testing.T, name string, data []byte) int64 {
+	t.Helper()
+	s.mu.Lock()
+	delete(s.objects, name)
+	s.mu.Unlock()
+	generation, err := s.Write(context.Background(), name, "application/octet-stream", data, 0)
+	if err != nil {
+		t.Fatalf("put %s: %v", name, err)
+	}
+	return generation
+}
+
+// setCreated backdates the creation time of name
+func (s *memStore) setCreated(name string, created time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := s.objects[name]
+	obj.created = created
+	s.objects[name] = obj
+}
+
+// setVar sets *v to value for the rest of the test
+func setVar[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+func TestMemStoreConditions(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		exists     bool
+		generation func(current int64) int64
+		wantErr    bool
+	}{
+		{"create absent", false, func(int64) int64 { return 0 }, false},
+		{"create existing", true, func(int64) int64 { return 0 }, true},
+		{"update at generation", true, func(current int64) int64 { return current }, false},
+		{"update at stale generation", true, func(current int64) int64 { return current - 1 }, true},
+		{"update absent", false, func(int64) int64 { return 7 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			var current int64
+			if tt.exists {
+				current = store.put(t, "a", []byte("old"))
+			}
+			_, err := store.Write(ctx, "a", "text/plain", []byte("new"), tt.generation(current))
+			if got := isPreconditionFailed(err); got != tt.wantErr {
+				t.Fatalf("Write error = %v, want precondition failure %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetCurrentMetadata(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		stored   string
+		wantFile string
+		wantErr  bool
+	}{
+		{"absent", "", "", false},
+		{"stored", `{"filename":"alice/a.wav","current_size":4}`, "alice/a.wav", false},
+		{"corrupt", `{"filename":`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			var wantGeneration int64
+			if tt.stored != "" {
+				wantGeneration = store.put(t, metadataPath("alice"), []byte(tt.stored))
+			}
+			metadata, generation, err := getCurrentMetadata(ctx, store, "alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getCurrentMetadata error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.wantFile == "" {
+				if metadata != nil || generation != 0 {
+					t.Fatalf("getCurrentMetadata = %+v, %d, want nil, 0", metadata, generation)
+				}
+				return
+			}
+			if metadata == nil || metadata.Filename != tt.wantFile || generation != wantGeneration {
+				t.Fatalf("getCurrentMetadata = %+v, %d, want %s at %d", metadata, generation, tt.wantFile, wantGeneration)
+			}
+		})
+	}
+}
+
+func TestCommitMetadata(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// stored is the metadata another request wrote after ours was read
+		stored   WAVMetadata
+		ours     WAVMetadata
+		wantFile string
+		wantGen  int64
+	}{
+		{
+			name:     "same file older generation is overwritten",
+			stored:   WAVMetadata{Filename: "a", ObjectGeneration: 1},
+			ours:     WAVMetadata{Filename: "a", ObjectGeneration: 2},
+			wantFile: "a", wantGen: 2,
+		},
+		{
+			name:     "same file newer generation is kept",
+			stored:   WAVMetadata{Filename: "a", ObjectGeneration: 3},
+			ours:     WAVMetadata{Filename: "a", ObjectGeneration: 2},
+			wantFile: "a", wantGen: 3,
+		},
+		{
+			name:     "newer file is kept",
+			stored:   WAVMetadata{Filename: "b", LastWriteTime: base.Add(time.Minute)},
+			ours:     WAVMetadata{Filename: "a", LastWriteTime: base},
+			wantFile: "b",
+		},
+		{
+			name:     "older file is replaced",
+			stored:   WAVMetadata{Filename: "a", LastWriteTime: base},
+			ours:     WAVMetadata{Filename: "b", LastWriteTime: base.Add(time.Minute)},
+			wantFile: "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			stale := store.put(t, metadataPath("alice"), []byte(`{}`))
+			data, _ := json.Marshal(tt.stored)
+			store.put(t, metadataPath("alice"), data)
+
+			if err := commitMetadata(ctx, store, "alice", &tt.ours, stale); err != nil {
+				t.Fatalf("commitMetadata: %v", err)
+			}
+			got, _, err := getCurrentMetadata(ctx, store, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Filename != tt.wantFile || got.ObjectGeneration != tt.wantGen {
+				t.Fatalf("stored metadata = %s@%d, want %s@%d", got.Filename, got.ObjectGeneration, tt.wantFile, tt.wantGen)
+			}
+		})
+	}
+}
+
+func TestAssignSequence(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		files []string
+		want  []int64
+	}{
+		{"counts up within a file", []string{"a", "a", "a"}, []int64{1, 2, 3}},
+		{"restarts for a new file", []string{"a", "a", "b", "b"}, []int64{1, 2, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			for i, file := range tt.files {
+				got, err := assignSequence(ctx, store, "alice", file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want[i] {
+					t.Fatalf("chunk %d of %s got sequence %d, want %d", i, file, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAssignSequenceConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	const writers = 5
+	seen := make(chan int64, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sequence, err := assignSequence(ctx, store, "alice", "a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			seen <- sequence
+		}()
+	}
+	wg.Wait()
+	close(seen)
+	unique := map[int64]bool{}
+	for sequence := range seen {
+		if unique[sequence] {
+			t.Fatalf("sequence %d assigned twice", sequence)
+		}
+		unique[sequence] = true
+	}
+	// Every writer got a sequence, so with none shared they must be 1..writers
+	for sequence := int64(1); sequence <= writers; sequence++ {
+		if !unique[sequence] {
+			t.Fatalf("sequence %d was skipped, assigned %v", sequence, unique)
+		}
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	ctx := context.Background()
+	setVar(t, &writeLockTimeout, 200*time.Millisecond)
+	setVar(t, &gcsTimeout, time.Minute)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	setVar(t, &nowFunc, func() time.Time { return now })
+
+	tests := []struct {
+		name string
+		// held, when set, is how long before now another holder took the lock
+		held    time.Duration
+		wantErr error
+	}{
+		{"free", 0, nil},
+		{"busy", time.Second, errLockBusy},
+		{"stale", 2 * time.Minute, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			if tt.held != 0 {
+				store.put(t, lockPath("alice"), []byte("other"))
+				store.setCreated(lockPath("alice"), now.Add(-tt.held))
+			}
+			release, err := acquireLock(ctx, store, "alice")
+			if err != tt.wantErr {
+				t.Fatalf("acquireLock error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			release()
+			if names := store.names(lockPrefix); len(names) != 0 {
+				t.Fatalf("lock left behind after release: %v", names)
+			}
+		})
+	}
+}
+
+// lostResponseStore is a memStore whose first write of each object lands but is
+// answered with a precondition failure, as a retried write whose first response was
+// lost is
+type lostResponseStore struct {
+	*memStore
+	written map[string]bool
+}
+
+func (s *lostResponseStore) Write(ctx context.Context, name, contentType string, data []byte, generation int64) (int64, error) {
+	generation, err := s.memStore.Write(ctx, name, contentType, data, generation)
+	if err == nil && !s.written[name] {
+		s.written[name] = true
+		return 0, preconditionFailed()
+	}
+	return generation, err
+}
+
+func TestAcquireLockAfterLostResponse(t *testing.T) {
+	setVar(t, &writeLockTimeout, 200*time.Millisecond)
+	store := &lostResponseStore{memStore: newMemStore(), written: map[string]bool{}}
+
+	release, err := acquireLock(context.Background(), store, "alice")
+	if err != nil {
+		t.Fatalf("acquireLock whose write landed without its response = %v", err)
+	}
+	release()
+	if names := store.names(lockPrefix); len(names) != 0 {
+		t.Fatalf("lock left behind after release: %v", names)
+	}
+}
+
+func TestClearMetadata(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name          string
+		key           string
+		wantFinalized bool
+	}{
+		{"default session", "alice", false},
+		{"named session", sessionKey("alice", "s1"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			generation := store.put(t, metadataPath(tt.key), []byte(`{"filename":"x"}`))
+			if err := clearMetadata(ctx, store, tt.key, generation); err != nil {
+				t.Fatal(err)
+			}
+			if metadata, _, _ := getCurrentMetadata(ctx, store, tt.key); metadata != nil {
+				t.Fatalf("metadata still present: %+v", metadata)
+			}
+			finalized, err := sessionFinalized(ctx, store, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if finalized != tt.wantFinalized {
+				t.Fatalf("sessionFinalized = %v, want %v", finalized, tt.wantFinalized)
+			}
+		})
+	}
+}
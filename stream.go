@@ -0,0 +1,194 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/websocket"
+)
+
+// streamAckInterval is the least time between two acks sent by HandleStream
+const streamAckInterval = 2 * time.Second
+
+// maxCloseReason is the most text a WebSocket close frame can carry
+const maxCloseReason = 123
+
+// streamUnsupportedParams lists the upload params that have no meaning on a stream
+var streamUnsupportedParams = []string{"codec", "byte_order", "seq", "chunk_id", "dry_run", "framing", "force_new", "pair_channel"}
+
+// HandleStream ingests audio over a WebSocket, avoiding the overhead of one POST per
+// chunk for continuous capture. It takes the query params of HandlePostAudio except
+// those listed in streamUnsupportedParams: every binary message is a chunk of
+// little-endian PCM, written to uid's session exactly like a POSTed chunk, including
+// rolling over to a new file. The client receives an ack with the accumulated size
+// at most every streamAckInterval.
+//
+// Closing the connection normally finalizes the recording, as HandleFinalize would.
+// A connection that drops instead leaves the session open, so the client can
+// reconnect and keep appending to the same file.
+func HandleStream(w http.ResponseWriter, r *http.Request) {
+	ctx, logger := startRequestLog(r.Context(), w, r)
+
+	query := r.URL.Query()
+	uid := query.Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received stream request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting stream with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+	sessionID, err := parseSessionID(query)
+	if err != nil {
+		logger.Warn("Rejecting stream with invalid session_id")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sessionID != "" {
+		ctx, logger = logWith(ctx, "session_id", sessionID)
+	}
+	key := sessionKey(uid, sessionID)
+
+	params, err := parseAudioParams(query)
+	if err != nil {
+		logger.Warn("Invalid query parameter", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, name := range streamUnsupportedParams {
+		if query.Has(name) {
+			logger.Warn("Rejecting stream with an unsupported param", "param", name)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s is not supported when streaming", name))
+			return
+		}
+	}
+	if unknown := unknownParams(query); len(unknown) > 0 && strictParamsEnabled() {
+		logger.Warn("Rejecting unknown query parameters", "params", unknown)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown query parameters: %s (accepted: %s)",
+			strings.Join(unknown, ", "), strings.Join(acceptedParams, ", ")))
+		return
+	}
+
+	// The handshake carries no body, so the signature covers only the session key and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, key, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated stream", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Only signed requests spend a uid's tokens, so forged ones can't throttle it
+	if ok, retryAfter := allowRequest(uid); !ok {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		logger.Warn("Rate limiting uid", "retry_after_seconds", seconds)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("Rate limit of %d requests per minute exceeded", rateLimitPerMin))
+		return
+	}
+
+	bucket, err := openBucket(bucketOverride(query, r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || corsOriginAllowed(origin)
+	}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request
+		logger.Warn("Failed to upgrade to WebSocket", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxBodyBytes)
+
+	var lastAck time.Time
+	for {
+		messageType, body, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			finalizeStream(ctx, bucket, key)
+			return
+		}
+		if err != nil {
+			logger.Warn("Stream ended without a clean close, leaving the session open", "error", err)
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			logger.Warn("Rejecting non-binary stream message", "type", messageType)
+			closeStream(conn, websocket.CloseUnsupportedData, "Audio must be sent as binary messages")
+			return
+		}
+		audioBytesReceived.Add(float64(len(body)))
+
+		// Each chunk gets its own GCS_TIMEOUT, since the stream itself is unbounded
+		chunkCtx, cancel := context.WithTimeout(ctx, gcsTimeout)
+		result, err := writeChunk(chunkCtx, bucket, key, params, query.Get("device_id"), body)
+		cancel()
+		if err != nil {
+			code := websocket.CloseInternalServerErr
+			var chunkErr *chunkError
+			if errors.As(err, &chunkErr) && chunkErr.status == http.StatusConflict {
+				code = websocket.ClosePolicyViolation
+			}
+			closeStream(conn, code, err.Error())
+			return
+		}
+
+		if time.Since(lastAck) >= streamAckInterval {
+			metadata := result.metadata
+			err := conn.WriteJSON(audioResponse{
+				Status:          "ok",
+				Filename:        metadata.Filename,
+				CurrentSize:     metadata.CurrentSize,
+				DurationSeconds: calculateDuration(metadata.CurrentSize, metadata.fileSampleRate(), metadata.fileChannels(), metadata.fileBits()).Seconds(),
+				Sequence:        metadata.Sequence,
+				Created:         result.created,
+			})
+			if err != nil {
+				logger.Warn("Failed to send stream ack, leaving the session open", "error", err)
+				return
+			}
+			lastAck = time.Now()
+		}
+	}
+}
+
+// finalizeStream closes the recording of session key once its stream was closed
+// normally
+func finalizeStream(ctx context.Context, bucket *storage.BucketHandle, key string) {
+	ctx, cancel := context.WithTimeout(ctx, gcsTimeout)
+	defer cancel()
+
+	logger := loggerFrom(ctx)
+	metadata, _, err := finalizeSession(ctx, bucket, key)
+	if err != nil {
+		logger.Error("Failed to finalize session after stream closed", "error", err)
+		return
+	}
+	if metadata == nil {
+		logger.Info("Stream closed with no active session to finalize")
+		return
+	}
+	logger.Info("Finalized session after stream closed", "file", metadata.Filename)
+}
+
+// closeStream sends a close frame with code and reason, trimmed to what a close frame
+// can carry
+func closeStream(conn *websocket.Conn, code int, reason string) {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	message := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
@@ -0,0 +1,129 @@
+package function
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamClient is a WebSocket client connected to HandleStream
+type streamClient struct {
+	*websocket.Conn
+	// done is closed once the handler has returned
+	done chan struct{}
+}
+
+// dialStream connects a WebSocket client to HandleStream with query
+func dialStream(t *testing.T, query string) *streamClient {
+	t.Helper()
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		HandleStream(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?"+query, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial answered %d: %v", status, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &streamClient{Conn: conn, done: done}
+}
+
+// closeAndWait closes the stream normally and waits for the handler to act on it
+func (c *streamClient) closeAndWait(t *testing.T) {
+	t.Helper()
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler did not return after a clean close")
+	}
+}
+
+func TestStreamFrames(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	conn := dialStream(t, "uid=alice")
+
+	var want []byte
+	for i, d := range []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, 250 * time.Millisecond} {
+		frame := tone(d, 16000)
+		want = append(want, frame...)
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+		// The first frame is acked at once, later ones within streamAckInterval aren't
+		if i == 0 {
+			var ack audioResponse
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.ReadJSON(&ack); err != nil {
+				t.Fatal(err)
+			}
+			if ack.Status != "ok" || ack.CurrentSize != len(frame) || !ack.Created {
+				t.Fatalf("first ack = %+v", ack)
+			}
+		}
+	}
+	conn.closeAndWait(t)
+
+	filename := "alice/2024-05-01T12-00-00Z.wav"
+	if _, dataLen := storedWAV(t, f, filename); dataLen != len(want) {
+		t.Fatalf("streamed file holds %d bytes of audio, want %d", dataLen, len(want))
+	}
+	data, _ := f.get(filename)
+	if !bytes.Equal(data[wavHeaderSize:], want) {
+		t.Fatal("streamed audio differs from the frames in order")
+	}
+	if _, ok := f.get(metadataPath("alice")); ok {
+		t.Fatal("clean close left the session open")
+	}
+}
+
+func TestStreamDropLeavesSessionOpen(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	conn := dialStream(t, "uid=alice")
+
+	conn.WriteMessage(websocket.BinaryMessage, tone(250*time.Millisecond, 16000))
+	var ack audioResponse
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Reconnecting appends to the same file
+	conn = dialStream(t, "uid=alice")
+	conn.WriteMessage(websocket.BinaryMessage, tone(250*time.Millisecond, 16000))
+	ack = audioResponse{}
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.CurrentSize != 16000 || ack.Created {
+		t.Fatalf("ack after reconnecting = %+v, want an append to 16000 bytes", ack)
+	}
+	if metadata := currentMetadata(t, f, "alice"); metadata == nil || metadata.Filename != ack.Filename {
+		t.Fatal("dropped stream did not leave its session open")
+	}
+}
+
+func TestStreamRejectsTextMessages(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	conn := dialStream(t, "uid=alice")
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"audio":"..."}`))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+		t.Fatalf("text message got %v, want a close with %d", err, websocket.CloseUnsupportedData)
+	}
+}
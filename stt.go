@@ -0,0 +1,89 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// fallbackSTTLanguage is used when STT_DEFAULT_LANGUAGE is unset or invalid
+const fallbackSTTLanguage = "en-US"
+
+// languageTagPattern matches the shape of a BCP-47 language tag: a 2 or 3 letter
+// language followed by subtags such as a script, region or variant
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// A client may hint the spoken language of a session with the lang param, which is
+// kept in the session's metadata; a chunk carrying it changes the hint for the rest of
+// the session, and a file started by rolling over keeps it. When STT_URL is set,
+// every finalized recording is handed to the speech-to-text backend there along with
+// its language, falling back to STT_DEFAULT_LANGUAGE for sessions that gave none.
+
+// sttRequest is the JSON body posted to STT_URL for a finalized recording
+type sttRequest struct {
+	// URI is the recording's gs:// location, from which the backend reads it
+	URI           string `json:"uri"`
+	UID           string `json:"uid"`
+	Language      string `json:"language"`
+	SampleRate    int    `json:"sample_rate"`
+	Channels      int    `json:"channels"`
+	BitsPerSample int    `json:"bits_per_sample"`
+}
+
+// parseLanguage returns the optional lang param, which must look like a BCP-47 tag
+func parseLanguage(value string) (string, error) {
+	if value != "" && !languageTagPattern.MatchString(value) {
+		return "", fmt.Errorf("invalid lang %q, expected a BCP-47 language tag such as en-US", value)
+	}
+	return value, nil
+}
+
+// requestTranscript posts the recording entry describes, finalized in bucketName from
+// the session metadata describes, to the STT backend at STT_URL. Transcription is
+// opt-in and best effort: failures are logged and never fail the request that
+// finalized the recording.
+func requestTranscript(ctx context.Context, bucketName, uid string, metadata *WAVMetadata, entry recordingEntry) {
+	if sttURL == "" {
+		return
+	}
+	language := metadata.Language
+	if language == "" {
+		language = sttDefaultLanguage
+	}
+	logger := loggerFrom(ctx).With("file", entry.Filename, "language", language)
+
+	data, err := json.Marshal(sttRequest{
+		URI:           fmt.Sprintf("gs://%s/%s", bucketName, entry.Filename),
+		UID:           uid,
+		Language:      language,
+		SampleRate:    metadata.fileSampleRate(),
+		Channels:      metadata.fileChannels(),
+		BitsPerSample: metadata.fileBits(),
+	})
+	if err != nil {
+		logger.Error("Failed to encode transcription request", "error", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sttURL, bytes.NewReader(data))
+	if err != nil {
+		logger.Error("Failed to build transcription request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("Failed to request transcription", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		logger.Error("STT backend refused transcription request", "status", resp.StatusCode)
+		return
+	}
+	logger.Info("Requested transcription")
+}
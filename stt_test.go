@@ -0,0 +1,97 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSTT is a speech-to-text backend recording every transcription request
+type fakeSTT struct {
+	mu       sync.Mutex
+	requests []sttRequest
+}
+
+// newFakeSTT starts a fakeSTT and points STT_URL at it for the rest of the test
+func newFakeSTT(t *testing.T) *fakeSTT {
+	t.Helper()
+	s := &fakeSTT{}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	setVar(t, &sttURL, srv.URL)
+	return s
+}
+
+func (s *fakeSTT) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request sttRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// received returns the transcription requests made so far
+func (s *fakeSTT) received() []sttRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sttRequest(nil), s.requests...)
+}
+
+func TestTranscriptionGetsLanguageHint(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	stt := newFakeSTT(t)
+	setVar(t, &sttDefaultLanguage, "en-US")
+
+	// The hint given with the first chunk holds for the rest of the session
+	mustPost(t, "uid=alice&lang=de-DE", tone(250*time.Millisecond, 16000))
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	if language := currentMetadata(t, f, "alice").Language; language != "de-DE" {
+		t.Fatalf("session metadata has language %q, want de-DE", language)
+	}
+	filename := currentMetadata(t, f, "alice").Filename
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+
+	requests := stt.received()
+	if len(requests) != 1 {
+		t.Fatalf("STT backend got %d requests, want 1", len(requests))
+	}
+	want := sttRequest{URI: "gs://" + testBucket + "/" + filename, UID: "alice", Language: "de-DE", SampleRate: 16000, Channels: 1, BitsPerSample: 16}
+	if requests[0] != want {
+		t.Fatalf("STT backend got %+v, want %+v", requests[0], want)
+	}
+}
+
+func TestTranscriptionFallsBackToDefaultLanguage(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	stt := newFakeSTT(t)
+	setVar(t, &sttDefaultLanguage, "fr-FR")
+
+	mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000))
+	if w := serve(t, HandleFinalize, http.MethodPost, "/?uid=alice", nil); w.Code != http.StatusOK {
+		t.Fatalf("finalize answered %d: %s", w.Code, w.Body)
+	}
+	if requests := stt.received(); len(requests) != 1 || requests[0].Language != "fr-FR" {
+		t.Fatalf("STT backend got %+v, want one request in fr-FR", requests)
+	}
+}
+
+func TestPostRejectsInvalidLanguage(t *testing.T) {
+	newFakeGCS(t)
+	useFakeClock(t, testStart)
+	for _, lang := range []string{"english", "e", "en_US", "en-"} {
+		if w := postAudio(t, "uid=alice&lang="+lang, tone(100*time.Millisecond, 16000)); w.Code != http.StatusBadRequest {
+			t.Errorf("lang=%s answered %d, want %d", lang, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// sweepResponse is the JSON body returned by HandleSweep. A sweep that fails partway
+// answers with status "error" and a message, like any error, but still lists what it
+// finalized before and after the failure.
+type sweepResponse struct {
+	Status    string   `json:"status"`
+	Message   string   `json:"message,omitempty"`
+	Finalized []string `json:"finalized"`
+	Active    int      `json:"active"`
+	// Failed lists the sessions that could not be finalized
+	Failed []string `json:"failed,omitempty"`
+	// MarkersRemoved counts the expired dedup markers deleted
+	MarkersRemoved int `json:"markers_removed"`
+}
+
+// HandleSweep finalizes every session that has been inactive for INACTIVITY_LIMIT.
+// Without it an abandoned session is only noticed by the next upload for its uid,
+// which may never come, leaving a PCM accumulator that never becomes a WAV. It is
+// meant to be called periodically by Cloud Scheduler, so it carries no uid and no
+// signature; deploy it behind IAM rather than allowing unauthenticated calls.
+//
+// Each stale session is finalized like HandleFinalize would, and its metadata is
+// only cleared if it still has the generation that was judged stale, so a session
+// that receives audio during the sweep stays open.
+func HandleSweep(w http.ResponseWriter, r *http.Request) {
+	ctx, logger := startRequestLog(r.Context(), w, r)
+	logger.Info("Received sweep request")
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+	sweepSessions(ctx, w, bucket, inactivityLimit)
+}
+
+// HandleFinalizeAll finalizes every session whose last write is at least older_than
+// ago, a duration such as 10m, so stale sessions can be closed at once, for example
+// before a deploy. Without older_than it closes those inactive for INACTIVITY_LIMIT,
+// like HandleSweep; older_than=0 closes every session. Like HandleSweep it carries no
+// uid and no signature and must be deployed behind IAM. Each session is finalized as
+// HandleFinalize would, so LATE_CHUNK_POLICY applies to it, and any that receives
+// audio meanwhile is left open.
+func HandleFinalizeAll(w http.ResponseWriter, r *http.Request) {
+	ctx, logger := startRequestLog(r.Context(), w, r)
+	logger.Info("Received finalize all request")
+
+	olderThan := inactivityLimit
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		var err error
+		olderThan, err = time.ParseDuration(value)
+		if err != nil || olderThan < 0 {
+			logger.Warn("Invalid query parameter", "older_than", value)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid older_than %q, expected a non-negative duration such as 10m", value))
+			return
+		}
+	}
+
+	bucket, err := openBucket(bucketOverride(r.URL.Query(), r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+	sweepSessions(ctx, w, bucket, olderThan)
+}
+
+// sweepSessions finalizes every session in bucket whose last write is at least
+// olderThan ago, deletes the expired dedup markers and writes the summary as the
+// response. A session that fails doesn't stop the sweep, and the response of a sweep
+// with failures still reports every session it finalized.
+func sweepSessions(ctx context.Context, w http.ResponseWriter, bucket *storage.BucketHandle, olderThan time.Duration) {
+	logger := loggerFrom(ctx)
+	response := sweepResponse{Status: "ok", Finalized: []string{}}
+	names, err := openStore(bucket).List(ctx, metadataPrefix)
+	if err != nil {
+		logger.Error("Failed to list sessions", "error", err)
+		response.Message = "Failed to list sessions"
+	}
+	for _, name := range names {
+		uid := strings.TrimSuffix(strings.TrimPrefix(name, metadataPrefix), ".json")
+
+		// Sessions are swept one GCS_TIMEOUT at a time, since a sweep has no bound
+		sessionCtx, cancel := context.WithTimeout(ctx, gcsTimeout)
+		sessionCtx, _ = logWith(sessionCtx, "uid", uid)
+		filename, err := sweepSession(sessionCtx, bucket, uid, olderThan)
+		cancel()
+		switch {
+		case err != nil:
+			logger.Error("Failed to sweep session", "uid", uid, "error", err)
+			response.Failed = append(response.Failed, uid)
+		case filename != "":
+			response.Finalized = append(response.Finalized, filename)
+		default:
+			response.Active++
+		}
+	}
+
+	// Markers are otherwise only deleted when their chunk_id is delivered again
+	markersCtx, cancel := context.WithTimeout(ctx, gcsTimeout)
+	response.MarkersRemoved, err = sweepDedupMarkers(markersCtx, openStore(bucket))
+	cancel()
+
+	logger.Info("Swept sessions", "older_than", olderThan.String(), "finalized", len(response.Finalized), "active", response.Active, "failed", len(response.Failed), "markers_removed", response.MarkersRemoved)
+	if len(response.Failed) > 0 && response.Message == "" {
+		response.Message = fmt.Sprintf("Failed to finalize %d stale sessions", len(response.Failed))
+	}
+	if err != nil {
+		logger.Error("Failed to sweep dedup markers", "error", err)
+		if response.Message == "" {
+			response.Message = "Failed to sweep dedup markers"
+		}
+	}
+	if response.Message != "" {
+		response.Status = "error"
+		status := http.StatusInternalServerError
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		writeJSON(w, status, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sweepSession finalizes session key if it has been inactive for olderThan,
+// returning the name of the finalized recording, or "" when the session is still
+// active or gone. It holds the session's lock throughout and closes the session as
+// HandleFinalize does, and counts a session whose lock stays busy as active.
+func sweepSession(ctx context.Context, bucket *storage.BucketHandle, key string, olderThan time.Duration) (string, error) {
+	store := openStore(bucket)
+	release, err := acquireLock(ctx, store, key)
+	if errors.Is(err, errLockBusy) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	metadata, generation, err := getCurrentMetadata(ctx, store, key)
+	if err != nil || metadata == nil {
+		return "", err
+	}
+	if nowFunc().Sub(metadata.LastWriteTime) < olderThan {
+		return "", nil
+	}
+
+	ctx, logger := logWith(ctx, "object", metadata.Filename)
+	if _, err := closeSession(ctx, bucket, store, key, metadata, generation); err != nil {
+		if isPreconditionFailed(err) {
+			logger.Info("Session changed during the sweep, leaving its metadata for the next upload to reconcile")
+			return "", nil
+		}
+		return "", err
+	}
+	logger.Info("Finalized inactive session", "last_write_time", metadata.LastWriteTime)
+	return recordingPath(metadata), nil
+}
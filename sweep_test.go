@@ -0,0 +1,144 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sweep(t *testing.T, handler http.HandlerFunc, target string) (int, sweepResponse) {
+	t.Helper()
+	w := serve(t, handler, http.MethodPost, target, nil)
+	var response sweepResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("sweep answered %d with %q: %v", w.Code, w.Body, err)
+	}
+	return w.Code, response
+}
+
+func TestSweepFinalizesInactiveSessions(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	stale := currentMetadata(t, f, "alice").Filename
+	clock.Advance(inactivityLimit)
+	mustPost(t, "uid=bob", tone(500*time.Millisecond, 16000))
+
+	code, response := sweep(t, HandleSweep, "/")
+	if code != http.StatusOK {
+		t.Fatalf("sweep answered %d", code)
+	}
+	if len(response.Finalized) != 1 || response.Finalized[0] != stale || response.Active != 1 {
+		t.Fatalf("sweep = %+v, want %s finalized and 1 active", response, stale)
+	}
+	if _, dataLen := storedWAV(t, f, stale); dataLen != 16000 {
+		t.Fatalf("swept file holds %d bytes, want 16000", dataLen)
+	}
+	if _, ok := f.get(metadataPath("bob")); !ok {
+		t.Fatal("active session was swept")
+	}
+}
+
+func TestFinalizeAllDefaultsToInactivityLimit(t *testing.T) {
+	f := newFakeGCS(t)
+	useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+
+	code, response := sweep(t, HandleFinalizeAll, "/")
+	if code != http.StatusOK || len(response.Finalized) != 0 || response.Active != 1 {
+		t.Fatalf("finalize all without older_than = %d %+v, want the recent session left open", code, response)
+	}
+
+	code, response = sweep(t, HandleFinalizeAll, "/?older_than=0")
+	if code != http.StatusOK || len(response.Finalized) != 1 {
+		t.Fatalf("finalize all with older_than=0 = %d %+v, want the session finalized", code, response)
+	}
+	if _, ok := f.get(metadataPath("alice")); ok {
+		t.Fatal("finalized session kept its metadata")
+	}
+}
+
+func TestSweepSkipsLockedSession(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+	clock.Advance(inactivityLimit)
+
+	setVar(t, &writeLockTimeout, 100*time.Millisecond)
+	f.put(lockPath("alice"), []byte("held"))
+
+	code, response := sweep(t, HandleSweep, "/")
+	if code != http.StatusOK || len(response.Finalized) != 0 || response.Active != 1 {
+		t.Fatalf("sweep of a locked session = %d %+v, want it counted as active", code, response)
+	}
+	if _, ok := f.get(metadataPath("alice")); !ok {
+		t.Fatal("locked session was finalized")
+	}
+}
+
+func TestSweepReportsPartialResults(t *testing.T) {
+	f := newFakeGCS(t)
+	clock := useFakeClock(t, testStart)
+	for _, uid := range []string{"alice", "bob", "carol"} {
+		mustPost(t, "uid="+uid, tone(500*time.Millisecond, 16000))
+	}
+	clock.Advance(inactivityLimit)
+
+	// bob's finished file can't be written
+	f.fail = func(r *http.Request) int {
+		if r.Method != http.MethodGet && strings.Contains(r.URL.Path, "bob/") && strings.HasSuffix(r.URL.Path, "/compose") {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+
+	code, response := sweep(t, HandleSweep, "/")
+	if code != http.StatusInternalServerError {
+		t.Fatalf("sweep with a failure answered %d, want %d", code, http.StatusInternalServerError)
+	}
+	if response.Status != "error" || response.Message == "" {
+		t.Fatalf("sweep = %+v, want an error status and message", response)
+	}
+	if len(response.Finalized) != 2 || len(response.Failed) != 1 || response.Failed[0] != "bob" {
+		t.Fatalf("sweep = %+v, want alice and carol finalized and bob failed", response)
+	}
+}
+
+func TestSweepClosesSessionsLikeFinalize(t *testing.T) {
+	for _, handler := range []struct {
+		name string
+		fn   http.HandlerFunc
+		path string
+	}{
+		{"sweep", HandleSweep, "/"},
+		{"finalize all", HandleFinalizeAll, "/?older_than=0"},
+	} {
+		t.Run(handler.name, func(t *testing.T) {
+			f := newFakeGCS(t)
+			clock := useFakeClock(t, testStart)
+			setVar(t, &finalizeFormat, "flac")
+			setVar(t, &lateChunkPolicy, "drop")
+			setVar(t, &lateChunkGrace, inactivityLimit+time.Minute)
+
+			mustPost(t, "uid=alice", tone(500*time.Millisecond, 16000))
+			filename := currentMetadata(t, f, "alice").Filename
+			clock.Advance(inactivityLimit)
+
+			code, response := sweep(t, handler.fn, handler.path)
+			if code != http.StatusOK || len(response.Finalized) != 1 || response.Finalized[0] != flacPath(filename) {
+				t.Fatalf("%s = %d %+v, want %s reported", handler.name, code, response, flacPath(filename))
+			}
+			if _, ok := f.get(flacPath(filename)); !ok {
+				t.Fatal("swept session has no FLAC recording")
+			}
+
+			// LATE_CHUNK_POLICY applies to a swept session as to a finalized one
+			if w := mustPost(t, "uid=alice", tone(250*time.Millisecond, 16000)); w.Code != http.StatusOK || currentMetadata(t, f, "alice") != nil {
+				t.Fatalf("late chunk after the %s answered %d and left a session open, want it dropped", handler.name, w.Code)
+			}
+		})
+	}
+}
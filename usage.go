@@ -0,0 +1,108 @@
+package function
+
+import (
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// usageResponse is the JSON body returned by HandleUsage
+type usageResponse struct {
+	Status               string  `json:"status"`
+	Files                int     `json:"files"`
+	TotalBytes           int64   `json:"total_bytes"`
+	TotalDurationSeconds float64 `json:"total_duration_seconds"`
+	// Oldest and Newest are the recordings created first and last, absent when
+	// there are none
+	Oldest *listedRecording `json:"oldest,omitempty"`
+	Newest *listedRecording `json:"newest,omitempty"`
+}
+
+// HandleUsage returns the storage uid's finalized recordings take up: how many there
+// are, their total size and duration, and the oldest and newest of them, for billing
+// and dashboards. Like HandleList it iterates the bucket, so its cost grows with the
+// number of objects under uid's prefix, and it takes the same from and to params to
+// count only recordings created in [from, to). The duration only counts WAV and raw
+// PCM files. The fields param and gzip are handled by writeQueryJSON.
+func HandleUsage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := gcsContext(r)
+	defer cancel()
+	ctx, logger := startRequestLog(ctx, w, r)
+
+	query := r.URL.Query()
+	uid := query.Get("uid")
+	ctx, logger = logWith(ctx, "uid", uid)
+	logger.Info("Received usage request")
+	if !validUID(uid) {
+		logger.Warn("Rejecting usage request with invalid uid")
+		writeError(w, http.StatusBadRequest, "uid query parameter is required, must not contain '/' and must not be a reserved name")
+		return
+	}
+
+	from, err := parseListTime(query.Get("from"), "from")
+	if err != nil {
+		logger.Warn("Invalid query parameter", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseListTime(query.Get("to"), "to")
+	if err != nil {
+		logger.Warn("Invalid query parameter", "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Usage requests carry no body, so the signature covers only uid and timestamp
+	if authEnabled() {
+		if err := verifySignature(r, uid, nil); err != nil {
+			logger.Warn("Rejecting unauthenticated usage request", "error", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	prefix, scoped := filePathTemplate.prefix(uid)
+	if !scoped {
+		writeError(w, http.StatusNotImplemented, "Usage requires PATH_TEMPLATE to place {uid} before any time token")
+		return
+	}
+
+	bucket, err := openBucket(bucketOverride(query, r.Header))
+	if err != nil {
+		writeBucketError(ctx, w, err)
+		return
+	}
+
+	response := usageResponse{Status: "ok"}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logger.Error("Failed to list objects", "prefix", prefix, "error", err)
+			writeServerError(ctx, w, "Failed to list objects")
+			return
+		}
+		recording, ok := uidRecording(attrs, uid, from, to)
+		if !ok {
+			continue
+		}
+		response.Files++
+		response.TotalBytes += recording.Size
+		response.TotalDurationSeconds += recording.DurationSeconds
+		if response.Oldest == nil || recording.CreatedAt.Before(response.Oldest.CreatedAt) {
+			oldest := recording
+			response.Oldest = &oldest
+		}
+		if response.Newest == nil || recording.CreatedAt.After(response.Newest.CreatedAt) {
+			newest := recording
+			response.Newest = &newest
+		}
+	}
+
+	logger.Info("Computed usage", "files", response.Files, "bytes", response.TotalBytes)
+	writeQueryJSON(ctx, w, r, response)
+}
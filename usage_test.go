@@ -0,0 +1,62 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// usage calls HandleUsage with query and decodes its totals
+func usage(t *testing.T, query url.Values) usageResponse {
+	t.Helper()
+	w := serve(t, HandleUsage, http.MethodGet, "/?"+query.Encode(), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("usage answered %d: %s", w.Code, w.Body)
+	}
+	var totals usageResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &totals); err != nil {
+		t.Fatal(err)
+	}
+	return totals
+}
+
+func TestUsageTotals(t *testing.T) {
+	f := newFakeGCS(t)
+	// More recordings than fit in one page of the listing, along with another uid's
+	putRecordings(t, f, 120)
+	f.put(filePathTemplate.render("bob", testStart), []byte("RIFF"))
+
+	totals := usage(t, url.Values{"uid": {"alice"}})
+	if totals.Files != 120 || totals.TotalBytes != 120*int64(wavObjectSize(32000)) || totals.TotalDurationSeconds != 120 {
+		t.Fatalf("usage = %d files, %d bytes, %vs, want 120 one-second recordings", totals.Files, totals.TotalBytes, totals.TotalDurationSeconds)
+	}
+	if totals.Oldest == nil || !totals.Oldest.CreatedAt.Equal(testStart) {
+		t.Fatalf("oldest recording = %+v, want the one created at %v", totals.Oldest, testStart)
+	}
+	if newest := testStart.Add(119 * time.Minute); totals.Newest == nil || !totals.Newest.CreatedAt.Equal(newest) {
+		t.Fatalf("newest recording = %+v, want the one created at %v", totals.Newest, newest)
+	}
+}
+
+func TestUsageDateRange(t *testing.T) {
+	f := newFakeGCS(t)
+	putRecordings(t, f, 10)
+
+	totals := usage(t, url.Values{
+		"uid":  {"alice"},
+		"from": {testStart.Add(3 * time.Minute).Format(time.RFC3339)},
+		"to":   {testStart.Add(6 * time.Minute).Format(time.RFC3339)},
+	})
+	if totals.Files != 3 || totals.TotalDurationSeconds != 3 {
+		t.Fatalf("usage in [3m, 6m) = %d files of %vs, want 3 of 3s", totals.Files, totals.TotalDurationSeconds)
+	}
+	if !totals.Oldest.CreatedAt.Equal(testStart.Add(3*time.Minute)) || !totals.Newest.CreatedAt.Equal(testStart.Add(5*time.Minute)) {
+		t.Fatalf("range spans %v to %v", totals.Oldest.CreatedAt, totals.Newest.CreatedAt)
+	}
+
+	if empty := usage(t, url.Values{"uid": {"carol"}}); empty.Files != 0 || empty.Oldest != nil || empty.Newest != nil {
+		t.Fatalf("usage of a uid without recordings = %+v", empty)
+	}
+}